@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errBackendDown = errors.New("backend marked down")
+
+// breaker is a per-backend circuit breaker.  After threshold consecutive
+// failures it opens for cooldown, during which calls fail fast.  Once the
+// cooldown is over a single probe is let through, and its outcome closes or
+// reopens the breaker.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreakers(backends []string, threshold int, cooldown time.Duration) map[string]*breaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	breakers := make(map[string]*breaker)
+	for _, b := range backends {
+		breakers[b] = &breaker{threshold: threshold, cooldown: cooldown}
+	}
+
+	return breakers
+}
+
+// allow reports whether a call may be made.  A nil breaker allows everything.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if b.probing || timeNow().Before(b.openUntil) {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.failures = 0
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *breaker) failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = timeNow().Add(b.cooldown)
+	}
+	b.mu.Unlock()
+}
+
+// cancel is called when a call was abandoned by the client, which says
+// nothing about the health of the backend
+func (b *breaker) cancel() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
+	"math/rand"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/garyburd/redigo/redis"
 
 	ecache "github.com/dgryski/go-expirecache"
 )
@@ -15,6 +19,77 @@ type bytesCache interface {
 	set(k string, v []byte, expire int32)
 }
 
+// Query cache entries are prefixed with the time they were computed and their
+// ttl.  They are kept for staleGrace past their expiry, so that a popular entry
+// can still be served while one request refreshes it.
+var (
+	entryMagic = []byte("\xffqc1")
+
+	// staleGrace is how long past its expiry an entry may be served
+	staleGrace int32
+
+	// earlyRefresh is the fraction of the ttl at the end of which an entry
+	// may be refreshed before it expires, with increasing probability
+	earlyRefresh float64
+)
+
+const entryHeaderLen = 4 + 8 + 4
+
+type entryState int
+
+const (
+	entryFresh entryState = iota
+	entryEarly
+	entryStale
+)
+
+// setEntry stores v for ttl seconds, plus the grace period
+func setEntry(c bytesCache, k string, v []byte, ttl int32) {
+	b := make([]byte, entryHeaderLen+len(v))
+	copy(b, entryMagic)
+	binary.BigEndian.PutUint64(b[4:], uint64(timeNow().Unix()))
+	binary.BigEndian.PutUint32(b[12:], uint32(ttl))
+	copy(b[entryHeaderLen:], v)
+
+	c.set(k, b, ttl+staleGrace)
+}
+
+// getEntry returns the value stored for k, and whether it is fresh, due for
+// an early refresh, or stale
+func getEntry(c bytesCache, k string) ([]byte, entryState, bool) {
+	b, ok := c.get(k)
+	if !ok {
+		return nil, entryFresh, false
+	}
+
+	if len(b) < entryHeaderLen || !bytes.Equal(b[:4], entryMagic) {
+		// stored without a header
+		return b, entryFresh, true
+	}
+
+	stored := int64(binary.BigEndian.Uint64(b[4:]))
+	ttl := int64(binary.BigEndian.Uint32(b[12:]))
+	v := b[entryHeaderLen:]
+
+	age := timeNow().Unix() - stored
+	switch {
+	case age >= ttl+int64(staleGrace):
+		// left behind by a cache with a different clock
+		return nil, entryFresh, false
+	case age >= ttl:
+		return v, entryStale, true
+	}
+
+	if earlyRefresh > 0 {
+		window := earlyRefresh * float64(ttl)
+		if into := float64(age) - (float64(ttl) - window); into > 0 && rand.Float64()*window < into {
+			return v, entryEarly, true
+		}
+	}
+
+	return v, entryFresh, true
+}
+
 type nullCache struct{}
 
 func (nullCache) get(string) ([]byte, bool) { return nil, false }
@@ -76,3 +151,75 @@ func (m *memcachedCache) set(k string, v []byte, expire int32) {
 	hk := hex.EncodeToString(key[:])
 	go m.client.Set(&memcache.Item{Key: hk, Value: v, Expiration: expire})
 }
+
+type redisCache struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+func newRedisCache(server, prefix string, maxIdle int) *redisCache {
+	return &redisCache{
+		pool: &redis.Pool{
+			MaxIdle:     maxIdle,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", server,
+					redis.DialConnectTimeout(time.Second),
+					redis.DialReadTimeout(time.Second),
+					redis.DialWriteTimeout(time.Second),
+				)
+			},
+		},
+		prefix: prefix,
+	}
+}
+
+func (r *redisCache) key(k string) string {
+	key := sha1.Sum([]byte(k))
+	return r.prefix + hex.EncodeToString(key[:])
+}
+
+func (r *redisCache) get(k string) ([]byte, bool) {
+	hk := r.key(k)
+	done := make(chan bool, 1)
+
+	var err error
+	var v []byte
+
+	go func() {
+		c := r.pool.Get()
+		v, err = redis.Bytes(c.Do("GET", hk))
+		c.Close()
+		done <- true
+	}()
+
+	timeout := time.After(50 * time.Millisecond)
+
+	select {
+	case <-timeout:
+		Metrics.RedisTimeouts.Add(1)
+		return nil, false
+	case <-done:
+	}
+
+	if err != nil {
+		Metrics.RedisMisses.Add(1)
+		return nil, false
+	}
+
+	Metrics.RedisHits.Add(1)
+	return v, true
+}
+
+func (r *redisCache) set(k string, v []byte, expire int32) {
+	hk := r.key(k)
+	go func() {
+		c := r.pool.Get()
+		if expire > 0 {
+			c.Do("SET", hk, v, "EX", expire)
+		} else {
+			c.Do("SET", hk, v)
+		}
+		c.Close()
+	}()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheEntry(t *testing.T) {
+	now := time.Unix(1000000000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	staleGrace = 30
+	defer func() { staleGrace = 0 }()
+
+	c := &ttlCache{}
+	setEntry(c, "k", []byte("v"), 60)
+
+	tests := []struct {
+		after time.Duration
+		state entryState
+		ok    bool
+	}{
+		{0, entryFresh, true},
+		{59 * time.Second, entryFresh, true},
+		{60 * time.Second, entryStale, true},
+		{89 * time.Second, entryStale, true},
+		{90 * time.Second, entryFresh, false},
+	}
+
+	start := now
+	for _, tt := range tests {
+		now = start.Add(tt.after)
+		v, state, ok := getEntry(c, "k")
+		if ok != tt.ok || state != tt.state || (ok && string(v) != "v") {
+			t.Errorf("after %v: got %q, %v, %v, want %v, %v", tt.after, v, state, ok, tt.state, tt.ok)
+		}
+	}
+
+	// entries written without a header are served as they are
+	c.set("raw", []byte("body"), 60)
+	if v, state, ok := getEntry(c, "raw"); !ok || state != entryFresh || string(v) != "body" {
+		t.Errorf("raw entry: got %q, %v, %v", v, state, ok)
+	}
+
+	earlyRefresh = 0.5
+	defer func() { earlyRefresh = 0 }()
+
+	now = start
+	setEntry(c, "k", []byte("v"), 60)
+	now = start.Add(59 * time.Second)
+	var early int
+	for i := 0; i < 100; i++ {
+		if _, state, _ := getEntry(c, "k"); state == entryEarly {
+			early++
+		}
+	}
+	if early < 80 {
+		t.Errorf("only %d of 100 reads near expiry triggered an early refresh", early)
+	}
+
+	now = start.Add(29 * time.Second)
+	for i := 0; i < 100; i++ {
+		if _, state, _ := getEntry(c, "k"); state != entryFresh {
+			t.Fatalf("early refresh before the refresh window")
+		}
+	}
+}
+
+func TestRenderServesStale(t *testing.T) {
+	var renders int32
+	fake := fakeZipper([]string{"foo.bar"}, []string{"foo.bar"})
+	defer fake.Close()
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/render/" {
+			atomic.AddInt32(&renders, 1)
+		}
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+
+	Zipper = zipper{backends: []string{counting.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+
+	staleGrace = 300
+	defer func() { staleGrace = 0 }()
+
+	var now int64 = 1000000000
+	timeNow = func() time.Time { return time.Unix(atomic.LoadInt64(&now), 0) }
+	defer func() { timeNow = time.Now }()
+
+	render := func() *http.Request {
+		req := httptest.NewRequest("GET", "/render?target=foo.bar&format=json&from=999999940&until=1000000000", nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		return req
+	}
+
+	waitRefresh := func() {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			requestFlights.mu.Lock()
+			n := len(requestFlights.calls)
+			requestFlights.mu.Unlock()
+			if n == 0 {
+				break
+			}
+		}
+	}
+
+	render()
+	render()
+	if n := atomic.LoadInt32(&renders); n != 1 {
+		t.Fatalf("got %d zipper renders for a cached request, want 1", n)
+	}
+
+	// expired, but within the grace period: served at once, and refreshed behind our back
+	atomic.AddInt64(&now, 90)
+	req := render()
+	// the request is done with once served, while the refresh goes on
+	req.Form.Set("format", "png")
+	req.Form.Del("target")
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&renders) != 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&renders); n != 2 {
+		t.Errorf("got %d zipper renders after a stale hit, want 2", n)
+	}
+
+	// let the refresh finish before restoring the globals it uses
+	waitRefresh()
+
+	// refreshes count against the quotas of the client, which is served the
+	// stale entry without one when over them
+	quotas = newClientQuotas(1, 0, 0)
+	defer func() { quotas = nil }()
+	client := clientID(httptest.NewRequest("GET", "/render", nil))
+	if err := quotas.admit(client); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.AddInt64(&now, 90)
+	render()
+	waitRefresh()
+	if n := atomic.LoadInt32(&renders); n != 2 {
+		t.Errorf("got %d zipper renders after a stale hit over the quotas, want 2", n)
+	}
+
+	quotas.release(client)
+	render()
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&renders) != 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&renders); n != 3 {
+		t.Errorf("got %d zipper renders after a stale hit within the quotas, want 3", n)
+	}
+	waitRefresh()
+}
+
+// fakeRedis speaks just enough of the redis protocol for GET and SET
+type fakeRedis struct {
+	l     net.Listener
+	delay time.Duration
+
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	f := &fakeRedis{l: l, m: make(map[string]string)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = r.ReadString('\n')
+			l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, l+2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			args[i] = string(b[:l])
+		}
+
+		f.mu.Lock()
+		delay := f.delay
+		f.mu.Unlock()
+		time.Sleep(delay)
+
+		f.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			if v, ok := f.m[args[1]]; ok {
+				fmt.Fprintf(c, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(c, "$-1\r\n")
+			}
+		case "SET":
+			f.m[args[1]] = args[2]
+			fmt.Fprint(c, "+OK\r\n")
+		default:
+			fmt.Fprint(c, "-ERR unknown command\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	srv := newFakeRedis(t)
+	defer srv.l.Close()
+
+	c := newRedisCache(srv.l.Addr().String(), "capi:", 2)
+
+	hits, misses, timeouts := Metrics.RedisHits.Value(), Metrics.RedisMisses.Value(), Metrics.RedisTimeouts.Value()
+
+	if _, ok := c.get("foo"); ok {
+		t.Errorf("get of a missing key succeeded")
+	}
+
+	c.set("foo", []byte("bar"), 60)
+
+	// sets are asynchronous
+	var v []byte
+	var ok bool
+	for deadline := time.Now().Add(time.Second); !ok && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		v, ok = c.get("foo")
+	}
+	if !ok || string(v) != "bar" {
+		t.Fatalf("get(foo)=%q, %v, want bar", v, ok)
+	}
+
+	srv.mu.Lock()
+	for k := range srv.m {
+		if !strings.HasPrefix(k, "capi:") {
+			t.Errorf("key %q stored without prefix", k)
+		}
+	}
+	srv.mu.Unlock()
+
+	if Metrics.RedisHits.Value() != hits+1 || Metrics.RedisMisses.Value() <= misses {
+		t.Errorf("hits/misses not counted")
+	}
+
+	srv.mu.Lock()
+	srv.delay = 100 * time.Millisecond
+	srv.mu.Unlock()
+
+	if _, ok := c.get("foo"); ok {
+		t.Errorf("slow get succeeded")
+	}
+	if Metrics.RedisTimeouts.Value() != timeouts+1 {
+		t.Errorf("timeout not counted")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientKey says how clients are told apart for scheduling, quotas and
+// logging: by address with "ip", by the value of a request header with
+// "header:Name", or of a request parameter with "param:name" (an API key for
+// instance).  Requests lacking the header or parameter fall back to their
+// address.  Behind a proxy, "header:X-Forwarded-For" takes the last address of
+// that header, the one added by the proxy: those before it are whatever the
+// client sent.
+var clientKey = "ip"
+
+// clientID identifies the client of a request
+func clientID(r *http.Request) string {
+	switch {
+	case clientKey == "header:X-Forwarded-For":
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			addrs := strings.Split(fwd, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	case strings.HasPrefix(clientKey, "header:"):
+		if v := r.Header.Get(strings.TrimPrefix(clientKey, "header:")); v != "" {
+			return v
+		}
+	case strings.HasPrefix(clientKey, "param:"):
+		if v := r.FormValue(strings.TrimPrefix(clientKey, "param:")); v != "" {
+			return v
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientParam returns the request parameter identifying clients, if any
+func clientParam() string {
+	if strings.HasPrefix(clientKey, "param:") {
+		return strings.TrimPrefix(clientKey, "param:")
+	}
+	return ""
+}
+
+type clientContextKey struct{}
+
+// withClient returns a context carrying the client on whose behalf work is done
+func withClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+func clientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientContextKey{}).(string)
+	return client
+}
+
+var (
+	errConcurrencyQuota = errors.New("too many concurrent requests")
+	errRateQuota        = errors.New("request rate quota exceeded")
+)
+
+// clientQuotas limits the number of concurrent render requests of each
+// client, and their rate with a token bucket of burst requests
+type clientQuotas struct {
+	concurrent int
+	rate       float64
+	burst      float64
+
+	mu      sync.Mutex
+	clients map[string]*clientState
+	swept   time.Time
+}
+
+type clientState struct {
+	active int
+	tokens float64
+	last   time.Time
+}
+
+// quotas are the limits on each client, if any
+var quotas *clientQuotas
+
+// newClientQuotas returns nil if there are no limits.  A zero concurrent or
+// rate means no limit.
+func newClientQuotas(concurrent int, rate float64, burst int) *clientQuotas {
+	if concurrent <= 0 && rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &clientQuotas{
+		concurrent: concurrent,
+		rate:       rate,
+		burst:      float64(burst),
+		clients:    make(map[string]*clientState),
+		swept:      timeNow(),
+	}
+}
+
+// admit takes a request of client against its quotas, and must be followed
+// by release if it succeeds.  A nil clientQuotas admits everything.
+func (q *clientQuotas) admit(client string) error {
+	if q == nil {
+		return nil
+	}
+
+	now := timeNow()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if now.Sub(q.swept) > time.Minute {
+		q.sweep(now)
+	}
+
+	c, ok := q.clients[client]
+	if !ok {
+		c = &clientState{tokens: q.burst, last: now}
+		q.clients[client] = c
+	}
+
+	if q.concurrent > 0 && c.active >= q.concurrent {
+		return errConcurrencyQuota
+	}
+
+	if q.rate > 0 {
+		c.refill(now, q.rate, q.burst)
+		if c.tokens < 1 {
+			return errRateQuota
+		}
+		c.tokens--
+	}
+
+	c.active++
+	return nil
+}
+
+func (q *clientQuotas) release(client string) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	if c, ok := q.clients[client]; ok {
+		c.active--
+	}
+	q.mu.Unlock()
+}
+
+// sweep forgets the clients which are idle and whose bucket is full again
+func (q *clientQuotas) sweep(now time.Time) {
+	for client, c := range q.clients {
+		c.refill(now, q.rate, q.burst)
+		if c.active == 0 && (q.rate <= 0 || c.tokens >= q.burst) {
+			delete(q.clients, client)
+		}
+	}
+	q.swept = now
+}
+
+func (c *clientState) refill(now time.Time, rate, burst float64) {
+	c.tokens += now.Sub(c.last).Seconds() * rate
+	if c.tokens > burst {
+		c.tokens = burst
+	}
+	c.last = now
+}
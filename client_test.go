@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientID(t *testing.T) {
+	defer func() { clientKey = "ip" }()
+
+	req := httptest.NewRequest("GET", "/render?target=foo&apikey=k1", nil)
+	req.Header.Set("X-Team", "team1")
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 203.0.113.9")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"ip", "192.0.2.1"},
+		{"header:X-Team", "team1"},
+		{"header:X-Missing", "192.0.2.1"},
+		{"param:apikey", "k1"},
+		{"param:missing", "192.0.2.1"},
+		{"header:X-Forwarded-For", "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		clientKey = tt.key
+		if got := clientID(req); got != tt.want {
+			t.Errorf("clientID with %q=%q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestClientQuotas(t *testing.T) {
+	now := time.Unix(1000000000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	q := newClientQuotas(1, 1, 2)
+
+	if err := q.admit("a"); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := q.admit("a"); err != errConcurrencyQuota {
+		t.Errorf("concurrent request: got %v, want %v", err, errConcurrencyQuota)
+	}
+	if err := q.admit("b"); err != nil {
+		t.Errorf("request of another client: %v", err)
+	}
+	q.release("b")
+
+	q.release("a")
+	if err := q.admit("a"); err != nil {
+		t.Fatalf("second request, within the burst: %v", err)
+	}
+	q.release("a")
+
+	if err := q.admit("a"); err != errRateQuota {
+		t.Errorf("third request: got %v, want %v", err, errRateQuota)
+	}
+
+	now = now.Add(time.Second)
+	if err := q.admit("a"); err != nil {
+		t.Errorf("request after a refill: %v", err)
+	}
+	q.release("a")
+
+	// idle clients with a full bucket are forgotten
+	now = now.Add(time.Hour)
+	q.admit("c")
+	if _, ok := q.clients["a"]; ok || len(q.clients) != 1 {
+		t.Errorf("idle clients not forgotten: %v", q.clients)
+	}
+
+	var none *clientQuotas
+	if err := none.admit("a"); err != nil {
+		t.Errorf("admit without quotas: %v", err)
+	}
+	none.release("a")
+}
+
+func TestRenderQuota(t *testing.T) {
+	fake := fakeZipper([]string{"foo.bar"}, []string{"foo.bar"})
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+
+	quotas = newClientQuotas(0, 0.001, 1)
+	defer func() { quotas = nil }()
+
+	var codes []int
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/render?target=foo.bar&format=json&from=1000000000&until=1000000600", nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+		codes = append(codes, w.Code)
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("got statuses %v, want 200 then 429", codes)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/dgryski/carbonapi/expr"
+)
+
+// explainResponse tells how the targets of a render request were parsed,
+// fetched and evaluated, for explain=1
+type explainResponse struct {
+	From           int64           `json:"from"`
+	Until          int64           `json:"until"`
+	FindRequests   int             `json:"findRequests"`
+	RenderRequests int             `json:"renderRequests"`
+	Leaves         int             `json:"leaves"`
+	Targets        []explainTarget `json:"targets"`
+	Warnings       []renderWarning `json:"warnings,omitempty"`
+}
+
+type explainTarget struct {
+	Target string     `json:"target"`
+	Cost   expr.Cost  `json:"cost"`
+	Tree   *expr.Node `json:"tree"`
+	// Fetches are the metric requests of the target, with their time range
+	// adjusted by functions such as timeShift
+	Fetches []fetchStats `json:"fetches"`
+	Runtime float64      `json:"runtime"`
+}
+
+// explainRender evaluates the targets of a render request, bypassing the
+// query cache, and responds with an explainResponse instead of the series
+func explainRender(ctx context.Context, w http.ResponseWriter, r *http.Request, client string, targets []string, from64, until64 int64, useCache bool, stats *renderStats) {
+
+	if from64 == until64 {
+		http.Error(w, "Invalid empty time range", http.StatusBadRequest)
+		return
+	}
+
+	if err := quotas.admit(client); err != nil {
+		Metrics.QuotaRejections.Add(1)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests)+": "+err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer quotas.release(client)
+
+	trace := expr.NewTrace()
+	ctx = expr.WithTrace(withClient(ctx, client), trace)
+
+	_, warnings, err := evalTargets(ctx, r, targets, from64, until64, useCache, stats)
+	if err != nil {
+		writeRenderError(w, r, err)
+		return
+	}
+
+	resp := explainResponse{
+		From:           from64,
+		Until:          until64,
+		FindRequests:   stats.findRequests,
+		RenderRequests: stats.renderRequests,
+		Leaves:         stats.leaves,
+		Warnings:       warnings,
+	}
+
+	for i, target := range targets {
+		t := explainTarget{
+			Target:  target,
+			Cost:    stats.exprs[i].Cost(),
+			Tree:    stats.exprs[i].Tree(trace),
+			Fetches: []fetchStats{},
+			Runtime: stats.targetTimes[i].Runtime,
+		}
+		for _, f := range stats.fetches {
+			if f.target == i {
+				t.Fetches = append(t.Fetches, f)
+			}
+		}
+		resp.Targets = append(resp.Targets, t)
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, b, "json", "")
+}
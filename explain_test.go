@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	leaves := []string{"foo.a", "foo.b", "foo.c"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}, batchSize: 2}
+	Limiter = newLimiter(1)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+
+	req := httptest.NewRequest("GET", "/render?target=sum(foo.*)&target=timeShift(foo.*,'1h')&explain=1&from=1000000000&until=1000000600", nil)
+	w := httptest.NewRecorder()
+	var stats renderStats
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		From, Until    int64
+		FindRequests   int
+		RenderRequests int
+		Targets        []struct {
+			Target string
+			Cost   struct{ Depth, Functions, Fetches int }
+			Tree   struct {
+				Type, Name string
+				Args       []struct {
+					Type, Name string
+					Eval       *struct{ Series int }
+				}
+				Eval *struct{ Calls, Series int }
+			}
+			Fetches []struct {
+				Metric                                  string
+				From, Until                             int64
+				Reused                                  bool
+				Matches, Leaves, RenderRequests, Series int
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %q: %v", w.Body.String(), err)
+	}
+
+	if resp.From != 1000000000 || resp.Until != 1000000600 || resp.FindRequests != 2 || resp.RenderRequests != 4 || len(resp.Targets) != 2 {
+		t.Fatalf("got %+v", resp)
+	}
+
+	sum := resp.Targets[0]
+	if sum.Target != "sum(foo.*)" || sum.Cost.Depth != 1 || sum.Cost.Fetches != 1 {
+		t.Errorf("sum: got target %q, cost %+v", sum.Target, sum.Cost)
+	}
+	if sum.Tree.Name != "sumSeries" || sum.Tree.Eval == nil || sum.Tree.Eval.Series != 1 || sum.Tree.Args[0].Eval == nil || sum.Tree.Args[0].Eval.Series != 3 {
+		t.Errorf("sum: got tree %+v", sum.Tree)
+	}
+	if len(sum.Fetches) != 1 {
+		t.Fatalf("sum: got fetches %+v", sum.Fetches)
+	}
+	if f := sum.Fetches[0]; f.Metric != "foo.*" || f.From != 1000000000 || f.Until != 1000000600 || f.Matches != 3 || f.Leaves != 3 || f.RenderRequests != 2 || f.Series != 3 {
+		t.Errorf("sum: got fetch %+v", f)
+	}
+
+	shifted := resp.Targets[1]
+	if len(shifted.Fetches) != 1 {
+		t.Fatalf("timeShift: got fetches %+v", shifted.Fetches)
+	}
+	if f := shifted.Fetches[0]; f.From != 1000000000-3600 || f.Until != 1000000600-3600 || f.Reused {
+		t.Errorf("timeShift: got fetch %+v", f)
+	}
+}
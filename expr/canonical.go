@@ -0,0 +1,13 @@
+package expr
+
+import "bytes"
+
+// Canonical returns the expression in normalized form: without whitespace,
+// with function aliases replaced by the function name, named arguments sorted
+// and strings in double quotes where possible.  Expressions which only differ
+// in these respects have the same canonical form, which ParseExpr accepts.
+func (e *Expr) Canonical() string {
+	var buf bytes.Buffer
+	e.write(&buf, true)
+	return buf.String()
+}
@@ -0,0 +1,63 @@
+package expr
+
+import "testing"
+
+func TestCanonical(t *testing.T) {
+
+	tests := []struct {
+		targets []string
+		want    string
+	}{
+		{
+			[]string{"foo.bar.*", " foo.bar.*"},
+			"foo.bar.*",
+		},
+		{
+			[]string{"sum(foo.*, bar.{a,b})", "sumSeries(foo.*,bar.{a,b})", "sum( foo.*,  bar.{a,b})"},
+			"sumSeries(foo.*,bar.{a,b})",
+		},
+		{
+			[]string{`alias(scale(foo, 2.0), 'x y')`, `alias(scale(foo,2),"x y")`},
+			`alias(scale(foo,2),"x y")`,
+		},
+		{
+			[]string{`alias(foo, 'say "hi"')`},
+			`alias(foo,'say "hi"')`,
+		},
+		{
+			[]string{"summarize(foo, '1h', func='max', alignToFrom=true)", `summarize(foo,"1h",alignToFrom=true,func="max")`},
+			`summarize(foo,"1h",alignToFrom=true,func="max")`,
+		},
+		{
+			[]string{"movingAverage(foo, -1.5e3)", "movingAverage(foo,-1500)"},
+			"movingAverage(foo,-1500)",
+		},
+		{
+			[]string{"noSuchFunction(foo, 1)"},
+			"noSuchFunction(foo,1)",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, target := range tt.targets {
+			exp, e, err := ParseExpr(target)
+			if err != nil || e != "" {
+				t.Fatalf("failed to parse %q: %v (left %q)", target, err, e)
+			}
+
+			got := exp.Canonical()
+			if got != tt.want {
+				t.Errorf("Canonical(%q)=%q, want %q", target, got, tt.want)
+				continue
+			}
+
+			// the canonical form is its own canonical form
+			exp, e, err = ParseExpr(got)
+			if err != nil || e != "" {
+				t.Errorf("failed to parse canonical %q: %v (left %q)", got, err, e)
+			} else if again := exp.Canonical(); again != got {
+				t.Errorf("Canonical(%q)=%q", got, again)
+			}
+		}
+	}
+}
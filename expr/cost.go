@@ -0,0 +1,206 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+)
+
+// Cost is an estimate of the work needed to evaluate an expression, as far
+// as it can be told from the expression alone, before fetching anything.
+type Cost struct {
+	// Depth is the deepest nesting of function calls.
+	Depth int `json:"depth"`
+	// Functions is the number of function calls.
+	Functions int `json:"functions"`
+	// Fetches is the number of metric requests, with those multiplied by
+	// timeStack counted once per shift.
+	Fetches int64 `json:"fetches"`
+	// WindowPoints and WindowSeconds are the largest moving window, given as
+	// a number of points or as an interval.
+	WindowPoints  int64 `json:"windowPoints,omitempty"`
+	WindowSeconds int64 `json:"windowSeconds,omitempty"`
+}
+
+// Limits bound the cost of the expressions of a request.  Zero means no limit.
+type Limits struct {
+	Depth         int
+	Functions     int
+	Fetches       int64
+	WindowPoints  int64
+	WindowSeconds int64
+}
+
+// CostError is returned by Check for a cost over one of the limits.
+type CostError struct {
+	What  string
+	Cost  int64
+	Limit int64
+}
+
+func (e *CostError) Error() string {
+	return fmt.Sprintf("%s is %d, over the limit of %d", e.What, e.Cost, e.Limit)
+}
+
+// Add returns the cost of evaluating the expressions of both c and o.
+func (c Cost) Add(o Cost) Cost {
+	return Cost{
+		Depth:         maxInt(c.Depth, o.Depth),
+		Functions:     c.Functions + o.Functions,
+		Fetches:       addInt64(c.Fetches, o.Fetches),
+		WindowPoints:  maxInt64(c.WindowPoints, o.WindowPoints),
+		WindowSeconds: maxInt64(c.WindowSeconds, o.WindowSeconds),
+	}
+}
+
+// Check returns a *CostError if c is over any of the limits.
+func (c Cost) Check(l Limits) error {
+	checks := []struct {
+		what        string
+		cost, limit int64
+	}{
+		{"nesting depth", int64(c.Depth), int64(l.Depth)},
+		{"number of function calls", int64(c.Functions), int64(l.Functions)},
+		{"number of metric fetches", c.Fetches, l.Fetches},
+		{"moving window in points", c.WindowPoints, l.WindowPoints},
+		{"moving window in seconds", c.WindowSeconds, l.WindowSeconds},
+	}
+
+	for _, ch := range checks {
+		if ch.limit > 0 && ch.cost > ch.limit {
+			return &CostError{What: ch.what, Cost: ch.cost, Limit: ch.limit}
+		}
+	}
+
+	return nil
+}
+
+// Cost estimates the cost of evaluating e.  The template of applyByNode is
+// counted once, as the number of nodes it is applied to is only known once the
+// series are fetched.
+func (e *Expr) Cost() Cost {
+	switch e.etype {
+	case etName:
+		return Cost{Fetches: 1}
+	case etFunc:
+	default:
+		return Cost{}
+	}
+
+	var c Cost
+	for _, a := range e.args {
+		c = c.Add(a.Cost())
+	}
+
+	f, ok := lookupFunction(e.target)
+	if ok {
+		switch f.Name {
+		case "timeStack":
+			if start, ok := constArg(e, 2); ok {
+				if end, ok := constArg(e, 3); ok && end > start {
+					c.Fetches = mulInt64(c.Fetches, subInt64(end, start))
+				}
+			}
+		case "applyByNode":
+			if template, err := getStringArg(e, 2); err == nil {
+				// the template is evaluated with % replaced by a metric prefix
+				if t, rest, err := ParseExpr(template); err == nil && rest == "" {
+					// its names are looked up among the fetched series
+					tc := t.Cost()
+					tc.Fetches = 0
+					c = c.Add(tc)
+				}
+			}
+		}
+
+		for i, p := range f.Params {
+			if p.Type != ParamIntOrInterval {
+				continue
+			}
+			w := e.NamedArg(p.Name)
+			if w == nil && i < len(e.args) {
+				w = e.args[i]
+			}
+			if w == nil {
+				continue
+			}
+			switch w.etype {
+			case etConst:
+				c.WindowPoints = maxInt64(c.WindowPoints, clampInt64(w.val))
+			case etString:
+				if w.valStr == "" {
+					continue
+				}
+				if seconds, err := IntervalString(w.valStr, 1); err == nil {
+					c.WindowSeconds = maxInt64(c.WindowSeconds, seconds)
+				}
+			}
+		}
+	}
+
+	c.Depth++
+	c.Functions++
+
+	return c
+}
+
+// constArg returns the number given as argument n of e, truncated as
+// getIntArg does
+func constArg(e *Expr, n int) (int64, bool) {
+	if len(e.args) <= n || e.args[n].etype != etConst {
+		return 0, false
+	}
+	return clampInt64(e.args[n].val), true
+}
+
+// The costs saturate rather than wrap around, so that no expression, however
+// large, gets under the limits.
+
+func clampInt64(f float64) int64 {
+	switch {
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	case math.IsNaN(f):
+		return 0
+	}
+	return int64(f)
+}
+
+// addInt64 adds costs, which are never negative
+func addInt64(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// mulInt64 multiplies costs, which are never negative
+func mulInt64(a, b int64) int64 {
+	if a != 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
+	}
+	return a * b
+}
+
+// subInt64 returns b-a for b > a
+func subInt64(b, a int64) int64 {
+	if a < 0 && b > math.MaxInt64+a {
+		return math.MaxInt64
+	}
+	return b - a
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
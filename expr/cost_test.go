@@ -0,0 +1,80 @@
+package expr
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCost(t *testing.T) {
+
+	tests := []struct {
+		target string
+		want   Cost
+	}{
+		{"foo.bar", Cost{Fetches: 1}},
+		{"sumSeries(foo, bar, baz)", Cost{Depth: 1, Functions: 1, Fetches: 3}},
+		{"scale(absolute(derivative(foo)), 2)", Cost{Depth: 3, Functions: 3, Fetches: 1}},
+		{"sumSeries(scale(foo, 2), absolute(bar))", Cost{Depth: 2, Functions: 3, Fetches: 2}},
+		{"timeStack(foo, '1d', 0, 7)", Cost{Depth: 1, Functions: 1, Fetches: 7}},
+		{"timeStack(sumSeries(foo, bar), '1d', 2, 5)", Cost{Depth: 2, Functions: 2, Fetches: 6}},
+		{"movingMedian(foo, 1000)", Cost{Depth: 1, Functions: 1, Fetches: 1, WindowPoints: 1000}},
+		{"movingAverage(movingMedian(foo, '1h'), windowSize='1d')", Cost{Depth: 2, Functions: 2, Fetches: 1, WindowSeconds: 86400}},
+		{"applyByNode(foo.*.bar, 1, 'sumSeries(%.baz, scale(%.qux, 2))')", Cost{Depth: 3, Functions: 3, Fetches: 1}},
+		{"noSuchFunction(foo)", Cost{Depth: 1, Functions: 1, Fetches: 1}},
+		// too many to count saturates rather than wrapping around
+		{"timeStack(timeStack(foo, '1d', 0, 4000000000), '1d', 0, 4000000000)", Cost{Depth: 2, Functions: 2, Fetches: math.MaxInt64}},
+		{"timeStack(timeStack(timeStack(foo, '1d', 0, 3000000), '1d', 0, 3000000), '1d', 0, 3000000)", Cost{Depth: 3, Functions: 3, Fetches: math.MaxInt64}},
+		{"timeStack(foo, '1d', -9000000000000000000, 9000000000000000000)", Cost{Depth: 1, Functions: 1, Fetches: math.MaxInt64}},
+		{"timeStack(foo, '1d', 0, 100000000000000000000)", Cost{Depth: 1, Functions: 1, Fetches: math.MaxInt64}},
+		{"movingMedian(foo, 100000000000000000000)", Cost{Depth: 1, Functions: 1, Fetches: 1, WindowPoints: math.MaxInt64}},
+	}
+
+	for _, tt := range tests {
+		e, _, err := ParseExpr(tt.target)
+		if err != nil {
+			t.Errorf("%s: parse error: %v", tt.target, err)
+			continue
+		}
+		if got := e.Cost(); got != tt.want {
+			t.Errorf("%s: Cost()=%+v, want %+v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCostCheck(t *testing.T) {
+
+	c := Cost{Depth: 3, Functions: 5, Fetches: 10, WindowPoints: 100, WindowSeconds: 3600}
+
+	if err := c.Check(Limits{}); err != nil {
+		t.Errorf("Check with no limits: %v", err)
+	}
+
+	if err := c.Check(Limits{Depth: 3, Functions: 5, Fetches: 10, WindowPoints: 100, WindowSeconds: 3600}); err != nil {
+		t.Errorf("Check at the limits: %v", err)
+	}
+
+	err := c.Check(Limits{Fetches: 9})
+	ce, ok := err.(*CostError)
+	if !ok {
+		t.Fatalf("Check over the fetch limit: got %v, want a *CostError", err)
+	}
+	if ce.What != "number of metric fetches" || ce.Cost != 10 || ce.Limit != 9 {
+		t.Errorf("Check over the fetch limit: got %+v", ce)
+	}
+
+	if got := c.Add(Cost{Depth: 1, Functions: 1, Fetches: 2, WindowSeconds: 7200}); got != (Cost{Depth: 3, Functions: 6, Fetches: 12, WindowPoints: 100, WindowSeconds: 7200}) {
+		t.Errorf("Add: got %+v", got)
+	}
+
+	if got := c.Add(Cost{Fetches: math.MaxInt64}); got.Fetches != math.MaxInt64 {
+		t.Errorf("Add of too many fetches: got %d, want %d", got.Fetches, int64(math.MaxInt64))
+	}
+
+	nested, _, err := ParseExpr("timeStack(timeStack(foo, '1d', 0, 4000000000), '1d', 0, 4000000000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nested.Cost().Check(Limits{Fetches: 1000}); err == nil {
+		t.Errorf("Check of nested timeStacks under the fetch limit")
+	}
+}
@@ -1,21 +1,16 @@
 package expr
 
 import (
-	"container/heap"
+	"context"
 	"errors"
 	"fmt"
 	"math"
-	"math/rand"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/JaderDias/movingmedian"
 	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
-	"github.com/dgryski/go-onlinestats"
-	"github.com/dustin/go-humanize"
 	"github.com/gogo/protobuf/proto"
 	"github.com/wangjohn/quickselect"
 )
@@ -31,23 +26,47 @@ const (
 	etString
 )
 
-type expr struct {
+type Expr struct {
 	target    string
 	etype     exprType
 	val       float64
 	valStr    string
-	args      []*expr // positional
-	namedArgs map[string]*expr
+	args      []*Expr // positional
+	namedArgs map[string]*Expr
 	argString string
 }
 
+// Target returns the metric name, or the function name for a function call.
+func (e *Expr) Target() string { return e.target }
+
+// Args returns the positional arguments of a function call.
+func (e *Expr) Args() []*Expr { return e.args }
+
+// NamedArg returns the named argument k of a function call, or nil if it was not given.
+func (e *Expr) NamedArg(k string) *Expr { return getNamedArg(e, k) }
+
+// ArgString returns the unparsed argument list of a function call.
+func (e *Expr) ArgString() string { return e.argString }
+
+// StringValue returns the value of a string argument.
+func (e *Expr) StringValue() (string, error) { return doGetStringArg(e) }
+
+// FloatValue returns the value of a numeric argument.
+func (e *Expr) FloatValue() (float64, error) { return doGetFloatArg(e) }
+
+// IntValue returns the value of a numeric argument, truncated to an int.
+func (e *Expr) IntValue() (int, error) { return doGetIntArg(e) }
+
+// BoolValue returns the value of a boolean argument.
+func (e *Expr) BoolValue() (bool, error) { return doGetBoolArg(e) }
+
 type MetricRequest struct {
 	Metric string
-	From   int32
-	Until  int32
+	From   int64
+	Until  int64
 }
 
-func (e *expr) Metrics() []MetricRequest {
+func (e *Expr) Metrics() []MetricRequest {
 
 	switch e.etype {
 	case etName:
@@ -55,64 +74,18 @@ func (e *expr) Metrics() []MetricRequest {
 	case etConst, etString:
 		return nil
 	case etFunc:
+		if f, ok := lookupFunction(e.target); ok && f.Name == "template" && len(e.args) != 0 {
+			// the variables are set from the outside in
+			return templateArg(e).Metrics()
+		}
+
 		var r []MetricRequest
 		for _, a := range e.args {
 			r = append(r, a.Metrics()...)
 		}
 
-		switch e.target {
-		case "timeShift":
-			offs, err := getIntervalArg(e, 1, -1)
-			if err != nil {
-				return nil
-			}
-			for i := range r {
-				r[i].From += offs
-				r[i].Until += offs
-			}
-		case "timeStack":
-			offs, err := getIntervalArg(e, 1, -1)
-			if err != nil {
-				return nil
-			}
-
-			start, err := getIntArg(e, 2)
-			if err != nil {
-				return nil
-			}
-
-			end, err := getIntArg(e, 3)
-			if err != nil {
-				return nil
-			}
-
-			var r2 []MetricRequest
-			for _, v := range r {
-				for i := int32(start); i < int32(end); i++ {
-					r2 = append(r2, MetricRequest{
-						Metric: v.Metric,
-						From:   v.From + (i * offs),
-						Until:  v.Until + (i * offs),
-					})
-				}
-			}
-
-			return r2
-		case "holtWintersForecast":
-			for i := range r {
-				r[i].From -= 7 * 86400 // starts -7 days from where the original starts
-			}
-		case "movingAverage", "movingMedian":
-			switch e.args[1].etype {
-			case etString:
-				offs, err := getIntervalArg(e, 1, 1)
-				if err != nil {
-					return nil
-				}
-				for i := range r {
-					r[i].From -= offs
-				}
-			}
+		if f, ok := lookupFunction(e.target); ok && f.Lookback != nil {
+			return f.Lookback(e, r)
 		}
 		return r
 	}
@@ -120,7 +93,13 @@ func (e *expr) Metrics() []MetricRequest {
 	return nil
 }
 
-func ParseExpr(e string) (*expr, string, error) {
+func ParseExpr(e string) (*Expr, string, error) {
+	return parseExpr(e, nil)
+}
+
+// parseExpr parses e, recording in rest the length of the input left at the
+// start of each node if it is not nil
+func parseExpr(e string, rest map[*Expr]int) (*Expr, string, error) {
 
 	// skip whitespace
 	for len(e) > 1 && e[0] == ' ' {
@@ -131,14 +110,22 @@ func ParseExpr(e string) (*expr, string, error) {
 		return nil, "", ErrMissingExpr
 	}
 
+	n := len(e)
+	record := func(exp *Expr) *Expr {
+		if rest != nil {
+			rest[exp] = n
+		}
+		return exp
+	}
+
 	if '0' <= e[0] && e[0] <= '9' || e[0] == '-' || e[0] == '+' {
 		val, e, err := parseConst(e)
-		return &expr{val: val, etype: etConst}, e, err
+		return record(&Expr{val: val, etype: etConst}), e, err
 	}
 
 	if e[0] == '\'' || e[0] == '"' {
 		val, e, err := parseString(e)
-		return &expr{valStr: val, etype: etString}, e, err
+		return record(&Expr{valStr: val, etype: etString}), e, err
 	}
 
 	name, e := parseName(e)
@@ -148,9 +135,9 @@ func ParseExpr(e string) (*expr, string, error) {
 	}
 
 	if e != "" && e[0] == '(' {
-		exp := &expr{target: name, etype: etFunc}
+		exp := record(&Expr{target: name, etype: etFunc})
 
-		argString, posArgs, namedArgs, e, err := parseArgList(e)
+		argString, posArgs, namedArgs, e, err := parseArgList(e, rest)
 		exp.argString = argString
 		exp.args = posArgs
 		exp.namedArgs = namedArgs
@@ -158,7 +145,7 @@ func ParseExpr(e string) (*expr, string, error) {
 		return exp, e, err
 	}
 
-	return &expr{target: name}, e, nil
+	return record(&Expr{target: name}), e, nil
 }
 
 var (
@@ -174,11 +161,11 @@ var (
 
 const defaultStackName = "__DEFAULT__"
 
-func parseArgList(e string) (string, []*expr, map[string]*expr, string, error) {
+func parseArgList(e string, rest map[*Expr]int) (string, []*Expr, map[string]*Expr, string, error) {
 
 	var (
-		posArgs   []*expr
-		namedArgs map[string]*expr
+		posArgs   []*Expr
+		namedArgs map[string]*Expr
 	)
 
 	if e[0] != '(' {
@@ -190,9 +177,9 @@ func parseArgList(e string) (string, []*expr, map[string]*expr, string, error) {
 	e = e[1:]
 
 	for {
-		var arg *expr
+		var arg *Expr
 		var err error
-		arg, e, err = ParseExpr(e)
+		arg, e, err = parseExpr(e, rest)
 		if err != nil {
 			return "", nil, nil, e, err
 		}
@@ -204,7 +191,7 @@ func parseArgList(e string) (string, []*expr, map[string]*expr, string, error) {
 		// we now know we're parsing a key-value pair
 		if arg.etype == etName && e[0] == '=' {
 			e = e[1:]
-			argCont, eCont, errCont := ParseExpr(e)
+			argCont, eCont, errCont := parseExpr(e, rest)
 			if errCont != nil {
 				return "", nil, nil, eCont, errCont
 			}
@@ -218,15 +205,18 @@ func parseArgList(e string) (string, []*expr, map[string]*expr, string, error) {
 			}
 
 			if namedArgs == nil {
-				namedArgs = make(map[string]*expr)
+				namedArgs = make(map[string]*Expr)
 			}
 
-			namedArgs[arg.target] = &expr{
+			namedArgs[arg.target] = &Expr{
 				etype:  argCont.etype,
 				val:    argCont.val,
 				valStr: argCont.valStr,
 				target: argCont.target,
 			}
+			if rest != nil {
+				rest[namedArgs[arg.target]] = rest[argCont]
+			}
 
 			e = eCont
 		} else {
@@ -251,7 +241,10 @@ func isNameChar(r byte) bool {
 		'A' <= r && r <= 'Z' ||
 		'0' <= r && r <= '9' ||
 		r == '.' || r == '_' || r == '-' || r == '*' || r == '?' || r == ':' ||
-		r == '[' || r == ']'
+		r == '[' || r == ']' ||
+		r == '%' || // stands for the group in applyByNode templates
+		r == '$' || // template variables
+		r == '@' // saved expressions
 }
 
 func isDigit(r byte) bool {
@@ -346,7 +339,7 @@ var (
 	ErrSeriesDoesNotExist = errors.New("no timeseries with that name")
 )
 
-func getStringArg(e *expr, n int) (string, error) {
+func getStringArg(e *Expr, n int) (string, error) {
 	if len(e.args) <= n {
 		return "", ErrMissingArgument
 	}
@@ -354,7 +347,7 @@ func getStringArg(e *expr, n int) (string, error) {
 	return doGetStringArg(e.args[n])
 }
 
-func getStringArgDefault(e *expr, n int, s string) (string, error) {
+func getStringArgDefault(e *Expr, n int, s string) (string, error) {
 	if len(e.args) <= n {
 		return s, nil
 	}
@@ -362,7 +355,7 @@ func getStringArgDefault(e *expr, n int, s string) (string, error) {
 	return doGetStringArg(e.args[n])
 }
 
-func getStringNamedOrPosArgDefault(e *expr, k string, n int, s string) (string, error) {
+func getStringNamedOrPosArgDefault(e *Expr, k string, n int, s string) (string, error) {
 	if a := getNamedArg(e, k); a != nil {
 		return doGetStringArg(a)
 	}
@@ -370,7 +363,7 @@ func getStringNamedOrPosArgDefault(e *expr, k string, n int, s string) (string,
 	return getStringArgDefault(e, n, s)
 }
 
-func doGetStringArg(e *expr) (string, error) {
+func doGetStringArg(e *Expr) (string, error) {
 	if e.etype != etString {
 		return "", ErrBadType
 	}
@@ -378,7 +371,7 @@ func doGetStringArg(e *expr) (string, error) {
 	return e.valStr, nil
 }
 
-func getIntervalArg(e *expr, n int, defaultSign int) (int32, error) {
+func getIntervalArg(e *Expr, n int, defaultSign int) (int64, error) {
 	if len(e.args) <= n {
 		return 0, ErrMissingArgument
 	}
@@ -395,7 +388,7 @@ func getIntervalArg(e *expr, n int, defaultSign int) (int32, error) {
 	return seconds, nil
 }
 
-func getFloatArg(e *expr, n int) (float64, error) {
+func getFloatArg(e *Expr, n int) (float64, error) {
 	if len(e.args) <= n {
 		return 0, ErrMissingArgument
 	}
@@ -403,7 +396,7 @@ func getFloatArg(e *expr, n int) (float64, error) {
 	return doGetFloatArg(e.args[n])
 }
 
-func getFloatArgDefault(e *expr, n int, v float64) (float64, error) {
+func getFloatArgDefault(e *Expr, n int, v float64) (float64, error) {
 	if len(e.args) <= n {
 		return v, nil
 	}
@@ -411,7 +404,7 @@ func getFloatArgDefault(e *expr, n int, v float64) (float64, error) {
 	return doGetFloatArg(e.args[n])
 }
 
-func getFloatNamedOrPosArgDefault(e *expr, k string, n int, v float64) (float64, error) {
+func getFloatNamedOrPosArgDefault(e *Expr, k string, n int, v float64) (float64, error) {
 	if a := getNamedArg(e, k); a != nil {
 		return doGetFloatArg(a)
 	}
@@ -419,7 +412,7 @@ func getFloatNamedOrPosArgDefault(e *expr, k string, n int, v float64) (float64,
 	return getFloatArgDefault(e, n, v)
 }
 
-func doGetFloatArg(e *expr) (float64, error) {
+func doGetFloatArg(e *Expr) (float64, error) {
 	if e.etype != etConst {
 		return 0, ErrBadType
 	}
@@ -427,7 +420,7 @@ func doGetFloatArg(e *expr) (float64, error) {
 	return e.val, nil
 }
 
-func getIntArg(e *expr, n int) (int, error) {
+func getIntArg(e *Expr, n int) (int, error) {
 	if len(e.args) <= n {
 		return 0, ErrMissingArgument
 	}
@@ -435,7 +428,7 @@ func getIntArg(e *expr, n int) (int, error) {
 	return doGetIntArg(e.args[n])
 }
 
-func getIntArgs(e *expr, n int) ([]int, error) {
+func getIntArgs(e *Expr, n int) ([]int, error) {
 
 	if len(e.args) <= n {
 		return nil, ErrMissingArgument
@@ -454,7 +447,7 @@ func getIntArgs(e *expr, n int) ([]int, error) {
 	return ints, nil
 }
 
-func getIntArgDefault(e *expr, n int, d int) (int, error) {
+func getIntArgDefault(e *Expr, n int, d int) (int, error) {
 	if len(e.args) <= n {
 		return d, nil
 	}
@@ -462,7 +455,7 @@ func getIntArgDefault(e *expr, n int, d int) (int, error) {
 	return doGetIntArg(e.args[n])
 }
 
-func getIntNamedOrPosArgDefault(e *expr, k string, n int, d int) (int, error) {
+func getIntNamedOrPosArgDefault(e *Expr, k string, n int, d int) (int, error) {
 	if a := getNamedArg(e, k); a != nil {
 		return doGetIntArg(a)
 	}
@@ -470,7 +463,7 @@ func getIntNamedOrPosArgDefault(e *expr, k string, n int, d int) (int, error) {
 	return getIntArgDefault(e, n, d)
 }
 
-func doGetIntArg(e *expr) (int, error) {
+func doGetIntArg(e *Expr) (int, error) {
 	if e.etype != etConst {
 		return 0, ErrBadType
 	}
@@ -478,7 +471,7 @@ func doGetIntArg(e *expr) (int, error) {
 	return int(e.val), nil
 }
 
-func getBoolNamedOrPosArgDefault(e *expr, k string, n int, b bool) (bool, error) {
+func getBoolNamedOrPosArgDefault(e *Expr, k string, n int, b bool) (bool, error) {
 	if a := getNamedArg(e, k); a != nil {
 		return doGetBoolArg(a)
 	}
@@ -486,7 +479,7 @@ func getBoolNamedOrPosArgDefault(e *expr, k string, n int, b bool) (bool, error)
 	return getBoolArgDefault(e, n, b)
 }
 
-func getBoolArgDefault(e *expr, n int, b bool) (bool, error) {
+func getBoolArgDefault(e *Expr, n int, b bool) (bool, error) {
 	if len(e.args) <= n {
 		return b, nil
 	}
@@ -494,7 +487,7 @@ func getBoolArgDefault(e *expr, n int, b bool) (bool, error) {
 	return doGetBoolArg(e.args[n])
 }
 
-func doGetBoolArg(e *expr) (bool, error) {
+func doGetBoolArg(e *Expr) (bool, error) {
 	if e.etype != etName {
 		return false, ErrBadType
 	}
@@ -510,12 +503,15 @@ func doGetBoolArg(e *expr) (bool, error) {
 	return false, ErrBadType
 }
 
-func getSeriesArg(arg *expr, from, until int32, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+func getSeriesArg(ctx context.Context, arg *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
 	if arg.etype != etName && arg.etype != etFunc {
 		return nil, ErrMissingTimeseries
 	}
 
-	a, _ := EvalExpr(arg, from, until, values)
+	a, _ := EvalExpr(ctx, arg, from, until, values)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	if len(a) == 0 {
 		return nil, ErrSeriesDoesNotExist
@@ -524,12 +520,12 @@ func getSeriesArg(arg *expr, from, until int32, values map[MetricRequest][]*Metr
 	return a, nil
 }
 
-func getSeriesArgs(e []*expr, from, until int32, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+func getSeriesArgs(ctx context.Context, e []*Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
 
 	var args []*MetricData
 
 	for _, arg := range e {
-		a, err := getSeriesArg(arg, from, until, values)
+		a, err := getSeriesArg(ctx, arg, from, until, values)
 		if err != nil {
 			return nil, err
 		}
@@ -543,7 +539,7 @@ func getSeriesArgs(e []*expr, from, until int32, values map[MetricRequest][]*Met
 	return args, nil
 }
 
-func getNamedArg(e *expr, name string) *expr {
+func getNamedArg(e *Expr, name string) *Expr {
 	if a, ok := e.namedArgs[name]; ok {
 		return a
 	}
@@ -558,9 +554,26 @@ var (
 	ErrTooManyArguments = errors.New("too many arguments")
 )
 
-var backref = regexp.MustCompile(`\\(\d+)`)
+// EvalExpr evaluates e for the time range [from, until) using the series in values.
+// It stops early with ctx.Err() once ctx is cancelled.
+func EvalExpr(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+
+	t := traceFromContext(ctx)
+	if t == nil {
+		return evalExpr(ctx, e, from, until, values)
+	}
+
+	t0 := time.Now()
+	r, err := evalExpr(ctx, e, from, until, values)
+	t.record(e, len(r), time.Since(t0))
+	return r, err
+}
+
+func evalExpr(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
 
-func EvalExpr(e *expr, from, until int32, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	switch e.etype {
 	case etName:
@@ -577,2867 +590,12 @@ func EvalExpr(e *expr, from, until int32, values map[MetricRequest][]*MetricData
 		return nil, ErrMissingArgument
 	}
 
-	switch e.target {
-	case "absolute": // absolute(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = math.Abs(v)
-			}
-			return r
-		})
-
-	case "alias": // alias(seriesList, newName)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		alias, err := getStringArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(alias)
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "aliasByMetric": // aliasByMetric(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
-			metric := extractMetric(a.GetName())
-			part := strings.Split(metric, ".")
-			r.Name = proto.String(part[len(part)-1])
-			r.Values = a.Values
-			r.IsAbsent = a.IsAbsent
-			return r
-		})
-
-	case "aliasByNode": // aliasByNode(seriesList, *nodes)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		fields, err := getIntArgs(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range args {
-
-			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
-
-			var name []string
-			for _, f := range fields {
-				if f < 0 {
-					f += len(nodes)
-				}
-				if f >= len(nodes) || f < 0 {
-					continue
-				}
-				name = append(name, nodes[f])
-			}
-
-			r := *a
-			r.Name = proto.String(strings.Join(name, "."))
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "aliasSub": // aliasSub(seriesList, search, replace)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		search, err := getStringArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		replace, err := getStringArg(e, 2)
-		if err != nil {
-			return nil, err
-		}
-
-		re, err := regexp.Compile(search)
-		if err != nil {
-			return nil, err
-		}
-
-		replace = backref.ReplaceAllString(replace, "$${$1}")
-
-		var results []*MetricData
-
-		for _, a := range args {
-			metric := extractMetric(a.GetName())
-
-			r := *a
-			r.Name = proto.String(re.ReplaceAllString(metric, replace))
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "asPercent": // asPercent(seriesList, total=None)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var getTotal func(i int) float64
-		var formatName func(a *MetricData) string
-
-		if len(e.args) == 1 {
-			getTotal = func(i int) float64 {
-				var t float64
-				var atLeastOne bool
-				for _, a := range arg {
-					if a.IsAbsent[i] {
-						continue
-					}
-					atLeastOne = true
-					t += a.Values[i]
-				}
-				if !atLeastOne {
-					t = math.NaN()
-				}
-
-				return t
-			}
-			formatName = func(a *MetricData) string {
-				return fmt.Sprintf("asPercent(%s)", a.GetName())
-			}
-		} else if len(e.args) == 2 && e.args[1].etype == etConst {
-			total, err := getFloatArg(e, 1)
-			if err != nil {
-				return nil, err
-			}
-			getTotal = func(i int) float64 { return total }
-			formatName = func(a *MetricData) string {
-				return fmt.Sprintf("asPercent(%s,%g)", a.GetName(), total)
-			}
-		} else if len(e.args) == 2 && (e.args[1].etype == etName || e.args[1].etype == etFunc) {
-			total, err := getSeriesArg(e.args[1], from, until, values)
-			if err != nil {
-				return nil, err
-			}
-			if len(total) != 1 {
-				return nil, ErrWildcardNotAllowed
-			}
-			getTotal = func(i int) float64 {
-				if total[0].IsAbsent[i] {
-					return math.NaN()
-				}
-				return total[0].Values[i]
-			}
-			var totalString string
-			if e.args[1].etype == etName {
-				totalString = e.args[1].target
-			} else {
-				totalString = fmt.Sprintf("%s(%s)", e.args[1].target, e.args[1].argString)
-			}
-			formatName = func(a *MetricData) string {
-				return fmt.Sprintf("asPercent(%s,%s)", a.GetName(), totalString)
-			}
-		} else {
-			return nil, errors.New("total must be either a constant or a series")
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(formatName(a))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-			results = append(results, &r)
-		}
-
-		for i := range results[0].Values {
-
-			total := getTotal(i)
-
-			for j := range results {
-				r := results[j]
-				a := arg[j]
-
-				if a.IsAbsent[i] || math.IsNaN(total) || total == 0 {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-
-				r.Values[i] = (a.Values[i] / total) * 100
-			}
-		}
-		return results, nil
-
-	case "avg", "averageSeries": // averageSeries(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		e.target = "averageSeries"
-		return aggregateSeries(e, args, func(values []float64) float64 {
-			sum := 0.0
-			for _, value := range values {
-				sum += value
-			}
-			return sum / float64(len(values))
-		})
-
-	case "averageSeriesWithWildcards": // averageSeriesWithWildcards(seriesLIst, *position)
-		/* TODO(dgryski): make sure the arrays are all the same 'size'
-		   (duplicated from sumSeriesWithWildcards because of similar logic but aggregation) */
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		fields, err := getIntArgs(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		nodeList := []string{}
-		groups := make(map[string][]*MetricData)
-
-		for _, a := range args {
-			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
-			var s []string
-			// Yes, this is O(n^2), but len(nodes) < 10 and len(fields) < 3
-			// Iterating an int slice is faster than a map for n ~ 30
-			// http://www.antoine.im/posts/someone_is_wrong_on_the_internet
-			for i, n := range nodes {
-				if !contains(fields, i) {
-					s = append(s, n)
-				}
-			}
-
-			node := strings.Join(s, ".")
-
-			if len(groups[node]) == 0 {
-				nodeList = append(nodeList, node)
-			}
-
-			groups[node] = append(groups[node], a)
-		}
-
-		for _, series := range nodeList {
-			args := groups[series]
-			r := *args[0]
-			r.Name = proto.String(fmt.Sprintf("averageSeriesWithWildcards(%s)", series))
-			r.Values = make([]float64, len(args[0].Values))
-			r.IsAbsent = make([]bool, len(args[0].Values))
-
-			length := make([]float64, len(args[0].Values))
-			atLeastOne := make([]bool, len(args[0].Values))
-			for _, arg := range args {
-				for i, v := range arg.Values {
-					if arg.IsAbsent[i] {
-						continue
-					}
-					atLeastOne[i] = true
-					length[i]++
-					r.Values[i] += v
-				}
-			}
-
-			for i, v := range atLeastOne {
-				if v {
-					r.Values[i] = r.Values[i] / length[i]
-				} else {
-					r.IsAbsent[i] = true
-				}
-			}
-
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "averageAbove", "averageBelow", "currentAbove", "currentBelow", "maximumAbove", "maximumBelow", "minimumAbove", "minimumBelow": // averageAbove(seriesList, n), averageBelow(seriesList, n), currentAbove(seriesList, n), currentBelow(seriesList, n), maximumAbove(seriesList, n), maximumBelow(seriesList, n), minimumAbove(seriesList, n), minimumBelow
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		n, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		isAbove := strings.HasSuffix(e.target, "Above")
-		isInclusive := true
-		var compute func([]float64, []bool) float64
-		switch {
-		case strings.HasPrefix(e.target, "average"):
-			compute = avgValue
-		case strings.HasPrefix(e.target, "current"):
-			compute = currentValue
-		case strings.HasPrefix(e.target, "maximum"):
-			compute = maxValue
-			isInclusive = false
-		case strings.HasPrefix(e.target, "minimum"):
-			compute = minValue
-			isInclusive = false
-		}
-		var results []*MetricData
-		for _, a := range args {
-			value := compute(a.Values, a.IsAbsent)
-			if isAbove {
-				if isInclusive {
-					if value >= n {
-						results = append(results, a)
-					}
-				} else {
-					if value > n {
-						results = append(results, a)
-					}
-				}
-			} else {
-				if value <= n {
-					results = append(results, a)
-				}
-			}
-		}
-
-		return results, err
-
-	case "derivative": // derivative(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
-			prev := a.Values[0]
-			for i, v := range a.Values {
-				if i == 0 || a.IsAbsent[i] {
-					r.IsAbsent[i] = true
-					continue
-				}
-
-				r.Values[i] = v - prev
-				prev = v
-			}
-			return r
-		})
-	case "countSeries": // countSeries(seriesList)
-		// TODO(civil): Check that series have equal length
-		args, err := getSeriesArgs(e.args, from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		r := *args[0]
-		r.Name = proto.String(fmt.Sprintf("countSeries(%s)", e.argString))
-		r.Values = make([]float64, len(args[0].Values))
-		r.IsAbsent = make([]bool, len(args[0].Values))
-		count := float64(len(args))
-
-		for i := range args[0].Values {
-			r.Values[i] = count
-		}
-
-		return []*MetricData{&r}, nil
-
-	case "diffSeries": // diffSeries(*seriesLists)
-		minuend, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		subtrahends, err := getSeriesArgs(e.args[1:], from, until, values)
-		if err != nil {
-			if len(minuend) < 2 {
-				return nil, err
-			}
-			subtrahends = minuend[1:]
-			err = nil
-		}
-
-		// FIXME: need more error checking on minuend, subtrahends here
-		r := *minuend[0]
-		r.Name = proto.String(fmt.Sprintf("diffSeries(%s)", e.argString))
-		r.Values = make([]float64, len(minuend[0].Values))
-		r.IsAbsent = make([]bool, len(minuend[0].Values))
-
-		for i, v := range minuend[0].Values {
-
-			if minuend[0].IsAbsent[i] {
-				r.IsAbsent[i] = true
-				continue
-			}
-
-			var sub float64
-			for _, s := range subtrahends {
-				if s.IsAbsent[i] {
-					continue
-				}
-				sub += s.Values[i]
-			}
-
-			r.Values[i] = v - sub
-		}
-		return []*MetricData{&r}, err
-	case "rangeOfSeries": // rangeOfSeries(*seriesLists)
-		series, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		r := *series[0]
-		r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, e.argString))
-		r.Values = make([]float64, len(series[0].Values))
-		r.IsAbsent = make([]bool, len(series[0].Values))
-
-		for i := range series[0].Values {
-			var min, max float64
-			count := 0
-			for _, s := range series {
-				if s.IsAbsent[i] {
-					continue
-				}
-
-				if count == 0 {
-					min = s.Values[i]
-					max = s.Values[i]
-				} else {
-					min = math.Min(min, s.Values[i])
-					max = math.Max(max, s.Values[i])
-				}
-
-				count++
-			}
-
-			if count >= 2 {
-				r.Values[i] = max - min
-			} else {
-				r.IsAbsent[i] = true
-			}
-		}
-		return []*MetricData{&r}, err
-
-	case "divideSeries": // divideSeries(dividendSeriesList, divisorSeriesList)
-		if len(e.args) < 1 {
-			return nil, ErrMissingTimeseries
-		}
-
-		numerators, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var numerator, denominator *MetricData
-		if len(numerators) == 1 && len(e.args) == 2 {
-			numerator = numerators[0]
-			denominators, err := getSeriesArg(e.args[1], from, until, values)
-			if err != nil {
-				return nil, err
-			}
-			if len(denominators) != 1 {
-				return nil, ErrWildcardNotAllowed
-			}
-
-			denominator = denominators[0]
-		} else if len(numerators) == 2 && len(e.args) == 1 {
-			numerator = numerators[0]
-			denominator = numerators[1]
-		} else {
-			return nil, errors.New("must be called with 2 series or a wildcard that matches exactly 2 series")
-		}
-
-		if numerator.GetStepTime() != denominator.GetStepTime() || len(numerator.Values) != len(denominator.Values) {
-			return nil, errors.New("series must have the same length")
-		}
-
-		r := *numerator
-		r.Name = proto.String(fmt.Sprintf("divideSeries(%s)", e.argString))
-		r.Values = make([]float64, len(numerator.Values))
-		r.IsAbsent = make([]bool, len(numerator.Values))
-
-		for i, v := range numerator.Values {
-
-			if numerator.IsAbsent[i] || denominator.IsAbsent[i] || denominator.Values[i] == 0 {
-				r.IsAbsent[i] = true
-				continue
-			}
-
-			r.Values[i] = v / denominator.Values[i]
-		}
-		return []*MetricData{&r}, nil
-
-	case "multiplySeries": // multiplySeries(factorsSeriesList)
-		r := MetricData{
-			FetchResponse: pb.FetchResponse{
-				Name:      proto.String(fmt.Sprintf("multiplySeries(%s)", e.argString)),
-				StartTime: &from,
-				StopTime:  &until,
-			},
-		}
-		for _, arg := range e.args {
-			series, err := getSeriesArg(arg, from, until, values)
-			if err != nil {
-				return nil, err
-			}
-
-			if r.Values == nil {
-				r.IsAbsent = make([]bool, len(series[0].IsAbsent))
-				r.StepTime = series[0].StepTime
-				r.Values = make([]float64, len(series[0].Values))
-				copy(r.IsAbsent, series[0].IsAbsent)
-				copy(r.Values, series[0].Values)
-				series = series[1:]
-			}
-
-			for _, factor := range series {
-				for i, v := range r.Values {
-					if r.IsAbsent[i] || factor.IsAbsent[i] {
-						r.IsAbsent[i] = true
-						r.Values[i] = math.NaN()
-						continue
-					}
-
-					r.Values[i] = v * factor.Values[i]
-				}
-			}
-		}
-
-		return []*MetricData{&r}, nil
-
-	case "ewma", "exponentialWeightedMovingAverage": // ewma(seriesList, alpha)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		alpha, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		e.target = "ewma"
-
-		// ugh, forEachSeriesDo does not handle arguments properly
-		var results []*MetricData
-		for _, a := range arg {
-			name := fmt.Sprintf("ewma(%s,%v)", a.GetName(), alpha)
-
-			r := *a
-			r.Name = proto.String(name)
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			ewma := onlinestats.NewExpWeight(alpha)
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.IsAbsent[i] = true
-					continue
-				}
-
-				ewma.Push(v)
-				r.Values[i] = ewma.Mean()
-			}
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "exclude": // exclude(seriesList, pattern)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		pat, err := getStringArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		patre, err := regexp.Compile(pat)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			if !patre.MatchString(a.GetName()) {
-				results = append(results, a)
-			}
-		}
-
-		return results, nil
-
-	case "grep": // grep(seriesList, pattern)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		pat, err := getStringArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		patre, err := regexp.Compile(pat)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			if patre.MatchString(a.GetName()) {
-				results = append(results, a)
-			}
-		}
-
-		return results, nil
-
-	case "group": // group(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		return args, nil
-
-	case "groupByNode", "applyByNode": // groupByNode(seriesList, nodeNum, callback), applyByNode(seriesList, nodeNum, templateFunction)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		field, err := getIntArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		callback, err := getStringArg(e, 2)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		groups := make(map[string][]*MetricData)
-		nodeList := []string{}
-
-		for _, a := range args {
-
-			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
-			node := nodes[field]
-			if e.target == "applyByNode" {
-				node = strings.Join(nodes[0:field+1], ".")
-			}
-
-			if len(groups[node]) == 0 {
-				nodeList = append(nodeList, node)
-			}
-
-			groups[node] = append(groups[node], a)
-		}
-
-		for _, k := range nodeList {
-			k := k // k's reference is used later, so it's important to make it unique per loop
-			v := groups[k]
-
-			// Ensure that names won't be parsed as consts, appending stub to them
-			expr := fmt.Sprintf("%s(stub_%s)", callback, k)
-			if e.target == "applyByNode" {
-				expr = strings.Replace(callback, "%", k, -1)
-			}
-
-			// create a stub context to evaluate the callback in
-			nexpr, _, err := ParseExpr(expr)
-			// remove all stub_ prefixes we've prepended before
-			nexpr.argString = strings.Replace(nexpr.argString, "stub_", "", 1)
-			for argIdx := range nexpr.args {
-				nexpr.args[argIdx].target = strings.Replace(nexpr.args[0].target, "stub_", "", 1)
-			}
-			if err != nil {
-				return nil, err
-			}
-
-			nvalues := values
-			if e.target == "groupByNode" {
-				nvalues = map[MetricRequest][]*MetricData{
-					MetricRequest{k, from, until}: v,
-				}
-			}
-
-			r, _ := EvalExpr(nexpr, from, until, nvalues)
-			if r != nil {
-				r[0].Name = &k
-				results = append(results, r...)
-			}
-		}
-
-		return results, nil
-
-	case "isNonNull", "isNotNull": // isNonNull(seriesList), isNotNull(seriesList)
-
-		e.target = "isNonNull"
-
-		return forEachSeriesDo(e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
-			for i := range a.Values {
-				r.IsAbsent[i] = false
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-				} else {
-					r.Values[i] = 1
-				}
-
-			}
-			return r
-		})
-
-	case "lowestAverage", "lowestCurrent": // lowestAverage(seriesList, n) , lowestCurrent(seriesList, n)
-
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		n, err := getIntArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-		var results []*MetricData
-
-		// we have fewer arguments than we want result series
-		if len(arg) < n {
-			return arg, nil
-		}
-
-		var mh metricHeap
-
-		var compute func([]float64, []bool) float64
-
-		switch e.target {
-		case "lowestAverage":
-			compute = avgValue
-		case "lowestCurrent":
-			compute = currentValue
-		}
-
-		for i, a := range arg {
-			m := compute(a.Values, a.IsAbsent)
-			heap.Push(&mh, metricHeapElement{idx: i, val: m})
-		}
-
-		results = make([]*MetricData, n)
-
-		// results should be ordered ascending
-		for i := 0; i < n; i++ {
-			v := heap.Pop(&mh).(metricHeapElement)
-			results[i] = arg[v.idx]
-		}
-
-		return results, nil
-
-	case "highestAverage", "highestCurrent", "highestMax": // highestAverage(seriesList, n) , highestCurrent(seriesList, n), highestMax(seriesList, n)
-
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		n, err := getIntArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-		var results []*MetricData
-
-		// we have fewer arguments than we want result series
-		if len(arg) < n {
-			return arg, nil
-		}
-
-		var mh metricHeap
-
-		var compute func([]float64, []bool) float64
-
-		switch e.target {
-		case "highestMax":
-			compute = maxValue
-		case "highestAverage":
-			compute = avgValue
-		case "highestCurrent":
-			compute = currentValue
-		}
-
-		for i, a := range arg {
-			m := compute(a.Values, a.IsAbsent)
-			if math.IsNaN(m) {
-				continue
-			}
-
-			if len(mh) < n {
-				heap.Push(&mh, metricHeapElement{idx: i, val: m})
-				continue
-			}
-			// m is bigger than smallest max found so far
-			if mh[0].val < m {
-				mh[0].val = m
-				mh[0].idx = i
-				heap.Fix(&mh, 0)
-			}
-		}
-
-		results = make([]*MetricData, len(mh))
-
-		// results should be ordered ascending
-		for len(mh) > 0 {
-			v := heap.Pop(&mh).(metricHeapElement)
-			results[len(mh)] = arg[v.idx]
-		}
-
-		return results, nil
-
-	case "hitcount": // hitcount(seriesList, intervalString, alignToInterval=False)
-		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		bucketSize, err := getIntervalArg(e, 1, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		alignToInterval, err := getBoolNamedOrPosArgDefault(e, "alignToInterval", 2, false)
-		if err != nil {
-			return nil, err
-		}
-		_, ok := e.namedArgs["alignToInterval"]
-		if !ok {
-			ok = len(e.args) > 2
-		}
-
-		start := args[0].GetStartTime()
-		stop := args[0].GetStopTime()
-		if alignToInterval {
-			start = alignStartToInterval(start, stop, bucketSize)
-		}
-
-		buckets := getBuckets(start, stop, bucketSize)
-		results := make([]*MetricData, 0, len(args))
-		for _, arg := range args {
-
-			name := fmt.Sprintf("hitcount(%s,'%s'", arg.GetName(), e.args[1].valStr)
-			if ok {
-				name += fmt.Sprintf(",%v", alignToInterval)
-			}
-			name += ")"
-
-			r := MetricData{FetchResponse: pb.FetchResponse{
-				Name:      proto.String(name),
-				Values:    make([]float64, buckets, buckets+1),
-				IsAbsent:  make([]bool, buckets, buckets+1),
-				StepTime:  proto.Int32(bucketSize),
-				StartTime: proto.Int32(start),
-				StopTime:  proto.Int32(stop),
-			}}
-
-			bucketEnd := start + bucketSize
-			t := arg.GetStartTime()
-			ridx := 0
-			var count float64
-			bucketItems := 0
-			for i, v := range arg.Values {
-				bucketItems++
-				if !arg.IsAbsent[i] {
-					if math.IsNaN(count) {
-						count = 0
-					}
-
-					count += v * float64(arg.GetStepTime())
-				}
-
-				t += arg.GetStepTime()
-
-				if t >= stop {
-					break
-				}
-
-				if t >= bucketEnd {
-					if math.IsNaN(count) {
-						r.Values[ridx] = 0
-						r.IsAbsent[ridx] = true
-					} else {
-						r.Values[ridx] = count
-					}
-
-					ridx++
-					bucketEnd += bucketSize
-					count = math.NaN()
-					bucketItems = 0
-				}
-			}
-
-			// remaining values
-			if bucketItems > 0 {
-				if math.IsNaN(count) {
-					r.Values[ridx] = 0
-					r.IsAbsent[ridx] = true
-				} else {
-					r.Values[ridx] = count
-				}
-			}
-
-			results = append(results, &r)
-		}
-		return results, nil
-	case "integral": // integral(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
-			current := 0.0
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				current += v
-				r.Values[i] = current
-			}
-			return r
-		})
-
-	case "invert": // invert(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
-			for i, v := range a.Values {
-				if a.IsAbsent[i] || v == 0 {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = 1 / v
-			}
-			return r
-		})
-
-	case "keepLastValue": // keepLastValue(seriesList, limit=inf)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		keep, err := getIntNamedOrPosArgDefault(e, "limit", 1, -1)
-		if err != nil {
-			return nil, err
-		}
-		_, ok := e.namedArgs["limit"]
-		if !ok {
-			ok = len(e.args) > 1
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			var name string
-			if ok {
-				name = fmt.Sprintf("keepLastValue(%s,%d)", a.GetName(), keep)
-			} else {
-				name = fmt.Sprintf("keepLastValue(%s)", a.GetName())
-			}
-
-			r := *a
-			r.Name = proto.String(name)
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			prev := math.NaN()
-			missing := 0
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-
-					if (keep < 0 || missing < keep) && !math.IsNaN(prev) {
-						r.Values[i] = prev
-						missing++
-					} else {
-						r.IsAbsent[i] = true
-					}
-
-					continue
-				}
-				missing = 0
-				prev = v
-				r.Values[i] = v
-			}
-			results = append(results, &r)
-		}
-		return results, err
-
-	case "changed": // changed(SeriesList)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var result []*MetricData
-		for _, a := range args {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, a.GetName()))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			prev := math.NaN()
-			for i, v := range a.Values {
-				if math.IsNaN(prev) {
-					prev = v
-					r.Values[i] = 0
-				} else if !math.IsNaN(v) && prev != v {
-					r.Values[i] = 1
-					prev = v
-				} else {
-					r.Values[i] = 0
-				}
-			}
-			result = append(result, &r)
-		}
-		return result, nil
-
-	case "kolmogorovSmirnovTest2", "ksTest2": // ksTest2(series, series, points|"interval")
-		arg1, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		arg2, err := getSeriesArg(e.args[1], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		if len(arg1) != 1 || len(arg2) != 1 {
-			return nil, ErrWildcardNotAllowed
-		}
-
-		a1 := arg1[0]
-		a2 := arg2[0]
-
-		windowSize, err := getIntArg(e, 2)
-		if err != nil {
-			return nil, err
-		}
-
-		w1 := &windowed{data: make([]float64, windowSize)}
-		w2 := &windowed{data: make([]float64, windowSize)}
-
-		r := *a1
-		r.Name = proto.String(fmt.Sprintf("kolmogorovSmirnovTest2(%s,%s,%d)", a1.GetName(), a2.GetName(), windowSize))
-		r.Values = make([]float64, len(a1.Values))
-		r.IsAbsent = make([]bool, len(a1.Values))
-		r.StartTime = proto.Int32(from)
-		r.StopTime = proto.Int32(until)
-
-		d1 := make([]float64, windowSize)
-		d2 := make([]float64, windowSize)
-
-		for i, v1 := range a1.Values {
-			v2 := a2.Values[i]
-			if a1.IsAbsent[i] || a2.IsAbsent[i] {
-				// make sure missing values are ignored
-				v1 = math.NaN()
-				v2 = math.NaN()
-			}
-			w1.Push(v1)
-			w2.Push(v2)
-
-			if i >= windowSize {
-				// need a copy here because KS is destructive
-				copy(d1, w1.data)
-				copy(d2, w2.data)
-				r.Values[i] = onlinestats.KS(d1, d2)
-			} else {
-				r.Values[i] = 0
-				r.IsAbsent[i] = true
-			}
-		}
-		return []*MetricData{&r}, nil
-
-	case "limit": // limit(seriesList, n)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		limit, err := getIntArg(e, 1) // get limit
-		if err != nil {
-			return nil, err
-		}
-
-		if limit >= len(arg) {
-			return arg, nil
-		}
-
-		return arg[:limit], nil
-
-	case "logarithm", "log": // logarithm(seriesList, base=10)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		base, err := getIntNamedOrPosArgDefault(e, "base", 1, 10)
-		if err != nil {
-			return nil, err
-		}
-		_, ok := e.namedArgs["base"]
-		if !ok {
-			ok = len(e.args) > 1
-		}
-
-		baseLog := math.Log(float64(base))
-
-		var results []*MetricData
-
-		for _, a := range arg {
-
-			var name string
-			if ok {
-				name = fmt.Sprintf("logarithm(%s,%d)", a.GetName(), base)
-			} else {
-				name = fmt.Sprintf("logarithm(%s)", a.GetName())
-			}
-
-			r := *a
-			r.Name = proto.String(name)
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = math.Log(v) / baseLog
-			}
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "maxSeries": // maxSeries(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		return aggregateSeries(e, args, func(values []float64) float64 {
-			max := math.Inf(-1)
-			for _, value := range values {
-				if value > max {
-					max = value
-				}
-			}
-			return max
-		})
-
-	case "minSeries": // minSeries(*seriesLists)
-		args, err := getSeriesArgs(e.args, from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		return aggregateSeries(e, args, func(values []float64) float64 {
-			min := math.Inf(1)
-			for _, value := range values {
-				if value < min {
-					min = value
-				}
-			}
-			return min
-		})
-
-	case "mostDeviant": // mostDeviant(seriesList, n) -or- mostDeviant(n, seriesList)
-		var nArg int
-		if e.args[0].etype != etConst {
-			// mostDeviant(seriesList, n)
-			nArg = 1
-		}
-		seriesArg := nArg ^ 1 // XOR to make seriesArg the opposite argument. ( 0^1 -> 1 ; 1^1 -> 0 )
-
-		n, err := getIntArg(e, nArg)
-		if err != nil {
-			return nil, err
-		}
-
-		args, err := getSeriesArg(e.args[seriesArg], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var mh metricHeap
-
-		for index, arg := range args {
-			variance := varianceValue(arg.Values, arg.IsAbsent)
-			if math.IsNaN(variance) {
-				continue
-			}
-
-			if len(mh) < n {
-				heap.Push(&mh, metricHeapElement{idx: index, val: variance})
-				continue
-			}
-
-			if variance > mh[0].val {
-				mh[0].idx = index
-				mh[0].val = variance
-				heap.Fix(&mh, 0)
-			}
-		}
-
-		results := make([]*MetricData, len(mh))
-
-		for len(mh) > 0 {
-			v := heap.Pop(&mh).(metricHeapElement)
-			results[len(mh)] = args[v.idx]
-		}
-
-		return results, err
-
-	case "movingAverage": // movingAverage(seriesList, windowSize)
-		var n int
-		var err error
-
-		var scaleByStep bool
-
-		var argstr string
-
-		switch e.args[1].etype {
-		case etConst:
-			n, err = getIntArg(e, 1)
-			argstr = strconv.Itoa(n)
-		case etString:
-			var n32 int32
-			n32, err = getIntervalArg(e, 1, 1)
-			argstr = fmt.Sprintf("%q", e.args[1].valStr)
-			n = int(n32)
-			scaleByStep = true
-		default:
-			err = ErrBadType
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		windowSize := n
-
-		start := from
-		if scaleByStep {
-			start -= int32(n)
-		}
-
-		arg, err := getSeriesArg(e.args[0], start, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var offset int
-
-		if scaleByStep {
-			windowSize /= int(arg[0].GetStepTime())
-			offset = windowSize
-		}
-
-		var result []*MetricData
-
-		for _, a := range arg {
-			w := &windowed{data: make([]float64, windowSize)}
-
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("movingAverage(%s,%s)", a.GetName(), argstr))
-			r.Values = make([]float64, len(a.Values)-offset)
-			r.IsAbsent = make([]bool, len(a.Values)-offset)
-			r.StartTime = proto.Int32(from)
-			r.StopTime = proto.Int32(until)
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					// make sure missing values are ignored
-					v = math.NaN()
-				}
-
-				if ridx := i - offset; ridx >= 0 {
-					r.Values[ridx] = w.Mean()
-					if i < windowSize || math.IsNaN(r.Values[ridx]) {
-						r.Values[ridx] = 0
-						r.IsAbsent[ridx] = true
-					}
-				}
-				w.Push(v)
-			}
-			result = append(result, &r)
-		}
-		return result, nil
-
-	case "movingMedian": // movingMedian(seriesList, windowSize)
-		var n int
-		var err error
-
-		var scaleByStep bool
-
-		var argstr string
-
-		switch e.args[1].etype {
-		case etConst:
-			n, err = getIntArg(e, 1)
-			argstr = strconv.Itoa(n)
-		case etString:
-			var n32 int32
-			n32, err = getIntervalArg(e, 1, 1)
-			n = int(n32)
-			argstr = fmt.Sprintf("%q", e.args[1].valStr)
-			scaleByStep = true
-		default:
-			err = ErrBadType
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		windowSize := n
-
-		start := from
-		if scaleByStep {
-			start -= int32(n)
-		}
-
-		arg, err := getSeriesArg(e.args[0], start, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var offset int = 0
-
-		if scaleByStep {
-			windowSize /= int(arg[0].GetStepTime())
-			offset = windowSize
-		}
-
-		var result []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("movingMedian(%s,%s)", a.GetName(), argstr))
-			r.Values = make([]float64, len(a.Values)-offset)
-			r.IsAbsent = make([]bool, len(a.Values)-offset)
-			r.StartTime = proto.Int32(from)
-			r.StopTime = proto.Int32(until)
-
-			data := movingmedian.NewMovingMedian(windowSize)
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					data.Push(math.NaN())
-				} else {
-					data.Push(v)
-				}
-				if ridx := i - offset; ridx >= 0 {
-					r.Values[ridx] = math.NaN()
-					if i >= (windowSize - 1) {
-						r.Values[ridx] = data.Median()
-					}
-					if math.IsNaN(r.Values[ridx]) {
-						r.IsAbsent[ridx] = true
-					}
-				}
-			}
-			result = append(result, &r)
-		}
-		return result, nil
-
-	case "nonNegativeDerivative": // nonNegativeDerivative(seriesList, maxValue=None)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		maxValue, err := getFloatNamedOrPosArgDefault(e, "maxValue", 1, math.NaN())
-		if err != nil {
-			return nil, err
-		}
-		_, ok := e.namedArgs["maxValue"]
-		if !ok {
-			ok = len(e.args) > 1
-		}
-
-		var result []*MetricData
-		for _, a := range args {
-			var name string
-			if ok {
-				name = fmt.Sprintf("nonNegativeDerivative(%s,%g)", a.GetName(), maxValue)
-			} else {
-				name = fmt.Sprintf("nonNegativeDerivative(%s)", a.GetName())
-			}
-
-			r := *a
-			r.Name = proto.String(name)
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			prev := a.Values[0]
-			for i, v := range a.Values {
-				if i == 0 || a.IsAbsent[i] || a.IsAbsent[i-1] {
-					r.IsAbsent[i] = true
-					prev = v
-					continue
-				}
-				diff := v - prev
-				if diff >= 0 {
-					r.Values[i] = diff
-				} else if !math.IsNaN(maxValue) && maxValue >= v {
-					r.Values[i] = ((maxValue - prev) + v + 1)
-				} else {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-				}
-				prev = v
-			}
-			result = append(result, &r)
-		}
-		return result, nil
-
-	case "perSecond": // perSecond(seriesList, maxValue=None)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		maxValue, err := getFloatArgDefault(e, 1, math.NaN())
-		if err != nil {
-			return nil, err
-		}
-
-		var result []*MetricData
-		for _, a := range args {
-			r := *a
-			if len(e.args) == 1 {
-				r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, a.GetName()))
-			} else {
-				r.Name = proto.String(fmt.Sprintf("%s(%s,%g)", e.target, a.GetName(), maxValue))
-			}
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			prev := a.Values[0]
-			for i, v := range a.Values {
-				if i == 0 || a.IsAbsent[i] || a.IsAbsent[i-1] {
-					r.IsAbsent[i] = true
-					prev = v
-					continue
-				}
-				diff := v - prev
-				if diff >= 0 {
-					r.Values[i] = diff / float64(a.GetStepTime())
-				} else if !math.IsNaN(maxValue) && maxValue >= v {
-					r.Values[i] = ((maxValue - prev) + v + 1/float64(a.GetStepTime()))
-				} else {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-				}
-				prev = v
-			}
-			result = append(result, &r)
-		}
-		return result, nil
-
-	case "nPercentile": // nPercentile(seriesList, n)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		percent, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("nPercentile(%s,%g)", a.GetName(), percent))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			var values []float64
-			for i, v := range a.IsAbsent {
-				if !v {
-					values = append(values, a.Values[i])
-				}
-			}
-
-			value := percentile(values, percent, true)
-			for i := range r.Values {
-				r.Values[i] = value
-			}
-
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "pearson": // pearson(series, series, windowSize)
-		arg1, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		arg2, err := getSeriesArg(e.args[1], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		if len(arg1) != 1 || len(arg2) != 1 {
-			return nil, ErrWildcardNotAllowed
-		}
-
-		a1 := arg1[0]
-		a2 := arg2[0]
-
-		windowSize, err := getIntArg(e, 2)
-		if err != nil {
-			return nil, err
-		}
-
-		w1 := &windowed{data: make([]float64, windowSize)}
-		w2 := &windowed{data: make([]float64, windowSize)}
-
-		r := *a1
-		r.Name = proto.String(fmt.Sprintf("pearson(%s,%s,%d)", a1.GetName(), a2.GetName(), windowSize))
-		r.Values = make([]float64, len(a1.Values))
-		r.IsAbsent = make([]bool, len(a1.Values))
-		r.StartTime = proto.Int32(from)
-		r.StopTime = proto.Int32(until)
-
-		for i, v1 := range a1.Values {
-			v2 := a2.Values[i]
-			if a1.IsAbsent[i] || a2.IsAbsent[i] {
-				// ignore if either is missing
-				v1 = math.NaN()
-				v2 = math.NaN()
-			}
-			w1.Push(v1)
-			w2.Push(v2)
-			if i >= windowSize-1 {
-				r.Values[i] = onlinestats.Pearson(w1.data, w2.data)
-			} else {
-				r.Values[i] = 0
-				r.IsAbsent[i] = true
-			}
-		}
-
-		return []*MetricData{&r}, nil
-
-	case "pearsonClosest": // pearsonClosest(series, seriesList, n, direction=abs)
-		if len(e.args) > 3 {
-			return nil, ErrTooManyArguments
-		}
-
-		ref, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		if len(ref) != 1 {
-			// TODO(nnuss) error("First argument must be single reference series")
-			return nil, ErrWildcardNotAllowed
-		}
-
-		compare, err := getSeriesArg(e.args[1], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		n, err := getIntArg(e, 2)
-		if err != nil {
-			return nil, err
-		}
-
-		direction, err := getStringNamedOrPosArgDefault(e, "direction", 3, "abs")
-		if err != nil {
-			return nil, err
-		}
-		if direction != "pos" && direction != "neg" && direction != "abs" {
-			return nil, errors.New("direction must be one of: pos, neg, abs")
-		}
-
-		// NOTE: if direction == "abs" && len(compare) <= n : we'll still do the work to rank them
-
-		refValues := make([]float64, len(ref[0].Values))
-		copy(refValues, ref[0].Values)
-		for i, v := range ref[0].IsAbsent {
-			if v {
-				refValues[i] = math.NaN()
-			}
-		}
-
-		var mh metricHeap
-
-		for index, a := range compare {
-			compareValues := make([]float64, len(a.Values))
-			copy(compareValues, a.Values)
-			if len(refValues) != len(compareValues) {
-				// Pearson will panic if arrays are not equal length; skip
-				continue
-			}
-			for i, v := range a.IsAbsent {
-				if v {
-					compareValues[i] = math.NaN()
-				}
-			}
-			value := onlinestats.Pearson(refValues, compareValues)
-			// Standardize the value so sort ASC will have strongest correlation first
-			switch {
-			case math.IsNaN(value):
-				// special case of at least one series containing all zeros which leads to div-by-zero in Pearson
-				continue
-			case direction == "abs":
-				value = math.Abs(value) * -1
-			case direction == "pos" && value >= 0:
-				value = value * -1
-			case direction == "neg" && value <= 0:
-			default:
-				continue
-			}
-			heap.Push(&mh, metricHeapElement{idx: index, val: value})
-		}
-
-		if n > len(mh) {
-			n = len(mh)
-		}
-		results := make([]*MetricData, n)
-		for i := range results {
-			v := heap.Pop(&mh).(metricHeapElement)
-			results[i] = compare[v.idx]
-		}
-
-		return results, nil
-
-	case "offset": // offset(seriesList,factor)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		factor, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("offset(%s,%g)", a.GetName(), factor))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = v + factor
-			}
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "offsetToZero": // offsetToZero(seriesList)
-		return forEachSeriesDo(e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
-			minimum := math.Inf(1)
-			for i, v := range a.Values {
-				if !a.IsAbsent[i] && v < minimum {
-					minimum = v
-				}
-			}
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = v - minimum
-			}
-			return r
-		})
-
-	case "scale": // scale(seriesList, factor)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		scale, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("scale(%s,%g)", a.GetName(), scale))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = v * scale
-			}
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "scaleToSeconds": // scaleToSeconds(seriesList, seconds)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		seconds, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("scaleToSeconds(%s,%d)", a.GetName(), int(seconds)))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			factor := seconds / float64(a.GetStepTime())
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = v * factor
-			}
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "pow": // pow(seriesList,factor)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		factor, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("pow(%s,%g)", a.GetName(), factor))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = math.Pow(v, factor)
-			}
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "sortByMaxima", "sortByMinima", "sortByTotal": // sortByMaxima(seriesList), sortByMinima(seriesList), sortByTotal(seriesList)
-		original, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		arg := make([]*MetricData, len(original))
-		copy(arg, original)
-		vals := make([]float64, len(arg))
-
-		for i, a := range arg {
-			switch e.target {
-			case "sortByTotal":
-				vals[i] = summarizeValues("sum", a.GetValues())
-			case "sortByMaxima":
-				vals[i] = summarizeValues("max", a.GetValues())
-			case "sortByMinima":
-				vals[i] = 1 / summarizeValues("min", a.GetValues())
-			}
-		}
-
-		sort.Sort(byVals{vals: vals, series: arg})
-
-		return arg, nil
-
-	case "sortByName": // sortByName(seriesList, natural=false)
-		original, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		natSort, err := getBoolNamedOrPosArgDefault(e, "natural", 1, false)
-		if err != nil {
-			return nil, err
-		}
-
-		arg := make([]*MetricData, len(original))
-		copy(arg, original)
-		if natSort {
-			sort.Sort(ByNameNatural(arg))
-		} else {
-			sort.Sort(ByName(arg))
-		}
-
-		return arg, nil
-
-	case "stdev", "stddev": // stdev(seriesList, points, missingThreshold=0.1)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		points, err := getIntArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		missingThreshold, err := getFloatArgDefault(e, 2, 0.1)
-		if err != nil {
-			return nil, err
-		}
-
-		minLen := int((1 - missingThreshold) * float64(points))
-
-		var result []*MetricData
-
-		for _, a := range arg {
-			w := &windowed{data: make([]float64, points)}
-
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("stdev(%s,%d)", a.GetName(), points))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					// make sure missing values are ignored
-					v = math.NaN()
-				}
-				w.Push(v)
-				r.Values[i] = w.Stdev()
-				if math.IsNaN(r.Values[i]) || (i >= minLen && w.Len() < minLen) {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-				}
-			}
-			result = append(result, &r)
-		}
-		return result, nil
-
-	case "sum", "sumSeries": // sumSeries(*seriesLists)
-		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArgs(e.args, from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		e.target = "sumSeries"
-		return aggregateSeries(e, args, func(values []float64) float64 {
-			sum := 0.0
-			for _, value := range values {
-				sum += value
-			}
-			return sum
-		})
-
-	case "sumSeriesWithWildcards": // sumSeriesWithWildcards(seriesList, *position)
-		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		fields, err := getIntArgs(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		nodeList := []string{}
-		groups := make(map[string][]*MetricData)
-
-		for _, a := range args {
-			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
-			var s []string
-			// Yes, this is O(n^2), but len(nodes) < 10 and len(fields) < 3
-			// Iterating an int slice is faster than a map for n ~ 30
-			// http://www.antoine.im/posts/someone_is_wrong_on_the_internet
-			for i, n := range nodes {
-				if !contains(fields, i) {
-					s = append(s, n)
-				}
-			}
-
-			node := strings.Join(s, ".")
-
-			if len(groups[node]) == 0 {
-				nodeList = append(nodeList, node)
-			}
-
-			groups[node] = append(groups[node], a)
-		}
-
-		for _, series := range nodeList {
-			args := groups[series]
-			r := *args[0]
-			r.Name = proto.String(fmt.Sprintf("sumSeriesWithWildcards(%s)", series))
-			r.Values = make([]float64, len(args[0].Values))
-			r.IsAbsent = make([]bool, len(args[0].Values))
-
-			atLeastOne := make([]bool, len(args[0].Values))
-			for _, arg := range args {
-				for i, v := range arg.Values {
-					if arg.IsAbsent[i] {
-						continue
-					}
-					atLeastOne[i] = true
-					r.Values[i] += v
-				}
-			}
-
-			for i, v := range atLeastOne {
-				if !v {
-					r.IsAbsent[i] = true
-				}
-			}
-
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "percentileOfSeries": // percentileOfSeries(seriesList, n, interpolate=False)
-		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		percent, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		interpolate, err := getBoolNamedOrPosArgDefault(e, "interpolate", 2, false)
-		if err != nil {
-			return nil, err
-		}
-
-		return aggregateSeries(e, args, func(values []float64) float64 {
-			return percentile(values, percent, interpolate)
-		})
-
-	case "substr": // aliasSub(seriesList, start, stop)
-		// BUG: affected by the same positional arg issue as 'threshold'.
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		startField, err := getIntNamedOrPosArgDefault(e, "start", 1, 0)
-		if err != nil {
-			return nil, err
-		}
-
-		stopField, err := getIntNamedOrPosArgDefault(e, "stop", 2, 0)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range args {
-			metric := extractMetric(a.GetName())
-			nodes := strings.Split(metric, ".")
-			if startField != 0 {
-				if startField < 0 || startField > len(nodes)-1 {
-					return nil, errors.New("start out of range")
-				}
-				nodes = nodes[startField:]
-			}
-			if stopField != 0 {
-				if stopField <= startField || stopField-startField > len(nodes) {
-					return nil, errors.New("stop out of range")
-				}
-				nodes = nodes[:stopField-startField]
-			}
-
-			r := *a
-			r.Name = proto.String(strings.Join(nodes, "."))
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "summarize": // summarize(seriesList, intervalString, func='sum', alignToFrom=False)
-		// TODO(dgryski): make sure the arrays are all the same 'size'
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		bucketSize, err := getIntervalArg(e, 1, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		summarizeFunction, err := getStringNamedOrPosArgDefault(e, "func", 2, "sum")
-		if err != nil {
-			return nil, err
-		}
-		_, funcOk := e.namedArgs["func"]
-		if !funcOk {
-			funcOk = len(e.args) > 2
-		}
-
-		alignToFrom, err := getBoolNamedOrPosArgDefault(e, "alignToFrom", 3, false)
-		if err != nil {
-			return nil, err
-		}
-		_, alignOk := e.namedArgs["alignToFrom"]
-		if !alignOk {
-			alignOk = len(e.args) > 3
-		}
-
-		start := args[0].GetStartTime()
-		stop := args[0].GetStopTime()
-		if !alignToFrom {
-			start, stop = alignToBucketSize(start, stop, bucketSize)
-		}
-
-		buckets := getBuckets(start, stop, bucketSize)
-		results := make([]*MetricData, 0, len(args))
-		for _, arg := range args {
-
-			name := fmt.Sprintf("summarize(%s,'%s'", arg.GetName(), e.args[1].valStr)
-			if funcOk || alignOk {
-				// we include the "func" argument in the presence of
-				// "alignToFrom", even if the former was omitted
-				// this is so that a call like "summarize(foo, '5min', alignToFrom=true)"
-				// doesn't produce a metric name that has a boolean value
-				// where a function name should be
-				// so we show "summarize(foo,'5min','sum',true)" instead of "summarize(foo,'5min',true)"
-				//
-				// this does not match graphite's behaviour but seems more correct
-				name += fmt.Sprintf(",'%s'", summarizeFunction)
-			}
-			if alignOk {
-				name += fmt.Sprintf(",%v", alignToFrom)
-			}
-			name += ")"
-
-			r := MetricData{FetchResponse: pb.FetchResponse{
-				Name:      proto.String(name),
-				Values:    make([]float64, buckets, buckets),
-				IsAbsent:  make([]bool, buckets, buckets),
-				StepTime:  proto.Int32(bucketSize),
-				StartTime: proto.Int32(start),
-				StopTime:  proto.Int32(stop),
-			}}
-
-			t := arg.GetStartTime() // unadjusted
-			bucketEnd := start + bucketSize
-			values := make([]float64, 0, bucketSize/arg.GetStepTime())
-			ridx := 0
-			bucketItems := 0
-			for i, v := range arg.Values {
-				bucketItems++
-				if !arg.IsAbsent[i] {
-					values = append(values, v)
-				}
-
-				t += arg.GetStepTime()
-
-				if t >= stop {
-					break
-				}
-
-				if t >= bucketEnd {
-					rv := summarizeValues(summarizeFunction, values)
-
-					if math.IsNaN(rv) {
-						r.IsAbsent[ridx] = true
-					}
-
-					r.Values[ridx] = rv
-					ridx++
-					bucketEnd += bucketSize
-					bucketItems = 0
-					values = values[:0]
-				}
-			}
-
-			// last partial bucket
-			if bucketItems > 0 {
-				rv := summarizeValues(summarizeFunction, values)
-				if math.IsNaN(rv) {
-					r.Values[ridx] = 0
-					r.IsAbsent[ridx] = true
-				} else {
-					r.Values[ridx] = rv
-					r.IsAbsent[ridx] = false
-				}
-			}
-
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "timeShift": // timeShift(seriesList, timeShift, resetEnd=True)
-		// FIXME(dgryski): support resetEnd=true
-
-		offs, err := getIntervalArg(e, 1, -1)
-		if err != nil {
-			return nil, err
-		}
-
-		arg, err := getSeriesArg(e.args[0], from+offs, until+offs, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("timeShift(%s,'%d')", a.GetName(), offs))
-			r.StartTime = proto.Int32(a.GetStartTime() - offs)
-			r.StopTime = proto.Int32(a.GetStopTime() - offs)
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "timeStack": // timeStack(seriesList, timeShiftUnit, timeShiftStart, timeShiftEnd)
-		unit, err := getIntervalArg(e, 1, -1)
-		if err != nil {
-			return nil, err
-		}
-
-		start, err := getIntArg(e, 2)
-		if err != nil {
-			return nil, err
-		}
-
-		end, err := getIntArg(e, 3)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-		for i := int32(start); i < int32(end); i++ {
-			offs := i * unit
-			arg, err := getSeriesArg(e.args[0], from+offs, until+offs, values)
-			if err != nil {
-				return nil, err
-			}
-
-			for _, a := range arg {
-				r := *a
-				r.Name = proto.String(fmt.Sprintf("timeShift(%s,%d)", a.GetName(), offs))
-				r.StartTime = proto.Int32(a.GetStartTime() - offs)
-				r.StopTime = proto.Int32(a.GetStopTime() - offs)
-				results = append(results, &r)
-			}
-		}
-
-		return results, nil
-
-	case "transformNull": // transformNull(seriesList, default=0)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		defv, err := getFloatNamedOrPosArgDefault(e, "default", 1, 0)
-		if err != nil {
-			return nil, err
-		}
-
-		_, ok := e.namedArgs["default"]
-		if !ok {
-			ok = len(e.args) > 1
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-
-			var name string
-			if ok {
-				name = fmt.Sprintf("transformNull(%s,%g)", a.GetName(), defv)
-			} else {
-				name = fmt.Sprintf("transformNull(%s)", a.GetName())
-			}
-
-			r := *a
-			r.Name = proto.String(name)
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					v = defv
-				}
-
-				r.Values[i] = v
-			}
-
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "tukeyAbove", "tukeyBelow": // tukeyAbove(seriesList,basis,n,interval=0) , tukeyBelow(seriesList,basis,n,interval=0)
-
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		basis, err := getFloatArg(e, 1)
-		if err != nil || basis <= 0 {
-			return nil, err
-		}
-
-		n, err := getIntArg(e, 2)
-		if err != nil {
-			return nil, err
-		}
-		if n < 1 {
-			return nil, errors.New("n must be larger or equal to 1")
-		}
-
-		var beginInterval int
-		endInterval := len(arg[0].Values)
-		if len(e.args) >= 4 {
-			switch e.args[3].etype {
-			case etConst:
-				beginInterval, err = getIntArg(e, 3)
-			case etString:
-				var i32 int32
-				i32, err = getIntervalArg(e, 3, 1)
-				beginInterval = int(i32)
-				beginInterval /= int(arg[0].GetStepTime())
-				// TODO(nnuss): make sure the arrays are all the same 'size'
-			default:
-				err = ErrBadType
-			}
-			if err != nil {
-				return nil, err
-			}
-			if beginInterval < 0 && (-1*beginInterval) < endInterval {
-				// negative intervals are everything preceding the last 'interval' points
-				endInterval += beginInterval
-				beginInterval = 0
-			} else if beginInterval > 0 && beginInterval < endInterval {
-				// positive intervals are the last 'interval' points
-				beginInterval = endInterval - beginInterval
-				//endInterval = len(arg[0].Values)
-			} else {
-				// zero -or- beyond the len() of the series ; will revert to whole range
-				beginInterval = 0
-				//endInterval = len(arg[0].Values)
-			}
-		}
-
-		// gather all the valid points
-		var points []float64
-		for _, a := range arg {
-			for i, m := range a.Values[beginInterval:endInterval] {
-				if a.IsAbsent[beginInterval+i] {
-					continue
-				}
-				points = append(points, m)
-			}
-		}
-
-		sort.Float64s(points)
-
-		first := int(0.25 * float64(len(points)))
-		third := int(0.75 * float64(len(points)))
-
-		iqr := points[third] - points[first]
-
-		max := points[third] + basis*iqr
-		min := points[first] - basis*iqr
-
-		isAbove := strings.HasSuffix(e.target, "Above")
-
-		var mh metricHeap
-
-		// count how many points are above the threshold
-		for i, a := range arg {
-			var outlier int
-			for i, m := range a.Values[beginInterval:endInterval] {
-				if a.IsAbsent[beginInterval+i] {
-					continue
-				}
-				if isAbove {
-					if m >= max {
-						outlier++
-					}
-				} else {
-					if m <= min {
-						outlier++
-					}
-				}
-			}
-
-			// not even a single anomalous point -- ignore this metric
-			if outlier == 0 {
-				continue
-			}
-
-			if len(mh) < n {
-				heap.Push(&mh, metricHeapElement{idx: i, val: float64(outlier)})
-				continue
-			}
-			// current outlier count is is bigger than smallest max found so far
-			foutlier := float64(outlier)
-			if mh[0].val < foutlier {
-				mh[0].val = foutlier
-				mh[0].idx = i
-				heap.Fix(&mh, 0)
-			}
-		}
-
-		if len(mh) < n {
-			n = len(mh)
-		}
-		results := make([]*MetricData, n)
-		// results should be ordered ascending
-		for len(mh) > 0 {
-			v := heap.Pop(&mh).(metricHeapElement)
-			results[len(mh)] = arg[v.idx]
-		}
-
-		return results, nil
-
-	case "color": // color(seriesList, theColor)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		color, err := getStringArg(e, 1) // get color
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.color = color
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "stacked": // stacked(seriesList, stackname="__DEFAULT__")
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		stackName, err := getStringNamedOrPosArgDefault(e, "stackname", 1, defaultStackName)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.stacked = true
-			r.stackName = stackName
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "areaBetween":
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		if len(arg) != 2 {
-			return nil, fmt.Errorf("areaBetween needs exactly two arguments (%d given)", len(arg))
-		}
-
-		name := proto.String(fmt.Sprintf("%s(%s)", e.target, e.argString))
-
-		lower := *arg[0]
-		lower.stacked = true
-		lower.stackName = defaultStackName
-		lower.invisible = true
-		lower.Name = name
-
-		upper := *arg[1]
-		upper.stacked = true
-		upper.stackName = defaultStackName
-		upper.Name = name
-
-		vals := make([]float64, len(upper.Values))
-		absent := make([]bool, len(upper.Values))
-
-		for i, v := range upper.Values {
-			if upper.IsAbsent[i] || lower.IsAbsent[i] {
-				absent[i] = true
-				continue
-			}
-
-			vals[i] = v - lower.Values[i]
-		}
-
-		upper.Values = vals
-		upper.IsAbsent = absent
-
-		return []*MetricData{&lower, &upper}, nil
-
-	case "alpha": // alpha(seriesList, theAlpha)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		alpha, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.alpha = alpha
-			r.hasAlpha = true
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "dashed", "drawAsInfinite", "secondYAxis":
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, a.GetName()))
-
-			switch e.target {
-			case "dashed":
-				d, err := getFloatArgDefault(e, 1, 2.5)
-				if err != nil {
-					return nil, err
-				}
-				r.dashed = d
-			case "drawAsInfinite":
-				r.drawAsInfinite = true
-			case "secondYAxis":
-				r.secondYAxis = true
-			}
-
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "constantLine":
-		value, err := getFloatArg(e, 0)
-
-		if err != nil {
-			return nil, err
-		}
-		p := MetricData{
-			FetchResponse: pb.FetchResponse{
-				Name:      proto.String(fmt.Sprintf("%g", value)),
-				StartTime: proto.Int32(from),
-				StopTime:  proto.Int32(until),
-				StepTime:  proto.Int32(until - from),
-				Values:    []float64{value, value},
-				IsAbsent:  []bool{false, false},
-			},
-		}
-
-		return []*MetricData{&p}, nil
-
-	case "consolidateBy":
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		name, err := getStringArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-
-			var f func([]float64, []bool) (float64, bool)
-
-			switch name {
-			case "max":
-				f = aggMax
-			case "min":
-				f = aggMin
-			case "sum":
-				f = aggSum
-			case "average":
-				f = aggMean
-			}
-
-			r.aggregateFunction = f
-
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "timeFunction", "time":
-		name, err := getStringArg(e, 0)
-		if err != nil {
-			return nil, err
-		}
-
-		stepInt, err := getIntArgDefault(e, 1, 60)
-		if err != nil {
-			return nil, err
-		}
-		if stepInt <= 0 {
-			return nil, errors.New("step can't be less than 0")
-		}
-		step := int32(stepInt)
-
-		// emulate the behavior of this Python code:
-		//   while when < requestContext["endTime"]:
-		//     values.append(time.mktime(when.timetuple()))
-		//     when += delta
-
-		values := make([]float64, (until-from-1+step)/step)
-		value := from
-		for i := 0; i < len(values); i++ {
-			values[i] = float64(value)
-			value += step
-		}
-
-		p := MetricData{
-			FetchResponse: pb.FetchResponse{
-				Name:      proto.String(name),
-				StartTime: proto.Int32(from),
-				StopTime:  proto.Int32(until),
-				StepTime:  proto.Int32(step),
-				Values:    values,
-				IsAbsent:  make([]bool, len(values)),
-			},
-		}
-
-		return []*MetricData{&p}, nil
-
-	case "threshold": // threshold(value, label=None, color=None)
-		// XXX does not match graphite's signature
-		// BUG(nnuss): the signature *does* match but there is an edge case because of named argument handling if you use it *just* wrong:
-		//			   threshold(value, "gold", label="Aurum")
-		//			   will result in:
-		//			   value = value
-		//			   label = "Aurum" (by named argument)
-		//			   color = "" (by default as len(positionalArgs) == 2 and there is no named 'color' arg)
-
-		value, err := getFloatArg(e, 0)
-
-		if err != nil {
-			return nil, err
-		}
-
-		name, err := getStringNamedOrPosArgDefault(e, "label", 1, fmt.Sprintf("%g", value))
-		if err != nil {
-			return nil, err
-		}
-
-		color, err := getStringNamedOrPosArgDefault(e, "color", 2, "")
-		if err != nil {
-			return nil, err
-		}
-
-		p := MetricData{
-			FetchResponse: pb.FetchResponse{
-				Name:      proto.String(name),
-				StartTime: proto.Int32(from),
-				StopTime:  proto.Int32(until),
-				StepTime:  proto.Int32(until - from),
-				Values:    []float64{value, value},
-				IsAbsent:  []bool{false, false},
-			},
-			color: color,
-		}
-
-		return []*MetricData{&p}, nil
-
-	case "holtWintersForecast":
-		var results []*MetricData
-		args, err := getSeriesArgs(e.args, from-7*86400, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, arg := range args {
-			stepTime := arg.GetStepTime()
-
-			predictions := holtWintersAnalysis(arg.Values, stepTime)
-
-			windowPoints := 7 * 86400 / stepTime
-			predictionsOfInterest := predictions[windowPoints:]
-
-			r := MetricData{FetchResponse: pb.FetchResponse{
-				Name:      proto.String(fmt.Sprintf("holtWintersForecast(%s)", arg.GetName())),
-				Values:    predictionsOfInterest,
-				IsAbsent:  make([]bool, len(predictionsOfInterest)),
-				StepTime:  proto.Int32(arg.GetStepTime()),
-				StartTime: proto.Int32(arg.GetStartTime() + 7*86400),
-				StopTime:  proto.Int32(arg.GetStopTime()),
-			}}
-
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "squareRoot": // squareRoot(seriesList)
-		arg, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-		var results []*MetricData
-
-		for _, a := range arg {
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("squareRoot(%s)", a.GetName()))
-			r.Values = make([]float64, len(a.Values))
-			r.IsAbsent = make([]bool, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] {
-					r.Values[i] = 0
-					r.IsAbsent[i] = true
-					continue
-				}
-				r.Values[i] = math.Sqrt(v)
-			}
-			results = append(results, &r)
-		}
-		return results, nil
-
-	case "randomWalk", "randomWalkFunction":
-		name, err := getStringArg(e, 0)
-		if err != nil {
-			name = "randomWalk"
-		}
-
-		size := until - from
-
-		r := MetricData{FetchResponse: pb.FetchResponse{
-			Name:      proto.String(name),
-			Values:    make([]float64, size),
-			IsAbsent:  make([]bool, size),
-			StepTime:  proto.Int32(1),
-			StartTime: proto.Int32(from),
-			StopTime:  proto.Int32(until),
-		}}
-
-		for i := 1; i < len(r.Values)-1; i++ {
-			r.Values[i+1] = r.Values[i] + (rand.Float64() - 0.5)
-		}
-		return []*MetricData{&r}, nil
-
-	case "removeEmptySeries", "removeZeroSeries": // removeEmptySeries(seriesLists, n), removeZeroSeries(seriesLists, n)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		var results []*MetricData
-
-		for _, a := range args {
-			for i, v := range a.IsAbsent {
-				if !v {
-					if e.target == "removeEmptySeries" || (a.Values[i] != 0) {
-						results = append(results, a)
-						break
-					}
-				}
-			}
-		}
-		return results, nil
-
-	case "removeBelowValue", "removeAboveValue", "removeBelowPercentile", "removeAbovePercentile": // removeBelowValue(seriesLists, n), removeAboveValue(seriesLists, n), removeBelowPercentile(seriesLists, percent), removeAbovePercentile(seriesLists, percent)
-		args, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		number, err := getFloatArg(e, 1)
-		if err != nil {
-			return nil, err
-		}
-
-		condition := func(v float64, threshold float64) bool {
-			return v < threshold
-		}
-
-		if strings.HasPrefix(e.target, "removeAbove") {
-			condition = func(v float64, threshold float64) bool {
-				return v > threshold
-			}
-		}
-
-		var results []*MetricData
-
-		for _, a := range args {
-			threshold := number
-			if strings.HasSuffix(e.target, "Percentile") {
-				var values []float64
-				for i, v := range a.IsAbsent {
-					if !v {
-						values = append(values, a.Values[i])
-					}
-				}
-
-				threshold = percentile(values, number, true)
-			}
-
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("%s(%s, %g)", e.target, a.GetName(), number))
-			r.IsAbsent = make([]bool, len(a.Values))
-			r.Values = make([]float64, len(a.Values))
-
-			for i, v := range a.Values {
-				if a.IsAbsent[i] || condition(v, threshold) {
-					r.Values[i] = math.NaN()
-					r.IsAbsent[i] = true
-					continue
-				}
-
-				r.Values[i] = v
-			}
-
-			results = append(results, &r)
-		}
-
-		return results, nil
-
-	case "cactiStyle": // cactiStyle(seriesList, system=None, units=None)
-		// Get the series data
-		original, err := getSeriesArg(e.args[0], from, until, values)
-		if err != nil {
-			return nil, err
-		}
-
-		// Get the arguments
-		system, err := getStringNamedOrPosArgDefault(e, "system", 1, "")
-		if err != nil {
-			return nil, err
-		}
-		unit, err := getStringNamedOrPosArgDefault(e, "units", 2, "")
-		if err != nil {
-			return nil, err
-		}
-
-		// Deal with each of the series
-		var metrics []*MetricData
-		for _, a := range original {
-			// Calculate min, max, current
-			//
-			// This saves calling summarizeValues 3 times and looping over
-			// the metrics 3 times
-			//
-			// For min:
-			// Ignoring any absent values and inf (if we have a value)
-			// Using summarizeValues("min", ...) results in incorrect values, when absent
-			// values are present
-			//
-			minVal := math.Inf(1)
-			currentVal := math.Inf(-1)
-			maxVal := math.Inf(-1)
-			for i, av := range a.GetValues() {
-				if !a.IsAbsent[i] {
-					minVal = math.Min(minVal, av)
-					maxVal = math.Max(maxVal, av)
-					currentVal = av
-				}
-			}
-
-			// Format the output correctly
-			min := ""
-			max := ""
-			current := ""
-			if system == "si" {
-				mv, mf := humanize.ComputeSI(minVal)
-				xv, xf := humanize.ComputeSI(maxVal)
-				cv, cf := humanize.ComputeSI(currentVal)
-
-				min = fmt.Sprintf("%.0f%s", mv, mf)
-				max = fmt.Sprintf("%.0f%s", xv, xf)
-				current = fmt.Sprintf("%.0f%s", cv, cf)
-
-			} else if system == "" {
-				min = fmt.Sprintf("%.0f", minVal)
-				max = fmt.Sprintf("%.0f", maxVal)
-				current = fmt.Sprintf("%.0f", currentVal)
-
-			} else {
-				return nil, fmt.Errorf("%s is not supported for system", system)
-			}
-
-			// Append the unit if specified
-			if len(unit) > 0 {
-				min = fmt.Sprintf("%s %s", min, unit)
-				max = fmt.Sprintf("%s %s", max, unit)
-				current = fmt.Sprintf("%s %s", current, unit)
-			}
-
-			r := *a
-			r.Name = proto.String(fmt.Sprintf("%s Current: %s Max: %s Min: %s", *a.Name, current, max, min))
-			metrics = append(metrics, &r)
-		}
-
-		return metrics, nil
+	f, ok := lookupFunction(e.target)
+	if !ok {
+		return nil, fmt.Errorf("unknown function in evalExpr: %q", e.target)
 	}
 
-	return nil, fmt.Errorf("unknown function in evalExpr: %q", e.target)
+	return f.Eval(ctx, e, from, until, values)
 }
 
 // Total (sortByTotal), max (sortByMaxima), min (sortByMinima) sorting
@@ -3483,8 +641,8 @@ func (s ByNameNatural) Less(i, j int) bool { return s.pad(s[i].GetName()) < s.pa
 
 type seriesFunc func(*MetricData, *MetricData) *MetricData
 
-func forEachSeriesDo(e *expr, from, until int32, values map[MetricRequest][]*MetricData, function seriesFunc) ([]*MetricData, error) {
-	arg, err := getSeriesArg(e.args[0], from, until, values)
+func forEachSeriesDo(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData, function seriesFunc) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
 	if err != nil {
 		return nil, ErrMissingTimeseries
 	}
@@ -3502,7 +660,7 @@ func forEachSeriesDo(e *expr, from, until int32, values map[MetricRequest][]*Met
 
 type aggregateFunc func([]float64) float64
 
-func aggregateSeries(e *expr, args []*MetricData, function aggregateFunc) ([]*MetricData, error) {
+func aggregateSeries(e *Expr, args []*MetricData, function aggregateFunc) ([]*MetricData, error) {
 	length := len(args[0].Values)
 	r := *args[0]
 	r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, e.argString))
@@ -3576,12 +734,12 @@ func summarizeValues(f string, values []float64) float64 {
 	return rv
 }
 
-func getBuckets(start, stop, bucketSize int32) int32 {
-	return int32(math.Ceil(float64(stop-start) / float64(bucketSize)))
+func getBuckets(start, stop, bucketSize int64) int64 {
+	return int64(math.Ceil(float64(stop-start) / float64(bucketSize)))
 }
 
-func alignStartToInterval(start, stop, bucketSize int32) int32 {
-	for _, v := range []int32{86400, 3600, 60} {
+func alignStartToInterval(start, stop, bucketSize int64) int64 {
+	for _, v := range []int64{86400, 3600, 60} {
 		if bucketSize >= v {
 			start -= start % v
 			break
@@ -3591,9 +749,9 @@ func alignStartToInterval(start, stop, bucketSize int32) int32 {
 	return start
 }
 
-func alignToBucketSize(start, stop, bucketSize int32) (int32, int32) {
-	start = int32(time.Unix(int64(start), 0).Truncate(time.Duration(bucketSize) * time.Second).Unix())
-	newStop := int32(time.Unix(int64(stop), 0).Truncate(time.Duration(bucketSize) * time.Second).Unix())
+func alignToBucketSize(start, stop, bucketSize int64) (int64, int64) {
+	start = time.Unix(start, 0).Truncate(time.Duration(bucketSize) * time.Second).Unix()
+	newStop := time.Unix(stop, 0).Truncate(time.Duration(bucketSize) * time.Second).Unix()
 
 	// check if a partial bucket is needed
 	if stop != newStop {
@@ -1,6 +1,7 @@
 package expr
 
 import (
+	"context"
 	"math"
 	"reflect"
 	"testing"
@@ -68,10 +69,10 @@ func deepEqual(t *testing.T, target string, original, modified map[MetricRequest
 
 func TestGetBuckets(t *testing.T) {
 	tests := []struct {
-		start       int32
-		stop        int32
-		bucketSize  int32
-		wantBuckets int32
+		start       int64
+		stop        int64
+		bucketSize  int64
+		wantBuckets int64
 	}{
 		{13, 18, 5, 1},
 		{13, 17, 5, 1},
@@ -91,11 +92,11 @@ func TestGetBuckets(t *testing.T) {
 
 func TestAlignToBucketSize(t *testing.T) {
 	tests := []struct {
-		inputStart int32
-		inputStop  int32
-		bucketSize int32
-		wantStart  int32
-		wantStop   int32
+		inputStart int64
+		inputStop  int64
+		bucketSize int64
+		wantStart  int64
+		wantStop   int64
 	}{
 		{
 			13, 18, 5,
@@ -125,10 +126,10 @@ func TestAlignToBucketSize(t *testing.T) {
 
 func TestAlignToInterval(t *testing.T) {
 	tests := []struct {
-		inputStart int32
-		inputStop  int32
-		bucketSize int32
-		wantStart  int32
+		inputStart int64
+		inputStop  int64
+		bucketSize int64
+		wantStart  int64
 	}{
 		{
 			91111, 92222, 5,
@@ -177,8 +178,8 @@ func TestEvalExpr(t *testing.T) {
 	data := MetricData{
 		FetchResponse: pb.FetchResponse{
 			Name:      &request.Metric,
-			StartTime: &request.From,
-			StopTime:  &request.Until,
+			StartTime: proto.Int32(int32(request.From)),
+			StopTime:  proto.Int32(int32(request.Until)),
 			StepTime:  &stepTime,
 			Values:    []float64{343, 407, 385},
 			IsAbsent:  []bool{false, false, false},
@@ -189,40 +190,78 @@ func TestEvalExpr(t *testing.T) {
 		&data,
 	}
 
-	EvalExpr(exp, int32(request.From), int32(request.Until), metricMap)
+	EvalExpr(context.Background(), exp, request.From, request.Until, metricMap)
+}
+
+func TestEvalExprCancelled(t *testing.T) {
+	exp, _, err := ParseExpr("sum(scale(metric1,2))")
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	metricMap := map[MetricRequest][]*MetricData{
+		{"metric1", 0, 1}: {makeResponse("metric1", []float64{1, 2, 3}, 1, 0)},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := EvalExpr(ctx, exp, 0, 1, metricMap); err != context.Canceled {
+		t.Errorf("EvalExpr with cancelled context: got err %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestEvalHoltWintersForecastLateStart(t *testing.T) {
+	exp, _, err := ParseExpr("holtWintersForecast(metric1)")
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+
+	// less than the week of lookback, ending at the end of the int32 range
+	metricMap := map[MetricRequest][]*MetricData{
+		{"metric1", 0, 7 * 86400}: {makeResponse("metric1", []float64{1, 2, 3}, 3600, math.MaxInt32-3*3600)},
+	}
+
+	g, err := EvalExpr(context.Background(), exp, 7*86400, 7*86400, metricMap)
+	if err != nil {
+		t.Fatalf("failed to eval: %s", err)
+	}
+	if len(g) != 1 || len(g[0].Values) != 0 || g[0].GetStartTime() != math.MaxInt32 {
+		t.Errorf("got %v, want no points starting at %d", g, math.MaxInt32)
+	}
 }
 
 func TestParseExpr(t *testing.T) {
 
 	tests := []struct {
 		s string
-		e *expr
+		e *Expr
 	}{
 		{"metric",
-			&expr{target: "metric"},
+			&Expr{target: "metric"},
 		},
 		{
 			"metric.foo",
-			&expr{target: "metric.foo"},
+			&Expr{target: "metric.foo"},
 		},
 		{"metric.*.foo",
-			&expr{target: "metric.*.foo"},
+			&Expr{target: "metric.*.foo"},
 		},
 		{
 			"func(metric)",
-			&expr{
+			&Expr{
 				target:    "func",
 				etype:     etFunc,
-				args:      []*expr{{target: "metric"}},
+				args:      []*Expr{{target: "metric"}},
 				argString: "metric",
 			},
 		},
 		{
 			"func(metric1,metric2,metric3)",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"}},
@@ -231,14 +270,14 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func1(metric1,func2(metricA, metricB),metric3)",
-			&expr{
+			&Expr{
 				target: "func1",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "func2",
 						etype:     etFunc,
-						args:      []*expr{{target: "metricA"}, {target: "metricB"}},
+						args:      []*Expr{{target: "metricA"}, {target: "metricB"}},
 						argString: "metricA, metricB",
 					},
 					{target: "metric3"}},
@@ -248,18 +287,18 @@ func TestParseExpr(t *testing.T) {
 
 		{
 			"3",
-			&expr{val: 3, etype: etConst},
+			&Expr{val: 3, etype: etConst},
 		},
 		{
 			"3.1",
-			&expr{val: 3.1, etype: etConst},
+			&Expr{val: 3.1, etype: etConst},
 		},
 		{
 			"func1(metric1, 3, 1e2, 2e-3)",
-			&expr{
+			&Expr{
 				target: "func1",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 3, etype: etConst},
 					{val: 100, etype: etConst},
@@ -270,10 +309,10 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func1(metric1, 'stringconst')",
-			&expr{
+			&Expr{
 				target: "func1",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "stringconst", etype: etString},
 				},
@@ -282,10 +321,10 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			`func1(metric1, "stringconst")`,
-			&expr{
+			&Expr{
 				target: "func1",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "stringconst", etype: etString},
 				},
@@ -294,10 +333,10 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func1(metric1, -3)",
-			&expr{
+			&Expr{
 				target: "func1",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: -3, etype: etConst},
 				},
@@ -307,13 +346,13 @@ func TestParseExpr(t *testing.T) {
 
 		{
 			"func(metric, key='value')",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key": {etype: etString, valStr: "value"},
 				},
 				argString: "metric, key='value'",
@@ -321,13 +360,13 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func(metric, key=true)",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key": {etype: etName, target: "true"},
 				},
 				argString: "metric, key=true",
@@ -335,13 +374,13 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func(metric, key=1)",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key": {etype: etConst, val: 1},
 				},
 				argString: "metric, key=1",
@@ -349,13 +388,13 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func(metric, key=0.1)",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key": {etype: etConst, val: 0.1},
 				},
 				argString: "metric, key=0.1",
@@ -364,14 +403,14 @@ func TestParseExpr(t *testing.T) {
 
 		{
 			"func(metric, 1, key='value')",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 					{etype: etConst, val: 1},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key": {etype: etString, valStr: "value"},
 				},
 				argString: "metric, 1, key='value'",
@@ -379,14 +418,14 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func(metric, key='value', 1)",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 					{etype: etConst, val: 1},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key": {etype: etString, valStr: "value"},
 				},
 				argString: "metric, key='value', 1",
@@ -394,13 +433,13 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func(metric, key1='value1', key2='value2')",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key1": {etype: etString, valStr: "value1"},
 					"key2": {etype: etString, valStr: "value2"},
 				},
@@ -409,13 +448,13 @@ func TestParseExpr(t *testing.T) {
 		},
 		{
 			"func(metric, key2='value2', key1='value1')",
-			&expr{
+			&Expr{
 				target: "func",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"key2": {etype: etString, valStr: "value2"},
 					"key1": {etype: etString, valStr: "value1"},
 				},
@@ -425,14 +464,14 @@ func TestParseExpr(t *testing.T) {
 
 		{
 			`foo.{bar,baz}.qux`,
-			&expr{
+			&Expr{
 				target: "foo.{bar,baz}.qux",
 				etype:  etName,
 			},
 		},
 		{
 			`foo.b[0-9].qux`,
-			&expr{
+			&Expr{
 				target: "foo.b[0-9].qux",
 				etype:  etName,
 			},
@@ -479,19 +518,19 @@ func TestEvalExpression(t *testing.T) {
 	now32 := int32(time.Now().Unix())
 
 	tests := []struct {
-		e    *expr
+		e    *Expr
 		m    map[MetricRequest][]*MetricData
 		want []*MetricData
 	}{
 		{
-			&expr{target: "metric"},
+			&Expr{target: "metric"},
 			map[MetricRequest][]*MetricData{
 				MetricRequest{"metric", 0, 1}: {makeResponse("metric", []float64{1, 2, 3, 4, 5}, 1, now32)},
 			},
 			[]*MetricData{makeResponse("metric", []float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{target: "metric*"},
+			&Expr{target: "metric*"},
 			map[MetricRequest][]*MetricData{
 				MetricRequest{"metric*", 0, 1}: {
 					makeResponse("metric1", []float64{1, 2, 3, 4, 5}, 1, now32),
@@ -504,10 +543,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "sum",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"}},
@@ -521,10 +560,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("sumSeries(metric1,metric2,metric3)", []float64{6, 9, 8, 15, 11, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "countSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"}},
@@ -538,10 +577,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("countSeries(metric1,metric2,metric3)", []float64{3, 3, 3, 3, 3, 3}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "percentileOfSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 4, etype: etConst},
 				},
@@ -553,10 +592,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("percentileOfSeries(metric1,4)", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "percentileOfSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 50, etype: etConst},
 				},
@@ -573,14 +612,14 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("percentileOfSeries(metric1.foo.*.*,50)", []float64{7, 8, 9, 10, 11, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "percentileOfSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 50, etype: etConst},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"interpolate": {target: "true", etype: etName},
 				},
 				argString: "metric1.foo.*.*,50,interpolate=true",
@@ -596,10 +635,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("percentileOfSeries(metric1.foo.*.*,50,interpolate=true)", []float64{6.5, 7.5, 8.5, 9.5, 11, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "nPercentile",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 50, etype: etConst},
 				},
@@ -611,10 +650,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("nPercentile(metric1,50)", []float64{8, 8, 8, 8, 8, 8, 8}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "nonNegativeDerivative",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 			},
@@ -624,10 +663,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("nonNegativeDerivative(metric1)", []float64{math.NaN(), 2, 2, 4, 4, 6}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "nonNegativeDerivative",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 			},
@@ -637,13 +676,13 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("nonNegativeDerivative(metric1)", []float64{math.NaN(), 2, 2, math.NaN(), 3, math.NaN(), math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "nonNegativeDerivative",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"maxValue": {val: 32, etype: etConst},
 				},
 				argString: "metric1,maxValue=32",
@@ -654,10 +693,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("nonNegativeDerivative(metric1,32)", []float64{math.NaN(), 2, 29, 10, 24, math.NaN(), math.NaN(), 32, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "perSecond",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -668,10 +707,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("perSecond(metric1)", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), 99, math.NaN(), 8.7}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "perSecond",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 32, etype: etConst},
 				},
@@ -683,10 +722,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("perSecond(metric1,32)", []float64{math.NaN(), math.NaN(), 1, 1, 1, 26, 3, 32, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "movingAverage",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 4, etype: etConst},
 				},
@@ -698,10 +737,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("movingAverage(metric1,4)", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), 1, 1.25, 1.5, 1.75, 2.5, 3.5, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "movingMedian",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 4, etype: etConst},
 				},
@@ -713,10 +752,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("movingMedian(metric1,4)", []float64{math.NaN(), math.NaN(), math.NaN(), 1, 1, 1.5, 2, 2, 3, 4, 5, 6}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "movingMedian",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 5, etype: etConst},
 				},
@@ -728,10 +767,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("movingMedian(metric1,5)", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), 1, 1, 2, 2, 2, 4, 4, 6, 6, 4, 2}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "movingMedian",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "1s", etype: etString},
 				},
@@ -743,10 +782,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("movingMedian(metric1,\"1s\")", []float64{1, 1, 1, 1, 2, 2, 2, 4, 6, 4, 6, 8, 1, 2, 0}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "movingMedian",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "3s", etype: etString},
 				},
@@ -758,10 +797,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("movingMedian(metric1,\"3s\")", []float64{0, 1, 1, 1, 1, 2, 2, 2, 4, 4, 6, 6, 6, 2}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "pearson",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{val: 6, etype: etConst},
@@ -775,10 +814,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("pearson(metric1,metric2,6)", []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), 0.5298089018901744}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "scale",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 2.5, etype: etConst},
 				},
@@ -790,10 +829,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("scale(metric1,2.5)", []float64{2.5, 5.0, math.NaN(), 10.0, 12.5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "scaleToSeconds",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 5, etype: etConst},
 				},
@@ -805,10 +844,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("scaleToSeconds(metric1,5)", []float64{5, 10, math.NaN(), 10, 10}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "pow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 3, etype: etConst},
 				},
@@ -820,13 +859,13 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("pow(metric1,3)", []float64{125, 1, math.NaN(), 0, 1728, 1953125, 1124.864, 1.331}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "keepLastValue",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"limit": {val: 3, etype: etConst},
 				},
 				argString: "metric1,limit=3",
@@ -838,10 +877,10 @@ func TestEvalExpression(t *testing.T) {
 		},
 
 		{
-			&expr{
+			&Expr{
 				target: "keepLastValue",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -852,10 +891,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("keepLastValue(metric1)", []float64{math.NaN(), 2, 2, 2, 2, 2, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "keepLastValue",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 				},
 				argString: "metric*",
@@ -872,10 +911,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "changed",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -887,10 +926,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1, 1, 1, 0, 1, 0, 0, 1, 1}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "alias",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "renamed", etype: etString},
 				},
@@ -902,10 +941,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "aliasByMetric",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.bar.baz"},
 				},
 			},
@@ -915,10 +954,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("baz", []float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "aliasByNode",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.bar.baz"},
 					{val: 1, etype: etConst},
 				},
@@ -929,10 +968,10 @@ func TestEvalExpression(t *testing.T) {
 			[]*MetricData{makeResponse("foo", []float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "aliasByNode",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.bar.baz"},
 					{val: 1, etype: etConst},
 					{val: 3, etype: etConst},
@@ -945,10 +984,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "aliasByNode",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.bar.baz"},
 					{val: 1, etype: etConst},
 					{val: -2, etype: etConst},
@@ -961,10 +1000,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "substr",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.bar.baz"},
 					{val: 1, etype: etConst},
 					{val: 3, etype: etConst},
@@ -977,10 +1016,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "aliasSub",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.bar.baz"},
 					{valStr: "foo", etype: etString},
 					{valStr: "replaced", etype: etString},
@@ -993,10 +1032,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "aliasSub",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.TCP100"},
 					{valStr: "^.*TCP(\\d+)", etype: etString},
 					{valStr: "$1", etype: etString},
@@ -1009,10 +1048,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "aliasSub",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.TCP100"},
 					{valStr: "^.*TCP(\\d+)", etype: etString},
 					{valStr: "\\1", etype: etString},
@@ -1025,10 +1064,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "derivative",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 			},
@@ -1039,10 +1078,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{math.NaN(), 2, 2, -5, 3, math.NaN(), 4}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "avg",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"}},
@@ -1057,10 +1096,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{2, math.NaN(), 3, 4, 5, 5.5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "maxSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"}},
@@ -1075,10 +1114,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{3, math.NaN(), 4, 5, 6, 6}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "minSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"}},
@@ -1093,10 +1132,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, math.NaN(), 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "asPercent",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 				},
@@ -1110,10 +1149,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{50, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 200}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "divideSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 				},
@@ -1127,10 +1166,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0.5, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 2}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "divideSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric[12]"},
 				},
 				argString: "metric[12]",
@@ -1145,10 +1184,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0.5, math.NaN(), math.NaN(), math.NaN(), math.NaN(), 2}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "multiplySeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 				},
@@ -1162,10 +1201,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{2, math.NaN(), math.NaN(), math.NaN(), 0, 72}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "multiplySeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 				},
@@ -1179,10 +1218,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{2, math.NaN(), math.NaN(), math.NaN(), 0, 72}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "multiplySeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"},
@@ -1198,10 +1237,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{6, math.NaN(), math.NaN(), math.NaN(), 0, 576}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "diffSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 				},
@@ -1215,10 +1254,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{-1, math.NaN(), math.NaN(), 3, 4, 6}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "diffSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{target: "metric3"},
@@ -1234,10 +1273,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, math.NaN(), math.NaN(), 3, 4, 1}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "diffSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 				},
 				argString: "metric*",
@@ -1252,10 +1291,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{-1, math.NaN(), math.NaN(), 3, 4, 6}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "rangeOfSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 				},
 				argString: "metric*",
@@ -1271,10 +1310,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, math.NaN(), math.NaN(), 12, 5, 6, 20}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "transformNull",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1286,13 +1325,13 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 0, 0, 3, 4, 12}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "transformNull",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"default": {val: 5, etype: etConst},
 				},
 				argString: "metric1,default=5",
@@ -1304,10 +1343,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 5, 5, 3, 4, 12}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "highestMax",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 1, etype: etConst},
 				},
@@ -1324,10 +1363,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 1, 3, 3, 12, 11}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "lowestCurrent",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 1, etype: etConst},
 				},
@@ -1344,10 +1383,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 1, 3, 3, 4, 1}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "highestCurrent",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 1, etype: etConst},
 				},
@@ -1365,10 +1404,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 1, 3, 3, 4, 15}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "highestCurrent",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 4, etype: etConst},
 				},
@@ -1392,10 +1431,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "highestAverage",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 1, etype: etConst},
 				},
@@ -1412,10 +1451,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 5, 5, 5, 5, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "exclude",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "(Foo|Baz)", etype: etString},
 				},
@@ -1432,10 +1471,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{2, 2, 2, 2, 2}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "ewma",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 0.1, etype: etConst},
 				},
@@ -1449,10 +1488,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "exponentialWeightedMovingAverage",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 0.1, etype: etConst},
 				},
@@ -1466,10 +1505,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "grep",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "Bar", etype: etString},
 				},
@@ -1486,10 +1525,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{2, 2, 2, 2, 2}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "logarithm",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1501,13 +1540,13 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 1, 2, 3, 4}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "logarithm",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"base": {val: 2, etype: etConst},
 				},
 				argString: "metric1,base=2",
@@ -1519,10 +1558,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "absolute",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1534,10 +1573,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 1, 2, 3, 4, 5}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "isNonNull",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1549,10 +1588,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 1, 0, 1, 1, 1}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "averageAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 5, etype: etConst},
 				},
@@ -1571,10 +1610,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "averageBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 0, etype: etConst},
 				},
@@ -1591,10 +1630,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 0, 0, 0, 0, 0}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "maximumAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 6, etype: etConst},
 				},
@@ -1611,10 +1650,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{3, 4, 5, 6, 7, 8}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "maximumBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 5, etype: etConst},
 				},
@@ -1631,10 +1670,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 0, 0, 0, 0, 0}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "minimumAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 1, etype: etConst},
 				},
@@ -1651,10 +1690,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{2, 4, 4, 5, 5, 6}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "minimumBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: -2, etype: etConst},
 				},
@@ -1671,15 +1710,15 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{-2, 4, 4, 5, 5, 6}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "pearsonClosest",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{target: "metric2"},
 					{val: 1, etype: etConst},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"direction": {valStr: "abs", etype: etString},
 				},
 				argString: "metric1,metric2,1,direction='abs'",
@@ -1698,10 +1737,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{3, math.NaN(), 5, 6, 7, 8}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "invert",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1713,10 +1752,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{-0.25, -0.5, -1, math.NaN(), 1, 0.5, 0.25}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "offset",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 10, etype: etConst},
 				},
@@ -1729,10 +1768,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{103, 104, 105, math.NaN(), 107, 108, 109, 110, 111}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "offsetToZero",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1744,10 +1783,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 1, 2, math.NaN(), 4, 5, 6, 7, 8}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "currentAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 7, etype: etConst},
 				},
@@ -1764,10 +1803,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{3, 4, 5, 6, 7, 8}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "currentBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 0, etype: etConst},
 				},
@@ -1784,10 +1823,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{0, 0, 0, 0, 0, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "integral",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1799,10 +1838,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 1, 3, 6, 10, 15, math.NaN(), 22, 30}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "sortByTotal",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1821,10 +1860,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "sortByMaxima",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1843,10 +1882,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "sortByMinima",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1865,10 +1904,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "sortByName",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -1889,13 +1928,13 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "sortByName",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"natural": {target: "true", etype: etName},
 				},
 				argString: "metric1,natural=true",
@@ -1920,10 +1959,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "constantLine",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 				},
 				argString: "42.42",
@@ -1935,10 +1974,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{42.42, 42.42}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "threshold",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 				},
 				argString: "42.42",
@@ -1948,10 +1987,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{42.42, 42.42}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "threshold",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 					{valStr: "fourty-two", etype: etString},
 				},
@@ -1962,10 +2001,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{42.42, 42.42}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "threshold",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 					{valStr: "fourty-two", etype: etString},
 					{valStr: "blue", etype: etString},
@@ -1977,13 +2016,13 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{42.42, 42.42}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "threshold",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"label": {valStr: "fourty-two", etype: etString},
 				},
 				argString: "42.42,label='fourty-two'",
@@ -1993,13 +2032,13 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{42.42, 42.42}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "threshold",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"color": {valStr: "blue", etype: etString},
 					//TODO(nnuss): test blue is being set rather than just not causing expression to parse/fail
 				},
@@ -2010,13 +2049,13 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{42.42, 42.42}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "threshold",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"label": {valStr: "fourty-two-blue", etype: etString},
 					"color": {valStr: "blue", etype: etString},
 					//TODO(nnuss): test blue is being set rather than just not causing expression to parse/fail
@@ -2032,14 +2071,14 @@ func TestEvalExpression(t *testing.T) {
 			// how getStringNamedOrPosArgDefault works but we don't notice
 			// because we're not testing color is set.
 			// You may manually verify with this request URI: /render/?format=png&target=threshold(42.42,"gold",label="fourty-two-aurum")
-			&expr{
+			&Expr{
 				target: "threshold",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 42.42, etype: etConst},
 					{valStr: "gold", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"label": {valStr: "fourty-two-aurum", etype: etString},
 				},
 				argString: "42.42,'gold',label='fourty-two-aurum'",
@@ -2049,10 +2088,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{42.42, 42.42}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "squareRoot",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 				argString: "metric1",
@@ -2064,10 +2103,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 1.4142135623730951, 0, 2.6457513110645907, 2.8284271247461903, 4.47213595499958, 5.477225575051661, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "removeEmptySeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 				},
 				argString: "metric*",
@@ -2085,10 +2124,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "removeZeroSeries",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 				},
 				argString: "metric*",
@@ -2105,10 +2144,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "removeBelowValue",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 0, etype: etConst},
 				},
@@ -2121,10 +2160,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, math.NaN(), 7, 8, 20, 30, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "removeAboveValue",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 10, etype: etConst},
 				},
@@ -2137,10 +2176,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, -1, 7, 8, math.NaN(), math.NaN(), math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "removeBelowPercentile",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 50, etype: etConst},
 				},
@@ -2153,10 +2192,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{math.NaN(), math.NaN(), math.NaN(), 7, 8, 20, 30, math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "removeAbovePercentile",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 50, etype: etConst},
 				},
@@ -2169,10 +2208,10 @@ func TestEvalExpression(t *testing.T) {
 				[]float64{1, 2, -1, 7, math.NaN(), math.NaN(), math.NaN(), math.NaN()}, 1, now32)},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 				},
@@ -2189,10 +2228,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 				},
@@ -2209,10 +2248,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 					{valStr: "carrot", etype: etString},
@@ -2230,10 +2269,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 				},
@@ -2250,10 +2289,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 				},
@@ -2270,10 +2309,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
 			},
@@ -2289,13 +2328,13 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"units": {etype: etString, valStr: "apples"},
 				},
 			},
@@ -2311,10 +2350,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 				},
@@ -2331,10 +2370,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 				},
@@ -2351,10 +2390,10 @@ func TestEvalExpression(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "cactiStyle",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "si", etype: etString},
 				},
@@ -2375,7 +2414,7 @@ func TestEvalExpression(t *testing.T) {
 	for _, tt := range tests {
 		originalMetrics := deepClone(tt.m)
 		testName := tt.e.target + "(" + tt.e.argString + ")"
-		g, err := EvalExpr(tt.e, 0, 1, tt.m)
+		g, err := EvalExpr(context.Background(), tt.e, 0, 1, tt.m)
 		if err != nil {
 			t.Errorf("failed to eval %s: %s", testName, err)
 			continue
@@ -2432,7 +2471,7 @@ func TestEvalSummarize(t *testing.T) {
 	now32 := tenThirty
 
 	tests := []struct {
-		e     *expr
+		e     *Expr
 		m     map[MetricRequest][]*MetricData
 		w     []float64
 		name  string
@@ -2441,10 +2480,10 @@ func TestEvalSummarize(t *testing.T) {
 		stop  int32
 	}{
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 				},
@@ -2468,14 +2507,14 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 35,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"func": {valStr: "avg", etype: etString},
 				},
 				argString: "metric1,'5s',func='avg'",
@@ -2490,14 +2529,14 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 35,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"func": {valStr: "max", etype: etString},
 				},
 				argString: "metric1,'5s',func='max'",
@@ -2512,14 +2551,14 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"func": {valStr: "min", etype: etString},
 				},
 				argString: "metric1,'5s',func='min'",
@@ -2534,14 +2573,14 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"func": {valStr: "last", etype: etString},
 				},
 				argString: "metric1,'5s',func='last'",
@@ -2556,10 +2595,10 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 					{valStr: "p50", etype: etString},
@@ -2576,10 +2615,10 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 					{valStr: "p25", etype: etString},
@@ -2596,10 +2635,10 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 					{valStr: "p99.9", etype: etString},
@@ -2616,10 +2655,10 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "5s", etype: etString},
 					{valStr: "p100.1", etype: etString},
@@ -2636,10 +2675,10 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "1s", etype: etString},
 					{valStr: "p50", etype: etString},
@@ -2656,10 +2695,10 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 25*1,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "10min", etype: etString},
 				},
@@ -2678,14 +2717,14 @@ func TestEvalSummarize(t *testing.T) {
 			tenThirty + 30*60,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "10min", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"alignToFrom": {target: "true", etype: etName},
 					"func":        {valStr: "sum", etype: etString},
 				},
@@ -2704,14 +2743,14 @@ func TestEvalSummarize(t *testing.T) {
 			tenThirtyTwo + 25*60,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "summarize",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "10min", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"alignToFrom": {target: "true", etype: etName},
 				},
 				argString: "metric1,'10min',alignToFrom=true",
@@ -2729,10 +2768,10 @@ func TestEvalSummarize(t *testing.T) {
 			tenThirtyTwo + 25*60,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "hitcount",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "30s", etype: etString},
 				},
@@ -2754,10 +2793,10 @@ func TestEvalSummarize(t *testing.T) {
 			now32 + 31*5,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "hitcount",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "1h", etype: etString},
 				},
@@ -2776,10 +2815,10 @@ func TestEvalSummarize(t *testing.T) {
 			tenFiftyNine + 25*5,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "hitcount",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "1h", etype: etString},
 					{target: "true", etype: etName},
@@ -2799,14 +2838,14 @@ func TestEvalSummarize(t *testing.T) {
 			tenFiftyNine + 25*5,
 		},
 		{
-			&expr{
+			&Expr{
 				target: "hitcount",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{valStr: "1h", etype: etString},
 				},
-				namedArgs: map[string]*expr{
+				namedArgs: map[string]*Expr{
 					"alignToInterval": {target: "true", etype: etName},
 				},
 				argString: "metric1,'1h',alignToInterval=true",
@@ -2827,7 +2866,7 @@ func TestEvalSummarize(t *testing.T) {
 
 	for _, tt := range tests {
 		originalMetrics := deepClone(tt.m)
-		g, err := EvalExpr(tt.e, 0, 1, tt.m)
+		g, err := EvalExpr(context.Background(), tt.e, 0, 1, tt.m)
 		if err != nil {
 			t.Errorf("failed to eval %v: %s", tt.name, err)
 			continue
@@ -2857,16 +2896,16 @@ func TestEvalMultipleReturns(t *testing.T) {
 	now32 := int32(time.Now().Unix())
 
 	tests := []struct {
-		e       *expr
+		e       *Expr
 		m       map[MetricRequest][]*MetricData
 		name    string
 		results map[string][]*MetricData
 	}{
 		{
-			&expr{
+			&Expr{
 				target: "groupByNode",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 3, etype: etConst},
 					{valStr: "sum", etype: etString},
@@ -2887,10 +2926,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "groupByNode",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 3, etype: etConst},
 					{valStr: "sum", etype: etString},
@@ -2911,10 +2950,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "groupByNode",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 3, etype: etConst},
 					{valStr: "sum", etype: etString},
@@ -2935,10 +2974,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "applyByNode",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 2, etype: etConst},
 					{valStr: "sumSeries(%.baz)", etype: etString},
@@ -2963,10 +3002,38 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
+				target: "applyByNode",
+				etype:  etFunc,
+				args: []*Expr{
+					{target: "*.baz"},
+					{val: 0, etype: etConst},
+					{valStr: "sumSeries(%)", etype: etString},
+				},
+			},
+			map[MetricRequest][]*MetricData{
+				MetricRequest{"*.baz", 0, 1}: {
+					makeResponse("1.baz", []float64{1, 2, 3, 4, 5}, 1, now32),
+					makeResponse("2.baz", []float64{11, 12, 13, 14, 15}, 1, now32),
+				},
+				MetricRequest{"1", 0, 1}: {
+					makeResponse("1", []float64{1, 2, 3, 4, 5}, 1, now32),
+				},
+				MetricRequest{"2", 0, 1}: {
+					makeResponse("2", []float64{11, 12, 13, 14, 15}, 1, now32),
+				},
+			},
+			"applyByNode_numeric_nodes",
+			map[string][]*MetricData{
+				"1": {makeResponse("1", []float64{1, 2, 3, 4, 5}, 1, now32)},
+				"2": {makeResponse("2", []float64{11, 12, 13, 14, 15}, 1, now32)},
+			},
+		},
+		{
+			&Expr{
 				target: "sumSeriesWithWildcards",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 1, etype: etConst},
 					{val: 2, etype: etConst},
@@ -2987,10 +3054,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "averageSeriesWithWildcards",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1.foo.*.*"},
 					{val: 1, etype: etConst},
 					{val: 2, etype: etConst},
@@ -3011,10 +3078,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "highestCurrent",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 2, etype: etConst},
 				},
@@ -3034,10 +3101,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "lowestCurrent",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 3, etype: etConst},
 				},
@@ -3058,10 +3125,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "limit",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 2, etype: etConst},
 				},
@@ -3083,10 +3150,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "limit",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric1"},
 					{val: 20, etype: etConst},
 				},
@@ -3111,10 +3178,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "mostDeviant",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{val: 2, etype: etConst},
 					{target: "metric*"},
 				},
@@ -3135,10 +3202,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "mostDeviant",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 2, etype: etConst},
 				},
@@ -3159,10 +3226,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "pearsonClosest",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metricC"},
 					{target: "metric*"},
 					{val: 2, etype: etConst},
@@ -3187,10 +3254,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "pearsonClosest",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metricC"},
 					{target: "metric*"},
 					{val: 3, etype: etConst},
@@ -3216,10 +3283,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 1.5, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3243,10 +3310,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 3, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3268,10 +3335,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 1.5, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3296,10 +3363,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyAbove",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 1.5, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3324,10 +3391,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 1.5, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3350,10 +3417,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 1.5, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3377,10 +3444,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 1.5, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3404,10 +3471,10 @@ func TestEvalMultipleReturns(t *testing.T) {
 			},
 		},
 		{
-			&expr{
+			&Expr{
 				target: "tukeyBelow",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{target: "metric*"},
 					{val: 3, etype: etConst},
 					{val: 5, etype: etConst},
@@ -3432,7 +3499,7 @@ func TestEvalMultipleReturns(t *testing.T) {
 
 	for _, tt := range tests {
 		originalMetrics := deepClone(tt.m)
-		g, err := EvalExpr(tt.e, 0, 1, tt.m)
+		g, err := EvalExpr(context.Background(), tt.e, 0, 1, tt.m)
 		if err != nil {
 			t.Errorf("failed to eval %v: %s", tt.name, err)
 			continue
@@ -3521,18 +3588,18 @@ func TestExtractMetric(t *testing.T) {
 func TestEvalCustomFromUntil(t *testing.T) {
 
 	tests := []struct {
-		e     *expr
+		e     *Expr
 		m     map[MetricRequest][]*MetricData
 		w     []float64
 		name  string
-		from  int32
-		until int32
+		from  int64
+		until int64
 	}{
 		{
-			&expr{
+			&Expr{
 				target: "timeFunction",
 				etype:  etFunc,
-				args: []*expr{
+				args: []*Expr{
 					{valStr: "footime", etype: etString},
 				},
 				argString: "footime",
@@ -3547,7 +3614,7 @@ func TestEvalCustomFromUntil(t *testing.T) {
 
 	for _, tt := range tests {
 		originalMetrics := deepClone(tt.m)
-		g, err := EvalExpr(tt.e, tt.from, tt.until, tt.m)
+		g, err := EvalExpr(context.Background(), tt.e, tt.from, tt.until, tt.m)
 		if err != nil {
 			t.Errorf("failed to eval %v: %s", tt.name, err)
 			continue
@@ -0,0 +1,4009 @@
+package expr
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JaderDias/movingmedian"
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/dgryski/go-onlinestats"
+	"github.com/dustin/go-humanize"
+	"github.com/gogo/protobuf/proto"
+)
+
+func init() {
+	for _, f := range []Function{
+		{
+			Name:        "absolute",
+			Description: "Takes the absolute value of each datapoint.",
+			Group:       "Transform",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalAbsolute,
+		},
+		{
+			Name:        "alias",
+			Description: "Renames each series to newName.",
+			Group:       "Alias",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "newName", Type: ParamString, Required: true},
+			},
+			Eval: evalAlias,
+		},
+		{
+			Name:        "aliasByMetric",
+			Description: "Renames each series to the last node of its name.",
+			Group:       "Alias",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalAliasByMetric,
+		},
+		{
+			Name:        "aliasByNode",
+			Description: "Renames each series to the given nodes of its name, joined with dots.",
+			Group:       "Alias",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "nodes", Type: ParamNode, Required: true, Multiple: true},
+			},
+			Eval: evalAliasByNode,
+		},
+		{
+			Name:        "aliasSub",
+			Description: "Runs a regular expression search and replace on each series name.",
+			Group:       "Alias",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "search", Type: ParamString, Required: true},
+				{Name: "replace", Type: ParamString, Required: true},
+			},
+			Eval: evalAliasSub,
+		},
+		{
+			Name:        "alpha",
+			Description: "Sets the alpha (transparency) of each series.",
+			Group:       "Graph",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "alpha", Type: ParamFloat, Required: true},
+			},
+			Eval: evalAlpha,
+		},
+		{
+			Name:        "applyByNode",
+			Description: "Groups series by the given node and evaluates templateFunction, with % replaced by the group prefix, for each group.",
+			Group:       "Combine",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "nodeNum", Type: ParamNode, Required: true},
+				{Name: "templateFunction", Type: ParamString, Required: true},
+			},
+			Eval: evalGroupByNode,
+		},
+		{
+			Name:        "areaBetween",
+			Description: "Fills the area between two series.",
+			Group:       "Graph",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalAreaBetween,
+		},
+		{
+			Name:        "asPercent",
+			Description: "Calculates each series as a percentage of total, or of the sum of all series if total is omitted.",
+			Group:       "Combine",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "total", Type: ParamAny},
+			},
+			Eval: evalAsPercent,
+		},
+		{
+			Name:        "averageAbove",
+			Description: "Keeps the series whose average is above n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "averageBelow",
+			Description: "Keeps the series whose average is below n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "averageSeries",
+			Aliases:     []string{"avg"},
+			Description: "Averages all series into a single series.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalAverageSeries,
+		},
+		{
+			Name:        "averageSeriesWithWildcards",
+			Description: "Averages series which are equal apart from the nodes at the given positions.",
+			Group:       "Combine",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "position", Type: ParamNode, Required: true, Multiple: true},
+			},
+			Eval: evalAverageSeriesWithWildcards,
+		},
+		{
+			Name:        "cactiStyle",
+			Description: "Appends the current, maximum and minimum values to each series name.",
+			Group:       "Special",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "system", Type: ParamString},
+				{Name: "units", Type: ParamString},
+			},
+			Eval: evalCactiStyle,
+		},
+		{
+			Name:        "changed",
+			Description: "Outputs 1 where the value changed from the previous datapoint and 0 elsewhere.",
+			Group:       "Special",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalChanged,
+		},
+		{
+			Name:        "color",
+			Description: "Sets the color of each series.",
+			Group:       "Graph",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "theColor", Type: ParamString, Required: true},
+			},
+			Eval: evalColor,
+		},
+		{
+			Name:        "consolidateBy",
+			Description: "Sets the function used to consolidate datapoints when there are more points than pixels.",
+			Group:       "Special",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "consolidationFunc", Type: ParamString, Required: true},
+			},
+			Eval: evalConsolidateBy,
+		},
+		{
+			Name:        "constantLine",
+			Description: "Draws a horizontal line at value.",
+			Group:       "Special",
+			Params:      []Param{{Name: "value", Type: ParamFloat, Required: true}},
+			Eval:        evalConstantLine,
+		},
+		{
+			Name:        "countSeries",
+			Description: "Returns a single series holding the number of series at each point.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalCountSeries,
+		},
+		{
+			Name:        "currentAbove",
+			Description: "Keeps the series whose last value is above n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "currentBelow",
+			Description: "Keeps the series whose last value is below n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "dashed",
+			Description: "Draws each series with a dashed line.",
+			Group:       "Graph",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "dashLength", Type: ParamFloat, Default: 2.5},
+			},
+			Eval: evalGraphOption,
+		},
+		{
+			Name:        "derivative",
+			Description: "Returns the difference between each datapoint and the previous one.",
+			Group:       "Transform",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalDerivative,
+		},
+		{
+			Name:        "diffSeries",
+			Description: "Subtracts all later series from the first one.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalDiffSeries,
+		},
+		{
+			Name:        "divideSeries",
+			Description: "Divides each dividend series by the divisor series.",
+			Group:       "Combine",
+			Params: []Param{
+				{Name: "dividendSeriesList", Type: ParamSeriesList, Required: true},
+				{Name: "divisorSeries", Type: ParamSeriesList},
+			},
+			Eval: evalDivideSeries,
+		},
+		{
+			Name:        "drawAsInfinite",
+			Description: "Draws a vertical line wherever a value is non-zero.",
+			Group:       "Graph",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalGraphOption,
+		},
+		{
+			Name:        "exclude",
+			Description: "Removes the series whose name matches the regular expression pattern.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "pattern", Type: ParamString, Required: true},
+			},
+			Eval: evalExclude,
+		},
+		{
+			Name:        "exponentialWeightedMovingAverage",
+			Aliases:     []string{"ewma"},
+			Description: "Returns the exponentially weighted moving average of each series, with smoothing factor alpha.",
+			Group:       "Calculate",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "alpha", Type: ParamFloat, Required: true},
+			},
+			Eval: evalEWMA,
+		},
+		{
+			Name:        "grep",
+			Description: "Keeps the series whose name matches the regular expression pattern.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "pattern", Type: ParamString, Required: true},
+			},
+			Eval: evalGrep,
+		},
+		{
+			Name:        "group",
+			Description: "Combines several series lists into one.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalGroup,
+		},
+		{
+			Name:        "groupByNode",
+			Description: "Groups series by the given node and aggregates each group with callback.",
+			Group:       "Combine",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "nodeNum", Type: ParamNode, Required: true},
+				{Name: "callback", Type: ParamString, Required: true},
+			},
+			Eval: evalGroupByNode,
+		},
+		{
+			Name:        "highestAverage",
+			Description: "Keeps the n series with the highest average.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+			},
+			Eval: evalHighest,
+		},
+		{
+			Name:        "highestCurrent",
+			Description: "Keeps the n series with the highest last value.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+			},
+			Eval: evalHighest,
+		},
+		{
+			Name:        "highestMax",
+			Description: "Keeps the n series with the highest maximum.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+			},
+			Eval: evalHighest,
+		},
+		{
+			Name:        "hitcount",
+			Description: "Estimates the hit counts per interval from a series of per-second rates.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "intervalString", Type: ParamInterval, Required: true},
+				{Name: "alignToInterval", Type: ParamBool, Default: false},
+			},
+			Eval: evalHitcount,
+		},
+		{
+			Name:        "holtWintersForecast",
+			Description: "Returns the Holt-Winters forecast of each series, using the previous week as bootstrap.",
+			Group:       "Calculate",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalHoltWintersForecast,
+			Lookback:    holtWintersLookback,
+		},
+		{
+			Name:        "integral",
+			Description: "Returns the running total of each series.",
+			Group:       "Transform",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalIntegral,
+		},
+		{
+			Name:        "invert",
+			Description: "Takes the inverse (1/x) of each datapoint.",
+			Group:       "Transform",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalInvert,
+		},
+		{
+			Name:        "isNonNull",
+			Aliases:     []string{"isNotNull"},
+			Description: "Outputs 1 for each non-null datapoint and 0 for each null.",
+			Group:       "Transform",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalIsNonNull,
+		},
+		{
+			Name:        "keepLastValue",
+			Description: "Replaces nulls with the last non-null value, for at most limit consecutive points.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "limit", Type: ParamInt},
+			},
+			Eval: evalKeepLastValue,
+		},
+		{
+			Name:        "kolmogorovSmirnovTest2",
+			Aliases:     []string{"ksTest2"},
+			Description: "Returns the two-sample Kolmogorov-Smirnov statistic of two series over a moving window.",
+			Group:       "Calculate",
+			Params: []Param{
+				{Name: "series1", Type: ParamSeries, Required: true},
+				{Name: "series2", Type: ParamSeries, Required: true},
+				{Name: "windowSize", Type: ParamInt, Required: true},
+			},
+			Eval: evalKSTest2,
+		},
+		{
+			Name:        "limit",
+			Description: "Keeps only the first n series.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+			},
+			Eval: evalLimit,
+		},
+		{
+			Name:        "logarithm",
+			Aliases:     []string{"log"},
+			Description: "Takes the logarithm of each datapoint in the given base.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "base", Type: ParamInt, Default: 10},
+			},
+			Eval: evalLogarithm,
+		},
+		{
+			Name:        "lowestAverage",
+			Description: "Keeps the n series with the lowest average.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+			},
+			Eval: evalLowest,
+		},
+		{
+			Name:        "lowestCurrent",
+			Description: "Keeps the n series with the lowest last value.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+			},
+			Eval: evalLowest,
+		},
+		{
+			Name:        "maximumAbove",
+			Description: "Keeps the series whose maximum is above n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "maximumBelow",
+			Description: "Keeps the series whose maximum is below n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "maxSeries",
+			Description: "Returns the maximum of all series at each point.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalMaxSeries,
+		},
+		{
+			Name:        "minimumAbove",
+			Description: "Keeps the series whose minimum is above n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "minimumBelow",
+			Description: "Keeps the series whose minimum is below n.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalFilterByAggregate,
+		},
+		{
+			Name:        "minSeries",
+			Description: "Returns the minimum of all series at each point.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalMinSeries,
+		},
+		{
+			Name:        "mostDeviant",
+			Description: "Keeps the n series with the highest standard deviation.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+			},
+			Eval: evalMostDeviant,
+		},
+		{
+			Name:        "movingAverage",
+			Description: "Returns the average over a moving window of points or an interval.",
+			Group:       "Calculate",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "windowSize", Type: ParamIntOrInterval, Required: true},
+			},
+			Eval:     evalMovingAverage,
+			Lookback: movingWindowLookback,
+		},
+		{
+			Name:        "movingMedian",
+			Description: "Returns the median over a moving window of points or an interval.",
+			Group:       "Calculate",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "windowSize", Type: ParamIntOrInterval, Required: true},
+			},
+			Eval:     evalMovingMedian,
+			Lookback: movingWindowLookback,
+		},
+		{
+			Name:        "multiplySeries",
+			Description: "Multiplies all series together.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalMultiplySeries,
+		},
+		{
+			Name:        "nonNegativeDerivative",
+			Description: "Returns the derivative of each series, ignoring negative deltas caused by counter wraps or resets.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "maxValue", Type: ParamFloat},
+			},
+			Eval: evalNonNegativeDerivative,
+		},
+		{
+			Name:        "nPercentile",
+			Description: "Returns the nth percentile of each series as a constant series.",
+			Group:       "Calculate",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalNPercentile,
+		},
+		{
+			Name:        "offset",
+			Description: "Adds factor to each datapoint.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "factor", Type: ParamFloat, Required: true},
+			},
+			Eval: evalOffset,
+		},
+		{
+			Name:        "offsetToZero",
+			Description: "Subtracts the minimum value of each series from all of its points.",
+			Group:       "Transform",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalOffsetToZero,
+		},
+		{
+			Name:        "pearson",
+			Description: "Returns the Pearson correlation of two series over a moving window.",
+			Group:       "Calculate",
+			Params: []Param{
+				{Name: "series1", Type: ParamSeries, Required: true},
+				{Name: "series2", Type: ParamSeries, Required: true},
+				{Name: "windowSize", Type: ParamInt, Required: true},
+			},
+			Eval: evalPearson,
+		},
+		{
+			Name:        "pearsonClosest",
+			Description: "Keeps the n series most correlated with the reference series.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "series", Type: ParamSeries, Required: true},
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+				{Name: "direction", Type: ParamString, Default: "abs"},
+			},
+			Eval: evalPearsonClosest,
+		},
+		{
+			Name:        "percentileOfSeries",
+			Description: "Returns the nth percentile of all series at each point.",
+			Group:       "Combine",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+				{Name: "interpolate", Type: ParamBool, Default: false},
+			},
+			Eval: evalPercentileOfSeries,
+		},
+		{
+			Name:        "perSecond",
+			Description: "Returns the per-second rate of change of each series, ignoring negative deltas.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "maxValue", Type: ParamFloat},
+			},
+			Eval: evalPerSecond,
+		},
+		{
+			Name:        "pow",
+			Description: "Raises each datapoint to the power of factor.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "factor", Type: ParamFloat, Required: true},
+			},
+			Eval: evalPow,
+		},
+		{
+			Name:        "randomWalkFunction",
+			Aliases:     []string{"randomWalk"},
+			Description: "Returns a random walk starting at 0.",
+			Group:       "Special",
+			Params:      []Param{{Name: "name", Type: ParamString, Required: true}},
+			Eval:        evalRandomWalk,
+		},
+		{
+			Name:        "rangeOfSeries",
+			Description: "Returns the difference between the maximum and the minimum of all series at each point.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalRangeOfSeries,
+		},
+		{
+			Name:        "removeAbovePercentile",
+			Description: "Removes datapoints above the nth percentile of each series.",
+			Group:       "Filter Data",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalRemoveByValue,
+		},
+		{
+			Name:        "removeAboveValue",
+			Description: "Removes datapoints above n.",
+			Group:       "Filter Data",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalRemoveByValue,
+		},
+		{
+			Name:        "removeBelowPercentile",
+			Description: "Removes datapoints below the nth percentile of each series.",
+			Group:       "Filter Data",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalRemoveByValue,
+		},
+		{
+			Name:        "removeBelowValue",
+			Description: "Removes datapoints below n.",
+			Group:       "Filter Data",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "n", Type: ParamFloat, Required: true},
+			},
+			Eval: evalRemoveByValue,
+		},
+		{
+			Name:        "removeEmptySeries",
+			Description: "Removes the series which have only null values.",
+			Group:       "Filter Series",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalRemoveEmptySeries,
+		},
+		{
+			Name:        "removeZeroSeries",
+			Description: "Removes the series which have only zero or null values.",
+			Group:       "Filter Series",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalRemoveEmptySeries,
+		},
+		{
+			Name:        "scale",
+			Description: "Multiplies each datapoint by factor.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "factor", Type: ParamFloat, Required: true},
+			},
+			Eval: evalScale,
+		},
+		{
+			Name:        "scaleToSeconds",
+			Description: "Scales each datapoint to a per-seconds rate.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "seconds", Type: ParamFloat, Required: true},
+			},
+			Eval: evalScaleToSeconds,
+		},
+		{
+			Name:        "secondYAxis",
+			Description: "Draws each series on the second Y axis.",
+			Group:       "Graph",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalGraphOption,
+		},
+		{
+			Name:        "sortByMaxima",
+			Description: "Sorts the series by their maximum value, descending.",
+			Group:       "Sorting",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalSortByValues,
+		},
+		{
+			Name:        "sortByMinima",
+			Description: "Sorts the series by their minimum value, ascending.",
+			Group:       "Sorting",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalSortByValues,
+		},
+		{
+			Name:        "sortByName",
+			Description: "Sorts the series by name, optionally in natural order.",
+			Group:       "Sorting",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "natural", Type: ParamBool, Default: false},
+			},
+			Eval: evalSortByName,
+		},
+		{
+			Name:        "sortByTotal",
+			Description: "Sorts the series by the sum of their values, descending.",
+			Group:       "Sorting",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalSortByValues,
+		},
+		{
+			Name:        "squareRoot",
+			Description: "Takes the square root of each datapoint.",
+			Group:       "Transform",
+			Params:      []Param{{Name: "seriesList", Type: ParamSeriesList, Required: true}},
+			Eval:        evalSquareRoot,
+		},
+		{
+			Name:        "stacked",
+			Description: "Stacks the series on top of each other.",
+			Group:       "Graph",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "stackname", Type: ParamString, Default: defaultStackName},
+			},
+			Eval: evalStacked,
+		},
+		{
+			Name:        "stdev",
+			Aliases:     []string{"stddev"},
+			Description: "Returns the standard deviation over a moving window of points.",
+			Group:       "Calculate",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "points", Type: ParamInt, Required: true},
+				{Name: "missingThreshold", Type: ParamFloat, Default: 0.1},
+			},
+			Eval: evalStdev,
+		},
+		{
+			Name:        "substr",
+			Description: "Renames each series to the nodes of its name between start and stop.",
+			Group:       "Alias",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "start", Type: ParamNode, Default: 0},
+				{Name: "stop", Type: ParamNode, Default: 0},
+			},
+			Eval: evalSubstr,
+		},
+		{
+			Name:        "summarize",
+			Description: "Aggregates each series into buckets of intervalString using func.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "intervalString", Type: ParamInterval, Required: true},
+				{Name: "func", Type: ParamAggFunc, Default: "sum"},
+				{Name: "alignToFrom", Type: ParamBool, Default: false},
+			},
+			Eval: evalSummarize,
+		},
+		{
+			Name:        "sumSeries",
+			Aliases:     []string{"sum"},
+			Description: "Adds all series together.",
+			Group:       "Combine",
+			Params:      []Param{{Name: "seriesLists", Type: ParamSeriesLists, Required: true, Multiple: true}},
+			Eval:        evalSumSeries,
+		},
+		{
+			Name:        "sumSeriesWithWildcards",
+			Description: "Adds up series which are equal apart from the nodes at the given positions.",
+			Group:       "Combine",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "position", Type: ParamNode, Required: true, Multiple: true},
+			},
+			Eval: evalSumSeriesWithWildcards,
+		},
+		{
+			Name:        "template",
+			Description: "Evaluates seriesList with $1, $2... replaced by the other arguments, and $name by the named ones, unless given for the request.",
+			Group:       "Special",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "values", Type: ParamAny, Multiple: true},
+			},
+			Eval: evalTemplate,
+		},
+		{
+			Name:        "threshold",
+			Description: "Draws a horizontal line at value, with an optional label and color.",
+			Group:       "Special",
+			Params: []Param{
+				{Name: "value", Type: ParamFloat, Required: true},
+				{Name: "label", Type: ParamString},
+				{Name: "color", Type: ParamString},
+			},
+			Eval: evalThreshold,
+		},
+		{
+			Name:        "timeFunction",
+			Aliases:     []string{"time"},
+			Description: "Returns a series whose value at each point is its timestamp.",
+			Group:       "Special",
+			Params: []Param{
+				{Name: "name", Type: ParamString, Required: true},
+				{Name: "step", Type: ParamInt, Default: 60},
+			},
+			Eval: evalTimeFunction,
+		},
+		{
+			Name:        "timeShift",
+			Description: "Draws each series shifted back in time by timeShift.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "timeShift", Type: ParamInterval, Required: true},
+				{Name: "resetEnd", Type: ParamBool, Default: true},
+			},
+			Eval:     evalTimeShift,
+			Lookback: timeShiftLookback,
+		},
+		{
+			Name:        "timeStack",
+			Description: "Draws each series shifted by each multiple of timeShiftUnit from timeShiftStart to timeShiftEnd.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "timeShiftUnit", Type: ParamInterval, Required: true},
+				{Name: "timeShiftStart", Type: ParamInt, Required: true},
+				{Name: "timeShiftEnd", Type: ParamInt, Required: true},
+			},
+			Eval:     evalTimeStack,
+			Lookback: timeStackLookback,
+		},
+		{
+			Name:        "transformNull",
+			Description: "Replaces nulls with default.",
+			Group:       "Transform",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "default", Type: ParamFloat, Default: 0},
+			},
+			Eval: evalTransformNull,
+		},
+		{
+			Name:        "tukeyAbove",
+			Description: "Keeps the n series with the most points above the upper Tukey fence.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "basis", Type: ParamFloat, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+				{Name: "interval", Type: ParamIntOrInterval, Default: 0},
+			},
+			Eval: evalTukey,
+		},
+		{
+			Name:        "tukeyBelow",
+			Description: "Keeps the n series with the most points below the lower Tukey fence.",
+			Group:       "Filter Series",
+			Params: []Param{
+				{Name: "seriesList", Type: ParamSeriesList, Required: true},
+				{Name: "basis", Type: ParamFloat, Required: true},
+				{Name: "n", Type: ParamInt, Required: true},
+				{Name: "interval", Type: ParamIntOrInterval, Default: 0},
+			},
+			Eval: evalTukey,
+		},
+	} {
+		RegisterFunction(f)
+	}
+}
+
+// timeShiftLookback fetches the shifted time range instead of the requested one.
+func timeShiftLookback(e *Expr, r []MetricRequest) []MetricRequest {
+	offs, err := getIntervalArg(e, 1, -1)
+	if err != nil {
+		return nil
+	}
+	for i := range r {
+		r[i].From += offs
+		r[i].Until += offs
+	}
+	return r
+}
+
+// timeStackLookback fetches one shifted time range for each stacked series.
+func timeStackLookback(e *Expr, r []MetricRequest) []MetricRequest {
+	offs, err := getIntervalArg(e, 1, -1)
+	if err != nil {
+		return nil
+	}
+
+	start, err := getIntArg(e, 2)
+	if err != nil {
+		return nil
+	}
+
+	end, err := getIntArg(e, 3)
+	if err != nil {
+		return nil
+	}
+
+	var r2 []MetricRequest
+	for _, v := range r {
+		for i := int64(start); i < int64(end); i++ {
+			r2 = append(r2, MetricRequest{
+				Metric: v.Metric,
+				From:   v.From + (i * offs),
+				Until:  v.Until + (i * offs),
+			})
+		}
+	}
+
+	return r2
+}
+
+func holtWintersLookback(e *Expr, r []MetricRequest) []MetricRequest {
+	for i := range r {
+		r[i].From -= 7 * 86400 // starts -7 days from where the original starts
+	}
+	return r
+}
+
+// movingWindowLookback extends the fetch window back by the window size, if
+// the window was given as an interval.
+func movingWindowLookback(e *Expr, r []MetricRequest) []MetricRequest {
+	if len(e.args) < 2 || e.args[1].etype != etString {
+		return r
+	}
+
+	offs, err := getIntervalArg(e, 1, 1)
+	if err != nil {
+		return nil
+	}
+	for i := range r {
+		r[i].From -= offs
+	}
+	return r
+}
+
+// absolute(seriesList)
+func evalAbsolute(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	return forEachSeriesDo(ctx, e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = math.Abs(v)
+		}
+		return r
+	})
+}
+
+// alias(seriesList, newName)
+func evalAlias(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	alias, err := getStringArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(alias)
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// aliasByMetric(seriesList)
+func evalAliasByMetric(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	return forEachSeriesDo(ctx, e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
+		metric := extractMetric(a.GetName())
+		part := strings.Split(metric, ".")
+		r.Name = proto.String(part[len(part)-1])
+		r.Values = a.Values
+		r.IsAbsent = a.IsAbsent
+		return r
+	})
+}
+
+// aliasByNode(seriesList, *nodes)
+func evalAliasByNode(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := getIntArgs(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range args {
+
+		metric := extractMetric(a.GetName())
+		nodes := strings.Split(metric, ".")
+
+		var name []string
+		for _, f := range fields {
+			if f < 0 {
+				f += len(nodes)
+			}
+			if f >= len(nodes) || f < 0 {
+				continue
+			}
+			name = append(name, nodes[f])
+		}
+
+		r := *a
+		r.Name = proto.String(strings.Join(name, "."))
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+var backref = regexp.MustCompile(`\\(\d+)`)
+
+// aliasSub(seriesList, search, replace)
+func evalAliasSub(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	search, err := getStringArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	replace, err := getStringArg(e, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(search)
+	if err != nil {
+		return nil, err
+	}
+
+	replace = backref.ReplaceAllString(replace, "$${$1}")
+
+	var results []*MetricData
+
+	for _, a := range args {
+		metric := extractMetric(a.GetName())
+
+		r := *a
+		r.Name = proto.String(re.ReplaceAllString(metric, replace))
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+// asPercent(seriesList, total=None)
+func evalAsPercent(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var getTotal func(i int) float64
+	var formatName func(a *MetricData) string
+
+	if len(e.args) == 1 {
+		getTotal = func(i int) float64 {
+			var t float64
+			var atLeastOne bool
+			for _, a := range arg {
+				if a.IsAbsent[i] {
+					continue
+				}
+				atLeastOne = true
+				t += a.Values[i]
+			}
+			if !atLeastOne {
+				t = math.NaN()
+			}
+
+			return t
+		}
+		formatName = func(a *MetricData) string {
+			return fmt.Sprintf("asPercent(%s)", a.GetName())
+		}
+	} else if len(e.args) == 2 && e.args[1].etype == etConst {
+		total, err := getFloatArg(e, 1)
+		if err != nil {
+			return nil, err
+		}
+		getTotal = func(i int) float64 { return total }
+		formatName = func(a *MetricData) string {
+			return fmt.Sprintf("asPercent(%s,%g)", a.GetName(), total)
+		}
+	} else if len(e.args) == 2 && (e.args[1].etype == etName || e.args[1].etype == etFunc) {
+		total, err := getSeriesArg(ctx, e.args[1], from, until, values)
+		if err != nil {
+			return nil, err
+		}
+		if len(total) != 1 {
+			return nil, ErrWildcardNotAllowed
+		}
+		getTotal = func(i int) float64 {
+			if total[0].IsAbsent[i] {
+				return math.NaN()
+			}
+			return total[0].Values[i]
+		}
+		var totalString string
+		if e.args[1].etype == etName {
+			totalString = e.args[1].target
+		} else {
+			totalString = fmt.Sprintf("%s(%s)", e.args[1].target, e.args[1].argString)
+		}
+		formatName = func(a *MetricData) string {
+			return fmt.Sprintf("asPercent(%s,%s)", a.GetName(), totalString)
+		}
+	} else {
+		return nil, errors.New("total must be either a constant or a series")
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(formatName(a))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+		results = append(results, &r)
+	}
+
+	for i := range results[0].Values {
+
+		total := getTotal(i)
+
+		for j := range results {
+			r := results[j]
+			a := arg[j]
+
+			if a.IsAbsent[i] || math.IsNaN(total) || total == 0 {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+
+			r.Values[i] = (a.Values[i] / total) * 100
+		}
+	}
+	return results, nil
+}
+
+// averageSeries(*seriesLists)
+func evalAverageSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArgs(ctx, e.args, from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	e.target = "averageSeries"
+	return aggregateSeries(e, args, func(values []float64) float64 {
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum / float64(len(values))
+	})
+}
+
+// averageSeriesWithWildcards(seriesLIst, *position)
+func evalAverageSeriesWithWildcards(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	/* TODO(dgryski): make sure the arrays are all the same 'size'
+	   (duplicated from sumSeriesWithWildcards because of similar logic but aggregation) */
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := getIntArgs(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	nodeList := []string{}
+	groups := make(map[string][]*MetricData)
+
+	for _, a := range args {
+		metric := extractMetric(a.GetName())
+		nodes := strings.Split(metric, ".")
+		var s []string
+		// Yes, this is O(n^2), but len(nodes) < 10 and len(fields) < 3
+		// Iterating an int slice is faster than a map for n ~ 30
+		// http://www.antoine.im/posts/someone_is_wrong_on_the_internet
+		for i, n := range nodes {
+			if !contains(fields, i) {
+				s = append(s, n)
+			}
+		}
+
+		node := strings.Join(s, ".")
+
+		if len(groups[node]) == 0 {
+			nodeList = append(nodeList, node)
+		}
+
+		groups[node] = append(groups[node], a)
+	}
+
+	for _, series := range nodeList {
+		args := groups[series]
+		r := *args[0]
+		r.Name = proto.String(fmt.Sprintf("averageSeriesWithWildcards(%s)", series))
+		r.Values = make([]float64, len(args[0].Values))
+		r.IsAbsent = make([]bool, len(args[0].Values))
+
+		length := make([]float64, len(args[0].Values))
+		atLeastOne := make([]bool, len(args[0].Values))
+		for _, arg := range args {
+			for i, v := range arg.Values {
+				if arg.IsAbsent[i] {
+					continue
+				}
+				atLeastOne[i] = true
+				length[i]++
+				r.Values[i] += v
+			}
+		}
+
+		for i, v := range atLeastOne {
+			if v {
+				r.Values[i] = r.Values[i] / length[i]
+			} else {
+				r.IsAbsent[i] = true
+			}
+		}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// averageAbove(seriesList, n), averageBelow(seriesList, n), currentAbove(seriesList, n), currentBelow(seriesList, n), maximumAbove(seriesList, n), maximumBelow(seriesList, n), minimumAbove(seriesList, n), minimumBelow
+func evalFilterByAggregate(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	isAbove := strings.HasSuffix(e.target, "Above")
+	isInclusive := true
+	var compute func([]float64, []bool) float64
+	switch {
+	case strings.HasPrefix(e.target, "average"):
+		compute = avgValue
+	case strings.HasPrefix(e.target, "current"):
+		compute = currentValue
+	case strings.HasPrefix(e.target, "maximum"):
+		compute = maxValue
+		isInclusive = false
+	case strings.HasPrefix(e.target, "minimum"):
+		compute = minValue
+		isInclusive = false
+	}
+	var results []*MetricData
+	for _, a := range args {
+		value := compute(a.Values, a.IsAbsent)
+		if isAbove {
+			if isInclusive {
+				if value >= n {
+					results = append(results, a)
+				}
+			} else {
+				if value > n {
+					results = append(results, a)
+				}
+			}
+		} else {
+			if value <= n {
+				results = append(results, a)
+			}
+		}
+	}
+
+	return results, err
+}
+
+// derivative(seriesList)
+func evalDerivative(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	return forEachSeriesDo(ctx, e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
+		prev := a.Values[0]
+		for i, v := range a.Values {
+			if i == 0 || a.IsAbsent[i] {
+				r.IsAbsent[i] = true
+				continue
+			}
+
+			r.Values[i] = v - prev
+			prev = v
+		}
+		return r
+	})
+}
+
+// countSeries(seriesList)
+func evalCountSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// TODO(civil): Check that series have equal length
+	args, err := getSeriesArgs(ctx, e.args, from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	r := *args[0]
+	r.Name = proto.String(fmt.Sprintf("countSeries(%s)", e.argString))
+	r.Values = make([]float64, len(args[0].Values))
+	r.IsAbsent = make([]bool, len(args[0].Values))
+	count := float64(len(args))
+
+	for i := range args[0].Values {
+		r.Values[i] = count
+	}
+
+	return []*MetricData{&r}, nil
+}
+
+// diffSeries(*seriesLists)
+func evalDiffSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	minuend, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	subtrahends, err := getSeriesArgs(ctx, e.args[1:], from, until, values)
+	if err != nil {
+		if len(minuend) < 2 {
+			return nil, err
+		}
+		subtrahends = minuend[1:]
+		err = nil
+	}
+
+	// FIXME: need more error checking on minuend, subtrahends here
+	r := *minuend[0]
+	r.Name = proto.String(fmt.Sprintf("diffSeries(%s)", e.argString))
+	r.Values = make([]float64, len(minuend[0].Values))
+	r.IsAbsent = make([]bool, len(minuend[0].Values))
+
+	for i, v := range minuend[0].Values {
+
+		if minuend[0].IsAbsent[i] {
+			r.IsAbsent[i] = true
+			continue
+		}
+
+		var sub float64
+		for _, s := range subtrahends {
+			if s.IsAbsent[i] {
+				continue
+			}
+			sub += s.Values[i]
+		}
+
+		r.Values[i] = v - sub
+	}
+	return []*MetricData{&r}, err
+}
+
+// rangeOfSeries(*seriesLists)
+func evalRangeOfSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	series, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	r := *series[0]
+	r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, e.argString))
+	r.Values = make([]float64, len(series[0].Values))
+	r.IsAbsent = make([]bool, len(series[0].Values))
+
+	for i := range series[0].Values {
+		var min, max float64
+		count := 0
+		for _, s := range series {
+			if s.IsAbsent[i] {
+				continue
+			}
+
+			if count == 0 {
+				min = s.Values[i]
+				max = s.Values[i]
+			} else {
+				min = math.Min(min, s.Values[i])
+				max = math.Max(max, s.Values[i])
+			}
+
+			count++
+		}
+
+		if count >= 2 {
+			r.Values[i] = max - min
+		} else {
+			r.IsAbsent[i] = true
+		}
+	}
+	return []*MetricData{&r}, err
+}
+
+// divideSeries(dividendSeriesList, divisorSeriesList)
+func evalDivideSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	if len(e.args) < 1 {
+		return nil, ErrMissingTimeseries
+	}
+
+	numerators, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var numerator, denominator *MetricData
+	if len(numerators) == 1 && len(e.args) == 2 {
+		numerator = numerators[0]
+		denominators, err := getSeriesArg(ctx, e.args[1], from, until, values)
+		if err != nil {
+			return nil, err
+		}
+		if len(denominators) != 1 {
+			return nil, ErrWildcardNotAllowed
+		}
+
+		denominator = denominators[0]
+	} else if len(numerators) == 2 && len(e.args) == 1 {
+		numerator = numerators[0]
+		denominator = numerators[1]
+	} else {
+		return nil, errors.New("must be called with 2 series or a wildcard that matches exactly 2 series")
+	}
+
+	if numerator.GetStepTime() != denominator.GetStepTime() || len(numerator.Values) != len(denominator.Values) {
+		return nil, errors.New("series must have the same length")
+	}
+
+	r := *numerator
+	r.Name = proto.String(fmt.Sprintf("divideSeries(%s)", e.argString))
+	r.Values = make([]float64, len(numerator.Values))
+	r.IsAbsent = make([]bool, len(numerator.Values))
+
+	for i, v := range numerator.Values {
+
+		if numerator.IsAbsent[i] || denominator.IsAbsent[i] || denominator.Values[i] == 0 {
+			r.IsAbsent[i] = true
+			continue
+		}
+
+		r.Values[i] = v / denominator.Values[i]
+	}
+	return []*MetricData{&r}, nil
+}
+
+// multiplySeries(factorsSeriesList)
+func evalMultiplySeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	r := MetricData{
+		FetchResponse: pb.FetchResponse{
+			Name:      proto.String(fmt.Sprintf("multiplySeries(%s)", e.argString)),
+			StartTime: proto.Int32(ClampInt32(from)),
+			StopTime:  proto.Int32(ClampInt32(until)),
+		},
+	}
+	for _, arg := range e.args {
+		series, err := getSeriesArg(ctx, arg, from, until, values)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Values == nil {
+			r.IsAbsent = make([]bool, len(series[0].IsAbsent))
+			r.StepTime = series[0].StepTime
+			r.Values = make([]float64, len(series[0].Values))
+			copy(r.IsAbsent, series[0].IsAbsent)
+			copy(r.Values, series[0].Values)
+			series = series[1:]
+		}
+
+		for _, factor := range series {
+			for i, v := range r.Values {
+				if r.IsAbsent[i] || factor.IsAbsent[i] {
+					r.IsAbsent[i] = true
+					r.Values[i] = math.NaN()
+					continue
+				}
+
+				r.Values[i] = v * factor.Values[i]
+			}
+		}
+	}
+
+	return []*MetricData{&r}, nil
+}
+
+// ewma(seriesList, alpha)
+func evalEWMA(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	alpha, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	e.target = "ewma"
+
+	// ugh, forEachSeriesDo does not handle arguments properly
+	var results []*MetricData
+	for _, a := range arg {
+		name := fmt.Sprintf("ewma(%s,%v)", a.GetName(), alpha)
+
+		r := *a
+		r.Name = proto.String(name)
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		ewma := onlinestats.NewExpWeight(alpha)
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.IsAbsent[i] = true
+				continue
+			}
+
+			ewma.Push(v)
+			r.Values[i] = ewma.Mean()
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// exclude(seriesList, pattern)
+func evalExclude(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	pat, err := getStringArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	patre, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		if !patre.MatchString(a.GetName()) {
+			results = append(results, a)
+		}
+	}
+
+	return results, nil
+}
+
+// grep(seriesList, pattern)
+func evalGrep(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	pat, err := getStringArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	patre, err := regexp.Compile(pat)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		if patre.MatchString(a.GetName()) {
+			results = append(results, a)
+		}
+	}
+
+	return results, nil
+}
+
+// group(*seriesLists)
+func evalGroup(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArgs(ctx, e.args, from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+// substitute returns a copy of e with the replacements of r made in its
+// names, strings and argument lists
+func (e *Expr) substitute(r *strings.Replacer) *Expr {
+	c := *e
+	if e.etype != etFunc {
+		c.target = r.Replace(e.target)
+	}
+	c.valStr = r.Replace(e.valStr)
+	c.argString = r.Replace(e.argString)
+
+	if e.args != nil {
+		c.args = make([]*Expr, len(e.args))
+		for i, a := range e.args {
+			c.args[i] = a.substitute(r)
+		}
+	}
+
+	if e.namedArgs != nil {
+		c.namedArgs = make(map[string]*Expr, len(e.namedArgs))
+		for k, a := range e.namedArgs {
+			c.namedArgs[k] = a.substitute(r)
+		}
+	}
+
+	return &c
+}
+
+// groupByNode(seriesList, nodeNum, callback), applyByNode(seriesList, nodeNum, templateFunction)
+func evalGroupByNode(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	field, err := getIntArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	callback, err := getStringArg(e, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	var template *Expr
+	if e.target == "applyByNode" {
+		template, _, err = ParseExpr(callback)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var results []*MetricData
+
+	groups := make(map[string][]*MetricData)
+	nodeList := []string{}
+
+	for _, a := range args {
+
+		metric := extractMetric(a.GetName())
+		nodes := strings.Split(metric, ".")
+		node := nodes[field]
+		if e.target == "applyByNode" {
+			node = strings.Join(nodes[0:field+1], ".")
+		}
+
+		if len(groups[node]) == 0 {
+			nodeList = append(nodeList, node)
+		}
+
+		groups[node] = append(groups[node], a)
+	}
+
+	for _, k := range nodeList {
+		k := k // k's reference is used later, so it's important to make it unique per loop
+		v := groups[k]
+
+		// callback(k), with k a name even if it looks like a number
+		nexpr := &Expr{target: callback, etype: etFunc, args: []*Expr{{target: k}}, argString: k}
+		if e.target == "applyByNode" {
+			nexpr = template.substitute(strings.NewReplacer("%", k))
+		}
+
+		nvalues := values
+		if e.target == "groupByNode" {
+			nvalues = map[MetricRequest][]*MetricData{
+				MetricRequest{k, from, until}: v,
+			}
+		}
+
+		r, _ := EvalExpr(ctx, nexpr, from, until, nvalues)
+		if r != nil {
+			r[0].Name = &k
+			results = append(results, r...)
+		}
+	}
+
+	return results, nil
+}
+
+// isNonNull(seriesList), isNotNull(seriesList)
+func evalIsNonNull(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	e.target = "isNonNull"
+
+	return forEachSeriesDo(ctx, e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
+		for i := range a.Values {
+			r.IsAbsent[i] = false
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+			} else {
+				r.Values[i] = 1
+			}
+
+		}
+		return r
+	})
+}
+
+// lowestAverage(seriesList, n) , lowestCurrent(seriesList, n)
+func evalLowest(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	n, err := getIntArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+	var results []*MetricData
+
+	// we have fewer arguments than we want result series
+	if len(arg) < n {
+		return arg, nil
+	}
+
+	var mh metricHeap
+
+	var compute func([]float64, []bool) float64
+
+	switch e.target {
+	case "lowestAverage":
+		compute = avgValue
+	case "lowestCurrent":
+		compute = currentValue
+	}
+
+	for i, a := range arg {
+		m := compute(a.Values, a.IsAbsent)
+		heap.Push(&mh, metricHeapElement{idx: i, val: m})
+	}
+
+	results = make([]*MetricData, n)
+
+	// results should be ordered ascending
+	for i := 0; i < n; i++ {
+		v := heap.Pop(&mh).(metricHeapElement)
+		results[i] = arg[v.idx]
+	}
+
+	return results, nil
+}
+
+// highestAverage(seriesList, n) , highestCurrent(seriesList, n), highestMax(seriesList, n)
+func evalHighest(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	n, err := getIntArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+	var results []*MetricData
+
+	// we have fewer arguments than we want result series
+	if len(arg) < n {
+		return arg, nil
+	}
+
+	var mh metricHeap
+
+	var compute func([]float64, []bool) float64
+
+	switch e.target {
+	case "highestMax":
+		compute = maxValue
+	case "highestAverage":
+		compute = avgValue
+	case "highestCurrent":
+		compute = currentValue
+	}
+
+	for i, a := range arg {
+		m := compute(a.Values, a.IsAbsent)
+		if math.IsNaN(m) {
+			continue
+		}
+
+		if len(mh) < n {
+			heap.Push(&mh, metricHeapElement{idx: i, val: m})
+			continue
+		}
+		// m is bigger than smallest max found so far
+		if mh[0].val < m {
+			mh[0].val = m
+			mh[0].idx = i
+			heap.Fix(&mh, 0)
+		}
+	}
+
+	results = make([]*MetricData, len(mh))
+
+	// results should be ordered ascending
+	for len(mh) > 0 {
+		v := heap.Pop(&mh).(metricHeapElement)
+		results[len(mh)] = arg[v.idx]
+	}
+
+	return results, nil
+}
+
+// hitcount(seriesList, intervalString, alignToInterval=False)
+func evalHitcount(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// TODO(dgryski): make sure the arrays are all the same 'size'
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketSize, err := getIntervalArg(e, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	alignToInterval, err := getBoolNamedOrPosArgDefault(e, "alignToInterval", 2, false)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := e.namedArgs["alignToInterval"]
+	if !ok {
+		ok = len(e.args) > 2
+	}
+
+	start := int64(args[0].GetStartTime())
+	stop := int64(args[0].GetStopTime())
+	if alignToInterval {
+		start = alignStartToInterval(start, stop, bucketSize)
+	}
+
+	buckets := getBuckets(start, stop, bucketSize)
+	results := make([]*MetricData, 0, len(args))
+	for _, arg := range args {
+
+		name := fmt.Sprintf("hitcount(%s,'%s'", arg.GetName(), e.args[1].valStr)
+		if ok {
+			name += fmt.Sprintf(",%v", alignToInterval)
+		}
+		name += ")"
+
+		r := MetricData{FetchResponse: pb.FetchResponse{
+			Name:      proto.String(name),
+			Values:    make([]float64, buckets, buckets+1),
+			IsAbsent:  make([]bool, buckets, buckets+1),
+			StepTime:  proto.Int32(ClampInt32(bucketSize)),
+			StartTime: proto.Int32(ClampInt32(start)),
+			StopTime:  proto.Int32(ClampInt32(stop)),
+		}}
+
+		bucketEnd := start + bucketSize
+		t := int64(arg.GetStartTime())
+		ridx := 0
+		var count float64
+		bucketItems := 0
+		for i, v := range arg.Values {
+			bucketItems++
+			if !arg.IsAbsent[i] {
+				if math.IsNaN(count) {
+					count = 0
+				}
+
+				count += v * float64(arg.GetStepTime())
+			}
+
+			t += int64(arg.GetStepTime())
+
+			if t >= stop {
+				break
+			}
+
+			if t >= bucketEnd {
+				if math.IsNaN(count) {
+					r.Values[ridx] = 0
+					r.IsAbsent[ridx] = true
+				} else {
+					r.Values[ridx] = count
+				}
+
+				ridx++
+				bucketEnd += bucketSize
+				count = math.NaN()
+				bucketItems = 0
+			}
+		}
+
+		// remaining values
+		if bucketItems > 0 {
+			if math.IsNaN(count) {
+				r.Values[ridx] = 0
+				r.IsAbsent[ridx] = true
+			} else {
+				r.Values[ridx] = count
+			}
+		}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// integral(seriesList)
+func evalIntegral(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	return forEachSeriesDo(ctx, e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
+		current := 0.0
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			current += v
+			r.Values[i] = current
+		}
+		return r
+	})
+}
+
+// invert(seriesList)
+func evalInvert(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	return forEachSeriesDo(ctx, e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
+		for i, v := range a.Values {
+			if a.IsAbsent[i] || v == 0 {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = 1 / v
+		}
+		return r
+	})
+}
+
+// keepLastValue(seriesList, limit=inf)
+func evalKeepLastValue(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	keep, err := getIntNamedOrPosArgDefault(e, "limit", 1, -1)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := e.namedArgs["limit"]
+	if !ok {
+		ok = len(e.args) > 1
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		var name string
+		if ok {
+			name = fmt.Sprintf("keepLastValue(%s,%d)", a.GetName(), keep)
+		} else {
+			name = fmt.Sprintf("keepLastValue(%s)", a.GetName())
+		}
+
+		r := *a
+		r.Name = proto.String(name)
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		prev := math.NaN()
+		missing := 0
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+
+				if (keep < 0 || missing < keep) && !math.IsNaN(prev) {
+					r.Values[i] = prev
+					missing++
+				} else {
+					r.IsAbsent[i] = true
+				}
+
+				continue
+			}
+			missing = 0
+			prev = v
+			r.Values[i] = v
+		}
+		results = append(results, &r)
+	}
+	return results, err
+}
+
+// changed(SeriesList)
+func evalChanged(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*MetricData
+	for _, a := range args {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, a.GetName()))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		prev := math.NaN()
+		for i, v := range a.Values {
+			if math.IsNaN(prev) {
+				prev = v
+				r.Values[i] = 0
+			} else if !math.IsNaN(v) && prev != v {
+				r.Values[i] = 1
+				prev = v
+			} else {
+				r.Values[i] = 0
+			}
+		}
+		result = append(result, &r)
+	}
+	return result, nil
+}
+
+// ksTest2(series, series, points|"interval")
+func evalKSTest2(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg1, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	arg2, err := getSeriesArg(ctx, e.args[1], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arg1) != 1 || len(arg2) != 1 {
+		return nil, ErrWildcardNotAllowed
+	}
+
+	a1 := arg1[0]
+	a2 := arg2[0]
+
+	windowSize, err := getIntArg(e, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	w1 := &windowed{data: make([]float64, windowSize)}
+	w2 := &windowed{data: make([]float64, windowSize)}
+
+	r := *a1
+	r.Name = proto.String(fmt.Sprintf("kolmogorovSmirnovTest2(%s,%s,%d)", a1.GetName(), a2.GetName(), windowSize))
+	r.Values = make([]float64, len(a1.Values))
+	r.IsAbsent = make([]bool, len(a1.Values))
+	r.StartTime = proto.Int32(ClampInt32(from))
+	r.StopTime = proto.Int32(ClampInt32(until))
+
+	d1 := make([]float64, windowSize)
+	d2 := make([]float64, windowSize)
+
+	for i, v1 := range a1.Values {
+		v2 := a2.Values[i]
+		if a1.IsAbsent[i] || a2.IsAbsent[i] {
+			// make sure missing values are ignored
+			v1 = math.NaN()
+			v2 = math.NaN()
+		}
+		w1.Push(v1)
+		w2.Push(v2)
+
+		if i >= windowSize {
+			// need a copy here because KS is destructive
+			copy(d1, w1.data)
+			copy(d2, w2.data)
+			r.Values[i] = onlinestats.KS(d1, d2)
+		} else {
+			r.Values[i] = 0
+			r.IsAbsent[i] = true
+		}
+	}
+	return []*MetricData{&r}, nil
+}
+
+// limit(seriesList, n)
+func evalLimit(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := getIntArg(e, 1) // get limit
+	if err != nil {
+		return nil, err
+	}
+
+	if limit >= len(arg) {
+		return arg, nil
+	}
+
+	return arg[:limit], nil
+}
+
+// logarithm(seriesList, base=10)
+func evalLogarithm(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	base, err := getIntNamedOrPosArgDefault(e, "base", 1, 10)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := e.namedArgs["base"]
+	if !ok {
+		ok = len(e.args) > 1
+	}
+
+	baseLog := math.Log(float64(base))
+
+	var results []*MetricData
+
+	for _, a := range arg {
+
+		var name string
+		if ok {
+			name = fmt.Sprintf("logarithm(%s,%d)", a.GetName(), base)
+		} else {
+			name = fmt.Sprintf("logarithm(%s)", a.GetName())
+		}
+
+		r := *a
+		r.Name = proto.String(name)
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = math.Log(v) / baseLog
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// maxSeries(*seriesLists)
+func evalMaxSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArgs(ctx, e.args, from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregateSeries(e, args, func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, value := range values {
+			if value > max {
+				max = value
+			}
+		}
+		return max
+	})
+}
+
+// minSeries(*seriesLists)
+func evalMinSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArgs(ctx, e.args, from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregateSeries(e, args, func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, value := range values {
+			if value < min {
+				min = value
+			}
+		}
+		return min
+	})
+}
+
+// mostDeviant(seriesList, n) -or- mostDeviant(n, seriesList)
+func evalMostDeviant(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	var nArg int
+	if e.args[0].etype != etConst {
+		// mostDeviant(seriesList, n)
+		nArg = 1
+	}
+	seriesArg := nArg ^ 1 // XOR to make seriesArg the opposite argument. ( 0^1 -> 1 ; 1^1 -> 0 )
+
+	n, err := getIntArg(e, nArg)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := getSeriesArg(ctx, e.args[seriesArg], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var mh metricHeap
+
+	for index, arg := range args {
+		variance := varianceValue(arg.Values, arg.IsAbsent)
+		if math.IsNaN(variance) {
+			continue
+		}
+
+		if len(mh) < n {
+			heap.Push(&mh, metricHeapElement{idx: index, val: variance})
+			continue
+		}
+
+		if variance > mh[0].val {
+			mh[0].idx = index
+			mh[0].val = variance
+			heap.Fix(&mh, 0)
+		}
+	}
+
+	results := make([]*MetricData, len(mh))
+
+	for len(mh) > 0 {
+		v := heap.Pop(&mh).(metricHeapElement)
+		results[len(mh)] = args[v.idx]
+	}
+
+	return results, err
+}
+
+// movingAverage(seriesList, windowSize)
+func evalMovingAverage(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	var n int
+	var err error
+
+	var scaleByStep bool
+
+	var argstr string
+
+	switch e.args[1].etype {
+	case etConst:
+		n, err = getIntArg(e, 1)
+		argstr = strconv.Itoa(n)
+	case etString:
+		var n64 int64
+		n64, err = getIntervalArg(e, 1, 1)
+		argstr = fmt.Sprintf("%q", e.args[1].valStr)
+		n = int(n64)
+		scaleByStep = true
+	default:
+		err = ErrBadType
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	windowSize := n
+
+	start := from
+	if scaleByStep {
+		start -= int64(n)
+	}
+
+	arg, err := getSeriesArg(ctx, e.args[0], start, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int
+
+	if scaleByStep {
+		windowSize /= int(arg[0].GetStepTime())
+		offset = windowSize
+	}
+
+	var result []*MetricData
+
+	for _, a := range arg {
+		w := &windowed{data: make([]float64, windowSize)}
+
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("movingAverage(%s,%s)", a.GetName(), argstr))
+		r.Values = make([]float64, len(a.Values)-offset)
+		r.IsAbsent = make([]bool, len(a.Values)-offset)
+		r.StartTime = proto.Int32(ClampInt32(from))
+		r.StopTime = proto.Int32(ClampInt32(until))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				// make sure missing values are ignored
+				v = math.NaN()
+			}
+
+			if ridx := i - offset; ridx >= 0 {
+				r.Values[ridx] = w.Mean()
+				if i < windowSize || math.IsNaN(r.Values[ridx]) {
+					r.Values[ridx] = 0
+					r.IsAbsent[ridx] = true
+				}
+			}
+			w.Push(v)
+		}
+		result = append(result, &r)
+	}
+	return result, nil
+}
+
+// movingMedian(seriesList, windowSize)
+func evalMovingMedian(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	var n int
+	var err error
+
+	var scaleByStep bool
+
+	var argstr string
+
+	switch e.args[1].etype {
+	case etConst:
+		n, err = getIntArg(e, 1)
+		argstr = strconv.Itoa(n)
+	case etString:
+		var n64 int64
+		n64, err = getIntervalArg(e, 1, 1)
+		n = int(n64)
+		argstr = fmt.Sprintf("%q", e.args[1].valStr)
+		scaleByStep = true
+	default:
+		err = ErrBadType
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	windowSize := n
+
+	start := from
+	if scaleByStep {
+		start -= int64(n)
+	}
+
+	arg, err := getSeriesArg(ctx, e.args[0], start, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int = 0
+
+	if scaleByStep {
+		windowSize /= int(arg[0].GetStepTime())
+		offset = windowSize
+	}
+
+	var result []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("movingMedian(%s,%s)", a.GetName(), argstr))
+		r.Values = make([]float64, len(a.Values)-offset)
+		r.IsAbsent = make([]bool, len(a.Values)-offset)
+		r.StartTime = proto.Int32(ClampInt32(from))
+		r.StopTime = proto.Int32(ClampInt32(until))
+
+		data := movingmedian.NewMovingMedian(windowSize)
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				data.Push(math.NaN())
+			} else {
+				data.Push(v)
+			}
+			if ridx := i - offset; ridx >= 0 {
+				r.Values[ridx] = math.NaN()
+				if i >= (windowSize - 1) {
+					r.Values[ridx] = data.Median()
+				}
+				if math.IsNaN(r.Values[ridx]) {
+					r.IsAbsent[ridx] = true
+				}
+			}
+		}
+		result = append(result, &r)
+	}
+	return result, nil
+}
+
+// nonNegativeDerivative(seriesList, maxValue=None)
+func evalNonNegativeDerivative(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	maxValue, err := getFloatNamedOrPosArgDefault(e, "maxValue", 1, math.NaN())
+	if err != nil {
+		return nil, err
+	}
+	_, ok := e.namedArgs["maxValue"]
+	if !ok {
+		ok = len(e.args) > 1
+	}
+
+	var result []*MetricData
+	for _, a := range args {
+		var name string
+		if ok {
+			name = fmt.Sprintf("nonNegativeDerivative(%s,%g)", a.GetName(), maxValue)
+		} else {
+			name = fmt.Sprintf("nonNegativeDerivative(%s)", a.GetName())
+		}
+
+		r := *a
+		r.Name = proto.String(name)
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		prev := a.Values[0]
+		for i, v := range a.Values {
+			if i == 0 || a.IsAbsent[i] || a.IsAbsent[i-1] {
+				r.IsAbsent[i] = true
+				prev = v
+				continue
+			}
+			diff := v - prev
+			if diff >= 0 {
+				r.Values[i] = diff
+			} else if !math.IsNaN(maxValue) && maxValue >= v {
+				r.Values[i] = ((maxValue - prev) + v + 1)
+			} else {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+			}
+			prev = v
+		}
+		result = append(result, &r)
+	}
+	return result, nil
+}
+
+// perSecond(seriesList, maxValue=None)
+func evalPerSecond(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	maxValue, err := getFloatArgDefault(e, 1, math.NaN())
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*MetricData
+	for _, a := range args {
+		r := *a
+		if len(e.args) == 1 {
+			r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, a.GetName()))
+		} else {
+			r.Name = proto.String(fmt.Sprintf("%s(%s,%g)", e.target, a.GetName(), maxValue))
+		}
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		prev := a.Values[0]
+		for i, v := range a.Values {
+			if i == 0 || a.IsAbsent[i] || a.IsAbsent[i-1] {
+				r.IsAbsent[i] = true
+				prev = v
+				continue
+			}
+			diff := v - prev
+			if diff >= 0 {
+				r.Values[i] = diff / float64(a.GetStepTime())
+			} else if !math.IsNaN(maxValue) && maxValue >= v {
+				r.Values[i] = ((maxValue - prev) + v + 1/float64(a.GetStepTime()))
+			} else {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+			}
+			prev = v
+		}
+		result = append(result, &r)
+	}
+	return result, nil
+}
+
+// nPercentile(seriesList, n)
+func evalNPercentile(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	percent, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("nPercentile(%s,%g)", a.GetName(), percent))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		var values []float64
+		for i, v := range a.IsAbsent {
+			if !v {
+				values = append(values, a.Values[i])
+			}
+		}
+
+		value := percentile(values, percent, true)
+		for i := range r.Values {
+			r.Values[i] = value
+		}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// pearson(series, series, windowSize)
+func evalPearson(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg1, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	arg2, err := getSeriesArg(ctx, e.args[1], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arg1) != 1 || len(arg2) != 1 {
+		return nil, ErrWildcardNotAllowed
+	}
+
+	a1 := arg1[0]
+	a2 := arg2[0]
+
+	windowSize, err := getIntArg(e, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	w1 := &windowed{data: make([]float64, windowSize)}
+	w2 := &windowed{data: make([]float64, windowSize)}
+
+	r := *a1
+	r.Name = proto.String(fmt.Sprintf("pearson(%s,%s,%d)", a1.GetName(), a2.GetName(), windowSize))
+	r.Values = make([]float64, len(a1.Values))
+	r.IsAbsent = make([]bool, len(a1.Values))
+	r.StartTime = proto.Int32(ClampInt32(from))
+	r.StopTime = proto.Int32(ClampInt32(until))
+
+	for i, v1 := range a1.Values {
+		v2 := a2.Values[i]
+		if a1.IsAbsent[i] || a2.IsAbsent[i] {
+			// ignore if either is missing
+			v1 = math.NaN()
+			v2 = math.NaN()
+		}
+		w1.Push(v1)
+		w2.Push(v2)
+		if i >= windowSize-1 {
+			r.Values[i] = onlinestats.Pearson(w1.data, w2.data)
+		} else {
+			r.Values[i] = 0
+			r.IsAbsent[i] = true
+		}
+	}
+
+	return []*MetricData{&r}, nil
+}
+
+// pearsonClosest(series, seriesList, n, direction=abs)
+func evalPearsonClosest(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	if len(e.args) > 3 {
+		return nil, ErrTooManyArguments
+	}
+
+	ref, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	if len(ref) != 1 {
+		// TODO(nnuss) error("First argument must be single reference series")
+		return nil, ErrWildcardNotAllowed
+	}
+
+	compare, err := getSeriesArg(ctx, e.args[1], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getIntArg(e, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	direction, err := getStringNamedOrPosArgDefault(e, "direction", 3, "abs")
+	if err != nil {
+		return nil, err
+	}
+	if direction != "pos" && direction != "neg" && direction != "abs" {
+		return nil, errors.New("direction must be one of: pos, neg, abs")
+	}
+
+	// NOTE: if direction == "abs" && len(compare) <= n : we'll still do the work to rank them
+
+	refValues := make([]float64, len(ref[0].Values))
+	copy(refValues, ref[0].Values)
+	for i, v := range ref[0].IsAbsent {
+		if v {
+			refValues[i] = math.NaN()
+		}
+	}
+
+	var mh metricHeap
+
+	for index, a := range compare {
+		compareValues := make([]float64, len(a.Values))
+		copy(compareValues, a.Values)
+		if len(refValues) != len(compareValues) {
+			// Pearson will panic if arrays are not equal length; skip
+			continue
+		}
+		for i, v := range a.IsAbsent {
+			if v {
+				compareValues[i] = math.NaN()
+			}
+		}
+		value := onlinestats.Pearson(refValues, compareValues)
+		// Standardize the value so sort ASC will have strongest correlation first
+		switch {
+		case math.IsNaN(value):
+			// special case of at least one series containing all zeros which leads to div-by-zero in Pearson
+			continue
+		case direction == "abs":
+			value = math.Abs(value) * -1
+		case direction == "pos" && value >= 0:
+			value = value * -1
+		case direction == "neg" && value <= 0:
+		default:
+			continue
+		}
+		heap.Push(&mh, metricHeapElement{idx: index, val: value})
+	}
+
+	if n > len(mh) {
+		n = len(mh)
+	}
+	results := make([]*MetricData, n)
+	for i := range results {
+		v := heap.Pop(&mh).(metricHeapElement)
+		results[i] = compare[v.idx]
+	}
+
+	return results, nil
+}
+
+// offset(seriesList,factor)
+func evalOffset(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	factor, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("offset(%s,%g)", a.GetName(), factor))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = v + factor
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// offsetToZero(seriesList)
+func evalOffsetToZero(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	return forEachSeriesDo(ctx, e, from, until, values, func(a *MetricData, r *MetricData) *MetricData {
+		minimum := math.Inf(1)
+		for i, v := range a.Values {
+			if !a.IsAbsent[i] && v < minimum {
+				minimum = v
+			}
+		}
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = v - minimum
+		}
+		return r
+	})
+}
+
+// scale(seriesList, factor)
+func evalScale(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	scale, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("scale(%s,%g)", a.GetName(), scale))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = v * scale
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// scaleToSeconds(seriesList, seconds)
+func evalScaleToSeconds(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	seconds, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("scaleToSeconds(%s,%d)", a.GetName(), int(seconds)))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		factor := seconds / float64(a.GetStepTime())
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = v * factor
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// pow(seriesList,factor)
+func evalPow(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	factor, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("pow(%s,%g)", a.GetName(), factor))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = math.Pow(v, factor)
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// sortByMaxima(seriesList), sortByMinima(seriesList), sortByTotal(seriesList)
+func evalSortByValues(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	original, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	arg := make([]*MetricData, len(original))
+	copy(arg, original)
+	vals := make([]float64, len(arg))
+
+	for i, a := range arg {
+		switch e.target {
+		case "sortByTotal":
+			vals[i] = summarizeValues("sum", a.GetValues())
+		case "sortByMaxima":
+			vals[i] = summarizeValues("max", a.GetValues())
+		case "sortByMinima":
+			vals[i] = 1 / summarizeValues("min", a.GetValues())
+		}
+	}
+
+	sort.Sort(byVals{vals: vals, series: arg})
+
+	return arg, nil
+}
+
+// sortByName(seriesList, natural=false)
+func evalSortByName(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	original, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	natSort, err := getBoolNamedOrPosArgDefault(e, "natural", 1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	arg := make([]*MetricData, len(original))
+	copy(arg, original)
+	if natSort {
+		sort.Sort(ByNameNatural(arg))
+	} else {
+		sort.Sort(ByName(arg))
+	}
+
+	return arg, nil
+}
+
+// stdev(seriesList, points, missingThreshold=0.1)
+func evalStdev(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	points, err := getIntArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	missingThreshold, err := getFloatArgDefault(e, 2, 0.1)
+	if err != nil {
+		return nil, err
+	}
+
+	minLen := int((1 - missingThreshold) * float64(points))
+
+	var result []*MetricData
+
+	for _, a := range arg {
+		w := &windowed{data: make([]float64, points)}
+
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("stdev(%s,%d)", a.GetName(), points))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				// make sure missing values are ignored
+				v = math.NaN()
+			}
+			w.Push(v)
+			r.Values[i] = w.Stdev()
+			if math.IsNaN(r.Values[i]) || (i >= minLen && w.Len() < minLen) {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+			}
+		}
+		result = append(result, &r)
+	}
+	return result, nil
+}
+
+// sumSeries(*seriesLists)
+func evalSumSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// TODO(dgryski): make sure the arrays are all the same 'size'
+	args, err := getSeriesArgs(ctx, e.args, from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	e.target = "sumSeries"
+	return aggregateSeries(e, args, func(values []float64) float64 {
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum
+	})
+}
+
+// sumSeriesWithWildcards(seriesList, *position)
+func evalSumSeriesWithWildcards(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// TODO(dgryski): make sure the arrays are all the same 'size'
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := getIntArgs(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	nodeList := []string{}
+	groups := make(map[string][]*MetricData)
+
+	for _, a := range args {
+		metric := extractMetric(a.GetName())
+		nodes := strings.Split(metric, ".")
+		var s []string
+		// Yes, this is O(n^2), but len(nodes) < 10 and len(fields) < 3
+		// Iterating an int slice is faster than a map for n ~ 30
+		// http://www.antoine.im/posts/someone_is_wrong_on_the_internet
+		for i, n := range nodes {
+			if !contains(fields, i) {
+				s = append(s, n)
+			}
+		}
+
+		node := strings.Join(s, ".")
+
+		if len(groups[node]) == 0 {
+			nodeList = append(nodeList, node)
+		}
+
+		groups[node] = append(groups[node], a)
+	}
+
+	for _, series := range nodeList {
+		args := groups[series]
+		r := *args[0]
+		r.Name = proto.String(fmt.Sprintf("sumSeriesWithWildcards(%s)", series))
+		r.Values = make([]float64, len(args[0].Values))
+		r.IsAbsent = make([]bool, len(args[0].Values))
+
+		atLeastOne := make([]bool, len(args[0].Values))
+		for _, arg := range args {
+			for i, v := range arg.Values {
+				if arg.IsAbsent[i] {
+					continue
+				}
+				atLeastOne[i] = true
+				r.Values[i] += v
+			}
+		}
+
+		for i, v := range atLeastOne {
+			if !v {
+				r.IsAbsent[i] = true
+			}
+		}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// percentileOfSeries(seriesList, n, interpolate=False)
+func evalPercentileOfSeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// TODO(dgryski): make sure the arrays are all the same 'size'
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	percent, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	interpolate, err := getBoolNamedOrPosArgDefault(e, "interpolate", 2, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return aggregateSeries(e, args, func(values []float64) float64 {
+		return percentile(values, percent, interpolate)
+	})
+}
+
+// aliasSub(seriesList, start, stop)
+func evalSubstr(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// BUG: affected by the same positional arg issue as 'threshold'.
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	startField, err := getIntNamedOrPosArgDefault(e, "start", 1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	stopField, err := getIntNamedOrPosArgDefault(e, "stop", 2, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range args {
+		metric := extractMetric(a.GetName())
+		nodes := strings.Split(metric, ".")
+		if startField != 0 {
+			if startField < 0 || startField > len(nodes)-1 {
+				return nil, errors.New("start out of range")
+			}
+			nodes = nodes[startField:]
+		}
+		if stopField != 0 {
+			if stopField <= startField || stopField-startField > len(nodes) {
+				return nil, errors.New("stop out of range")
+			}
+			nodes = nodes[:stopField-startField]
+		}
+
+		r := *a
+		r.Name = proto.String(strings.Join(nodes, "."))
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+// summarize(seriesList, intervalString, func='sum', alignToFrom=False)
+func evalSummarize(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// TODO(dgryski): make sure the arrays are all the same 'size'
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketSize, err := getIntervalArg(e, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	summarizeFunction, err := getStringNamedOrPosArgDefault(e, "func", 2, "sum")
+	if err != nil {
+		return nil, err
+	}
+	_, funcOk := e.namedArgs["func"]
+	if !funcOk {
+		funcOk = len(e.args) > 2
+	}
+
+	alignToFrom, err := getBoolNamedOrPosArgDefault(e, "alignToFrom", 3, false)
+	if err != nil {
+		return nil, err
+	}
+	_, alignOk := e.namedArgs["alignToFrom"]
+	if !alignOk {
+		alignOk = len(e.args) > 3
+	}
+
+	start := int64(args[0].GetStartTime())
+	stop := int64(args[0].GetStopTime())
+	if !alignToFrom {
+		start, stop = alignToBucketSize(start, stop, bucketSize)
+	}
+
+	buckets := getBuckets(start, stop, bucketSize)
+	results := make([]*MetricData, 0, len(args))
+	for _, arg := range args {
+
+		name := fmt.Sprintf("summarize(%s,'%s'", arg.GetName(), e.args[1].valStr)
+		if funcOk || alignOk {
+			// we include the "func" argument in the presence of
+			// "alignToFrom", even if the former was omitted
+			// this is so that a call like "summarize(foo, '5min', alignToFrom=true)"
+			// doesn't produce a metric name that has a boolean value
+			// where a function name should be
+			// so we show "summarize(foo,'5min','sum',true)" instead of "summarize(foo,'5min',true)"
+			//
+			// this does not match graphite's behaviour but seems more correct
+			name += fmt.Sprintf(",'%s'", summarizeFunction)
+		}
+		if alignOk {
+			name += fmt.Sprintf(",%v", alignToFrom)
+		}
+		name += ")"
+
+		r := MetricData{FetchResponse: pb.FetchResponse{
+			Name:      proto.String(name),
+			Values:    make([]float64, buckets, buckets),
+			IsAbsent:  make([]bool, buckets, buckets),
+			StepTime:  proto.Int32(ClampInt32(bucketSize)),
+			StartTime: proto.Int32(ClampInt32(start)),
+			StopTime:  proto.Int32(ClampInt32(stop)),
+		}}
+
+		t := int64(arg.GetStartTime()) // unadjusted
+		bucketEnd := start + bucketSize
+		values := make([]float64, 0, bucketSize/int64(arg.GetStepTime()))
+		ridx := 0
+		bucketItems := 0
+		for i, v := range arg.Values {
+			bucketItems++
+			if !arg.IsAbsent[i] {
+				values = append(values, v)
+			}
+
+			t += int64(arg.GetStepTime())
+
+			if t >= stop {
+				break
+			}
+
+			if t >= bucketEnd {
+				rv := summarizeValues(summarizeFunction, values)
+
+				if math.IsNaN(rv) {
+					r.IsAbsent[ridx] = true
+				}
+
+				r.Values[ridx] = rv
+				ridx++
+				bucketEnd += bucketSize
+				bucketItems = 0
+				values = values[:0]
+			}
+		}
+
+		// last partial bucket
+		if bucketItems > 0 {
+			rv := summarizeValues(summarizeFunction, values)
+			if math.IsNaN(rv) {
+				r.Values[ridx] = 0
+				r.IsAbsent[ridx] = true
+			} else {
+				r.Values[ridx] = rv
+				r.IsAbsent[ridx] = false
+			}
+		}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// timeShift(seriesList, timeShift, resetEnd=True)
+func evalTimeShift(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// FIXME(dgryski): support resetEnd=true
+
+	offs, err := getIntervalArg(e, 1, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	arg, err := getSeriesArg(ctx, e.args[0], from+offs, until+offs, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("timeShift(%s,'%d')", a.GetName(), offs))
+		r.StartTime = proto.Int32(ClampInt32(int64(a.GetStartTime()) - offs))
+		r.StopTime = proto.Int32(ClampInt32(int64(a.GetStopTime()) - offs))
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// timeStack(seriesList, timeShiftUnit, timeShiftStart, timeShiftEnd)
+func evalTimeStack(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	unit, err := getIntervalArg(e, 1, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := getIntArg(e, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := getIntArg(e, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+	for i := int64(start); i < int64(end); i++ {
+		offs := i * unit
+		arg, err := getSeriesArg(ctx, e.args[0], from+offs, until+offs, values)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range arg {
+			r := *a
+			r.Name = proto.String(fmt.Sprintf("timeShift(%s,%d)", a.GetName(), offs))
+			r.StartTime = proto.Int32(ClampInt32(int64(a.GetStartTime()) - offs))
+			r.StopTime = proto.Int32(ClampInt32(int64(a.GetStopTime()) - offs))
+			results = append(results, &r)
+		}
+	}
+
+	return results, nil
+}
+
+// transformNull(seriesList, default=0)
+func evalTransformNull(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	defv, err := getFloatNamedOrPosArgDefault(e, "default", 1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := e.namedArgs["default"]
+	if !ok {
+		ok = len(e.args) > 1
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+
+		var name string
+		if ok {
+			name = fmt.Sprintf("transformNull(%s,%g)", a.GetName(), defv)
+		} else {
+			name = fmt.Sprintf("transformNull(%s)", a.GetName())
+		}
+
+		r := *a
+		r.Name = proto.String(name)
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				v = defv
+			}
+
+			r.Values[i] = v
+		}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// tukeyAbove(seriesList,basis,n,interval=0) , tukeyBelow(seriesList,basis,n,interval=0)
+func evalTukey(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	basis, err := getFloatArg(e, 1)
+	if err != nil || basis <= 0 {
+		return nil, err
+	}
+
+	n, err := getIntArg(e, 2)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, errors.New("n must be larger or equal to 1")
+	}
+
+	var beginInterval int
+	endInterval := len(arg[0].Values)
+	if len(e.args) >= 4 {
+		switch e.args[3].etype {
+		case etConst:
+			beginInterval, err = getIntArg(e, 3)
+		case etString:
+			var i64 int64
+			i64, err = getIntervalArg(e, 3, 1)
+			beginInterval = int(i64)
+			beginInterval /= int(arg[0].GetStepTime())
+			// TODO(nnuss): make sure the arrays are all the same 'size'
+		default:
+			err = ErrBadType
+		}
+		if err != nil {
+			return nil, err
+		}
+		if beginInterval < 0 && (-1*beginInterval) < endInterval {
+			// negative intervals are everything preceding the last 'interval' points
+			endInterval += beginInterval
+			beginInterval = 0
+		} else if beginInterval > 0 && beginInterval < endInterval {
+			// positive intervals are the last 'interval' points
+			beginInterval = endInterval - beginInterval
+			//endInterval = len(arg[0].Values)
+		} else {
+			// zero -or- beyond the len() of the series ; will revert to whole range
+			beginInterval = 0
+			//endInterval = len(arg[0].Values)
+		}
+	}
+
+	// gather all the valid points
+	var points []float64
+	for _, a := range arg {
+		for i, m := range a.Values[beginInterval:endInterval] {
+			if a.IsAbsent[beginInterval+i] {
+				continue
+			}
+			points = append(points, m)
+		}
+	}
+
+	sort.Float64s(points)
+
+	first := int(0.25 * float64(len(points)))
+	third := int(0.75 * float64(len(points)))
+
+	iqr := points[third] - points[first]
+
+	max := points[third] + basis*iqr
+	min := points[first] - basis*iqr
+
+	isAbove := strings.HasSuffix(e.target, "Above")
+
+	var mh metricHeap
+
+	// count how many points are above the threshold
+	for i, a := range arg {
+		var outlier int
+		for i, m := range a.Values[beginInterval:endInterval] {
+			if a.IsAbsent[beginInterval+i] {
+				continue
+			}
+			if isAbove {
+				if m >= max {
+					outlier++
+				}
+			} else {
+				if m <= min {
+					outlier++
+				}
+			}
+		}
+
+		// not even a single anomalous point -- ignore this metric
+		if outlier == 0 {
+			continue
+		}
+
+		if len(mh) < n {
+			heap.Push(&mh, metricHeapElement{idx: i, val: float64(outlier)})
+			continue
+		}
+		// current outlier count is is bigger than smallest max found so far
+		foutlier := float64(outlier)
+		if mh[0].val < foutlier {
+			mh[0].val = foutlier
+			mh[0].idx = i
+			heap.Fix(&mh, 0)
+		}
+	}
+
+	if len(mh) < n {
+		n = len(mh)
+	}
+	results := make([]*MetricData, n)
+	// results should be ordered ascending
+	for len(mh) > 0 {
+		v := heap.Pop(&mh).(metricHeapElement)
+		results[len(mh)] = arg[v.idx]
+	}
+
+	return results, nil
+}
+
+// color(seriesList, theColor)
+func evalColor(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	color, err := getStringArg(e, 1) // get color
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.color = color
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+// stacked(seriesList, stackname="__DEFAULT__")
+func evalStacked(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	stackName, err := getStringNamedOrPosArgDefault(e, "stackname", 1, defaultStackName)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.stacked = true
+		r.stackName = stackName
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+func evalAreaBetween(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arg) != 2 {
+		return nil, fmt.Errorf("areaBetween needs exactly two arguments (%d given)", len(arg))
+	}
+
+	name := proto.String(fmt.Sprintf("%s(%s)", e.target, e.argString))
+
+	lower := *arg[0]
+	lower.stacked = true
+	lower.stackName = defaultStackName
+	lower.invisible = true
+	lower.Name = name
+
+	upper := *arg[1]
+	upper.stacked = true
+	upper.stackName = defaultStackName
+	upper.Name = name
+
+	vals := make([]float64, len(upper.Values))
+	absent := make([]bool, len(upper.Values))
+
+	for i, v := range upper.Values {
+		if upper.IsAbsent[i] || lower.IsAbsent[i] {
+			absent[i] = true
+			continue
+		}
+
+		vals[i] = v - lower.Values[i]
+	}
+
+	upper.Values = vals
+	upper.IsAbsent = absent
+
+	return []*MetricData{&lower, &upper}, nil
+}
+
+// alpha(seriesList, theAlpha)
+func evalAlpha(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	alpha, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.alpha = alpha
+		r.hasAlpha = true
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+func evalGraphOption(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("%s(%s)", e.target, a.GetName()))
+
+		switch e.target {
+		case "dashed":
+			d, err := getFloatArgDefault(e, 1, 2.5)
+			if err != nil {
+				return nil, err
+			}
+			r.dashed = d
+		case "drawAsInfinite":
+			r.drawAsInfinite = true
+		case "secondYAxis":
+			r.secondYAxis = true
+		}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+func evalConstantLine(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	value, err := getFloatArg(e, 0)
+
+	if err != nil {
+		return nil, err
+	}
+	p := MetricData{
+		FetchResponse: pb.FetchResponse{
+			Name:      proto.String(fmt.Sprintf("%g", value)),
+			StartTime: proto.Int32(ClampInt32(from)),
+			StopTime:  proto.Int32(ClampInt32(until)),
+			StepTime:  proto.Int32(ClampInt32(until - from)),
+			Values:    []float64{value, value},
+			IsAbsent:  []bool{false, false},
+		},
+	}
+
+	return []*MetricData{&p}, nil
+}
+
+func evalConsolidateBy(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	name, err := getStringArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+
+		var f func([]float64, []bool) (float64, bool)
+
+		switch name {
+		case "max":
+			f = aggMax
+		case "min":
+			f = aggMin
+		case "sum":
+			f = aggSum
+		case "average":
+			f = aggMean
+		}
+
+		r.aggregateFunction = f
+
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+func evalTimeFunction(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	name, err := getStringArg(e, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	stepInt, err := getIntArgDefault(e, 1, 60)
+	if err != nil {
+		return nil, err
+	}
+	if stepInt <= 0 {
+		return nil, errors.New("step can't be less than 0")
+	}
+	step := int64(stepInt)
+
+	// emulate the behavior of this Python code:
+	//   while when < requestContext["endTime"]:
+	//     values.append(time.mktime(when.timetuple()))
+	//     when += delta
+
+	vals := make([]float64, (until-from-1+step)/step)
+	value := from
+	for i := 0; i < len(vals); i++ {
+		vals[i] = float64(value)
+		value += step
+	}
+
+	p := MetricData{
+		FetchResponse: pb.FetchResponse{
+			Name:      proto.String(name),
+			StartTime: proto.Int32(ClampInt32(from)),
+			StopTime:  proto.Int32(ClampInt32(until)),
+			StepTime:  proto.Int32(ClampInt32(step)),
+			Values:    vals,
+			IsAbsent:  make([]bool, len(vals)),
+		},
+	}
+
+	return []*MetricData{&p}, nil
+}
+
+// threshold(value, label=None, color=None)
+func evalThreshold(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// XXX does not match graphite's signature
+	// BUG(nnuss): the signature *does* match but there is an edge case because of named argument handling if you use it *just* wrong:
+	//			   threshold(value, "gold", label="Aurum")
+	//			   will result in:
+	//			   value = value
+	//			   label = "Aurum" (by named argument)
+	//			   color = "" (by default as len(positionalArgs) == 2 and there is no named 'color' arg)
+
+	value, err := getFloatArg(e, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := getStringNamedOrPosArgDefault(e, "label", 1, fmt.Sprintf("%g", value))
+	if err != nil {
+		return nil, err
+	}
+
+	color, err := getStringNamedOrPosArgDefault(e, "color", 2, "")
+	if err != nil {
+		return nil, err
+	}
+
+	p := MetricData{
+		FetchResponse: pb.FetchResponse{
+			Name:      proto.String(name),
+			StartTime: proto.Int32(ClampInt32(from)),
+			StopTime:  proto.Int32(ClampInt32(until)),
+			StepTime:  proto.Int32(ClampInt32(until - from)),
+			Values:    []float64{value, value},
+			IsAbsent:  []bool{false, false},
+		},
+		color: color,
+	}
+
+	return []*MetricData{&p}, nil
+}
+
+func evalHoltWintersForecast(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	var results []*MetricData
+	args, err := getSeriesArgs(ctx, e.args, from-7*86400, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, arg := range args {
+		stepTime := int64(arg.GetStepTime())
+
+		predictions := holtWintersAnalysis(arg.Values, stepTime)
+
+		windowPoints := 7 * 86400 / stepTime
+		if windowPoints > int64(len(predictions)) {
+			windowPoints = int64(len(predictions))
+		}
+		predictionsOfInterest := predictions[windowPoints:]
+
+		r := MetricData{FetchResponse: pb.FetchResponse{
+			Name:      proto.String(fmt.Sprintf("holtWintersForecast(%s)", arg.GetName())),
+			Values:    predictionsOfInterest,
+			IsAbsent:  make([]bool, len(predictionsOfInterest)),
+			StepTime:  proto.Int32(arg.GetStepTime()),
+			StartTime: proto.Int32(ClampInt32(int64(arg.GetStartTime()) + 7*86400)),
+			StopTime:  proto.Int32(arg.GetStopTime()),
+		}}
+
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// squareRoot(seriesList)
+func evalSquareRoot(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	arg, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	var results []*MetricData
+
+	for _, a := range arg {
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("squareRoot(%s)", a.GetName()))
+		r.Values = make([]float64, len(a.Values))
+		r.IsAbsent = make([]bool, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] {
+				r.Values[i] = 0
+				r.IsAbsent[i] = true
+				continue
+			}
+			r.Values[i] = math.Sqrt(v)
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+func evalRandomWalk(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	name, err := getStringArg(e, 0)
+	if err != nil {
+		name = "randomWalk"
+	}
+
+	size := until - from
+
+	r := MetricData{FetchResponse: pb.FetchResponse{
+		Name:      proto.String(name),
+		Values:    make([]float64, size),
+		IsAbsent:  make([]bool, size),
+		StepTime:  proto.Int32(1),
+		StartTime: proto.Int32(ClampInt32(from)),
+		StopTime:  proto.Int32(ClampInt32(until)),
+	}}
+
+	for i := 1; i < len(r.Values)-1; i++ {
+		r.Values[i+1] = r.Values[i] + (rand.Float64() - 0.5)
+	}
+	return []*MetricData{&r}, nil
+}
+
+// removeEmptySeries(seriesLists, n), removeZeroSeries(seriesLists, n)
+func evalRemoveEmptySeries(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*MetricData
+
+	for _, a := range args {
+		for i, v := range a.IsAbsent {
+			if !v {
+				if e.target == "removeEmptySeries" || (a.Values[i] != 0) {
+					results = append(results, a)
+					break
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// removeBelowValue(seriesLists, n), removeAboveValue(seriesLists, n), removeBelowPercentile(seriesLists, percent), removeAbovePercentile(seriesLists, percent)
+func evalRemoveByValue(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	args, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	number, err := getFloatArg(e, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	condition := func(v float64, threshold float64) bool {
+		return v < threshold
+	}
+
+	if strings.HasPrefix(e.target, "removeAbove") {
+		condition = func(v float64, threshold float64) bool {
+			return v > threshold
+		}
+	}
+
+	var results []*MetricData
+
+	for _, a := range args {
+		threshold := number
+		if strings.HasSuffix(e.target, "Percentile") {
+			var values []float64
+			for i, v := range a.IsAbsent {
+				if !v {
+					values = append(values, a.Values[i])
+				}
+			}
+
+			threshold = percentile(values, number, true)
+		}
+
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("%s(%s, %g)", e.target, a.GetName(), number))
+		r.IsAbsent = make([]bool, len(a.Values))
+		r.Values = make([]float64, len(a.Values))
+
+		for i, v := range a.Values {
+			if a.IsAbsent[i] || condition(v, threshold) {
+				r.Values[i] = math.NaN()
+				r.IsAbsent[i] = true
+				continue
+			}
+
+			r.Values[i] = v
+		}
+
+		results = append(results, &r)
+	}
+
+	return results, nil
+}
+
+// cactiStyle(seriesList, system=None, units=None)
+func evalCactiStyle(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	// Get the series data
+	original, err := getSeriesArg(ctx, e.args[0], from, until, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the arguments
+	system, err := getStringNamedOrPosArgDefault(e, "system", 1, "")
+	if err != nil {
+		return nil, err
+	}
+	unit, err := getStringNamedOrPosArgDefault(e, "units", 2, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Deal with each of the series
+	var metrics []*MetricData
+	for _, a := range original {
+		// Calculate min, max, current
+		//
+		// This saves calling summarizeValues 3 times and looping over
+		// the metrics 3 times
+		//
+		// For min:
+		// Ignoring any absent values and inf (if we have a value)
+		// Using summarizeValues("min", ...) results in incorrect values, when absent
+		// values are present
+		//
+		minVal := math.Inf(1)
+		currentVal := math.Inf(-1)
+		maxVal := math.Inf(-1)
+		for i, av := range a.GetValues() {
+			if !a.IsAbsent[i] {
+				minVal = math.Min(minVal, av)
+				maxVal = math.Max(maxVal, av)
+				currentVal = av
+			}
+		}
+
+		// Format the output correctly
+		min := ""
+		max := ""
+		current := ""
+		if system == "si" {
+			mv, mf := humanize.ComputeSI(minVal)
+			xv, xf := humanize.ComputeSI(maxVal)
+			cv, cf := humanize.ComputeSI(currentVal)
+
+			min = fmt.Sprintf("%.0f%s", mv, mf)
+			max = fmt.Sprintf("%.0f%s", xv, xf)
+			current = fmt.Sprintf("%.0f%s", cv, cf)
+
+		} else if system == "" {
+			min = fmt.Sprintf("%.0f", minVal)
+			max = fmt.Sprintf("%.0f", maxVal)
+			current = fmt.Sprintf("%.0f", currentVal)
+
+		} else {
+			return nil, fmt.Errorf("%s is not supported for system", system)
+		}
+
+		// Append the unit if specified
+		if len(unit) > 0 {
+			min = fmt.Sprintf("%s %s", min, unit)
+			max = fmt.Sprintf("%s %s", max, unit)
+			current = fmt.Sprintf("%s %s", current, unit)
+		}
+
+		r := *a
+		r.Name = proto.String(fmt.Sprintf("%s Current: %s Max: %s Min: %s", *a.Name, current, max, min))
+		metrics = append(metrics, &r)
+	}
+
+	return metrics, nil
+}
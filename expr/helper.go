@@ -2,13 +2,29 @@ package expr
 
 import (
 	"errors"
+	"math"
 	"strconv"
 )
 
-var errUnknownTimeUnits = errors.New("unknown time units")
+var (
+	errUnknownTimeUnits = errors.New("unknown time units")
+	errIntervalOverflow = errors.New("interval value out of range")
+)
+
+// ClampInt32 narrows a time or step to the int32 of a FetchResponse, saturating
+// rather than wrapping around for values out of its range
+func ClampInt32(v int64) int32 {
+	switch {
+	case v > math.MaxInt32:
+		return math.MaxInt32
+	case v < math.MinInt32:
+		return math.MinInt32
+	}
+	return int32(v)
+}
 
 // IntervalString converts a sign and string into a number of seconds
-func IntervalString(s string, defaultSign int) (int32, error) {
+func IntervalString(s string, defaultSign int) (int64, error) {
 
 	sign := defaultSign
 
@@ -21,7 +37,7 @@ func IntervalString(s string, defaultSign int) (int32, error) {
 		s = s[1:]
 	}
 
-	var totalInterval int32
+	var totalInterval int64
 	for len(s) > 0 {
 		var j int
 		for j < len(s) && '0' <= s[j] && s[j] <= '9' {
@@ -37,7 +53,7 @@ func IntervalString(s string, defaultSign int) (int32, error) {
 		var unitStr string
 		unitStr, s = s[:j], s[j:]
 
-		var units int
+		var units int64
 		switch unitStr {
 		case "s", "sec", "secs", "second", "seconds":
 			units = 1
@@ -57,11 +73,20 @@ func IntervalString(s string, defaultSign int) (int32, error) {
 			return 0, errUnknownTimeUnits
 		}
 
-		offset, err := strconv.Atoi(offsetStr)
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
 		if err != nil {
 			return 0, err
 		}
-		totalInterval += int32(sign * offset * units)
+
+		if offset > math.MaxInt64/units {
+			return 0, errIntervalOverflow
+		}
+		offset *= units * int64(sign)
+
+		if (offset > 0 && totalInterval > math.MaxInt64-offset) || (offset < 0 && totalInterval < math.MinInt64-offset) {
+			return 0, errIntervalOverflow
+		}
+		totalInterval += offset
 	}
 
 	return totalInterval, nil
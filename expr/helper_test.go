@@ -1,6 +1,7 @@
 package expr
 
 import (
+	"math"
 	"strings"
 	"testing"
 )
@@ -9,7 +10,7 @@ func TestInterval(t *testing.T) {
 
 	var tests = []struct {
 		t       string
-		seconds int32
+		seconds int64
 		sign    int
 	}{
 		{"1s", 1, 1},
@@ -23,6 +24,8 @@ func TestInterval(t *testing.T) {
 		{"+2d", 2 * 60 * 60 * 24, -1},
 		{"-10hours", -60 * 60 * 10, -1},
 		{"-360h2min", -360*60*60 - 2*60, -1},
+		{"100y", 100 * 365 * 24 * 60 * 60, 1},
+		{"-100y", -100 * 365 * 24 * 60 * 60, 1},
 	}
 
 	for _, tt := range tests {
@@ -33,12 +36,14 @@ func TestInterval(t *testing.T) {
 
 	var exceptTests = []struct {
 		t       string
-		seconds int32
+		seconds int64
 		err     string
 		sign    int
 	}{
 		{"10m10s", 0, "unknown time units", 1},
 		{"10000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000y", 0, "value out of range", 1},
+		{"300000000000y", 0, "value out of range", 1},
+		{"200000000000y200000000000y", 0, "value out of range", 1},
 	}
 	for _, tt := range exceptTests {
 		secs, err := IntervalString(tt.t, tt.sign)
@@ -50,3 +55,24 @@ func TestInterval(t *testing.T) {
 		}
 	}
 }
+
+func TestClampInt32(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want int32
+	}{
+		{0, 0},
+		{-60, -60},
+		{math.MaxInt32, math.MaxInt32},
+		{math.MaxInt32 + 1, math.MaxInt32},
+		{1 << 40, math.MaxInt32},
+		{math.MinInt32 - 1, math.MinInt32},
+		{-300 * 365 * 24 * 60 * 60, math.MinInt32},
+	}
+
+	for _, tt := range tests {
+		if got := ClampInt32(tt.v); got != tt.want {
+			t.Errorf("ClampInt32(%d)=%d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
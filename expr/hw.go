@@ -20,7 +20,7 @@ func holtWintersSeasonal(gamma, actual, intercept, lastSeason float64) float64 {
 
 }
 
-func holtWintersAnalysis(series []float64, step int32) []float64 {
+func holtWintersAnalysis(series []float64, step int64) []float64 {
 	const (
 		alpha = 0.1
 		beta  = 0.0035
@@ -28,7 +28,7 @@ func holtWintersAnalysis(series []float64, step int32) []float64 {
 	)
 
 	// season is currently one day
-	seasonLength := 24 * 60 * 60 / int(step)
+	seasonLength := int(24 * 60 * 60 / step)
 
 	var (
 		intercepts  []float64
@@ -0,0 +1,102 @@
+package expr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrBadJSONExpr is returned when decoding a JSON expression which is neither a target, number, boolean nor function call.
+	ErrBadJSONExpr = errors.New("expression must be a string, number, boolean or function call")
+)
+
+// jsonCall is a function call in a JSON expression
+type jsonCall struct {
+	Function  string                     `json:"function"`
+	Args      []json.RawMessage          `json:"args"`
+	NamedArgs map[string]json.RawMessage `json:"namedArgs"`
+}
+
+// UnmarshalJSON decodes an expression given in JSON, as a string holding a
+// target in the usual syntax, a number, a boolean, or a function call object
+// such as
+//
+//	{"function": "summarize", "args": ["foo.*", "'1h'"], "namedArgs": {"func": "'max'"}}
+//
+// whose arguments are expressions in turn.  Metric names and other targets
+// are thus JSON strings, and string arguments quoted strings within them.
+func (e *Expr) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] == 'n' {
+		// nothing, or null
+		return ErrBadJSONExpr
+	}
+
+	switch b[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		exp, rest, err := ParseExpr(s)
+		if err == nil && rest != "" {
+			err = ErrTrailingCharacters
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %v", s, err)
+		}
+		*e = *exp
+
+	case 't', 'f':
+		var v bool
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		*e = Expr{target: fmt.Sprint(v)}
+
+	case '{':
+		var c jsonCall
+		if err := json.Unmarshal(b, &c); err != nil {
+			return err
+		}
+		if c.Function == "" {
+			return errors.New("function call without a function")
+		}
+
+		*e = Expr{target: c.Function, etype: etFunc}
+		for _, raw := range c.Args {
+			a := new(Expr)
+			if err := a.UnmarshalJSON(raw); err != nil {
+				return fmt.Errorf("%s: %v", c.Function, err)
+			}
+			e.args = append(e.args, a)
+		}
+		for k, raw := range c.NamedArgs {
+			a := new(Expr)
+			if err := a.UnmarshalJSON(raw); err != nil {
+				return fmt.Errorf("%s: %s: %v", c.Function, k, err)
+			}
+			if a.etype == etFunc {
+				// as in targets, where named arguments are plain values
+				return fmt.Errorf("%s: %s: %v", c.Function, k, ErrBadType)
+			}
+			if e.namedArgs == nil {
+				e.namedArgs = make(map[string]*Expr)
+			}
+			e.namedArgs[k] = a
+		}
+
+		e.setArgString()
+
+	default:
+		var v float64
+		if err := json.Unmarshal(b, &v); err != nil {
+			return ErrBadJSONExpr
+		}
+		*e = Expr{val: v, etype: etConst}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package expr
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnmarshalJSON(t *testing.T) {
+
+	tests := []struct {
+		json   string
+		target string
+	}{
+		{`"foo.bar.*"`, "foo.bar.*"},
+		{`"sum(foo.*, bar)"`, "sum(foo.*,bar)"},
+		{`2.5`, "2.5"},
+		{`true`, "true"},
+		{`{"function": "scale", "args": ["foo.*", 2]}`, "scale(foo.*,2)"},
+		{
+			`{"function": "summarize", "args": [{"function": "sum", "args": ["foo.*"]}, "'1h'"], "namedArgs": {"func": "'max'", "alignToFrom": true}}`,
+			`summarize(sum(foo.*),"1h",alignToFrom=true,func="max")`,
+		},
+	}
+
+	for _, tt := range tests {
+		var e Expr
+		if err := json.Unmarshal([]byte(tt.json), &e); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.json, err)
+			continue
+		}
+		if got := e.String(); got != tt.target {
+			t.Errorf("%s: got %s, want %s", tt.json, got, tt.target)
+		}
+
+		// the same tree as parsing the target
+		p, _, _ := ParseExpr(tt.target)
+		if e.Canonical() != p.Canonical() || tt.json[0] == '{' && e.ArgString() != p.ArgString() {
+			t.Errorf("%s: got %+v, want %+v", tt.json, e, p)
+		}
+	}
+
+	for _, bad := range []string{
+		`null`,
+		`[1]`,
+		`"sum(foo"`,
+		`"foo bar"`,
+		`{"args": ["foo"]}`,
+		`{"function": "scale", "args": ["foo", null]}`,
+		`{"function": "summarize", "args": ["foo"], "namedArgs": {"func": {"function": "sum", "args": ["x"]}}}`,
+	} {
+		var e Expr
+		if err := json.Unmarshal([]byte(bad), &e); err == nil {
+			t.Errorf("%s: got %s, want an error", bad, e.String())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package expr
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// String returns the expression as a target.  Parsing it with ParseExpr gives
+// back an equivalent tree, with the same functions, names, values and
+// arguments, for any tree from ParseExpr or changed with values ParseExpr can
+// produce: targets have no escapes, so a string can't hold both kinds of
+// quote.  Unlike Canonical, function aliases are kept.
+func (e *Expr) String() string {
+	var buf bytes.Buffer
+	e.write(&buf, false)
+	return buf.String()
+}
+
+func (e *Expr) write(buf *bytes.Buffer, canonical bool) {
+	switch e.etype {
+	case etName:
+		buf.WriteString(e.target)
+	case etConst:
+		buf.WriteString(strconv.FormatFloat(e.val, 'g', -1, 64))
+	case etString:
+		buf.WriteString(quote(e.valStr))
+	case etFunc:
+		name := e.target
+		if f, ok := lookupFunction(name); ok && canonical {
+			name = f.Name
+		}
+		buf.WriteString(name)
+		buf.WriteByte('(')
+
+		for i, a := range e.args {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			a.write(buf, canonical)
+		}
+
+		for i, k := range e.namedArgNames() {
+			if i > 0 || len(e.args) > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(k)
+			buf.WriteByte('=')
+			e.namedArgs[k].write(buf, canonical)
+		}
+
+		buf.WriteByte(')')
+	}
+}
+
+// quote returns s in double quotes, or in single quotes if it contains a
+// double quote, as there are no escapes
+func quote(s string) string {
+	if strings.Contains(s, `"`) {
+		return `'` + s + `'`
+	}
+	return `"` + s + `"`
+}
+
+func (e *Expr) namedArgNames() []string {
+	var names []string
+	for k := range e.namedArgs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// prettyWidth is the longest function call Pretty keeps on one line
+const prettyWidth = 60
+
+// Pretty returns the expression for display, with the arguments of function
+// calls too long for one line each on their own line, indented.  It is only
+// meant to be read: ParseExpr does not accept line breaks.
+func (e *Expr) Pretty() string {
+	var buf bytes.Buffer
+	e.writePretty(&buf, "")
+	return buf.String()
+}
+
+func (e *Expr) writePretty(buf *bytes.Buffer, indent string) {
+	s := e.String()
+	if e.etype != etFunc || len(indent)+len(s) <= prettyWidth {
+		buf.WriteString(s)
+		return
+	}
+
+	inner := indent + "  "
+
+	buf.WriteString(e.target)
+	buf.WriteString("(\n")
+
+	n := len(e.args) + len(e.namedArgs)
+	i := 0
+	next := func() {
+		i++
+		if i < n {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+
+	for _, a := range e.args {
+		buf.WriteString(inner)
+		a.writePretty(buf, inner)
+		next()
+	}
+
+	for _, k := range e.namedArgNames() {
+		buf.WriteString(inner)
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		e.namedArgs[k].writePretty(buf, inner)
+		next()
+	}
+
+	buf.WriteString(indent)
+	buf.WriteByte(')')
+}
@@ -0,0 +1,107 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withoutArgStrings returns a copy of e without the raw argument lists, which
+// keep the whitespace of the target
+func withoutArgStrings(e *Expr) *Expr {
+	c := *e
+	c.argString = ""
+	c.args = nil
+	for _, a := range e.args {
+		c.args = append(c.args, withoutArgStrings(a))
+	}
+	if e.namedArgs != nil {
+		c.namedArgs = make(map[string]*Expr)
+		for k, a := range e.namedArgs {
+			c.namedArgs[k] = withoutArgStrings(a)
+		}
+	}
+	return &c
+}
+
+func TestString(t *testing.T) {
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"foo.bar.*", "foo.bar.*"},
+		{"sum( foo.*,  bar.{a,b})", "sum(foo.*,bar.{a,b})"},
+		{"alias(scale(foo, 2.0), 'x y')", `alias(scale(foo,2),"x y")`},
+		{`alias(foo, 'say "hi"')`, `alias(foo,'say "hi"')`},
+		{"summarize(foo, '1h', func='max', alignToFrom=true)", `summarize(foo,"1h",alignToFrom=true,func="max")`},
+		{"movingAverage(foo, -1.5e3)", "movingAverage(foo,-1500)"},
+		{"scale(foo, 1e30)", "scale(foo,1e+30)"},
+		{"applyByNode(foo.*.bar, 1, 'sumSeries(%.baz)')", `applyByNode(foo.*.bar,1,"sumSeries(%.baz)")`},
+		{"sumSeries(%.baz)", "sumSeries(%.baz)"},
+	}
+
+	for _, tt := range tests {
+		e, _, err := ParseExpr(tt.target)
+		if err != nil {
+			t.Errorf("%s: parse error: %v", tt.target, err)
+			continue
+		}
+
+		s := e.String()
+		if s != tt.want {
+			t.Errorf("%s: String()=%q, want %q", tt.target, s, tt.want)
+		}
+
+		e2, rest, err := ParseExpr(s)
+		if err != nil || rest != "" {
+			t.Errorf("%s: String()=%q does not parse: %v, %q left", tt.target, s, err, rest)
+			continue
+		}
+		if !reflect.DeepEqual(withoutArgStrings(e), withoutArgStrings(e2)) {
+			t.Errorf("%s: String()=%q parses to a different tree: %+v", tt.target, s, e2)
+		}
+	}
+}
+
+func TestPretty(t *testing.T) {
+	e, _, err := ParseExpr("alias(sumSeries(scale(servers.*.cpu.user, 100), scale(servers.*.cpu.system, 100)), 'cpu', x=1)")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	want := `alias(
+  sumSeries(
+    scale(servers.*.cpu.user,100),
+    scale(servers.*.cpu.system,100)
+  ),
+  "cpu",
+  x=1
+)`
+
+	if got := e.Pretty(); got != want {
+		t.Errorf("Pretty()=\n%s\nwant\n%s", got, want)
+	}
+
+	if got := e.Args()[1].Pretty(); got != `"cpu"` {
+		t.Errorf("Pretty() of a string=%s", got)
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	e, _, err := ParseExpr("alias(sumSeries(%.baz, %.qux), 'sum of %')")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	got := e.substitute(strings.NewReplacer("%", "1"))
+	if s := got.String(); s != `alias(sumSeries(1.baz,1.qux),"sum of 1")` {
+		t.Errorf("substitute: got %s", s)
+	}
+	if got.args[0].argString != "1.baz, 1.qux" {
+		t.Errorf("substitute: got argString %q", got.args[0].argString)
+	}
+	if s := e.String(); s != `alias(sumSeries(%.baz,%.qux),"sum of %")` {
+		t.Errorf("substitute changed the original: %s", s)
+	}
+}
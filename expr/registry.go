@@ -0,0 +1,148 @@
+package expr
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// EvalFunc evaluates the function call e for the time range [from, until),
+// using the series already fetched into values.  ctx should be passed on to
+// EvalExpr when evaluating arguments.
+type EvalFunc func(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error)
+
+// LookbackFunc adjusts the metric requests gathered from the arguments of e.
+// Functions which need data outside of the requested time range (timeShift,
+// movingAverage, ...) use it to move or widen the fetch window.
+type LookbackFunc func(e *Expr, r []MetricRequest) []MetricRequest
+
+// ParamType is the type of a function parameter.
+type ParamType int
+
+const (
+	ParamSeries ParamType = iota
+	ParamSeriesList
+	ParamSeriesLists
+	ParamNode
+	ParamInt
+	ParamFloat
+	ParamString
+	ParamBool
+	ParamInterval
+	ParamIntOrInterval
+	ParamAggFunc
+	ParamAny
+)
+
+var paramTypeNames = [...]string{
+	ParamSeries:        "series",
+	ParamSeriesList:    "seriesList",
+	ParamSeriesLists:   "seriesLists",
+	ParamNode:          "node",
+	ParamInt:           "integer",
+	ParamFloat:         "float",
+	ParamString:        "string",
+	ParamBool:          "boolean",
+	ParamInterval:      "interval",
+	ParamIntOrInterval: "intOrInterval",
+	ParamAggFunc:       "aggFunc",
+	ParamAny:           "any",
+}
+
+// String returns the graphite-web name of the parameter type.
+func (t ParamType) String() string {
+	if t < 0 || int(t) >= len(paramTypeNames) {
+		return "any"
+	}
+	return paramTypeNames[t]
+}
+
+// Param describes a single function parameter.
+type Param struct {
+	Name     string
+	Type     ParamType
+	Required bool
+	// Multiple is set for variadic parameters, which must come last.
+	Multiple bool
+	Default  interface{}
+}
+
+// Function describes a function which can be used in a target expression.
+type Function struct {
+	Name        string
+	Aliases     []string
+	Description string
+	// Group is the graphite-web category of the function, eg. "Combine" or "Transform".
+	Group    string
+	Params   []Param
+	Eval     EvalFunc
+	Lookback LookbackFunc
+}
+
+var (
+	functionsMu sync.RWMutex
+	functions   = make(map[string]*Function)
+)
+
+// RegisterFunction makes f available to target expressions under its name
+// and all of its aliases.  It panics if f has no name or eval callback, or if
+// any of the names is already registered.
+func RegisterFunction(f Function) {
+	if f.Name == "" {
+		panic("expr: RegisterFunction with empty name")
+	}
+	if f.Eval == nil {
+		panic("expr: RegisterFunction without Eval for " + f.Name)
+	}
+
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+
+	fn := &f
+	for _, name := range append([]string{f.Name}, f.Aliases...) {
+		if _, dup := functions[name]; dup {
+			panic(fmt.Sprintf("expr: RegisterFunction called twice for %q", name))
+		}
+		functions[name] = fn
+	}
+}
+
+func lookupFunction(name string) (*Function, bool) {
+	functionsMu.RLock()
+	f, ok := functions[name]
+	functionsMu.RUnlock()
+	return f, ok
+}
+
+// LookupFunction returns the function registered under name, which may be an alias.
+func LookupFunction(name string) (Function, bool) {
+	f, ok := lookupFunction(name)
+	if !ok {
+		return Function{}, false
+	}
+	return *f, true
+}
+
+// Functions returns all registered functions, sorted by name.
+func Functions() []Function {
+	functionsMu.RLock()
+	defer functionsMu.RUnlock()
+
+	var list []Function
+	for name, f := range functions {
+		if name == f.Name {
+			list = append(list, *f)
+		}
+	}
+
+	sort.Sort(byFunctionName(list))
+
+	return list
+}
+
+type byFunctionName []Function
+
+func (s byFunctionName) Len() int           { return len(s) }
+func (s byFunctionName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byFunctionName) Less(i, j int) bool { return s[i].Name < s[j].Name }
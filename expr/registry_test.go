@@ -0,0 +1,97 @@
+package expr
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestRegisterFunction(t *testing.T) {
+
+	RegisterFunction(Function{
+		Name:    "testShiftName",
+		Aliases: []string{"testShiftNameAlias"},
+		Params: []Param{
+			{Name: "seriesList", Type: ParamSeriesList, Required: true},
+			{Name: "prefix", Type: ParamString, Required: true},
+		},
+		Eval: func(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+			args, err := EvalExpr(ctx, e.Args()[0], from, until, values)
+			if err != nil {
+				return nil, err
+			}
+			prefix, err := e.Args()[1].StringValue()
+			if err != nil {
+				return nil, err
+			}
+			var results []*MetricData
+			for _, a := range args {
+				r := *a
+				r.Name = proto.String(prefix + a.GetName())
+				results = append(results, &r)
+			}
+			return results, nil
+		},
+		Lookback: func(e *Expr, r []MetricRequest) []MetricRequest {
+			for i := range r {
+				r[i].From -= 60
+			}
+			return r
+		},
+	})
+
+	exp, _, err := ParseExpr("testShiftNameAlias(metric1,'x.')")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if got, want := exp.Metrics(), []MetricRequest{{Metric: "metric1", From: -60}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Metrics()=%v, want %v", got, want)
+	}
+
+	m := map[MetricRequest][]*MetricData{
+		{"metric1", 0, 1}: {makeResponse("metric1", []float64{1, 2, 3}, 1, 0)},
+	}
+
+	g, err := EvalExpr(context.Background(), exp, 0, 1, m)
+	if err != nil {
+		t.Fatalf("failed to eval: %v", err)
+	}
+	if len(g) != 1 || g[0].GetName() != "x.metric1" {
+		t.Errorf("unexpected result: %v", g)
+	}
+
+	if _, ok := LookupFunction("testShiftNameAlias"); !ok {
+		t.Errorf("alias not registered")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("duplicate registration did not panic")
+			}
+		}()
+		RegisterFunction(Function{Name: "sum", Eval: evalSumSeries})
+	}()
+}
+
+func TestFunctionsSorted(t *testing.T) {
+	fns := Functions()
+	seen := make(map[string]bool)
+	for i, f := range fns {
+		if i > 0 && fns[i-1].Name >= f.Name {
+			t.Errorf("functions not sorted: %q before %q", fns[i-1].Name, f.Name)
+		}
+		for _, a := range f.Aliases {
+			if seen[a] {
+				t.Errorf("alias %q listed twice", a)
+			}
+			seen[a] = true
+		}
+		if f.Eval == nil {
+			t.Errorf("%s has no eval callback", f.Name)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package expr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SavedExpr is a named expression, which targets refer to as @name(args).
+// Its parameters are referred to as $param: a name which is only $param is
+// replaced by the argument itself, which may be a series list or a number,
+// and $param within names and strings is replaced by the text of the
+// argument.
+type SavedExpr struct {
+	Params []string
+	Expr   *Expr
+}
+
+// SavedExprs are saved expressions by name.
+type SavedExprs map[string]*SavedExpr
+
+// savedName returns the name of the saved expression e refers to, if any
+func savedName(e *Expr) (string, bool) {
+	if (e.etype == etName || e.etype == etFunc) && strings.HasPrefix(e.target, "@") {
+		return e.target[1:], true
+	}
+	return "", false
+}
+
+// Check returns an error if a saved expression refers to an unknown one, or
+// to itself through others.
+func (s SavedExprs) Check() error {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	done := make(map[string]bool)
+	for _, name := range names {
+		if err := s.check(name, nil, done); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s SavedExprs) check(name string, stack []string, done map[string]bool) error {
+	if err := checkCycle(name, stack); err != nil {
+		return err
+	}
+	if done[name] {
+		return nil
+	}
+
+	stack = append(stack, name)
+
+	var err error
+	s[name].Expr.walk(func(e *Expr) {
+		ref, ok := savedName(e)
+		if !ok || err != nil {
+			return
+		}
+		if _, ok := s[ref]; !ok {
+			err = fmt.Errorf("@%s: unknown saved expression @%s", name, ref)
+			return
+		}
+		err = s.check(ref, stack, done)
+	})
+
+	done[name] = true
+	return err
+}
+
+// checkCycle returns an error if name is already being expanded
+func checkCycle(name string, stack []string) error {
+	for i, n := range stack {
+		if n == name {
+			return fmt.Errorf("@%s: cycle @%s -> @%s", name, strings.Join(stack[i:], " -> @"), name)
+		}
+	}
+	return nil
+}
+
+// walk calls f for e and each of its arguments, recursively
+func (e *Expr) walk(f func(*Expr)) {
+	f(e)
+	for _, a := range e.args {
+		a.walk(f)
+	}
+	for _, a := range e.namedArgs {
+		a.walk(f)
+	}
+}
+
+// Expand returns e with its references to saved expressions replaced by
+// them, or e itself if it has none.
+func (e *Expr) Expand(s SavedExprs) (*Expr, error) {
+	x := expander{saved: s}
+	return x.expand(e, nil)
+}
+
+// ExpandTarget parses target, replaces its references to saved expressions
+// by them and validates the result as ParseTarget does.  Errors are returned
+// as a *ParseError in target: those in a saved expression point at the
+// reference to it.
+func ExpandTarget(target string, s SavedExprs) (*Expr, error) {
+	rest := make(map[*Expr]int)
+
+	exp, e, err := parseExpr(target, rest)
+	if err == nil && e != "" {
+		err = ErrTrailingCharacters
+	}
+	if err != nil {
+		return nil, &ParseError{Target: target, Offset: len(target) - len(e), Err: err}
+	}
+
+	x := expander{saved: s, origins: make(map[*Expr]*Expr)}
+	expanded, err := x.expand(exp, nil)
+	if err != nil {
+		xerr := err.(*expandError)
+		return nil, &ParseError{Target: target, Offset: len(target) - rest[x.origin(xerr.node)], Err: xerr.err}
+	}
+
+	v := validator{target: target, rest: rest, origins: x.origins}
+	if err := v.validate(expanded); err != nil {
+		return nil, err
+	}
+
+	return expanded, nil
+}
+
+// expandError is an error in expanding the reference node
+type expandError struct {
+	node *Expr
+	err  error
+}
+
+func (e *expandError) Error() string { return e.err.Error() }
+
+// expander replaces references to saved expressions
+type expander struct {
+	saved SavedExprs
+	// origins maps the nodes made by the expansion to the nodes of the
+	// target they come from, if not nil
+	origins map[*Expr]*Expr
+}
+
+func (x *expander) errorf(e *Expr, format string, args ...interface{}) error {
+	return &expandError{node: e, err: fmt.Errorf(format, args...)}
+}
+
+// derive records that n was made from the node from
+func (x *expander) derive(n, from *Expr) {
+	if x.origins != nil {
+		x.origins[n] = x.origin(from)
+	}
+}
+
+// origin returns the node of the target e comes from
+func (x *expander) origin(e *Expr) *Expr {
+	if o, ok := x.origins[e]; ok {
+		return o
+	}
+	return e
+}
+
+func (x *expander) expand(e *Expr, stack []string) (*Expr, error) {
+	args, changed, err := x.expandArgs(e.args, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	namedArgs := e.namedArgs
+	if len(e.namedArgs) != 0 {
+		namedArgs = make(map[string]*Expr, len(e.namedArgs))
+		for k, a := range e.namedArgs {
+			if namedArgs[k], err = x.expand(a, stack); err != nil {
+				return nil, err
+			}
+			changed = changed || namedArgs[k] != a
+		}
+	}
+
+	name, ok := savedName(e)
+	if !ok {
+		if !changed {
+			return e, nil
+		}
+		c := *e
+		c.args, c.namedArgs = args, namedArgs
+		c.setArgString()
+		x.derive(&c, e)
+		return &c, nil
+	}
+
+	if err := checkCycle(name, stack); err != nil {
+		return nil, &expandError{node: e, err: err}
+	}
+
+	saved, ok := x.saved[name]
+	if !ok {
+		return nil, x.errorf(e, "unknown saved expression @%s", name)
+	}
+
+	if len(args) > len(saved.Params) {
+		return nil, x.errorf(e, "@%s takes %d arguments, got %d", name, len(saved.Params), len(args))
+	}
+
+	bound := make(map[string]*Expr)
+	for i, a := range args {
+		bound[saved.Params[i]] = a
+	}
+	for k, a := range namedArgs {
+		if !hasParam(saved, k) {
+			return nil, x.errorf(e, "@%s has no argument %q", name, k)
+		}
+		bound[k] = a
+	}
+	for _, p := range saved.Params {
+		if bound[p] == nil {
+			return nil, x.errorf(e, "@%s: missing argument %s", name, p)
+		}
+	}
+
+	body := saved.Expr.bind(bound, func(n *Expr) { x.derive(n, e) })
+	return x.expand(body, append(stack, name))
+}
+
+func (x *expander) expandArgs(args []*Expr, stack []string) ([]*Expr, bool, error) {
+	if len(args) == 0 {
+		return args, false, nil
+	}
+
+	changed := false
+	expanded := make([]*Expr, len(args))
+	for i, a := range args {
+		var err error
+		if expanded[i], err = x.expand(a, stack); err != nil {
+			return nil, false, err
+		}
+		changed = changed || expanded[i] != a
+	}
+
+	return expanded, changed, nil
+}
+
+func hasParam(saved *SavedExpr, name string) bool {
+	for _, p := range saved.Params {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bind returns a copy of e with its parameters replaced by the arguments,
+// calling made for each node of the copy which isn't an argument
+func (e *Expr) bind(args map[string]*Expr, made func(*Expr)) *Expr {
+	vars := make(map[string]string, len(args))
+	for k, a := range args {
+		vars[k] = a.value()
+	}
+	return e.bindWith(args, variableReplacer(vars), made)
+}
+
+func (e *Expr) bindWith(args map[string]*Expr, r *strings.Replacer, made func(*Expr)) *Expr {
+	if e.etype == etName && strings.HasPrefix(e.target, "$") {
+		if a, ok := args[e.target[1:]]; ok {
+			return a
+		}
+	}
+
+	c := *e
+	switch e.etype {
+	case etName:
+		c.target = r.Replace(e.target)
+	case etString:
+		c.valStr = r.Replace(e.valStr)
+	case etFunc:
+		c.args = make([]*Expr, len(e.args))
+		for i, a := range e.args {
+			c.args[i] = a.bindWith(args, r, made)
+		}
+		if e.namedArgs != nil {
+			c.namedArgs = make(map[string]*Expr, len(e.namedArgs))
+			for k, a := range e.namedArgs {
+				c.namedArgs[k] = a.bindWith(args, r, made)
+			}
+		}
+		c.setArgString()
+	}
+
+	made(&c)
+	return &c
+}
+
+// setArgString sets the argument list of a function call as it would be
+// parsed from its target
+func (e *Expr) setArgString() {
+	s := e.String()
+	e.argString = s[len(e.target)+1 : len(s)-1]
+}
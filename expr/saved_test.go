@@ -0,0 +1,165 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, s string) *Expr {
+	e, err := ParseTarget(s)
+	if err != nil {
+		// saved expressions aren't validated until expanded
+		var rest string
+		e, rest, err = ParseExpr(s)
+		if err != nil || rest != "" {
+			t.Fatalf("%s: parse error: %v", s, err)
+		}
+	}
+	return e
+}
+
+func testSavedExprs(t *testing.T, defs map[string][]string) SavedExprs {
+	s := make(SavedExprs)
+	for name, d := range defs {
+		s[name] = &SavedExpr{Params: d[1:], Expr: mustParse(t, d[0])}
+	}
+	return s
+}
+
+func TestExpand(t *testing.T) {
+	saved := testSavedExprs(t, map[string][]string{
+		"errorRate": {"divideSeries(sumSeries(apps.$app.errors), sumSeries(apps.$app.requests))", "app"},
+		"pct":       {"scale($series, 100)", "series"},
+		"errorPct":  {"@pct(@errorRate($app))", "app"},
+		"top":       {"highestMax($series, $n)", "series", "n"},
+		"named":     {"alias(apps.$app.requests, 'requests of $app')", "app"},
+		"all":       {"apps.*.requests"},
+	})
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"apps.checkout.requests", "apps.checkout.requests"},
+		{"@errorRate(checkout)", "divideSeries(sumSeries(apps.checkout.errors),sumSeries(apps.checkout.requests))"},
+		{"@errorRate(app=checkout)", "divideSeries(sumSeries(apps.checkout.errors),sumSeries(apps.checkout.requests))"},
+		{"@pct(sumSeries(a.b))", "scale(sumSeries(a.b),100)"},
+		{"@errorPct(checkout)", "scale(divideSeries(sumSeries(apps.checkout.errors),sumSeries(apps.checkout.requests)),100)"},
+		{"@top(@all, 3)", "highestMax(apps.*.requests,3)"},
+		{"@top(@all, n=3)", "highestMax(apps.*.requests,3)"},
+		{"@named(checkout)", "alias(apps.checkout.requests,\"requests of checkout\")"},
+		{"timeShift(@all, '1h')", "timeShift(apps.*.requests,\"1h\")"},
+	}
+
+	definition := saved["errorRate"].Expr.Canonical()
+
+	for _, tt := range tests {
+		e := mustParse(t, tt.target)
+		got, err := e.Expand(saved)
+		if err != nil {
+			t.Errorf("%s: expand error: %v", tt.target, err)
+			continue
+		}
+		if got.Canonical() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.target, got.Canonical(), tt.want)
+		}
+		if _, err := ParseTarget(got.String()); err != nil {
+			t.Errorf("%s: expanded to invalid %s: %v", tt.target, got.String(), err)
+		}
+	}
+
+	// the definitions are left alone
+	if s := saved["errorRate"].Expr.Canonical(); s != definition {
+		t.Errorf("definition changed from %s to %s", definition, s)
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	saved := testSavedExprs(t, map[string][]string{
+		"a":         {"sumSeries(@b)"},
+		"b":         {"scale(@a, 2)"},
+		"errorRate": {"divideSeries(apps.$app.errors, apps.$app.requests)", "app"},
+	})
+
+	tests := []struct {
+		target string
+		err    string
+	}{
+		{"@a", "cycle @a -> @b -> @a"},
+		{"@unknown(x)", "unknown saved expression @unknown"},
+		{"@errorRate", "missing argument app"},
+		{"@errorRate(a, b)", "takes 1 arguments, got 2"},
+		{"@errorRate(host=a)", `no argument "host"`},
+		{"sumSeries(@errorRate(@nope))", "unknown saved expression @nope"},
+	}
+
+	for _, tt := range tests {
+		_, err := mustParse(t, tt.target).Expand(saved)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.target, err, tt.err)
+		}
+	}
+}
+
+func TestExpandTarget(t *testing.T) {
+	saved := testSavedExprs(t, map[string][]string{
+		"errors": {"alias(apps.$app.errors, '$app')", "app"},
+		"bad":    {"scale(apps.$app.errors, 'x')", "app"},
+		"top":    {"highestMax($series, $n)", "series", "n"},
+		"nested": {"sumSeries(@bad($app))", "app"},
+	})
+
+	tests := []struct {
+		target string
+		err    string
+		offset int
+	}{
+		{"sumSeries(@errors(checkout))", "", 0},
+		{"sumSeries(foo, @nope(x))", "unknown saved expression @nope", 15},
+		{"sumSeries(@errors(a, b))", "@errors takes 1 arguments, got 2", 10},
+		// errors in the definitions point at the references to them
+		{"sumSeries(@bad(checkout))", "@bad: scale: argument factor must be of type float", 10},
+		{"absolute(@nested(checkout))", "@nested: scale: argument factor must be of type float", 9},
+		// and errors in the arguments at the arguments
+		{"@top(foo.*, 'three')", "highestMax: argument n must be of type integer", 12},
+		{"sumSeries(@errors(checkout)", "missing comma", 27},
+	}
+
+	for _, tt := range tests {
+		_, err := ExpandTarget(tt.target, saved)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.target, err)
+			}
+			continue
+		}
+
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: got %v, want a *ParseError", tt.target, err)
+			continue
+		}
+		if perr.Err.Error() != tt.err || perr.Offset != tt.offset {
+			t.Errorf("%s: got %q at %d, want %q at %d", tt.target, perr.Err, perr.Offset, tt.err, tt.offset)
+		}
+	}
+}
+
+func TestSavedExprsCheck(t *testing.T) {
+	tests := []struct {
+		defs map[string][]string
+		err  string
+	}{
+		{map[string][]string{"a": {"scale(@b, 2)"}, "b": {"x.y"}}, ""},
+		{map[string][]string{"a": {"scale(@a, 2)"}}, "@a: cycle @a -> @a"},
+		{map[string][]string{"a": {"@b"}, "b": {"sumSeries(@c, x)"}, "c": {"@a(1)"}}, "cycle @a -> @b -> @c -> @a"},
+		{map[string][]string{"a": {"scale(@b, 2)"}}, "@a: unknown saved expression @b"},
+	}
+
+	for _, tt := range tests {
+		err := testSavedExprs(t, tt.defs).Check()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: got error %v, want %q", tt.defs, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package expr
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WithVariables returns a copy of e with $name replaced by vars[name] in its
+// metric names and strings.  Variables set this way take precedence over the
+// values given to template().
+func (e *Expr) WithVariables(vars map[string]string) *Expr {
+	if len(vars) == 0 {
+		return e
+	}
+	return e.substitute(variableReplacer(vars))
+}
+
+// variableReplacer replaces $name by vars[name], trying longer names first
+// so that $hostname isn't taken for $host followed by "name"
+func variableReplacer(vars map[string]string) *strings.Replacer {
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	sort.Stable(byLengthDesc(names))
+
+	var pairs []string
+	for _, k := range names {
+		pairs = append(pairs, "$"+k, vars[k])
+	}
+
+	return strings.NewReplacer(pairs...)
+}
+
+type byLengthDesc []string
+
+func (s byLengthDesc) Len() int           { return len(s) }
+func (s byLengthDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLengthDesc) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+
+// templateArg returns the first argument of a template() call with its
+// variables set: $1, $2... to the other positional arguments, and $name to the
+// named ones
+func templateArg(e *Expr) *Expr {
+	vars := make(map[string]string)
+
+	for i, a := range e.args[1:] {
+		vars[strconv.Itoa(i+1)] = a.value()
+	}
+	for k, a := range e.namedArgs {
+		vars[k] = a.value()
+	}
+
+	return e.args[0].WithVariables(vars)
+}
+
+// value returns an argument as it is substituted for a template variable
+func (e *Expr) value() string {
+	switch e.etype {
+	case etConst:
+		return strconv.FormatFloat(e.val, 'g', -1, 64)
+	case etString:
+		return e.valStr
+	case etFunc:
+		return e.String()
+	}
+	return e.target
+}
+
+// template(seriesList, *values, **variables)
+func evalTemplate(ctx context.Context, e *Expr, from, until int64, values map[MetricRequest][]*MetricData) ([]*MetricData, error) {
+	return EvalExpr(ctx, templateArg(e), from, until, values)
+}
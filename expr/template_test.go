@@ -0,0 +1,60 @@
+package expr
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+
+	tests := []struct {
+		target  string
+		vars    map[string]string
+		metrics []string
+	}{
+		{"template(servers.$host.cpu, host='web01')", nil, []string{"servers.web01.cpu"}},
+		{"template(servers.$1.$2, 'web01', 'cpu')", nil, []string{"servers.web01.cpu"}},
+		{"template(servers.$1.cpu, 1)", nil, []string{"servers.1.cpu"}},
+		{"template(sumSeries(servers.$host.cpu, servers.$hostname.mem), host='web01', hostname='db01')", nil, []string{"servers.web01.cpu", "servers.db01.mem"}},
+		{"template(servers.$host.cpu, host='web01')", map[string]string{"host": "web02"}, []string{"servers.web02.cpu"}},
+		{"servers.$host.$metric", map[string]string{"host": "web02", "metric": "cpu"}, []string{"servers.web02.cpu"}},
+		{"timeShift(template(servers.$host.cpu, host='web01'), '1h')", nil, []string{"servers.web01.cpu"}},
+	}
+
+	for _, tt := range tests {
+		e, err := ParseTarget(tt.target)
+		if err != nil {
+			t.Errorf("%s: parse error: %v", tt.target, err)
+			continue
+		}
+		e = e.WithVariables(tt.vars)
+
+		var got []string
+		for _, m := range e.Metrics() {
+			got = append(got, m.Metric)
+		}
+		if !reflect.DeepEqual(got, tt.metrics) {
+			t.Errorf("%s with %v: got metrics %v, want %v", tt.target, tt.vars, got, tt.metrics)
+		}
+	}
+}
+
+func TestEvalTemplate(t *testing.T) {
+	e, err := ParseTarget("template(scale(servers.$host.cpu, 2), host='web01')")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	values := map[MetricRequest][]*MetricData{
+		{"servers.web01.cpu", 0, 1}: {makeResponse("servers.web01.cpu", []float64{1, 2, 3}, 1, 0)},
+	}
+
+	r, err := EvalExpr(context.Background(), e, 0, 1, values)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(r) != 1 || r[0].GetName() != "scale(servers.web01.cpu,2)" || !reflect.DeepEqual(r[0].Values, []float64{2, 4, 6}) {
+		t.Errorf("got %+v", r)
+	}
+}
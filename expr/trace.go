@@ -0,0 +1,102 @@
+package expr
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Trace records the evaluation of the nodes of expressions, when carried in
+// the context given to EvalExpr.
+type Trace struct {
+	mu    sync.Mutex
+	nodes map[*Expr]*NodeEval
+}
+
+// NodeEval is what the evaluation of an expression node returned and took.
+// The run time includes the evaluation of its arguments.
+type NodeEval struct {
+	Calls   int     `json:"calls"`
+	Series  int     `json:"series"`
+	Runtime float64 `json:"runtime"`
+}
+
+// NewTrace returns an empty trace.
+func NewTrace() *Trace {
+	return &Trace{nodes: make(map[*Expr]*NodeEval)}
+}
+
+type traceContextKey struct{}
+
+// WithTrace returns a context recording evaluations into t.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, t)
+}
+
+func traceFromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceContextKey{}).(*Trace)
+	return t
+}
+
+func (t *Trace) record(e *Expr, series int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, ok := t.nodes[e]
+	if !ok {
+		n = &NodeEval{}
+		t.nodes[e] = n
+	}
+	n.Calls++
+	n.Series += series
+	n.Runtime += d.Seconds()
+}
+
+// Node is a parsed expression in a form fit for JSON, along with what its
+// evaluation did if it was traced.
+type Node struct {
+	// Type is one of "name", "func", "const" and "string"
+	Type      string           `json:"type"`
+	Name      string           `json:"name,omitempty"`
+	Value     interface{}      `json:"value,omitempty"`
+	Args      []*Node          `json:"args,omitempty"`
+	NamedArgs map[string]*Node `json:"namedArgs,omitempty"`
+	Eval      *NodeEval        `json:"eval,omitempty"`
+}
+
+// Tree returns the tree of e, with the evaluations recorded in t, which may
+// be nil.
+func (e *Expr) Tree(t *Trace) *Node {
+	var n Node
+
+	switch e.etype {
+	case etName:
+		n.Type, n.Name = "name", e.target
+	case etFunc:
+		n.Type, n.Name = "func", e.target
+		for _, a := range e.args {
+			n.Args = append(n.Args, a.Tree(t))
+		}
+		if len(e.namedArgs) != 0 {
+			n.NamedArgs = make(map[string]*Node, len(e.namedArgs))
+			for k, a := range e.namedArgs {
+				n.NamedArgs[k] = a.Tree(t)
+			}
+		}
+	case etConst:
+		n.Type, n.Value = "const", e.val
+	case etString:
+		n.Type, n.Value = "string", e.valStr
+	}
+
+	if t != nil {
+		t.mu.Lock()
+		if ev, ok := t.nodes[e]; ok {
+			c := *ev
+			n.Eval = &c
+		}
+		t.mu.Unlock()
+	}
+
+	return &n
+}
@@ -0,0 +1,62 @@
+package expr
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestTrace(t *testing.T) {
+
+	e, _, err := ParseExpr("sumSeries(scale(foo.*, 2), bar)")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	series := func(name string) *MetricData {
+		return &MetricData{FetchResponse: pb.FetchResponse{Name: proto.String(name), StartTime: proto.Int32(0), StopTime: proto.Int32(60), StepTime: proto.Int32(60), Values: []float64{1}, IsAbsent: []bool{false}}}
+	}
+
+	values := map[MetricRequest][]*MetricData{
+		{"foo.*", 0, 1}: {series("foo.a"), series("foo.b")},
+		{"bar", 0, 1}:   {series("bar")},
+	}
+
+	trace := NewTrace()
+	if _, err := EvalExpr(WithTrace(context.Background(), trace), e, 0, 1, values); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	tree := e.Tree(trace)
+
+	check := func(what string, n *Node, typ, name string, series int) {
+		if n.Type != typ || n.Name != name {
+			t.Errorf("%s: got %s %q, want %s %q", what, n.Type, n.Name, typ, name)
+		}
+		if series < 0 {
+			if n.Eval != nil {
+				t.Errorf("%s: got eval %+v, want none", what, n.Eval)
+			}
+			return
+		}
+		if n.Eval == nil || n.Eval.Calls != 1 || n.Eval.Series != series {
+			t.Errorf("%s: got eval %+v, want 1 call returning %d series", what, n.Eval, series)
+		}
+	}
+
+	check("sumSeries", tree, "func", "sumSeries", 1)
+	check("scale", tree.Args[0], "func", "scale", 2)
+	check("foo.*", tree.Args[0].Args[0], "name", "foo.*", 2)
+	check("2", tree.Args[0].Args[1], "const", "", -1)
+	check("bar", tree.Args[1], "name", "bar", 1)
+
+	if v, ok := tree.Args[0].Args[1].Value.(float64); !ok || v != 2 {
+		t.Errorf("const: got value %v, want 2", tree.Args[0].Args[1].Value)
+	}
+
+	if untraced := e.Tree(nil); untraced.Eval != nil {
+		t.Errorf("untraced tree: got eval %+v", untraced.Eval)
+	}
+}
@@ -0,0 +1,266 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrTrailingCharacters is a parse error returned when a target goes on after its expression.
+	ErrTrailingCharacters = errors.New("unexpected characters after expression")
+)
+
+// ParseError is an error in a target, found while parsing or validating it.
+type ParseError struct {
+	Target string
+	// Offset is the position of the error in Target, in bytes.
+	Offset int
+	Err    error
+	// Suggestion is a known function name close to an unknown one.
+	Suggestion string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+// Excerpt returns the target with a caret under the error on the next line.
+func (e *ParseError) Excerpt() string {
+	return e.Target + "\n" + strings.Repeat(" ", e.Offset) + "^"
+}
+
+// ParseTarget parses target and validates its function calls: that each
+// function is known, and is given as many arguments as it takes, of the right
+// types.  Errors are returned as a *ParseError.
+func ParseTarget(target string) (*Expr, error) {
+	rest := make(map[*Expr]int)
+
+	exp, e, err := parseExpr(target, rest)
+	if err == nil && e != "" {
+		err = ErrTrailingCharacters
+	}
+	if err != nil {
+		return nil, &ParseError{Target: target, Offset: len(target) - len(e), Err: err}
+	}
+
+	v := validator{target: target, rest: rest}
+	if err := v.validate(exp); err != nil {
+		return nil, err
+	}
+
+	return exp, nil
+}
+
+// validator checks the function calls of a parsed target
+type validator struct {
+	target string
+	rest   map[*Expr]int
+	// origins are the nodes of the target those made by expanding saved
+	// expressions come from
+	origins map[*Expr]*Expr
+}
+
+func (v *validator) errorf(e *Expr, format string, args ...interface{}) *ParseError {
+	err := fmt.Errorf(format, args...)
+	if o, ok := v.origins[e]; ok {
+		if name, ok := savedName(o); ok {
+			err = fmt.Errorf("@%s: %v", name, err)
+		}
+		e = o
+	}
+	return &ParseError{Target: v.target, Offset: len(v.target) - v.rest[e], Err: err}
+}
+
+func (v *validator) validate(e *Expr) error {
+	if e.etype != etFunc {
+		return nil
+	}
+
+	if _, ok := savedName(e); ok {
+		// checked once expanded, but its arguments are targets in their own right
+		for _, a := range e.args {
+			if err := v.validate(a); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, ok := lookupFunction(e.target)
+	if !ok {
+		return v.unknownFunction(e, e.target)
+	}
+
+	params := positionalParams(f, e)
+
+	for i, a := range e.args {
+		var p Param
+		switch {
+		case i < len(params):
+			p = params[i]
+		case len(params) != 0 && params[len(params)-1].Multiple:
+			p = params[len(params)-1]
+		default:
+			return v.errorf(a, "%s takes at most %d arguments, got %d", f.Name, len(params), len(e.args))
+		}
+		if err := v.validateArg(f, p, a); err != nil {
+			return err
+		}
+	}
+
+	// sorted for the same error on each request
+	names := make([]string, 0, len(e.namedArgs))
+	for k := range e.namedArgs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		a := e.namedArgs[k]
+		p, ok := findParam(f, k)
+		if !ok && f.Name == "template" {
+			// any name is a variable
+			p, ok = Param{Name: k, Type: ParamAny}, true
+		}
+		if !ok {
+			return v.errorf(a, "%s has no argument %q", f.Name, k)
+		}
+		if err := v.validateArg(f, p, a); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range params {
+		if p.Required && i >= len(e.args) && e.namedArgs[p.Name] == nil {
+			return v.errorf(e, "%s: missing argument %s (%s)", f.Name, p.Name, p.Type)
+		}
+	}
+
+	// the callbacks are only parsed for each group at eval time
+	switch f.Name {
+	case "groupByNode":
+		callback, _ := getStringArg(e, 2)
+		if _, ok := lookupFunction(callback); !ok {
+			return v.unknownFunction(e.args[2], callback)
+		}
+	case "applyByNode":
+		template, _ := getStringArg(e, 2)
+		if _, err := ParseTarget(template); err != nil {
+			return v.errorf(e.args[2], "%s: bad templateFunction: %v", f.Name, err.(*ParseError).Err)
+		}
+	}
+
+	return nil
+}
+
+// positionalParams returns the parameters of f in the order e gives them
+func positionalParams(f *Function, e *Expr) []Param {
+	if f.Name == "mostDeviant" && len(e.args) != 0 && e.args[0].etype == etConst {
+		// the legacy mostDeviant(n, seriesList), still taken by evalMostDeviant
+		return []Param{f.Params[1], f.Params[0]}
+	}
+	return f.Params
+}
+
+func (v *validator) unknownFunction(e *Expr, name string) *ParseError {
+	s := suggestFunction(name)
+	if s == "" {
+		return v.errorf(e, "unknown function %q", name)
+	}
+	err := v.errorf(e, "unknown function %q, did you mean %q?", name, s)
+	err.Suggestion = s
+	return err
+}
+
+func findParam(f *Function, name string) (Param, bool) {
+	for _, p := range f.Params {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Param{}, false
+}
+
+// validateArg checks that a is of the type of parameter p of f
+func (v *validator) validateArg(f *Function, p Param, a *Expr) error {
+	ok := true
+
+	switch p.Type {
+	case ParamSeries, ParamSeriesList, ParamSeriesLists:
+		ok = a.etype == etName || a.etype == etFunc
+	case ParamNode, ParamInt, ParamFloat:
+		ok = a.etype == etConst
+	case ParamString, ParamAggFunc:
+		ok = a.etype == etString
+	case ParamBool:
+		_, err := doGetBoolArg(a)
+		ok = err == nil
+	case ParamInterval:
+		ok = a.etype == etString && validInterval(a.valStr)
+	case ParamIntOrInterval:
+		ok = a.etype == etConst || a.etype == etString && validInterval(a.valStr)
+	}
+
+	if !ok {
+		return v.errorf(a, "%s: argument %s must be of type %s", f.Name, p.Name, p.Type)
+	}
+
+	return v.validate(a)
+}
+
+func validInterval(s string) bool {
+	if s == "" {
+		return false
+	}
+	_, err := IntervalString(s, 1)
+	return err == nil
+}
+
+// suggestFunction returns the known function name closest to name, if any
+// is close enough to be a likely typo
+func suggestFunction(name string) string {
+	lower := strings.ToLower(name)
+
+	best, bestDist := "", len(name)/3+1
+	for _, f := range Functions() {
+		for _, n := range append([]string{f.Name}, f.Aliases...) {
+			if d := editDistance(lower, strings.ToLower(n)); d < bestDist || d == bestDist && best != "" && n < best {
+				best, bestDist = n, d
+			}
+		}
+	}
+
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
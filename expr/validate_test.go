@@ -0,0 +1,63 @@
+package expr
+
+import "testing"
+
+func TestParseTarget(t *testing.T) {
+
+	tests := []struct {
+		target     string
+		err        string
+		offset     int
+		suggestion string
+	}{
+		{"sumSeries(foo.*, bar)", "", 0, ""},
+		{"summarize(foo, '1h', func='max', alignToFrom=true)", "", 0, ""},
+		{"movingAverage(foo, windowSize='5min')", "", 0, ""},
+		{"aliasByNode(foo.*.bar, 1, 2, 3)", "", 0, ""},
+		{"applyByNode(foo.*.bar, 1, 'sumSeries(%.baz)')", "", 0, ""},
+		{"mostDeviant(foo.*, 2)", "", 0, ""},
+		{"mostDeviant(2, foo.*)", "", 0, ""},
+		{"mostDeviant(2, 3)", "mostDeviant: argument seriesList must be of type seriesList", 15, ""},
+		{"sumSeries(foo.*", "missing comma", 15, ""},
+		{"sumSeries(foo.*))", "unexpected characters after expression", 16, ""},
+		{"absolute(foo, 'bar)", "missing quote", 19, ""},
+		{"movingAverag(foo, 5)", `unknown function "movingAverag", did you mean "movingAverage"?`, 0, "movingAverage"},
+		{"scale(sumz(foo), 2)", `unknown function "sumz", did you mean "sum"?`, 6, "sum"},
+		{"scale(nothingLikeIt(foo), 2)", `unknown function "nothingLikeIt"`, 6, ""},
+		{"scale(foo)", "scale: missing argument factor (float)", 0, ""},
+		{"scale(foo, 'x')", "scale: argument factor must be of type float", 11, ""},
+		{"absolute(foo, 1)", "absolute takes at most 1 arguments, got 2", 14, ""},
+		{"timeShift(foo, '1fortnight')", "timeShift: argument timeShift must be of type interval", 15, ""},
+		{"sortByName(foo, natural=1)", "sortByName: argument natural must be of type boolean", 24, ""},
+		{"sortByName(foo, unnatural=true)", `sortByName has no argument "unnatural"`, 26, ""},
+		{"groupByNode(foo.*, 1, 'sumz')", `unknown function "sumz", did you mean "sum"?`, 22, "sum"},
+		{"applyByNode(foo.*, 1, 'sumSeries(%.bar')", "applyByNode: bad templateFunction: missing comma", 22, ""},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseTarget(tt.target)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.target, err)
+			}
+			continue
+		}
+
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: got %v, want a *ParseError", tt.target, err)
+			continue
+		}
+		if perr.Err.Error() != tt.err || perr.Offset != tt.offset || perr.Suggestion != tt.suggestion {
+			t.Errorf("%s: got %q at %d (suggesting %q), want %q at %d (suggesting %q)", tt.target, perr.Err, perr.Offset, perr.Suggestion, tt.err, tt.offset, tt.suggestion)
+		}
+	}
+}
+
+func TestParseErrorExcerpt(t *testing.T) {
+	err := &ParseError{Target: "scale(foo, 'x')", Offset: 11}
+	want := "scale(foo, 'x')\n           ^"
+	if got := err.Excerpt(); got != want {
+		t.Errorf("Excerpt()=%q, want %q", got, want)
+	}
+}
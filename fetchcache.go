@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dgryski/carbonapi/expr"
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// fetchSettleTime is how long after the end of a chunk its data may still
+// change, as carbon writes lag behind
+const fetchSettleTime = 5 * 60
+
+// chunkCache caches render data per series, in chunks of time aligned to a
+// multiple of the chunk size.  A sliding window then only needs the chunks it
+// has not seen yet from the zipper, and the rest is stitched together from the
+// cache.
+//
+// The step of a series depends on how far back the request goes, so the step
+// last returned for a series is remembered for each power-of-two age.  If a
+// fetch of the missing chunks comes back with a different step, the series is
+// no longer cached for requests of that age.
+type chunkCache struct {
+	cache bytesCache
+	chunk int64
+
+	// ttl is the expiry of settled chunks, recentTTL that of chunks which
+	// may still receive data
+	ttl       int32
+	recentTTL int32
+}
+
+// renderCache caches render data when enabled
+var renderCache *chunkCache
+
+// fetchRange is the time range of a zipper request for a set of leaves
+type fetchRange struct {
+	from, until int64
+}
+
+// seriesPlan is what we know about a leaf before going to the zipper
+type seriesPlan struct {
+	leaf   string
+	step   int64
+	chunks map[int64]*pb.FetchResponse
+}
+
+// render fetches the leaves for the time range, taking what it can from the
+// cache and asking the zipper for the rest, with one request for all leaves
+// missing the same chunks.  If some requests fail, the error is returned with
+// the results of the others.
+func (c *chunkCache) render(ctx context.Context, leaves []string, from, until int64) ([]expr.MetricData, error) {
+
+	now := timeNow().Unix()
+	age := c.ageBucket(now - from)
+	first, last := from-mod(from, c.chunk), until-mod(until, c.chunk)
+
+	var results []expr.MetricData
+	plans := make(map[string]*seriesPlan)
+	fetches := make(map[fetchRange][]string)
+
+	// leaves fetched as requested, without going through the cache
+	var direct []string
+
+	for _, leaf := range leaves {
+		if strings.ContainsAny(leaf, "*?[{") {
+			direct = append(direct, leaf)
+			continue
+		}
+
+		step, known := c.step(leaf, age)
+		if known && step == 0 {
+			direct = append(direct, leaf)
+			continue
+		}
+
+		p := &seriesPlan{leaf: leaf, step: step, chunks: make(map[int64]*pb.FetchResponse)}
+		plans[leaf] = p
+
+		if !known {
+			// fetch everything to learn the step
+			r := fetchRange{first, last + c.chunk}
+			fetches[r] = append(fetches[r], leaf)
+			continue
+		}
+
+		missFrom, missUntil := int64(-1), int64(-1)
+		for cs := first; cs <= last; cs += c.chunk {
+			if chunk, ok := c.getChunk(leaf, step, cs); ok {
+				Metrics.FetchCacheHits.Add(1)
+				observeCache("fetch", true)
+				p.chunks[cs] = chunk
+				continue
+			}
+			Metrics.FetchCacheMisses.Add(1)
+			observeCache("fetch", false)
+			if missFrom == -1 {
+				missFrom = cs
+			}
+			missUntil = cs + c.chunk
+		}
+
+		if missFrom == -1 {
+			results = append(results, c.stitch(p, from, until, nil))
+			continue
+		}
+
+		r := fetchRange{missFrom, missUntil}
+		fetches[r] = append(fetches[r], leaf)
+	}
+
+	var err error
+
+	for r, targets := range fetches {
+		// whisper returns the points after from, up to and including until
+		metrics, ferr := Zipper.RenderMulti(ctx, targets, r.from-1, r.until-1)
+		if ferr != nil {
+			if ferr != errNoMetrics {
+				err = ferr
+			}
+			continue
+		}
+
+		for i := range metrics {
+			m := &metrics[i]
+			p := plans[m.GetName()]
+			step := int64(m.GetStepTime())
+
+			switch {
+			case p == nil || step <= 0:
+				results = append(results, *m)
+			case p.step == 0 && c.chunk%step == 0:
+				// first fetch for this age
+				p.step = step
+				c.setStep(p.leaf, age, step)
+				c.store(p, &m.FetchResponse, r, now)
+				results = append(results, c.stitch(p, from, until, &m.FetchResponse))
+			case p.step != step:
+				// the step doesn't fit the chunks, or we crossed into another
+				// retention: stop caching, and fetch the requested range again
+				c.setStep(p.leaf, age, 0)
+				direct = append(direct, p.leaf)
+			default:
+				c.store(p, &m.FetchResponse, r, now)
+				results = append(results, c.stitch(p, from, until, &m.FetchResponse))
+			}
+		}
+	}
+
+	if len(direct) != 0 {
+		metrics, ferr := Zipper.RenderMulti(ctx, direct, from, until)
+		if ferr == nil {
+			results = append(results, metrics...)
+		} else if ferr != errNoMetrics {
+			err = ferr
+		}
+	}
+
+	// a failed fetch is reported along with the results of the others
+	return results, err
+}
+
+// store caches the chunks of the fetched range which are completely covered by m
+func (c *chunkCache) store(p *seriesPlan, m *pb.FetchResponse, r fetchRange, now int64) {
+	start, stop, step := int64(m.GetStartTime()), int64(m.GetStopTime()), int64(m.GetStepTime())
+
+	for cs := r.from; cs < r.until; cs += c.chunk {
+		ce := cs + c.chunk
+		if start > cs || (stop < ce && stop <= now) {
+			continue
+		}
+
+		chunk := &pb.FetchResponse{
+			Name:      proto.String(p.leaf),
+			StartTime: proto.Int32(expr.ClampInt32(cs)),
+			StopTime:  proto.Int32(expr.ClampInt32(ce)),
+			StepTime:  proto.Int32(expr.ClampInt32(step)),
+		}
+		copyPoints(chunk, m)
+
+		b, err := chunk.Marshal()
+		if err != nil {
+			continue
+		}
+
+		ttl := c.ttl
+		if ce+fetchSettleTime > now {
+			ttl = c.recentTTL
+		}
+		c.cache.set(c.chunkKey(p.leaf, step, cs), b, ttl)
+
+		p.chunks[cs] = chunk
+	}
+}
+
+// stitch assembles the points for the request from the cached chunks and the
+// fetched data, aligned the way whisper aligns them
+func (c *chunkCache) stitch(p *seriesPlan, from, until int64, fetched *pb.FetchResponse) expr.MetricData {
+	step := p.step
+	start := from - mod(from, step) + step
+	stop := until - mod(until, step) + step
+
+	r := pb.FetchResponse{
+		Name:      proto.String(p.leaf),
+		StartTime: proto.Int32(expr.ClampInt32(start)),
+		StopTime:  proto.Int32(expr.ClampInt32(stop)),
+		StepTime:  proto.Int32(expr.ClampInt32(step)),
+	}
+
+	for _, chunk := range p.chunks {
+		copyPoints(&r, chunk)
+	}
+	if fetched != nil {
+		copyPoints(&r, fetched)
+	}
+
+	return expr.MetricData{FetchResponse: r}
+}
+
+// copyPoints copies the points of src falling into the time range of dst,
+// which must have the same step.  dst is grown to its full length if needed,
+// with missing points marked absent.
+func copyPoints(dst, src *pb.FetchResponse) {
+	step := int64(dst.GetStepTime())
+	dstStart := int64(dst.GetStartTime())
+	n := int((int64(dst.GetStopTime()) - dstStart) / step)
+
+	if len(dst.Values) != n {
+		dst.Values = make([]float64, n)
+		dst.IsAbsent = make([]bool, n)
+		for i := range dst.IsAbsent {
+			dst.IsAbsent[i] = true
+		}
+	}
+
+	srcStart := int64(src.GetStartTime())
+	for i, v := range src.Values {
+		t := srcStart + int64(i)*step
+		j := (t - dstStart) / step
+		if t < dstStart || j >= int64(n) || (i < len(src.IsAbsent) && src.IsAbsent[i]) {
+			continue
+		}
+		dst.Values[j] = v
+		dst.IsAbsent[j] = false
+	}
+}
+
+func (c *chunkCache) ageBucket(age int64) int {
+	var bucket int
+	for a := age / c.chunk; a > 0; a >>= 1 {
+		bucket++
+	}
+	return bucket
+}
+
+func (c *chunkCache) stepKey(leaf string, age int) string {
+	return fmt.Sprintf("fetchstep:%s:%d", leaf, age)
+}
+
+func (c *chunkCache) chunkKey(leaf string, step, cs int64) string {
+	return fmt.Sprintf("fetch:%s:%d:%d:%d", leaf, step, c.chunk, cs)
+}
+
+// step returns the step remembered for the leaf, or 0 if it isn't cacheable
+func (c *chunkCache) step(leaf string, age int) (int64, bool) {
+	b, ok := c.cache.get(c.stepKey(leaf, age))
+	if !ok {
+		return 0, false
+	}
+
+	var step int64
+	if _, err := fmt.Sscan(string(b), &step); err != nil {
+		return 0, false
+	}
+
+	return step, true
+}
+
+func (c *chunkCache) setStep(leaf string, age int, step int64) {
+	c.cache.set(c.stepKey(leaf, age), []byte(fmt.Sprint(step)), c.ttl)
+}
+
+func (c *chunkCache) getChunk(leaf string, step, cs int64) (*pb.FetchResponse, bool) {
+	b, ok := c.cache.get(c.chunkKey(leaf, step, cs))
+	if !ok {
+		return nil, false
+	}
+
+	var chunk pb.FetchResponse
+	if err := chunk.Unmarshal(b); err != nil {
+		return nil, false
+	}
+
+	return &chunk, true
+}
+
+// mod is the modulo operation, always returning a value in [0, m)
+func mod(x, m int64) int64 {
+	r := x % m
+	if r < 0 {
+		r += m
+	}
+	return r
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// ttlCache is a bytesCache which expires entries according to timeNow
+type ttlCache struct {
+	sync.Mutex
+	m map[string]ttlEntry
+}
+
+type ttlEntry struct {
+	v       []byte
+	expires time.Time
+}
+
+func (c *ttlCache) get(k string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.m[k]
+	if !ok || !timeNow().Before(e.expires) {
+		return nil, false
+	}
+	return e.v, true
+}
+
+func (c *ttlCache) set(k string, v []byte, expire int32) {
+	c.Lock()
+	defer c.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]ttlEntry)
+	}
+	c.m[k] = ttlEntry{v, timeNow().Add(time.Duration(expire) * time.Second)}
+}
+
+// fakeWhisper answers renders like carbonserver would for a whisper file with
+// a 60s step, where the value of each point is its timestamp
+func fakeWhisper(requests *[]fetchRange) *httptest.Server {
+	const step = 60
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, _ := strconv.ParseInt(r.FormValue("from"), 10, 64)
+		until, _ := strconv.ParseInt(r.FormValue("until"), 10, 64)
+		*requests = append(*requests, fetchRange{from, until})
+
+		if now := timeNow().Unix(); until > now {
+			until = now
+		}
+		start := from - from%step + step
+		stop := until - until%step + step
+
+		var resp pb.MultiFetchResponse
+		for _, target := range r.Form["target"] {
+			m := &pb.FetchResponse{
+				Name:      proto.String(target),
+				StartTime: proto.Int32(int32(start)),
+				StopTime:  proto.Int32(int32(stop)),
+				StepTime:  proto.Int32(step),
+			}
+			for t := start; t < stop; t += step {
+				m.Values = append(m.Values, float64(t))
+				m.IsAbsent = append(m.IsAbsent, false)
+			}
+			resp.Metrics = append(resp.Metrics, m)
+		}
+		b, _ := resp.Marshal()
+		w.Write(b)
+	}))
+}
+
+func TestChunkCache(t *testing.T) {
+	var requests []fetchRange
+	srv := fakeWhisper(&requests)
+	defer srv.Close()
+
+	Zipper = zipper{backends: []string{srv.URL}, client: &http.Client{}}
+
+	now := time.Unix(1000000030, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	c := &chunkCache{cache: &ttlCache{}, chunk: 600, ttl: 3600, recentTTL: 60}
+
+	render := func(from, until int64) []float64 {
+		metrics, err := c.render(context.Background(), []string{"foo.bar"}, from, until)
+		if err != nil || len(metrics) != 1 {
+			t.Fatalf("render(%d, %d)=%v, %v", from, until, metrics, err)
+		}
+
+		// the stitched series must match what the zipper would have returned
+		want, err := Zipper.Render(context.Background(), "foo.bar", from, until)
+		if err != nil {
+			t.Fatalf("Render: %v", err)
+		}
+		requests = requests[:len(requests)-1]
+
+		got := metrics[0]
+		if got.GetStartTime() != want.GetStartTime() || got.GetStepTime() != want.GetStepTime() {
+			t.Errorf("render(%d, %d): got start=%d step=%d, want %d, %d", from, until, got.GetStartTime(), got.GetStepTime(), want.GetStartTime(), want.GetStepTime())
+		}
+		for i, v := range want.Values {
+			if i >= len(got.Values) || got.IsAbsent[i] || got.Values[i] != v {
+				t.Fatalf("render(%d, %d): got %v, want %v", from, until, got.Values, want.Values)
+			}
+		}
+
+		return got.Values
+	}
+
+	until := now.Unix()
+	render(until-3600, until)
+	if want := []fetchRange{{999995999, 1000000199}}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("first render: got requests %v, want %v", requests, want)
+	}
+
+	// a minute later only the chunk holding recent data has expired
+	requests = nil
+	now = now.Add(time.Minute)
+	until = now.Unix()
+	render(until-3600, until)
+	if want := []fetchRange{{999999599, 1000000199}}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("sliding render: got requests %v, want %v", requests, want)
+	}
+
+	// an older window is served from the cache alone
+	requests = nil
+	render(until-3000, until-1200)
+	if len(requests) != 0 {
+		t.Errorf("cached render: got requests %v, want none", requests)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// flightGroup collapses concurrent calls for the same key into one, in the
+// manner of groupcache's singleflight.  The shared call runs with its own
+// context, which is only cancelled once every caller waiting for it has given
+// up, so one impatient client doesn't fail the request for everybody else.
+type flightGroup struct {
+	// shared counts the callers which were given another caller's result
+	shared *expvar.Int
+
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn for key unless a call for key is already in flight, in which
+// case it waits for that call's result instead.  shared reports whether the
+// result came from another caller.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+
+	c, shared := g.calls[key]
+	if !shared {
+		fctx, cancel := context.WithCancel(context.Background())
+		c = &flight{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go g.run(fctx, c, key, fn)
+	} else if g.shared != nil {
+		g.shared.Add(1)
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody wants the result any more
+			c.cancel()
+			g.forget(key, c)
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+func (g *flightGroup) run(ctx context.Context, c *flight, key string, fn func(ctx context.Context) (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.val, c.err = nil, fmt.Errorf("panic: %v", r)
+		}
+
+		g.mu.Lock()
+		g.forget(key, c)
+		g.mu.Unlock()
+
+		c.cancel()
+		close(c.done)
+	}()
+
+	c.val, c.err = fn(ctx)
+}
+
+// forget removes c from the group, unless it has already been replaced by a newer call
+func (g *flightGroup) forget(key string, c *flight) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := flightGroup{shared: new(expvar.Int)}
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "done", nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, s := g.do(context.Background(), "key", fn)
+			if v != "done" || err != nil {
+				t.Errorf("do()=%v, %v", v, err)
+			}
+			if s {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+
+	waitForWaiters(&g, "key", n)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	if shared != n-1 || g.shared.Value() != n-1 {
+		t.Errorf("%d shared results, counted %d, want %d", shared, g.shared.Value(), n-1)
+	}
+
+	// a later call starts a new flight
+	if _, _, s := g.do(context.Background(), "key", func(ctx context.Context) (interface{}, error) { return nil, nil }); s {
+		t.Errorf("finished flight was reused")
+	}
+}
+
+// waitForWaiters waits until n callers have joined the flight for key
+func waitForWaiters(g *flightGroup, key string, n int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		c := g.calls[key]
+		joined := c != nil && c.waiters == n
+		g.mu.Unlock()
+		if joined {
+			return
+		}
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	var g flightGroup
+
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	errs := make(chan error, 2)
+	go func() { _, err, _ := g.do(ctx1, "key", fn); errs <- err }()
+	go func() { _, err, _ := g.do(ctx2, "key", fn); errs <- err }()
+
+	waitForWaiters(&g, "key", 2)
+
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+
+	select {
+	case <-cancelled:
+		t.Fatalf("flight cancelled while a caller is still waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancel2()
+	<-errs
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("flight not cancelled once every caller gave up")
+	}
+}
+
+func TestRenderDeduplicated(t *testing.T) {
+	var finds, renders int32
+	release := make(chan struct{})
+	fake := fakeZipper([]string{"foo.a", "foo.b"}, []string{"foo.a", "foo.b"})
+	defer fake.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics/find/":
+			atomic.AddInt32(&finds, 1)
+			<-release
+		case "/render/":
+			atomic.AddInt32(&renders, 1)
+		}
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+
+	Zipper = zipper{backends: []string{slow.URL}, client: &http.Client{}, batchSize: 10}
+	Limiter = newLimiter(10)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+
+	const n = 5
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/render?target=foo.*&format=json&from=0&until=60", nil)
+			w := httptest.NewRecorder()
+			var stats renderStats
+			renderHandler(w, req, &stats)
+			if w.Code != http.StatusOK {
+				t.Errorf("got status %d: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&finds) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if finds != 1 || renders != 1 {
+		t.Errorf("got %d finds and %d renders for %d identical requests, want 1 each", finds, renders, n)
+	}
+}
@@ -1,10 +1,188 @@
 package main
 
-type limiter chan struct{}
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
 
-func (l limiter) enter() { l <- struct{}{} }
-func (l limiter) leave() { <-l }
+var errQueueTimeout = errors.New("timed out waiting for a zipper request slot")
 
-func newLimiter(l int) limiter {
-	return make(chan struct{}, l)
+// limiter bounds the number of concurrent zipper requests.  When all slots
+// are taken, waiting requests are served by weighted fair queuing on the
+// client found in their context, so that one client sending many requests
+// only delays its own.
+//
+// Each waiter is tagged with the virtual time at which it would finish if
+// every client were given its share of the slots, that is the later of the
+// current virtual time and the client's previous tag, plus the inverse of the
+// client's weight.  Free slots go to the waiter with the lowest tag.
+type limiter struct {
+	slots int
+
+	// timeout bounds the wait for a slot, if non-zero
+	timeout time.Duration
+
+	// weights are the shares of the clients, 1 if not listed
+	weights map[string]float64
+
+	mu     sync.Mutex
+	inUse  int
+	vtime  float64
+	finish map[string]float64
+	queue  waitQueue
+	seq    uint64
+}
+
+func newLimiter(l int) *limiter {
+	return &limiter{slots: l, finish: make(map[string]float64)}
+}
+
+type waiter struct {
+	client string
+	tag    float64
+	seq    uint64
+	ready  chan struct{}
+	index  int
+}
+
+// enter blocks until a slot is free or ctx is done, in which case it returns
+// ctx.Err(), or the limiter's timeout is over, in which case it returns
+// errQueueTimeout
+func (l *limiter) enter(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	t0 := time.Now()
+	defer func() { limiterWait.with().observe(time.Since(t0).Seconds()) }()
+
+	l.mu.Lock()
+	if l.inUse < l.slots && len(l.queue) == 0 {
+		l.inUse++
+		l.mu.Unlock()
+		return nil
+	}
+
+	client := clientFromContext(ctx)
+	weight := l.weights[client]
+	if weight <= 0 {
+		weight = 1
+	}
+
+	start := l.vtime
+	if f := l.finish[client]; f > start {
+		start = f
+	}
+
+	w := &waiter{client: client, tag: start + 1/weight, seq: l.seq, ready: make(chan struct{})}
+	l.seq++
+	l.finish[client] = w.tag
+	heap.Push(&l.queue, w)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		Metrics.LimiterTimeouts.Add(1)
+		err = errQueueTimeout
+	}
+
+	l.mu.Lock()
+	if w.index < 0 {
+		// we were given a slot as we gave up: pass it on
+		l.inUse--
+		l.dispatch()
+	} else {
+		heap.Remove(&l.queue, w.index)
+		if l.finish[w.client] == w.tag {
+			// fall back to the tag of the client's last waiter still queued
+			delete(l.finish, w.client)
+			for _, q := range l.queue {
+				if q.client == w.client && q.tag > l.finish[w.client] {
+					l.finish[w.client] = q.tag
+				}
+			}
+		}
+	}
+	l.mu.Unlock()
+
+	return err
+}
+
+// leave releases a slot taken by enter
+func (l *limiter) leave() {
+	l.mu.Lock()
+	l.inUse--
+	l.dispatch()
+	l.mu.Unlock()
+}
+
+// dispatch hands the free slots to the waiters with the lowest tags
+func (l *limiter) dispatch() {
+	for l.inUse < l.slots && len(l.queue) != 0 {
+		w := heap.Pop(&l.queue).(*waiter)
+		l.vtime = w.tag
+		l.forget(w)
+		l.inUse++
+		close(w.ready)
+	}
+}
+
+// forget drops the finish tag of the client of w once it has nothing queued
+func (l *limiter) forget(w *waiter) {
+	if l.finish[w.client] == w.tag {
+		delete(l.finish, w.client)
+	}
+}
+
+// stats returns the number of slots in use and of waiting requests
+func (l *limiter) stats() (inUse, waiting int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inUse, len(l.queue)
+}
+
+// waitQueue is a heap of waiters, by tag and then arrival
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].tag != q[j].tag {
+		return q[i].tag < q[j].tag
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitForQueue waits until n requests are waiting for l
+func waitForQueue(l *limiter, n int) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, waiting := l.stats(); waiting == n {
+			return
+		}
+	}
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	l := newLimiter(1)
+	l.timeout = 10 * time.Millisecond
+
+	if err := l.enter(context.Background()); err != nil {
+		t.Fatalf("enter on empty limiter: %v", err)
+	}
+
+	if err := l.enter(context.Background()); err != errQueueTimeout {
+		t.Errorf("enter on full limiter: got %v, want %v", err, errQueueTimeout)
+	}
+
+	if inUse, waiting := l.stats(); inUse != 1 || waiting != 0 {
+		t.Errorf("got %d slots in use and %d waiting, want 1 and 0", inUse, waiting)
+	}
+
+	l.leave()
+	if err := l.enter(context.Background()); err != nil {
+		t.Errorf("enter after leave: %v", err)
+	}
+}
+
+func TestLimiterFairness(t *testing.T) {
+
+	tests := []struct {
+		weights map[string]float64
+		clients []string
+		want    []string
+	}{
+		{
+			// b isn't stuck behind all of a's requests
+			clients: []string{"a", "a", "a", "b"},
+			want:    []string{"a", "b", "a", "a"},
+		},
+		{
+			weights: map[string]float64{"b": 3},
+			clients: []string{"a", "a", "b", "b", "b", "b"},
+			want:    []string{"b", "b", "a", "b", "b", "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		l := newLimiter(1)
+		l.weights = tt.weights
+
+		if err := l.enter(context.Background()); err != nil {
+			t.Fatalf("enter on empty limiter: %v", err)
+		}
+
+		served := make(chan string)
+		for i, client := range tt.clients {
+			go func(client string) {
+				if err := l.enter(withClient(context.Background(), client)); err != nil {
+					t.Errorf("enter: %v", err)
+				}
+				served <- client
+			}(client)
+			waitForQueue(l, i+1)
+		}
+
+		var got []string
+		for range tt.clients {
+			l.leave()
+			got = append(got, <-served)
+		}
+		l.leave()
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("weights %v: served %v, want %v", tt.weights, got, tt.want)
+		}
+	}
+}
+
+func TestRenderQueueTimeout(t *testing.T) {
+	fake := fakeZipper([]string{"foo.bar"}, []string{"foo.bar"})
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	Limiter.timeout = 10 * time.Millisecond
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+
+	// somebody else holds the only slot
+	if err := Limiter.enter(context.Background()); err != nil {
+		t.Fatalf("enter on empty limiter: %v", err)
+	}
+	defer Limiter.leave()
+
+	req := httptest.NewRequest("GET", "/render?target=foo.bar&format=json&from=1000000000&until=1000000600", nil)
+	w := httptest.NewRecorder()
+	var stats renderStats
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
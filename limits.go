@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dgryski/carbonapi/expr"
+)
+
+// renderLimits bound the work done for a single render request, so that one
+// overly broad glob can't take the zipper down.  Zero means no limit.
+type renderLimits struct {
+	// globMatches bounds the find matches of each glob
+	globMatches int
+	// series bounds the number of series fetched
+	series int
+	// datapoints bounds the number of points fetched over all series
+	datapoints int
+	// step is the finest resolution of the metrics, in seconds, to estimate
+	// the points of series before fetching them.  If zero, the step of the
+	// first series fetched is used.
+	step int64
+	// responseSize bounds the size of the response body, in bytes
+	responseSize int
+	// cost bounds the nesting, function calls, fetches and moving windows
+	// of the targets, before anything is fetched
+	cost expr.Limits
+}
+
+var limits renderLimits
+
+// over reports whether n is over limit
+func over(n, limit int) bool {
+	return limit > 0 && n > limit
+}
+
+// limitError is the error for a request going over one of the limits, with
+// n of what for the target
+func limitError(target string, n int, what string, limit int) error {
+	msg := fmt.Sprintf("%s: target %s: %d %s, over the limit of %d", http.StatusText(http.StatusBadRequest), target, n, what, limit)
+	return renderError{http.StatusBadRequest, msg}
+}
+
+// costError is the error for a request whose targets, up to target, cost
+// more than limits.cost
+func costError(target string, err error) error {
+	msg := fmt.Sprintf("%s: target %s: %v", http.StatusText(http.StatusBadRequest), target, err)
+	return renderError{http.StatusBadRequest, msg}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dgryski/carbonapi/expr"
+)
+
+func TestRenderLimits(t *testing.T) {
+	leaves := []string{"foo.a", "foo.b", "foo.c", "foo.d", "foo.e"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}, batchSize: 5}
+	Limiter = newLimiter(1)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+	defer func() { limits = renderLimits{} }()
+
+	tests := []struct {
+		limits renderLimits
+		want   string
+	}{
+		{renderLimits{}, ""},
+		{renderLimits{globMatches: 5, series: 5, datapoints: 5, responseSize: 1000}, ""},
+		{renderLimits{globMatches: 4}, "target sum(foo.*): 5 find matches for foo.*, over the limit of 4"},
+		{renderLimits{series: 4}, "target sum(foo.*): 5 series, over the limit of 4"},
+		{renderLimits{datapoints: 3}, "target sum(foo.*): 5 datapoints, over the limit of 3"},
+		{renderLimits{responseSize: 10}, "target sum(foo.*): 52 bytes of response, over the limit of 10"},
+	}
+
+	for _, tt := range tests {
+		limits = tt.limits
+
+		req := httptest.NewRequest("GET", "/render?target=sum(foo.*)&format=json&from=1000000000&until=1000000600", nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+
+		if tt.want == "" {
+			if w.Code != http.StatusOK {
+				t.Errorf("limits %+v: got status %d: %s", tt.limits, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("limits %+v: got status %d, %q, want %d, %q", tt.limits, w.Code, w.Body.String(), http.StatusBadRequest, tt.want)
+		}
+	}
+}
+
+func TestRenderDatapointsEstimate(t *testing.T) {
+	leaves := []string{"foo.a", "foo.b", "foo.c", "foo.d", "foo.e"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+	var requests int32
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/render/" {
+			atomic.AddInt32(&requests, 1)
+		}
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+
+	// one leaf per render request, each series having 10 points of 60s over
+	// the range requested, though the fake zipper only returns one
+	Zipper = zipper{backends: []string{counting.URL}, client: &http.Client{}, batchSize: 1}
+	Limiter = newLimiter(1)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+	defer func() { limits = renderLimits{} }()
+
+	tests := []struct {
+		limits   renderLimits
+		requests int32
+		want     string
+	}{
+		{renderLimits{datapoints: 50}, 5, ""},
+		// the first series tells the step, and the others aren't fetched
+		{renderLimits{datapoints: 15}, 1, "target sum(foo.*): 41 estimated datapoints, over the limit of 15"},
+		// nothing is fetched at all with the step given
+		{renderLimits{datapoints: 15, step: 60}, 0, "target sum(foo.*): 50 estimated datapoints, over the limit of 15"},
+	}
+
+	for _, tt := range tests {
+		limits = tt.limits
+		atomic.StoreInt32(&requests, 0)
+
+		req := httptest.NewRequest("GET", "/render?target=sum(foo.*)&format=json&from=1000000000&until=1000000600", nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+
+		if n := atomic.LoadInt32(&requests); n != tt.requests {
+			t.Errorf("limits %+v: %d render requests, want %d", tt.limits, n, tt.requests)
+		}
+
+		if tt.want == "" {
+			if w.Code != http.StatusOK {
+				t.Errorf("limits %+v: got status %d: %s", tt.limits, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("limits %+v: got status %d, %q, want %d, %q", tt.limits, w.Code, w.Body.String(), http.StatusBadRequest, tt.want)
+		}
+	}
+}
+
+func TestRenderCostLimits(t *testing.T) {
+	fake := fakeZipper([]string{"foo.a"}, []string{"foo.a"})
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+	defer func() { limits = renderLimits{} }()
+
+	tests := []struct {
+		cost expr.Limits
+		want string
+	}{
+		{expr.Limits{Depth: 2, Functions: 3, Fetches: 8, WindowPoints: 10}, ""},
+		{expr.Limits{Depth: 1}, "target timeStack(movingMedian(foo.a,10),'1d',0,7): nesting depth is 2, over the limit of 1"},
+		{expr.Limits{Functions: 2}, "number of function calls is 3, over the limit of 2"},
+		{expr.Limits{Fetches: 7}, "number of metric fetches is 8, over the limit of 7"},
+		{expr.Limits{WindowPoints: 5}, "moving window in points is 10, over the limit of 5"},
+	}
+
+	for _, tt := range tests {
+		limits = renderLimits{cost: tt.cost}
+
+		req := httptest.NewRequest("GET", "/render?target=absolute(foo.a)&target=timeStack(movingMedian(foo.a,10),'1d',0,7)&format=json&from=1000000000&until=1000000600", nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+
+		if tt.want == "" {
+			if w.Code != http.StatusOK {
+				t.Errorf("limits %+v: got status %d: %s", tt.cost, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("limits %+v: got status %d, %q, want %d, %q", tt.cost, w.Code, w.Body.String(), http.StatusBadRequest, tt.want)
+		}
+		if stats.findRequests != 0 || stats.renderRequests != 0 {
+			t.Errorf("limits %+v: got %d find and %d render requests, want none", tt.cost, stats.findRequests, stats.renderRequests)
+		}
+	}
+}
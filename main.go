@@ -2,18 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dgryski/carbonapi/expr"
@@ -34,25 +40,73 @@ var Metrics = struct {
 	Requests         *expvar.Int
 	RequestCacheHits *expvar.Int
 
+	RequestCacheStaleHits      *expvar.Int
+	RequestCacheEarlyRefreshes *expvar.Int
+
 	FindRequests  *expvar.Int
 	FindCacheHits *expvar.Int
 
 	RenderRequests *expvar.Int
 
+	FetchCacheHits   *expvar.Int
+	FetchCacheMisses *expvar.Int
+
 	MemcacheTimeouts *expvar.Int
 
+	RedisHits     *expvar.Int
+	RedisMisses   *expvar.Int
+	RedisTimeouts *expvar.Int
+
+	PeerCacheTimeouts *expvar.Int
+	PeerCacheErrors   *expvar.Int
+
+	ZipperRetries     *expvar.Int
+	ZipperHedges      *expvar.Int
+	ZipperBackendDown *expvar.Int
+
+	RequestFlightsShared *expvar.Int
+	FindFlightsShared    *expvar.Int
+	RenderFlightsShared  *expvar.Int
+
+	LimiterTimeouts *expvar.Int
+	QuotaRejections *expvar.Int
+
 	CacheSize  expvar.Func
 	CacheItems expvar.Func
 }{
 	Requests:         expvar.NewInt("requests"),
 	RequestCacheHits: expvar.NewInt("request_cache_hits"),
 
+	RequestCacheStaleHits:      expvar.NewInt("request_cache_stale_hits"),
+	RequestCacheEarlyRefreshes: expvar.NewInt("request_cache_early_refreshes"),
+
 	FindRequests:  expvar.NewInt("find_requests"),
 	FindCacheHits: expvar.NewInt("find_cache_hits"),
 
 	RenderRequests: expvar.NewInt("render_requests"),
 
+	FetchCacheHits:   expvar.NewInt("fetch_cache_hits"),
+	FetchCacheMisses: expvar.NewInt("fetch_cache_misses"),
+
 	MemcacheTimeouts: expvar.NewInt("memcache_timeouts"),
+
+	RedisHits:     expvar.NewInt("redis_hits"),
+	RedisMisses:   expvar.NewInt("redis_misses"),
+	RedisTimeouts: expvar.NewInt("redis_timeouts"),
+
+	PeerCacheTimeouts: expvar.NewInt("peer_cache_timeouts"),
+	PeerCacheErrors:   expvar.NewInt("peer_cache_errors"),
+
+	ZipperRetries:     expvar.NewInt("zipper_retries"),
+	ZipperHedges:      expvar.NewInt("zipper_hedges"),
+	ZipperBackendDown: expvar.NewInt("zipper_backend_down"),
+
+	RequestFlightsShared: expvar.NewInt("request_flights_shared"),
+	FindFlightsShared:    expvar.NewInt("find_flights_shared"),
+	RenderFlightsShared:  expvar.NewInt("render_flights_shared"),
+
+	LimiterTimeouts: expvar.NewInt("limiter_timeouts"),
+	QuotaRejections: expvar.NewInt("quota_rejections"),
 }
 
 // BuildVersion is provided to be overridden at build time. Eg. go build -ldflags -X 'main.BuildVersion=...'
@@ -60,6 +114,10 @@ var BuildVersion = "(development build)"
 
 var queryCache bytesCache
 var findCache bytesCache
+var fetchCache bytesCache
+
+// cachePeers are the replicas sharing their caches with -cache=peer
+var cachePeers *peerPool
 
 var defaultTimeZone = time.Local
 
@@ -69,7 +127,13 @@ var logger mlog.Level
 var Zipper zipper
 
 // Limiter limits concurrent zipper requests
-var Limiter limiter
+var Limiter *limiter
+
+// renderTimeout bounds the total time spent on a render request, if non-zero
+var renderTimeout time.Duration
+
+// requestFlights collapses concurrent identical render requests which missed the cache
+var requestFlights = flightGroup{shared: Metrics.RequestFlightsShared}
 
 // for testing
 var timeNow = time.Now
@@ -120,21 +184,43 @@ const (
 	contentTypeSVG        = "image/svg+xml"
 )
 
-type renderStats struct {
-	zipperRequests int
+func buildParseErrorString(err *expr.ParseError) string {
+	return fmt.Sprintf("%s\n\n%-20s: %s\n%-20s: %s\n%-20s: %d\n\n%s\n",
+		http.StatusText(http.StatusBadRequest),
+		"Target", err.Target,
+		"Error", err.Err,
+		"Offset", err.Offset,
+		err.Excerpt())
 }
 
-func buildParseErrorString(target, e string, err error) string {
-	msg := fmt.Sprintf("%s\n\n%-20s: %s\n", http.StatusText(http.StatusBadRequest), "Target", target)
-	if err != nil {
-		msg += fmt.Sprintf("%-20s: %s\n", "Error", err.Error())
-	}
-	if e != "" {
-		msg += fmt.Sprintf("%-20s: %s\n%-20s: %s\n",
-			"Parsed so far", target[0:len(target)-len(e)],
-			"Could not parse", e)
+// parseErrorJSON is the response to a target failing to parse with format=json
+type parseErrorJSON struct {
+	Error      string `json:"error"`
+	Target     string `json:"target"`
+	Offset     int    `json:"offset"`
+	Excerpt    string `json:"excerpt"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// writeParseError responds to a render request with a target which failed to
+// parse, in JSON if that was the requested format
+func writeParseError(w http.ResponseWriter, r *http.Request, err *expr.ParseError) {
+	if r.FormValue("format") != "json" {
+		http.Error(w, buildParseErrorString(err), http.StatusBadRequest)
+		return
 	}
-	return msg
+
+	b, _ := json.Marshal(parseErrorJSON{
+		Error:      err.Err.Error(),
+		Target:     err.Target,
+		Offset:     err.Offset,
+		Excerpt:    err.Excerpt(),
+		Suggestion: err.Suggestion,
+	})
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(b)
 }
 
 var errBadTime = errors.New("bad time")
@@ -173,37 +259,42 @@ func parseTime(s string) (hour, minute int, err error) {
 var timeFormats = []string{"20060102", "01/02/06"}
 
 // dateParamToEpoch turns a passed string parameter into a unix epoch
-func dateParamToEpoch(s string, d int64) int32 {
+func dateParamToEpoch(s string, d int64) int64 {
 
 	if s == "" {
 		// return the default if nothing was passed
-		return int32(d)
+		return d
 	}
 
 	// relative timestamp
 	if s[0] == '-' {
 		offset, err := expr.IntervalString(s, -1)
 		if err != nil {
-			return int32(d)
+			return d
 		}
 
-		return int32(timeNow().Add(time.Duration(offset) * time.Second).Unix())
+		// in seconds, as a time.Duration overflows past 292 years
+		now := timeNow().Unix()
+		if offset < math.MinInt64+now {
+			return d
+		}
+		return now + offset
 	}
 
 	switch s {
 	case "now":
-		return int32(timeNow().Unix())
+		return timeNow().Unix()
 	case "midnight", "noon", "teatime":
 		yy, mm, dd := timeNow().Date()
 		hh, min, _ := parseTime(s) // error ignored, we know it's valid
 		dt := time.Date(yy, mm, dd, hh, min, 0, 0, defaultTimeZone)
-		return int32(dt.Unix())
+		return dt.Unix()
 	}
 
-	sint, err := strconv.Atoi(s)
+	sint, err := strconv.ParseInt(s, 10, 64)
 	// need to check that len(s) > 8 to avoid turning 20060102 into seconds
 	if err == nil && len(s) > 8 {
-		return int32(sint) // We got a timestamp so returning it
+		return sint // We got a timestamp so returning it
 	}
 
 	s = strings.Replace(s, "_", " ", 1) // Go can't parse _ in date strings
@@ -217,7 +308,7 @@ func dateParamToEpoch(s string, d int64) int32 {
 	case len(split) == 2:
 		ts, ds = split[0], split[1]
 	case len(split) > 2:
-		return int32(d)
+		return d
 	}
 
 	var t time.Time
@@ -238,7 +329,7 @@ dateStringSwitch:
 			}
 		}
 
-		return int32(d)
+		return d
 	}
 
 	var hour, minute int
@@ -250,24 +341,43 @@ dateStringSwitch:
 	yy, mm, dd := t.Date()
 	t = time.Date(yy, mm, dd, hour, minute, 0, 0, defaultTimeZone)
 
-	return int32(t.Unix())
+	return t.Unix()
 }
 
 func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 
 	Metrics.Requests.Add(1)
 
+	ctx := r.Context()
+	if renderTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, renderTimeout)
+		defer cancel()
+	}
+
 	err := r.ParseForm()
+	if err == nil && isJSONQuery(r) {
+		err = parseJSONQuery(w, r)
+	}
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest)+": "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	client := clientID(r)
+	// render requests forwarded by a peer are on behalf of its client, and
+	// already counted against its quotas there
+	forwardedClient, fromPeer := cachePeers.fromPeer(r)
+	if fromPeer && forwardedClient != "" {
+		client = forwardedClient
+	}
+
 	targets := r.Form["target"]
 	from := r.FormValue("from")
 	until := r.FormValue("until")
 	format := r.FormValue("format")
 	useCache := !expr.TruthyBool(r.FormValue("noCache"))
+	strict := expr.TruthyBool(r.FormValue("strict"))
 
 	var jsonp string
 
@@ -306,102 +416,615 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 	r.Form.Del("_ts")
 	r.Form.Del("_t") // Used by jquery.graphite.js
 
-	cacheKey := r.Form.Encode()
+	// API keys would split the cache by client
+	if name := clientParam(); name != "" {
+		r.Form.Del(name)
+	}
+
+	// normalize from and until values
+	// BUG(dgryski): doesn't handle timezones the same as graphite-web
+	from64 := dateParamToEpoch(from, timeNow().Add(-24*time.Hour).Unix())
+	until64 := dateParamToEpoch(until, timeNow().Unix())
+
+	// the same saved expressions for the cache key and the evaluation
+	saved := savedExprs.get()
+
+	cacheKey := renderCacheKey(r.Form, canonicalTargets(targets, saved), from64, until64)
+
+	stats.targets = targets
+	stats.from, stats.until = from64, until64
+	stats.format = format
+
+	if expr.TruthyBool(r.FormValue("explain")) {
+		explainRender(withSavedExprs(ctx, saved), w, r, client, targets, from64, until64, useCache, stats)
+		return
+	}
+
+	// the render may outlive the request when it refreshes the cache in the
+	// background, so it reads its own copy of the request
+	req := detachRequest(r)
+	targets = req.Form["target"]
 
-	if response, ok := queryCache.get(cacheKey); useCache && ok {
+	render := func(ctx context.Context) (interface{}, error) {
+		// zipper requests are scheduled on behalf of the client starting the
+		// flight, whose targets are expanded as in its cache key
+		ctx = withSavedExprs(withClient(ctx, client), saved)
+
+		if renderTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, renderTimeout)
+			defer cancel()
+		}
+
+		var rstats renderStats
+		results, warnings, err := evalTargets(ctx, req, targets, from64, until64, useCache, &rstats)
+		if err != nil {
+			return nil, err
+		}
+
+		if strict && len(warnings) != 0 {
+			return nil, renderError{http.StatusBadGateway, warningsString(warnings)}
+		}
+
+		body, err := marshalResults(req, format, results, warnings)
+		if err != nil {
+			return nil, renderError{http.StatusInternalServerError, err.Error()}
+		}
+
+		if over(len(body), limits.responseSize) {
+			return nil, limitError(strings.Join(targets, ","), len(body), "bytes of response", limits.responseSize)
+		}
+
+		if len(results) != 0 {
+			ttl := cacheTimeout
+			if len(warnings) != 0 && partialTimeout < ttl {
+				// the missing data may be back soon
+				ttl = partialTimeout
+			}
+			setEntry(queryCache, cacheKey, encodeResponse(body, warnings), ttl)
+		}
+
+		return renderResult{body: body, warnings: warnings, stats: rstats}, nil
+	}
+
+	response, state, ok := getEntry(queryCache, cacheKey)
+	if useCache {
+		observeCache("query", ok)
+	}
+	if useCache && ok {
 		Metrics.RequestCacheHits.Add(1)
-		writeResponse(w, response, format, jsonp)
+		stats.cacheHit = true
+		if state != entryFresh {
+			if state == entryStale {
+				Metrics.RequestCacheStaleHits.Add(1)
+			} else {
+				Metrics.RequestCacheEarlyRefreshes.Add(1)
+			}
+			// refresh in the background, counted against the quotas of the
+			// client as any render is; concurrent refreshes share the flight,
+			// and a client over its quotas is served the entry as it is
+			if quotas.admit(client) == nil {
+				go func() {
+					defer quotas.release(client)
+					requestFlights.do(context.Background(), cacheKey, render)
+				}()
+			}
+		}
+		body, warnings := decodeResponse(response)
+		setWarnings(w, warnings)
+		writeResponse(w, body, format, jsonp)
 		return
 	}
 
-	// normalize from and until values
-	// BUG(dgryski): doesn't handle timezones the same as graphite-web
-	from32 := dateParamToEpoch(from, timeNow().Add(-24*time.Hour).Unix())
-	until32 := dateParamToEpoch(until, timeNow().Unix())
-	if from32 == until32 {
+	if from64 == until64 {
 		http.Error(w, "Invalid empty time range", http.StatusBadRequest)
 		return
 	}
 
+	if !fromPeer {
+		if err := quotas.admit(client); err != nil {
+			Metrics.QuotaRejections.Add(1)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests)+": "+err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer quotas.release(client)
+	}
+
+	// a miss of an entry owned by another peer is rendered by the owner, once
+	// for the misses of all the peers, unless it can't be reached
+	if pc, ok := queryCache.(*peerCache); ok && useCache && !fromPeer {
+		if owner := pc.owner(cacheKey); owner != "" {
+			resp, err := pc.pool.forward(ctx, owner, client, peerForm(req.Form, from64, until64))
+			if err == nil {
+				writePeerResponse(w, resp, format, jsonp)
+				return
+			}
+			logger.Logf("render: forwarding to %s: %v", owner, err)
+			Metrics.PeerCacheErrors.Add(1)
+		}
+	}
+
+	v, err, shared := requestFlights.do(ctx, cacheKey, render)
+
+	if err != nil {
+		writeRenderError(w, r, err)
+		return
+	}
+
+	result := v.(renderResult)
+	if !shared {
+		stats.addEval(result.stats)
+	}
+
+	setWarnings(w, result.warnings)
+	writeResponse(w, result.body, format, jsonp)
+}
+
+// peerForm returns form with the time range resolved, to be forwarded to a peer
+func peerForm(form url.Values, from, until int64) url.Values {
+	f := make(url.Values, len(form))
+	for k, v := range form {
+		f[k] = v
+	}
+	f.Set("from", strconv.FormatInt(from, 10))
+	f.Set("until", strconv.FormatInt(until, 10))
+	return f
+}
+
+// writePeerResponse relays the response of the peer a render request was
+// forwarded to
+func writePeerResponse(w http.ResponseWriter, resp *peerResponse, format, jsonp string) {
+	if v := resp.header.Get(warningsHeader); v != "" {
+		w.Header().Set(warningsHeader, v)
+	}
+
+	if resp.status == http.StatusOK {
+		writeResponse(w, resp.body, format, jsonp)
+		return
+	}
+
+	w.Header().Set("Content-Type", resp.header.Get("Content-Type"))
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// detachRequest returns a copy of the form of r, which is all rendering reads
+// of a request, unaffected by what happens to r once it has been served
+func detachRequest(r *http.Request) *http.Request {
+	form := make(url.Values, len(r.Form))
+	for k, v := range r.Form {
+		form[k] = append([]string(nil), v...)
+	}
+	return &http.Request{Form: form}
+}
+
+// writeRenderError responds to a render request which failed with err
+func writeRenderError(w http.ResponseWriter, r *http.Request, err error) {
+	if perr, ok := err.(*expr.ParseError); ok {
+		writeParseError(w, r, perr)
+	} else if rerr, ok := err.(renderError); ok {
+		http.Error(w, rerr.msg, rerr.status)
+	} else if err == context.Canceled || err == context.DeadlineExceeded {
+		renderAborted(w, r, err)
+	} else {
+		logger.Logf("render: %s: %v", r.RequestURI, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// keyGranularity is what from and until are rounded to in render cache keys
+var keyGranularity time.Duration
+
+// canonicalTargets returns the canonical form of the targets, so that
+// equivalent targets share cache entries.  References to saved expressions
+// are expanded with saved first, so that the keys change with the
+// definitions, and are the same on every replica loading the same ones.
+// Targets which fail to parse or expand are left as they are.
+func canonicalTargets(targets []string, saved *savedExprSet) []string {
+	var exprs expr.SavedExprs
+	if saved != nil {
+		exprs = saved.exprs
+	}
+
+	canonical := make([]string, len(targets))
+	for i, target := range targets {
+		canonical[i] = target
+		exp, e, err := expr.ParseExpr(target)
+		if err != nil || e != "" {
+			continue
+		}
+		if expanded, err := exp.Expand(exprs); err == nil {
+			exp = expanded
+		}
+		canonical[i] = exp.Canonical()
+	}
+	return canonical
+}
+
+// canonicalExpr returns exp as parsed from its canonical form.  Series are
+// named after it, so that targets sharing a cache entry render the same;
+// targets are still checked as they were given, for errors to point into
+// them.
+func canonicalExpr(exp *expr.Expr) *expr.Expr {
+	c, rest, err := expr.ParseExpr(exp.Canonical())
+	if err != nil || rest != "" {
+		return exp
+	}
+	return c
+}
+
+// variablePrefix starts the names of request parameters setting template
+// variables, as in var-host=web01 for $host
+const variablePrefix = "var-"
+
+// requestVariables returns the template variables set by the parameters of a
+// render request
+func requestVariables(form url.Values) map[string]string {
+	vars := make(map[string]string)
+	for k, v := range form {
+		if strings.HasPrefix(k, variablePrefix) && len(k) > len(variablePrefix) && len(v) != 0 {
+			vars[strings.TrimPrefix(k, variablePrefix)] = v[0]
+		}
+	}
+	return vars
+}
+
+// renderCacheKey identifies the response to a render request from its
+// canonical targets, the time range rounded down to keyGranularity, and the
+// other parameters of the request.
+func renderCacheKey(form url.Values, targets []string, from, until int64) string {
+	key := make(url.Values)
+	for k, v := range form {
+		key[k] = v
+	}
+
+	if g := int64(keyGranularity / time.Second); g > 1 {
+		from -= mod(from, g)
+		until -= mod(until, g)
+	}
+
+	key["target"] = targets
+	key.Set("from", strconv.FormatInt(from, 10))
+	key.Set("until", strconv.FormatInt(until, 10))
+
+	return key.Encode()
+}
+
+// renderResult is the outcome of a render request, shared by all concurrent identical requests
+type renderResult struct {
+	body     []byte
+	warnings []renderWarning
+	stats    renderStats
+}
+
+// partialTimeout is the longest a response missing some data is cached for
+var partialTimeout int32
+
+// renderWarning lists the globs and leaves of a target which could not be
+// fetched, and are missing from the response, and the globs whose find failed
+// on some of the backends, whose matches may be missing some leaves
+type renderWarning struct {
+	Target       string   `json:"target"`
+	FailedGlobs  []string `json:"failedGlobs,omitempty"`
+	PartialGlobs []string `json:"partialGlobs,omitempty"`
+	FailedLeaves []string `json:"failedLeaves,omitempty"`
+}
+
+func (w *renderWarning) add(f renderWarning) {
+	w.FailedGlobs = append(w.FailedGlobs, f.FailedGlobs...)
+	w.PartialGlobs = append(w.PartialGlobs, f.PartialGlobs...)
+	w.FailedLeaves = append(w.FailedLeaves, f.FailedLeaves...)
+}
+
+func (w *renderWarning) empty() bool {
+	return len(w.FailedGlobs) == 0 && len(w.PartialGlobs) == 0 && len(w.FailedLeaves) == 0
+}
+
+// warningsHeader carries the warnings of a partial response, in JSON
+const warningsHeader = "X-Carbonapi-Warnings"
+
+func setWarnings(w http.ResponseWriter, warnings []renderWarning) {
+	if len(warnings) == 0 {
+		return
+	}
+	b, err := json.Marshal(warnings)
+	if err != nil {
+		return
+	}
+	w.Header().Set(warningsHeader, string(b))
+}
+
+func warningsString(warnings []renderWarning) string {
+	lines := []string{"Failed to fetch some metrics:"}
+	for _, w := range warnings {
+		failed := append(append(append([]string(nil), w.FailedGlobs...), w.PartialGlobs...), w.FailedLeaves...)
+		lines = append(lines, w.Target+": "+strings.Join(failed, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// partialMagic starts cached responses which carry warnings.  It is followed
+// by the length of the JSON encoded warnings, the warnings and the body.
+var partialMagic = []byte("\xffpr1")
+
+func encodeResponse(body []byte, warnings []renderWarning) []byte {
+	if len(warnings) == 0 {
+		return body
+	}
+
+	w, err := json.Marshal(warnings)
+	if err != nil {
+		return body
+	}
+
+	b := make([]byte, len(partialMagic)+4, len(partialMagic)+4+len(w)+len(body))
+	copy(b, partialMagic)
+	binary.BigEndian.PutUint32(b[len(partialMagic):], uint32(len(w)))
+	b = append(b, w...)
+	return append(b, body...)
+}
+
+func decodeResponse(b []byte) ([]byte, []renderWarning) {
+	if !bytes.HasPrefix(b, partialMagic) || len(b) < len(partialMagic)+4 {
+		return b, nil
+	}
+
+	b = b[len(partialMagic):]
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < n {
+		return nil, nil
+	}
+
+	var warnings []renderWarning
+	if err := json.Unmarshal(b[:n], &warnings); err != nil {
+		return b[n:], nil
+	}
+
+	return b[n:], warnings
+}
+
+// renderError is a render failure with the HTTP status to report it with
+type renderError struct {
+	status int
+	msg    string
+}
+
+func (e renderError) Error() string { return e.msg }
+
+// evalTargets fetches the metrics needed by targets and evaluates them,
+// along with warnings for the targets missing data because of failed
+// fetches.  It returns an *expr.ParseError for targets which fail to parse, a
+// renderError for other bad requests, or the context's error if the request
+// was aborted.
+func evalTargets(ctx context.Context, req *http.Request, targets []string, from64, until64 int64, useCache bool, stats *renderStats) ([]*expr.MetricData, []renderWarning, error) {
+
 	var results []*expr.MetricData
+	var warnings []renderWarning
 	var errors []string
 	metricMap := make(map[expr.MetricRequest][]*expr.MetricData)
 
-	for _, target := range targets {
+	// what failed to be fetched for each metric, for the targets sharing it
+	failures := make(map[expr.MetricRequest]renderWarning)
 
-		exp, e, err := expr.ParseExpr(target)
+	// the series and points fetched so far, for the limits
+	var series, datapoints int
 
-		if err != nil || e != "" {
-			msg := buildParseErrorString(target, e, err)
-			http.Error(w, msg, http.StatusBadRequest)
-			return
+	// the step of the series, to estimate the points of those not fetched yet
+	step := limits.step
+
+	// parse all the targets and check what they would cost before fetching
+	// anything for any of them
+	exps := make([]*expr.Expr, len(targets))
+	saved := savedExprsFromContext(ctx)
+	vars := requestVariables(req.Form)
+	var cost expr.Cost
+	for i, target := range targets {
+		exp, err := expr.ExpandTarget(target, saved)
+		if err != nil {
+			return nil, nil, err
 		}
+		exp = canonicalExpr(exp.WithVariables(vars))
+
+		exps[i] = exp
+		stats.exprs = append(stats.exprs, exp)
+		cost = cost.Add(exp.Cost())
+		if err := cost.Check(limits.cost); err != nil {
+			return nil, nil, costError(target, err)
+		}
+	}
+
+	for i, target := range targets {
+
+		t0 := time.Now()
+
+		exp := exps[i]
+
+		warning := renderWarning{Target: target}
 
 		for _, m := range exp.Metrics() {
 
+			if err := ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+
 			mfetch := m
-			mfetch.From += from32
-			mfetch.Until += until32
+			mfetch.From += from64
+			mfetch.Until += until64
+
+			fetch := fetchStats{target: i, Metric: m.Metric, From: mfetch.From, Until: mfetch.Until}
 
 			if _, ok := metricMap[mfetch]; ok {
 				// already fetched this metric for this request
+				warning.add(failures[mfetch])
+				fetch.Reused = true
+				stats.fetches = append(stats.fetches, fetch)
 				continue
 			}
 
 			var glob pb.GlobResponse
 			var haveCacheData bool
 
-			if response, ok := findCache.get(m.Metric); useCache && ok {
+			// what failed to be fetched for the metric
+			var failure renderWarning
+
+			response, ok := findCache.get(m.Metric)
+			if useCache {
+				observeCache("find", ok)
+			}
+			if useCache && ok {
 				Metrics.FindCacheHits.Add(1)
 				err := glob.Unmarshal(response)
 				haveCacheData = err == nil
+				fetch.FindCached = haveCacheData
 			}
 
 			if !haveCacheData {
 				var err error
 				Metrics.FindRequests.Add(1)
-				stats.zipperRequests++
-				glob, err = Zipper.Find(m.Metric)
-				if err != nil {
+				stats.findRequests++
+				glob, err = Zipper.Find(ctx, m.Metric)
+				if _, partial := err.(*partialFindError); partial {
+					// render the matches of the backends which answered,
+					// without caching them
 					logger.Logf("Find: %v: %v", m.Metric, err)
+					failure.PartialGlobs = append(failure.PartialGlobs, m.Metric)
+					stats.backendErrors = append(stats.backendErrors, "Find: "+m.Metric+": "+err.Error())
+					fetch.FindError = err.Error()
+				} else if err != nil {
+					logger.Logf("Find: %v: %v", m.Metric, err)
+					if err != errNoMetrics {
+						warning.FailedGlobs = append(warning.FailedGlobs, m.Metric)
+						stats.backendErrors = append(stats.backendErrors, "Find: "+m.Metric+": "+err.Error())
+					}
+					fetch.FindError = err.Error()
+					stats.fetches = append(stats.fetches, fetch)
 					continue
-				}
-				b, err := glob.Marshal()
-				if err == nil {
+				} else if b, err := glob.Marshal(); err == nil {
 					findCache.set(m.Metric, b, 5*60)
 				}
 			}
 
-			// For each metric returned in the Find response, query Render
-			// This is a conscious decision to *not* cache render data
-			rch := make(chan *expr.MetricData, len(glob.GetMatches()))
-			leaves := 0
-			for _, m := range glob.GetMatches() {
-				if !m.GetIsLeaf() {
-					continue
+			if n := len(glob.GetMatches()); over(n, limits.globMatches) {
+				return nil, nil, limitError(target, n, "find matches for "+m.Metric, limits.globMatches)
+			}
+
+			// Fetch the leaves returned in the Find response, a batch at a time
+			// Render data is only cached if the chunked fetch cache is enabled
+			var leaves []string
+			for _, g := range glob.GetMatches() {
+				if g.GetIsLeaf() {
+					leaves = append(leaves, g.GetPath())
+				}
+			}
+
+			fetch.Matches = len(glob.GetMatches())
+			fetch.Leaves = len(leaves)
+
+			series += len(leaves)
+			if over(series, limits.series) {
+				return nil, nil, limitError(target, series, "series", limits.series)
+			}
+
+			batches := Zipper.renderBatches(m.Metric, leaves)
+			rch := make(chan batchResult, len(batches))
+			requests, received := 0, 0
+			var enterErr error
+
+			// the leaves sent but not received yet, and those not sent yet,
+			// for the estimate of the points still to come
+			inflight, unsent := 0, len(leaves)
+			var estimate int64
+
+			receive := func() {
+				r := <-rch
+				received++
+				inflight -= r.leaves
+				for j := range r.metrics {
+					metricMap[mfetch] = append(metricMap[mfetch], &r.metrics[j])
+					datapoints += len(r.metrics[j].Values)
+					if step == 0 {
+						step = int64(r.metrics[j].GetStepTime())
+					}
 				}
+				stats.leaves += len(r.metrics)
+				fetch.Series += len(r.metrics)
+				failure.FailedLeaves = append(failure.FailedLeaves, r.failed...)
+				if r.err != "" {
+					stats.backendErrors = append(stats.backendErrors, r.err)
+				}
+			}
+
+			for _, batch := range batches {
+				if limits.datapoints > 0 {
+					if step == 0 && received < requests {
+						// the step of the first batch tells how many points the others have
+						receive()
+					}
+					if step > 0 {
+						estimate = int64(datapoints) + int64(inflight+unsent)*((mfetch.Until-mfetch.From)/step)
+						if estimate > int64(limits.datapoints) {
+							break
+						}
+						estimate = 0
+					}
+				}
+
+				if enterErr = Limiter.enter(ctx); enterErr != nil {
+					break
+				}
+				inflight += len(batch)
+				unsent -= len(batch)
 				Metrics.RenderRequests.Add(1)
-				leaves++
-				Limiter.enter()
-				stats.zipperRequests++
-				go func(m *pb.GlobMatch, from, until int32) {
-					var rptr *expr.MetricData
-					r, err := Zipper.Render(m.GetPath(), from, until)
-					if err == nil {
-						rptr = &r
+				requests++
+				stats.renderRequests++
+				go func(batch []string, from, until int64) {
+					var r []expr.MetricData
+					var err error
+					if renderCache != nil {
+						r, err = renderCache.render(ctx, batch, from, until)
 					} else {
-						logger.Logf("Render: %v: %v", m.GetPath(), err)
+						r, err = Zipper.RenderMulti(ctx, batch, from, until)
+					}
+					res := batchResult{metrics: r, leaves: len(batch)}
+					if err != nil {
+						msg := fmt.Sprintf("Render: %v (%d targets): %v", batch[0], len(batch), err)
+						logger.Logln(msg)
+						if err != errNoMetrics {
+							res.failed = missingLeaves(batch, r)
+							res.err = msg
+						}
 					}
-					rch <- rptr
 					Limiter.leave()
-				}(m, mfetch.From, mfetch.Until)
+					rch <- res
+				}(batch, mfetch.From, mfetch.Until)
 			}
 
-			for i := 0; i < leaves; i++ {
-				r := <-rch
-				if r != nil {
-					metricMap[mfetch] = append(metricMap[mfetch], r)
-				}
+			for received < requests {
+				receive()
+			}
+			failures[mfetch] = failure
+			warning.add(failure)
+
+			fetch.RenderRequests = requests
+			fetch.FailedLeaves = failure.FailedLeaves
+			stats.fetches = append(stats.fetches, fetch)
+
+			if err := ctx.Err(); err != nil {
+				// all render goroutines have returned, so the limiter is released
+				return nil, nil, err
+			}
+
+			if enterErr == errQueueTimeout {
+				return nil, nil, renderError{http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable) + ": " + enterErr.Error()}
+			}
+
+			if estimate != 0 {
+				return nil, nil, limitError(target, int(estimate), "estimated datapoints", limits.datapoints)
+			}
+
+			if over(datapoints, limits.datapoints) {
+				return nil, nil, limitError(target, datapoints, "datapoints", limits.datapoints)
 			}
 
 			expr.SortMetrics(metricMap[mfetch], mfetch)
@@ -413,25 +1036,74 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 				if r := recover(); r != nil {
 					var buf [1024]byte
 					runtime.Stack(buf[:], false)
-					logger.Logf("panic during eval: %s: %s\n%s\n", cacheKey, r, string(buf[:]))
+					logger.Logf("panic during eval: %s: %s\n%s\n", req.Form.Encode(), r, string(buf[:]))
 				}
 			}()
-			exprs, err := expr.EvalExpr(exp, from32, until32, metricMap)
+			exprs, err := expr.EvalExpr(ctx, exp, from64, until64, metricMap)
 			if err != nil && err != expr.ErrSeriesDoesNotExist {
 				errors = append(errors, target+": "+err.Error())
 				return
 			}
 			results = append(results, exprs...)
 		}()
+
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		if !warning.empty() {
+			warnings = append(warnings, warning)
+		}
+
+		stats.targetTimes = append(stats.targetTimes, targetTime{Target: target, Runtime: time.Since(t0).Seconds()})
 	}
 
 	if len(errors) > 0 {
 		errors = append([]string{"Encountered the following errors:"}, errors...)
-		http.Error(w, strings.Join(errors, "\n"), http.StatusBadRequest)
-		return
+		return nil, nil, renderError{http.StatusBadRequest, strings.Join(errors, "\n")}
+	}
+
+	return results, warnings, nil
+}
+
+// batchResult is the outcome of the render request for a batch of leaves
+type batchResult struct {
+	metrics []expr.MetricData
+	// leaves is the number of leaves requested
+	leaves int
+	failed []string
+	err    string
+}
+
+// missingLeaves returns the leaves of a failed render request not found in
+// its partial results
+func missingLeaves(batch []string, r []expr.MetricData) []string {
+	found := make(map[string]bool)
+	for _, m := range r {
+		found[m.GetName()] = true
+	}
+
+	var missing []string
+	for _, leaf := range batch {
+		if !found[leaf] {
+			missing = append(missing, leaf)
+		}
 	}
 
+	return missing
+}
+
+// jsonEnvelope wraps json results along with their warnings, for envelope=1
+type jsonEnvelope struct {
+	Series   json.RawMessage `json:"series"`
+	Warnings []renderWarning `json:"warnings"`
+}
+
+// marshalResults encodes the results in the requested format
+func marshalResults(r *http.Request, format string, results []*expr.MetricData, warnings []renderWarning) ([]byte, error) {
+
 	var body []byte
+	var err error
 
 	switch format {
 	case "json":
@@ -440,12 +1112,15 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 		}
 
 		body = expr.MarshalJSON(results)
+
+		if expr.TruthyBool(r.FormValue("envelope")) {
+			if warnings == nil {
+				warnings = []renderWarning{}
+			}
+			body, err = json.Marshal(jsonEnvelope{Series: body, Warnings: warnings})
+		}
 	case "protobuf":
 		body, err = expr.MarshalProtobuf(results)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
 	case "raw":
 		body = expr.MarshalRaw(results)
 	case "csv":
@@ -458,11 +1133,13 @@ func renderHandler(w http.ResponseWriter, r *http.Request, stats *renderStats) {
 		body = expr.MarshalSVG(r, results)
 	}
 
-	writeResponse(w, body, format, jsonp)
+	return body, err
+}
 
-	if len(results) != 0 {
-		queryCache.set(cacheKey, body, cacheTimeout)
-	}
+// renderAborted reports a render request which was cancelled by the client or timed out
+func renderAborted(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Logf("render: aborted: %s: %v", r.RequestURI, err)
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable)+": "+err.Error(), http.StatusServiceUnavailable)
 }
 
 func findHandler(w http.ResponseWriter, r *http.Request) {
@@ -481,8 +1158,10 @@ func findHandler(w http.ResponseWriter, r *http.Request) {
 		format = "treejson"
 	}
 
-	globs, err := Zipper.Find(query)
-	if err != nil {
+	globs, err := Zipper.Find(r.Context(), query)
+	if _, partial := err.(*partialFindError); partial {
+		setWarnings(w, []renderWarning{{Target: query, PartialGlobs: []string{query}}})
+	} else if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -621,11 +1300,82 @@ func findTreejson(globs pb.GlobResponse) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+type functionParam struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Required bool        `json:"required,omitempty"`
+	Multiple bool        `json:"multiple,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+}
+
+type functionInfo struct {
+	Name        string          `json:"name"`
+	Aliases     []string        `json:"aliases,omitempty"`
+	Description string          `json:"description"`
+	Group       string          `json:"group"`
+	Params      []functionParam `json:"params"`
+}
+
+func newFunctionInfo(f expr.Function) functionInfo {
+	info := functionInfo{
+		Name:        f.Name,
+		Aliases:     f.Aliases,
+		Description: f.Description,
+		Group:       f.Group,
+		Params:      make([]functionParam, 0, len(f.Params)),
+	}
+
+	for _, p := range f.Params {
+		info.Params = append(info.Params, functionParam{
+			Name:     p.Name,
+			Type:     p.Type.String(),
+			Required: p.Required,
+			Multiple: p.Multiple,
+			Default:  p.Default,
+		})
+	}
+
+	return info
+}
+
+// functionsHandler describes the supported functions in the format of graphite-web's /functions
+func functionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	jsonp := r.FormValue("jsonp")
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/functions"), "/")
+
+	var v interface{}
+
+	if name != "" {
+		f, ok := expr.LookupFunction(name)
+		if !ok {
+			http.Error(w, "unknown function: "+name, http.StatusNotFound)
+			return
+		}
+		v = newFunctionInfo(f)
+	} else {
+		all := make(map[string]functionInfo)
+		for _, f := range expr.Functions() {
+			all[f.Name] = newFunctionInfo(f)
+		}
+		v = all
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, b, "json", jsonp)
+}
+
 func passthroughHandler(w http.ResponseWriter, r *http.Request) {
 	var data []byte
 	var err error
 
-	if data, err = Zipper.Passthrough(r.URL.RequestURI()); err != nil {
+	if data, err = Zipper.Passthrough(r.Context(), r.URL.RequestURI()); err != nil {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
@@ -641,6 +1391,7 @@ supported requests:
 	/render/?target=
 	/metrics/find/?query=
 	/info/?target=
+	/functions/
 `)
 
 func usageHandler(w http.ResponseWriter, r *http.Request) {
@@ -649,11 +1400,25 @@ func usageHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
-	z := flag.String("z", "", "zipper")
+	z := flag.String("z", "", "comma separated list of zippers for metrics not matching a route")
+	routesFile := flag.String("routes", "", "JSON file mapping metric prefixes or globs to zippers")
+	savedExprsFile := flag.String("savedexprs", "", "JSON file of saved expressions for targets to refer to as @name(args), reloaded on SIGHUP")
 	port := flag.Int("p", 8080, "port")
 	l := flag.Int("l", 20, "concurrency limit")
+	queueTimeout := flag.Duration("queuetimeout", 0, "fail render requests with a 503 after waiting this long for the concurrency limit (0 for no limit)")
+	clientKeyFlag := flag.String("clientkey", "ip", "tell clients apart by ip, header:Name or param:name (header:X-Forwarded-For behind a proxy)")
+	clientWeights := flag.String("clientweights", "", "comma separated client:weight shares of the concurrency limit (default 1 each)")
+	clientConcurrency := flag.Int("clientconcurrency", 0, "concurrent render requests allowed per client (0 for no limit)")
+	clientRate := flag.Float64("clientrate", 0, "render requests per second allowed per client (0 for no limit)")
+	clientBurst := flag.Int("clientburst", 10, "render requests a client may send at once above -clientrate")
 	cacheType := flag.String("cache", "mem", "cache type to use")
 	mc := flag.String("mc", "", "comma separated memcached server list")
+	redisServer := flag.String("redis", "", "redis server (host:port)")
+	redisPrefix := flag.String("redisprefix", "", "prefix for redis cache keys")
+	redisIdle := flag.Int("redisidle", 10, "max idle redis connections")
+	peers := flag.String("peers", "", "comma separated list of carbonapi peers sharing their caches, including this one (http://host:port)")
+	self := flag.String("self", "", "address of this carbonapi in the -peers list")
+	peerSecret := flag.String("peersecret", "", "secret shared by the -peers, without which their cache requests are refused")
 	memsize := flag.Int("memsize", 0, "in-memory cache size in MB (0 is unlimited)")
 	cpus := flag.Int("cpus", 0, "number of CPUs to use")
 	tz := flag.String("tz", "", "timezone,offset to use for dates with no timezone")
@@ -663,6 +1428,34 @@ func main() {
 	interval := flag.Duration("i", 60*time.Second, "interval to report internal statistics to graphite")
 	idleconns := flag.Int("idleconns", 10, "max idle connections")
 	pidFile := flag.String("pid", "", "pidfile (default: empty, don't create pidfile)")
+	timeout := flag.Duration("timeout", 0, "overall timeout for render requests (0 for none)")
+	retries := flag.Int("retries", 2, "number of times to retry failed zipper requests")
+	retryDelay := flag.Duration("retrydelay", 50*time.Millisecond, "delay before the first zipper retry, doubled for each further retry")
+	hedge := flag.Duration("hedge", 0, "also ask the next zipper for a metric if the first has not answered after this long (0 to disable)")
+	breakFailures := flag.Int("breakfailures", 5, "consecutive failures after which a zipper is marked down (0 to disable)")
+	breakCooldown := flag.Duration("breakcooldown", 10*time.Second, "how long a zipper stays marked down")
+	batch := flag.Int("batch", 1, "number of metrics to fetch with each zipper render request")
+	renderGlob := flag.Bool("renderglob", false, "send globs to the zipper instead of their leaves when that saves requests")
+	fetchChunk := flag.Duration("fetchchunk", 0, "cache render data in chunks of this length (0 to disable)")
+	fetchTTL := flag.Duration("fetchttl", time.Hour, "expiry of cached render data")
+	fetchRecentTTL := flag.Duration("fetchrecentttl", time.Minute, "expiry of cached render data which may still change")
+	maxGlobMatches := flag.Int("maxglobmatches", 0, "fail render requests with a glob matching more metrics than this (0 for no limit)")
+	maxSeries := flag.Int("maxseries", 0, "fail render requests fetching more series than this (0 for no limit)")
+	maxDatapoints := flag.Int("maxdatapoints", 0, "fail render requests fetching more points than this over all series (0 for no limit)")
+	minStep := flag.Duration("minstep", 0, "finest resolution of the stored metrics, to estimate the points of a request for -maxdatapoints before fetching them (0 to take it from the first response)")
+	maxResponseSize := flag.Int("maxresponsesize", 0, "fail render requests with a response larger than this many bytes (0 for no limit)")
+	maxDepth := flag.Int("maxdepth", 0, "fail render requests with functions nested deeper than this (0 for no limit)")
+	maxFunctions := flag.Int("maxfunctions", 0, "fail render requests with more function calls than this over all targets (0 for no limit)")
+	maxFetches := flag.Int64("maxfetches", 0, "fail render requests with more metric fetches than this over all targets, counting each timeStack shift (0 for no limit)")
+	maxWindowPoints := flag.Int64("maxwindowpoints", 0, "fail render requests with a moving window of more points than this (0 for no limit)")
+	maxWindow := flag.Duration("maxwindow", 0, "fail render requests with a moving window longer than this (0 for no limit)")
+	partialTTL := flag.Duration("partialttl", 10*time.Second, "longest expiry of cached responses missing data from failed fetches")
+	granularity := flag.Duration("keygranularity", time.Minute, "round from and until to this in render cache keys")
+	grace := flag.Duration("stalegrace", 0, "serve expired query cache entries for this long while they are refreshed")
+	early := flag.Float64("earlyrefresh", 0, "fraction of its expiry at the end of which a query cache entry may be refreshed early, at random (0 to disable)")
+	slowLogFile := flag.String("slowlog", "", "also log render requests taking longer than -slowtime to this file")
+	slowTime := flag.Duration("slowtime", 5*time.Second, "threshold of the slow query log")
+	fetchMemsize := flag.Int("fetchmemsize", 0, "in-memory render data cache size in MB (0 is unlimited)")
 
 	flag.Parse()
 
@@ -680,24 +1473,107 @@ func main() {
 	}
 
 	Limiter = newLimiter(*l)
+	Limiter.timeout = *queueTimeout
+	Limiter.weights = make(map[string]float64)
+	if *clientWeights != "" {
+		for _, cw := range strings.Split(*clientWeights, ",") {
+			i := strings.LastIndex(cw, ":")
+			w, err := strconv.ParseFloat(cw[i+1:], 64)
+			if i == -1 || err != nil || w <= 0 {
+				logger.Fatalln("bad client weight:", cw)
+			}
+			Limiter.weights[cw[:i]] = w
+		}
+	}
+
+	clientKey = *clientKeyFlag
+	if clientKey != "ip" && !strings.HasPrefix(clientKey, "header:") && !strings.HasPrefix(clientKey, "param:") {
+		logger.Fatalln("bad client key:", clientKey)
+	}
+	quotas = newClientQuotas(*clientConcurrency, *clientRate, *clientBurst)
+	renderTimeout = *timeout
+	keyGranularity = *granularity
+	partialTimeout = int32(*partialTTL / time.Second)
+	limits = renderLimits{
+		globMatches:  *maxGlobMatches,
+		series:       *maxSeries,
+		datapoints:   *maxDatapoints,
+		step:         int64(*minStep / time.Second),
+		responseSize: *maxResponseSize,
+		cost: expr.Limits{
+			Depth:         *maxDepth,
+			Functions:     *maxFunctions,
+			Fetches:       *maxFetches,
+			WindowPoints:  *maxWindowPoints,
+			WindowSeconds: int64(*maxWindow / time.Second),
+		},
+	}
+	staleGrace = int32(*grace / time.Second)
+	earlyRefresh = *early
+
+	var routes []route
+	if *routesFile != "" {
+		var err error
+		if routes, err = loadRoutes(*routesFile); err != nil {
+			logger.Fatalln("unable to load routes:", err)
+		}
+	}
+
+	if *savedExprsFile != "" {
+		savedExprs.file = *savedExprsFile
+		if err := savedExprs.reload(); err != nil {
+			logger.Fatalln("unable to load saved expressions:", err)
+		}
+		logger.Logln("loaded", len(savedExprs.get().exprs), "saved expressions")
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := savedExprs.reload(); err != nil {
+					logger.Logln("unable to reload saved expressions:", err)
+					continue
+				}
+				logger.Logln("reloaded", len(savedExprs.get().exprs), "saved expressions")
+			}
+		}()
+	}
 
-	if *z == "" {
+	var backends []string
+	if *z != "" {
+		backends = strings.Split(*z, ",")
+	}
+
+	if len(backends) == 0 && len(routes) == 0 {
 		logger.Fatalln("no zipper provided")
 	}
 
-	if _, err := url.Parse(*z); err != nil {
-		logger.Fatalln("unable to parze zipper:", err)
+	for _, b := range backends {
+		if _, err := url.Parse(b); err != nil {
+			logger.Fatalln("unable to parze zipper:", err)
+		}
+	}
+
+	logger.Logln("using zippers", backends)
+	for _, r := range routes {
+		logger.Logln("routing", strings.Join(r.pattern, "."), "to", r.backends)
 	}
 
-	logger.Logln("using zipper", *z)
 	Zipper = zipper{
-		z: *z,
+		backends: backends,
+		routes:   routes,
 		client: &http.Client{
 			Transport: &http.Transport{
 				MaxIdleConnsPerHost: *idleconns,
 			},
 		},
+		retries:    *retries,
+		retryDelay: *retryDelay,
+		hedgeDelay: *hedge,
+		batchSize:  *batch,
+		renderGlob: *renderGlob,
 	}
+	Zipper.breakers = newBreakers(Zipper.allBackends(), *breakFailures, *breakCooldown)
 
 	switch *cacheType {
 	case "memcache":
@@ -709,6 +1585,52 @@ func main() {
 		logger.Logln("using memcache servers:", servers)
 		queryCache = &memcachedCache{client: memcache.New(servers...)}
 		findCache = &memcachedCache{client: memcache.New(servers...)}
+		fetchCache = &memcachedCache{client: memcache.New(servers...)}
+
+	case "redis":
+		if *redisServer == "" {
+			logger.Fatalln("redis cache requested but no redis server provided")
+		}
+
+		logger.Logln("using redis server:", *redisServer)
+		rcache := newRedisCache(*redisServer, *redisPrefix, *redisIdle)
+		queryCache = rcache
+		findCache = rcache
+		fetchCache = rcache
+
+	case "peer":
+		if *peers == "" || *self == "" {
+			logger.Fatalln("peer cache requested but no peers or own address provided")
+		}
+		if *peerSecret == "" {
+			logger.Fatalln("peer cache requested but no peer secret provided")
+		}
+
+		peerList := strings.Split(*peers, ",")
+		var found bool
+		for _, p := range peerList {
+			found = found || p == *self
+		}
+		if !found {
+			logger.Fatalln("own address", *self, "missing from peers")
+		}
+
+		logger.Logln("sharing caches with peers:", peerList)
+		cachePeers = newPeerPool(*self, *peerSecret, peerList)
+
+		qcache := &expireCache{ec: ecache.New(uint64(*memsize * 1024 * 1024))}
+		go qcache.ec.ApproximateCleaner(10 * time.Second)
+		queryCache = cachePeers.cache("query", qcache)
+
+		fcache := &expireCache{ec: ecache.New(0)}
+		go fcache.ec.ApproximateCleaner(10 * time.Second)
+		findCache = cachePeers.cache("find", fcache)
+
+		if *fetchChunk > 0 {
+			ccache := &expireCache{ec: ecache.New(uint64(*fetchMemsize * 1024 * 1024))}
+			go ccache.ec.ApproximateCleaner(10 * time.Second)
+			fetchCache = cachePeers.cache("fetch", ccache)
+		}
 
 	case "mem":
 		qcache := &expireCache{ec: ecache.New(uint64(*memsize * 1024 * 1024))}
@@ -718,6 +1640,11 @@ func main() {
 		findCache = &expireCache{ec: ecache.New(0)}
 		go findCache.(*expireCache).ec.ApproximateCleaner(10 * time.Second)
 
+		if *fetchChunk > 0 {
+			fetchCache = &expireCache{ec: ecache.New(uint64(*fetchMemsize * 1024 * 1024))}
+			go fetchCache.(*expireCache).ec.ApproximateCleaner(10 * time.Second)
+		}
+
 		Metrics.CacheSize = expvar.Func(func() interface{} {
 			return qcache.ec.Size()
 		})
@@ -733,6 +1660,16 @@ func main() {
 		findCache = &nullCache{}
 	}
 
+	if *fetchChunk >= time.Second && fetchCache != nil {
+		logger.Logln("caching render data in chunks of", *fetchChunk)
+		renderCache = &chunkCache{
+			cache:     fetchCache,
+			chunk:     int64(*fetchChunk / time.Second),
+			ttl:       int32(*fetchTTL / time.Second),
+			recentTTL: int32(*fetchRecentTTL / time.Second),
+		}
+	}
+
 	if *tz != "" {
 		fields := strings.Split(*tz, ",")
 		if len(fields) != 2 {
@@ -780,13 +1717,37 @@ func main() {
 		graphite.Register(fmt.Sprintf("carbon.api.%s.requests", hostname), Metrics.Requests)
 		graphite.Register(fmt.Sprintf("carbon.api.%s.request_cache_hits", hostname), Metrics.RequestCacheHits)
 
+		graphite.Register(fmt.Sprintf("carbon.api.%s.request_cache_stale_hits", hostname), Metrics.RequestCacheStaleHits)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.request_cache_early_refreshes", hostname), Metrics.RequestCacheEarlyRefreshes)
+
 		graphite.Register(fmt.Sprintf("carbon.api.%s.find_requests", hostname), Metrics.FindRequests)
 		graphite.Register(fmt.Sprintf("carbon.api.%s.find_cache_hits", hostname), Metrics.FindCacheHits)
 
 		graphite.Register(fmt.Sprintf("carbon.api.%s.render_requests", hostname), Metrics.RenderRequests)
 
+		graphite.Register(fmt.Sprintf("carbon.api.%s.fetch_cache_hits", hostname), Metrics.FetchCacheHits)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.fetch_cache_misses", hostname), Metrics.FetchCacheMisses)
+
 		graphite.Register(fmt.Sprintf("carbon.api.%s.memcache_timeouts", hostname), Metrics.MemcacheTimeouts)
 
+		graphite.Register(fmt.Sprintf("carbon.api.%s.redis_hits", hostname), Metrics.RedisHits)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.redis_misses", hostname), Metrics.RedisMisses)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.redis_timeouts", hostname), Metrics.RedisTimeouts)
+
+		graphite.Register(fmt.Sprintf("carbon.api.%s.peer_cache_timeouts", hostname), Metrics.PeerCacheTimeouts)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.peer_cache_errors", hostname), Metrics.PeerCacheErrors)
+
+		graphite.Register(fmt.Sprintf("carbon.api.%s.zipper_retries", hostname), Metrics.ZipperRetries)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.zipper_hedges", hostname), Metrics.ZipperHedges)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.zipper_backend_down", hostname), Metrics.ZipperBackendDown)
+
+		graphite.Register(fmt.Sprintf("carbon.api.%s.request_flights_shared", hostname), Metrics.RequestFlightsShared)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.find_flights_shared", hostname), Metrics.FindFlightsShared)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.render_flights_shared", hostname), Metrics.RenderFlightsShared)
+
+		graphite.Register(fmt.Sprintf("carbon.api.%s.limiter_timeouts", hostname), Metrics.LimiterTimeouts)
+		graphite.Register(fmt.Sprintf("carbon.api.%s.quota_rejections", hostname), Metrics.QuotaRejections)
+
 		if Metrics.CacheSize != nil {
 			graphite.Register(fmt.Sprintf("carbon.api.%s.cache_size", hostname), Metrics.CacheSize)
 			graphite.Register(fmt.Sprintf("carbon.api.%s.cache_items", hostname), Metrics.CacheItems)
@@ -801,12 +1762,14 @@ func main() {
 
 	}
 
-	render := func(w http.ResponseWriter, r *http.Request) {
-		var stats renderStats
-		t0 := time.Now()
-		renderHandler(w, r, &stats)
-		since := time.Since(t0)
-		logger.Logln(r.RequestURI, since.Nanoseconds()/int64(time.Millisecond), stats.zipperRequests)
+	queryLog = log.New(mlog.GetOutput(), "", 0)
+	if *slowLogFile != "" {
+		f, err := os.OpenFile(*slowLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			logger.Fatalln("unable to open slow query log:", err)
+		}
+		slowLog = log.New(f, "", 0)
+		slowThreshold = *slowTime
 	}
 
 	if *pidFile != "" {
@@ -818,14 +1781,23 @@ func main() {
 	}
 
 	r := http.DefaultServeMux
-	r.HandleFunc("/render/", render)
-	r.HandleFunc("/render", render)
+	r.HandleFunc("/render/", loggedRenderHandler)
+	r.HandleFunc("/render", loggedRenderHandler)
+
+	r.HandleFunc("/metrics/find/", timedHandler("find", findHandler))
+	r.HandleFunc("/metrics/find", timedHandler("find", findHandler))
+
+	r.HandleFunc("/info/", timedHandler("info", passthroughHandler))
+	r.HandleFunc("/info", timedHandler("info", passthroughHandler))
 
-	r.HandleFunc("/metrics/find/", findHandler)
-	r.HandleFunc("/metrics/find", findHandler)
+	r.HandleFunc("/metrics", metricsHandler)
 
-	r.HandleFunc("/info/", passthroughHandler)
-	r.HandleFunc("/info", passthroughHandler)
+	r.HandleFunc("/functions/", functionsHandler)
+	r.HandleFunc("/functions", functionsHandler)
+
+	if cachePeers != nil {
+		r.Handle("/peercache/", cachePeers)
+	}
 
 	r.HandleFunc("/lb_check", lbcheckHandler)
 	r.HandleFunc("/", usageHandler)
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
 )
 
 func TestDateParamToEpoch(t *testing.T) {
@@ -31,6 +42,7 @@ func TestDateParamToEpoch(t *testing.T) {
 		{"17:04 19940812", "17:04 1994-Aug-12"},
 		{"-1day", "15:30 1994-Aug-15"},
 		{"19940812", "00:00 1994-Aug-12"},
+		{"20420812", "00:00 2042-Aug-12"},
 	}
 
 	for _, tt := range tests {
@@ -40,9 +52,503 @@ func TestDateParamToEpoch(t *testing.T) {
 			panic(fmt.Sprintf("error parsing time: %q: %v", tt.output, err))
 		}
 
-		want := int32(ts.Unix())
+		want := ts.Unix()
 		if got != want {
 			t.Errorf("dateParamToEpoch(%q, 0)=%v, want %v", tt.input, got, want)
 		}
 	}
 }
+
+func TestDateParamToEpochLongOffsets(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Date(1994, time.August, 16, 15, 30, 0, 0, defaultTimeZone)
+	}
+	defer func() { timeNow = time.Now }()
+
+	now := timeNow().Unix()
+
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{"-300y", now - 300*365*24*60*60},
+		{"-100000000y", now - 100000000*365*24*60*60},
+		// past the earliest int64 time, as are intervals IntervalString rejects
+		{"-292471208677y", 42},
+		{"-300000000000y", 42},
+	}
+
+	for _, tt := range tests {
+		if got := dateParamToEpoch(tt.input, 42); got != tt.want {
+			t.Errorf("dateParamToEpoch(%q, 42)=%v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFunctionsHandler(t *testing.T) {
+
+	req := httptest.NewRequest("GET", "/functions", nil)
+	w := httptest.NewRecorder()
+	functionsHandler(w, req)
+
+	var all map[string]functionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil {
+		t.Fatalf("failed to decode /functions: %v", err)
+	}
+
+	f, ok := all["sumSeries"]
+	if !ok {
+		t.Fatalf("sumSeries missing from /functions")
+	}
+	if len(f.Aliases) != 1 || f.Aliases[0] != "sum" {
+		t.Errorf("sumSeries aliases=%v, want [sum]", f.Aliases)
+	}
+	if _, ok := all["sum"]; ok {
+		t.Errorf("alias sum listed as a separate function")
+	}
+
+	req = httptest.NewRequest("GET", "/functions/sum", nil)
+	w = httptest.NewRecorder()
+	functionsHandler(w, req)
+
+	var one functionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &one); err != nil {
+		t.Fatalf("failed to decode /functions/sum: %v", err)
+	}
+	if one.Name != "sumSeries" || len(one.Params) != 1 || one.Params[0].Type != "seriesLists" || !one.Params[0].Multiple {
+		t.Errorf("unexpected /functions/sum: %+v", one)
+	}
+
+	req = httptest.NewRequest("GET", "/functions/noSuchFunction", nil)
+	w = httptest.NewRecorder()
+	functionsHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown function: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestLimiterContext(t *testing.T) {
+	l := newLimiter(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.enter(ctx); err != context.Canceled {
+		t.Errorf("enter with cancelled context: got %v, want %v", err, context.Canceled)
+	}
+
+	if err := l.enter(context.Background()); err != nil {
+		t.Fatalf("enter on empty limiter: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.enter(ctx); err != context.DeadlineExceeded {
+		t.Errorf("enter on full limiter: got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	l.leave()
+	if inUse, _ := l.stats(); inUse != 0 {
+		t.Errorf("limiter still holds %d slots", inUse)
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+
+	zipperServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metrics/find/":
+			b, _ := (&pb.GlobResponse{
+				Name: proto.String("foo.*"),
+				Matches: []*pb.GlobMatch{
+					{Path: proto.String("foo.bar"), IsLeaf: proto.Bool(true)},
+					{Path: proto.String("foo.baz"), IsLeaf: proto.Bool(true)},
+				},
+			}).Marshal()
+			w.Write(b)
+		case "/render/":
+			// a stuck backend: only return once the client gives up
+			<-r.Context().Done()
+		}
+	}))
+	defer zipperServer.Close()
+
+	// room for both leaves, so the abandoned render doesn't wait for the limiter
+	Zipper = zipper{backends: []string{zipperServer.URL}, client: &http.Client{}}
+	Limiter = newLimiter(2)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+	renderTimeout = 50 * time.Millisecond
+	defer func() { renderTimeout = 0 }()
+
+	req := httptest.NewRequest("GET", "/render?target=sum(foo.*)&format=json", nil)
+	w := httptest.NewRecorder()
+
+	var stats renderStats
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	// the abandoned work is cancelled in the background, and releases its slots
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := Limiter.enter(ctx); err != nil {
+			t.Fatalf("limiter still full after an aborted request: %v", err)
+		}
+	}
+	Limiter.leave()
+	Limiter.leave()
+}
+
+func TestRenderCacheKey(t *testing.T) {
+
+	keyGranularity = time.Minute
+	defer func() { keyGranularity = 0 }()
+
+	key := func(query string, from, until int64) string {
+		form, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatalf("bad query %q: %v", query, err)
+		}
+		return renderCacheKey(form, canonicalTargets(form["target"], nil), from, until)
+	}
+
+	want := key("target=sumSeries(foo.*,scale(bar,2))&format=json", 1000000020, 1000003620)
+
+	same := []struct {
+		query       string
+		from, until int64
+	}{
+		{"target=sum(foo.*, scale(bar, 2))&format=json", 1000000020, 1000003620},
+		{"format=json&target=sumSeries(foo.*,scale(bar,2.0))", 1000000020, 1000003620},
+		{"target=sumSeries(foo.*,scale(bar,2))&format=json", 1000000079, 1000003679},
+	}
+
+	for _, tt := range same {
+		if got := key(tt.query, tt.from, tt.until); got != want {
+			t.Errorf("key(%q, %d, %d)=%q, want %q", tt.query, tt.from, tt.until, got, want)
+		}
+	}
+
+	different := []struct {
+		query       string
+		from, until int64
+	}{
+		{"target=sumSeries(foo.*,scale(bar,3))&format=json", 1000000020, 1000003620},
+		{"target=sumSeries(foo.*,scale(bar,2))&format=png", 1000000020, 1000003620},
+		{"target=sumSeries(foo.*,scale(bar,2))&format=json", 1000000080, 1000003620},
+		{"target=sumSeries(foo.*,scale(bar,2))&format=json", 1000000020, 1000003680},
+	}
+
+	for _, tt := range different {
+		if got := key(tt.query, tt.from, tt.until); got == want {
+			t.Errorf("key(%q, %d, %d) shares the key of the original request", tt.query, tt.from, tt.until)
+		}
+	}
+}
+
+func TestRenderPartial(t *testing.T) {
+	var renders int32
+	zipperServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/metrics/find/":
+			if r.FormValue("query") == "bad.*" {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			b, _ := (&pb.GlobResponse{
+				Name: proto.String("foo.*"),
+				Matches: []*pb.GlobMatch{
+					{Path: proto.String("foo.bar"), IsLeaf: proto.Bool(true)},
+					{Path: proto.String("foo.baz"), IsLeaf: proto.Bool(true)},
+				},
+			}).Marshal()
+			w.Write(b)
+		case "/render/":
+			atomic.AddInt32(&renders, 1)
+			if r.FormValue("target") == "foo.baz" {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			b, _ := (&pb.MultiFetchResponse{Metrics: []*pb.FetchResponse{{
+				Name:      proto.String("foo.bar"),
+				StartTime: proto.Int32(0),
+				StopTime:  proto.Int32(60),
+				StepTime:  proto.Int32(60),
+				Values:    []float64{1},
+				IsAbsent:  []bool{false},
+			}}}).Marshal()
+			w.Write(b)
+		}
+	}))
+	defer zipperServer.Close()
+
+	Zipper = zipper{backends: []string{zipperServer.URL}, client: &http.Client{}}
+	Limiter = newLimiter(2)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+
+	partialTimeout = 10
+	defer func() { partialTimeout = 0 }()
+
+	var now int64 = 1000000000
+	timeNow = func() time.Time { return time.Unix(atomic.LoadInt64(&now), 0) }
+	defer func() { timeNow = time.Now }()
+
+	want := []renderWarning{
+		{Target: "sum(foo.*)", FailedLeaves: []string{"foo.baz"}},
+		{Target: "bad.*", FailedGlobs: []string{"bad.*"}},
+	}
+
+	render := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/render?target=sum(foo.*)&target=bad.*&format=json&from=0&until=60"+query, nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+		return w
+	}
+
+	check := func(w *httptest.ResponseRecorder) {
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+
+		var got []renderWarning
+		if err := json.Unmarshal([]byte(w.Header().Get(warningsHeader)), &got); err != nil {
+			t.Fatalf("bad warnings header %q: %v", w.Header().Get(warningsHeader), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("header warnings=%+v, want %+v", got, want)
+		}
+
+		var env struct {
+			Series   []map[string]interface{}
+			Warnings []renderWarning
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatalf("bad envelope %q: %v", w.Body.String(), err)
+		}
+		if len(env.Series) != 1 || env.Series[0]["target"] != "sumSeries(foo.*)" {
+			t.Errorf("got series %v, want sumSeries(foo.*)", env.Series)
+		}
+		if !reflect.DeepEqual(env.Warnings, want) {
+			t.Errorf("envelope warnings=%+v, want %+v", env.Warnings, want)
+		}
+	}
+
+	check(render("&envelope=1"))
+	if n := atomic.LoadInt32(&renders); n != 2 {
+		t.Fatalf("got %d zipper renders, want 2", n)
+	}
+
+	// the warnings are cached with the response, for a short while only
+	check(render("&envelope=1"))
+	if n := atomic.LoadInt32(&renders); n != 2 {
+		t.Errorf("got %d zipper renders for a cached request, want 2", n)
+	}
+
+	atomic.AddInt64(&now, 11)
+	check(render("&envelope=1"))
+	if n := atomic.LoadInt32(&renders); n != 4 {
+		t.Errorf("got %d zipper renders after the partial response expired, want 4", n)
+	}
+
+	if w := render("&strict=1"); w.Code != http.StatusBadGateway {
+		t.Errorf("strict: got status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestRenderPartialFind(t *testing.T) {
+	up := fakeZipper([]string{"servers.a"}, []string{"servers.a"})
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	Zipper = zipper{
+		routes: []route{{pattern: []string{"servers"}, backends: []string{up.URL, down.URL}}},
+		client: &http.Client{},
+	}
+	Limiter = newLimiter(2)
+	queryCache = &nullCache{}
+	findCache = &ttlCache{}
+	defer func() { findCache = &nullCache{} }()
+
+	req := httptest.NewRequest("GET", "/render?target=sumSeries(servers.*)&format=json&from=0&until=60", nil)
+	w := httptest.NewRecorder()
+	var stats renderStats
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"target":"sumSeries(servers.*)"`) {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	var got []renderWarning
+	if err := json.Unmarshal([]byte(w.Header().Get(warningsHeader)), &got); err != nil {
+		t.Fatalf("bad warnings header %q: %v", w.Header().Get(warningsHeader), err)
+	}
+	want := []renderWarning{{Target: "sumSeries(servers.*)", PartialGlobs: []string{"servers.*"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings=%+v, want %+v", got, want)
+	}
+	if len(stats.backendErrors) != 1 || !strings.Contains(stats.backendErrors[0], down.URL) {
+		t.Errorf("got backend errors %v, want the failed find", stats.backendErrors)
+	}
+
+	// the matches of the backends which answered aren't cached
+	if _, ok := findCache.get("servers.*"); ok {
+		t.Errorf("partial find matches were cached")
+	}
+
+	// and the find endpoint returns them with the warning
+	req = httptest.NewRequest("GET", "/metrics/find/?query=servers.*&format=raw", nil)
+	w = httptest.NewRecorder()
+	findHandler(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "servers.a") || w.Header().Get(warningsHeader) == "" {
+		t.Errorf("find: got status %d, %q, warnings %q", w.Code, w.Body.String(), w.Header().Get(warningsHeader))
+	}
+}
+
+func TestRenderParseError(t *testing.T) {
+	queryCache = &nullCache{}
+
+	req := httptest.NewRequest("GET", "/render?target=scale(movingAverag(foo,5),2)&format=json&from=1000000000&until=1000000600", nil)
+	w := httptest.NewRecorder()
+	var stats renderStats
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != contentTypeJSON {
+		t.Fatalf("got status %d, %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	var got parseErrorJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad response %q: %v", w.Body.String(), err)
+	}
+
+	want := parseErrorJSON{
+		Error:      `unknown function "movingAverag", did you mean "movingAverage"?`,
+		Target:     "scale(movingAverag(foo,5),2)",
+		Offset:     6,
+		Excerpt:    "scale(movingAverag(foo,5),2)\n      ^",
+		Suggestion: "movingAverage",
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// the offset is in the target as it was given
+	target := "scale(movingAverage(foo,  '5min'), 'x')"
+	req = httptest.NewRequest("GET", "/render?format=json&from=1000000000&until=1000000600&target="+url.QueryEscape(target), nil)
+	w = httptest.NewRecorder()
+	renderHandler(w, req, &stats)
+
+	got = parseErrorJSON{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad response %q: %v", w.Body.String(), err)
+	}
+	if got.Target != target || got.Offset != 35 {
+		t.Errorf("got %+v, want target %s at offset 35", got, target)
+	}
+
+	req = httptest.NewRequest("GET", "/render?target=scale(foo,2&format=png", nil)
+	w = httptest.NewRecorder()
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Error               : missing comma\n") || !strings.Contains(body, "scale(foo,2\n           ^") {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestRenderCanonicalNames(t *testing.T) {
+	leaves := []string{"servers.web01.cpu", "servers.web02.cpu"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+	defer func() { queryCache = &nullCache{} }()
+
+	// both spellings share a cache entry, and render the same whichever
+	// fills it: series are named after the canonical form
+	want := `[{"target":"sumSeries(servers.web01.cpu,servers.web02.cpu)","datapoints":[[4,0]]}]`
+	for i, target := range []string{"sum(servers.web01.cpu, servers.web02.cpu)", "sumSeries(servers.web01.cpu,servers.web02.cpu)"} {
+		req := httptest.NewRequest("GET", "/render?format=json&from=1000000000&until=1000000600&target="+url.QueryEscape(target), nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: got status %d, %s, want %s", target, w.Code, w.Body.String(), want)
+		}
+		if stats.cacheHit != (i == 1) {
+			t.Errorf("%s: got cache hit %v", target, stats.cacheHit)
+		}
+		if len(stats.targets) != 1 || stats.targets[0] != target {
+			t.Errorf("logged targets %q, want %q", stats.targets, target)
+		}
+	}
+}
+
+func TestRenderMostDeviantLegacyOrder(t *testing.T) {
+	leaves := []string{"servers.web01.cpu", "servers.web02.cpu"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+
+	for _, target := range []string{"mostDeviant(servers.*.cpu, 1)", "mostDeviant(1, servers.*.cpu)"} {
+		req := httptest.NewRequest("GET", "/render?format=json&from=1000000000&until=1000000600&target="+url.QueryEscape(target), nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d: %s", target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRenderTemplateVariables(t *testing.T) {
+	leaves := []string{"servers.web01.cpu", "servers.web02.cpu"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+	defer func() { queryCache = &nullCache{} }()
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"target=template(servers.$host.cpu,host='web01')", `"target":"servers.web01.cpu"`},
+		{"target=template(servers.$host.cpu,host='web01')&var-host=web02", `"target":"servers.web02.cpu"`},
+		{"target=alias(servers.$host.cpu,'$host')&var-host=web01", `"target":"web01"`},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/render?format=json&from=1000000000&until=1000000600&"+tt.query, nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: got status %d, %s, want %s", tt.query, w.Code, w.Body.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hashRing maps keys to peers by consistent hashing, so that adding or
+// removing a peer only moves the keys it owns
+type hashRing struct {
+	hashes []uint32
+	peers  map[uint32]string
+}
+
+func newHashRing(replicas int, peers []string) *hashRing {
+	r := &hashRing{peers: make(map[uint32]string)}
+
+	for _, p := range peers {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + p))
+			r.hashes = append(r.hashes, h)
+			r.peers[h] = p
+		}
+	}
+
+	sort.Sort(uint32s(r.hashes))
+
+	return r
+}
+
+// get returns the peer owning key
+func (r *hashRing) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.peers[r.hashes[i]]
+}
+
+type uint32s []uint32
+
+func (s uint32s) Len() int           { return len(s) }
+func (s uint32s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint32s) Less(i, j int) bool { return s[i] < s[j] }
+
+// peerSecretHeader carries the secret shared by the peers in their requests
+const peerSecretHeader = "X-Carbonapi-Peer-Secret"
+
+// peerClientHeader carries the client of a render request forwarded by a peer
+const peerClientHeader = "X-Carbonapi-Peer-Client"
+
+// peerPool is the set of carbonapi replicas sharing their caches.  Each key is
+// kept by the one peer owning it, so the cache of the cluster grows with the
+// number of replicas instead of each of them caching the same entries.
+//
+// Render requests missing the query cache are forwarded to the owner of
+// their entry, which renders the concurrent misses of all the peers once and
+// keeps the response.  Find and fetch entries are stored with their owner by
+// whichever peer fetched them.
+type peerPool struct {
+	self   string
+	secret string
+	ring   *hashRing
+	client *http.Client
+
+	// renderClient sends forwarded render requests, which take as long as
+	// the render does
+	renderClient *http.Client
+
+	// groups holds the local part of each shared cache, by name
+	groups map[string]bytesCache
+}
+
+func newPeerPool(self, secret string, peers []string) *peerPool {
+	return &peerPool{
+		self:   self,
+		secret: secret,
+		ring:   newHashRing(50, peers),
+		client: &http.Client{Timeout: time.Second},
+		groups: make(map[string]bytesCache),
+
+		renderClient: &http.Client{},
+	}
+}
+
+// cache returns the shared cache called name, keeping its local entries in local
+func (p *peerPool) cache(name string, local bytesCache) *peerCache {
+	p.groups[name] = local
+	return &peerCache{pool: p, name: name, local: local}
+}
+
+// request returns a request to another peer, carrying the shared secret
+func (p *peerPool) request(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerSecretHeader, p.secret)
+	return req, nil
+}
+
+// fromPeer reports whether r was sent by another peer, knowing the shared
+// secret, and returns the client it was forwarded for
+func (p *peerPool) fromPeer(r *http.Request) (string, bool) {
+	if p == nil || subtle.ConstantTimeCompare([]byte(r.Header.Get(peerSecretHeader)), []byte(p.secret)) != 1 {
+		return "", false
+	}
+	return r.Header.Get(peerClientHeader), true
+}
+
+// peerResponse is what a peer answered to a forwarded render request
+type peerResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// forward sends the render request of client with form to peer, the owner of
+// its cache entry.  The form is POSTed, as it may be too long for a URL.
+func (p *peerPool) forward(ctx context.Context, peer, client string, form url.Values) (*peerResponse, error) {
+	req, err := p.request("POST", peer+"/render/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(peerClientHeader, client)
+
+	resp, err := p.renderClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerResponse{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// ServeHTTP answers the cache requests of the other peers, which are the only
+// ones knowing the shared secret
+func (p *peerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := p.fromPeer(r); !ok {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	local, ok := p.groups[r.FormValue("group")]
+	if !ok {
+		http.Error(w, "unknown cache group", http.StatusNotFound)
+		return
+	}
+
+	key := r.FormValue("key")
+
+	switch r.Method {
+	case "GET":
+		v, ok := local.get(key)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		w.Write(v)
+	case "PUT":
+		v, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		expire, _ := strconv.Atoi(r.FormValue("expire"))
+		local.set(key, v, int32(expire))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// peerCache is a bytesCache whose entries are spread over the peers
+type peerCache struct {
+	pool  *peerPool
+	name  string
+	local bytesCache
+}
+
+// key hashes k, as render cache keys can be longer than we'd like in a URL
+func (c *peerCache) key(k string) string {
+	key := sha1.Sum([]byte(k))
+	return hex.EncodeToString(key[:])
+}
+
+// owner returns the peer owning k, or "" if it is this one
+func (c *peerCache) owner(k string) string {
+	if owner := c.pool.ring.get(c.key(k)); owner != c.pool.self {
+		return owner
+	}
+	return ""
+}
+
+func (c *peerCache) url(peer, k string) string {
+	return peer + "/peercache/?" + url.Values{"group": {c.name}, "key": {k}}.Encode()
+}
+
+func (c *peerCache) get(k string) ([]byte, bool) {
+	k = c.key(k)
+	owner := c.pool.ring.get(k)
+	if owner == c.pool.self {
+		return c.local.get(k)
+	}
+
+	done := make(chan bool, 1)
+
+	var v []byte
+	var ok bool
+
+	go func() {
+		v, ok = c.fetch(owner, k)
+		done <- true
+	}()
+
+	timeout := time.After(50 * time.Millisecond)
+
+	select {
+	case <-timeout:
+		Metrics.PeerCacheTimeouts.Add(1)
+		return nil, false
+	case <-done:
+	}
+
+	return v, ok
+}
+
+func (c *peerCache) fetch(peer, k string) ([]byte, bool) {
+	req, err := c.pool.request("GET", c.url(peer, k), nil)
+	if err != nil {
+		return nil, false
+	}
+	resp, err := c.pool.client.Do(req)
+	if err != nil {
+		Metrics.PeerCacheErrors.Add(1)
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+
+	v, err := ioutil.ReadAll(resp.Body)
+	return v, err == nil
+}
+
+func (c *peerCache) set(k string, v []byte, expire int32) {
+	k = c.key(k)
+	owner := c.pool.ring.get(k)
+	if owner == c.pool.self {
+		c.local.set(k, v, expire)
+		return
+	}
+
+	go func() {
+		u := c.url(owner, k) + "&expire=" + strconv.Itoa(int(expire))
+		req, err := c.pool.request("PUT", u, bytes.NewReader(v))
+		if err != nil {
+			return
+		}
+		resp, err := c.pool.client.Do(req)
+		if err != nil {
+			Metrics.PeerCacheErrors.Add(1)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	peers := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	r := newHashRing(50, peers)
+
+	owned := make(map[string]int)
+	keys := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("target=foo.%d", i)
+		keys[k] = r.get(k)
+		owned[keys[k]]++
+	}
+
+	for _, p := range peers {
+		if owned[p] < 500 {
+			t.Errorf("%s owns only %d of 3000 keys", p, owned[p])
+		}
+	}
+
+	// adding a peer only moves keys to the new peer
+	r = newHashRing(50, append(peers, "http://d:8080"))
+	var moved int
+	for k, p := range keys {
+		if q := r.get(k); q != p {
+			moved++
+			if q != "http://d:8080" {
+				t.Fatalf("%s moved from %s to %s", k, p, q)
+			}
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Errorf("%d of 3000 keys moved to the new peer", moved)
+	}
+}
+
+func TestPeerCache(t *testing.T) {
+	// start the servers first, to know the addresses of the peers
+	handlers := make([]http.Handler, 2)
+	var servers []*httptest.Server
+	var addrs []string
+	for i := range handlers {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		servers = append(servers, srv)
+		addrs = append(addrs, srv.URL)
+	}
+
+	var caches []*peerCache
+	var locals []*ttlCache
+	for i := range servers {
+		pool := newPeerPool(addrs[i], "secret", addrs)
+		local := &ttlCache{}
+		caches = append(caches, pool.cache("query", local))
+		locals = append(locals, local)
+		handlers[i] = pool
+	}
+
+	// find a key owned by the second peer
+	var k string
+	for i := 0; ; i++ {
+		k = fmt.Sprintf("key%d", i)
+		if caches[0].pool.ring.get(caches[0].key(k)) == addrs[1] {
+			break
+		}
+	}
+
+	caches[0].set(k, []byte("value"), 60)
+
+	// the entry ends up with its owner only
+	var v []byte
+	var ok bool
+	for deadline := time.Now().Add(time.Second); !ok && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		v, ok = locals[1].get(caches[0].key(k))
+	}
+	if !ok || string(v) != "value" {
+		t.Fatalf("owner has %q, %v", v, ok)
+	}
+	if _, ok := locals[0].get(caches[0].key(k)); ok {
+		t.Errorf("entry stored by a peer not owning it")
+	}
+
+	for i, c := range caches {
+		if v, ok := c.get(k); !ok || string(v) != "value" {
+			t.Errorf("peer %d: get=%q, %v", i, v, ok)
+		}
+	}
+
+	if _, ok := caches[0].get("missing"); ok {
+		t.Errorf("get of a missing key succeeded")
+	}
+
+	// clients other than the peers can neither read nor write entries
+	owner := caches[0].url(addrs[1], caches[0].key(k))
+	for _, secret := range []string{"", "wrong"} {
+		for _, method := range []string{"GET", "PUT"} {
+			req, _ := http.NewRequest(method, owner, strings.NewReader("poisoned"))
+			if secret != "" {
+				req.Header.Set(peerSecretHeader, secret)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("%s with secret %q: got status %d, want %d", method, secret, resp.StatusCode, http.StatusForbidden)
+			}
+		}
+	}
+	if v, ok := locals[1].get(caches[0].key(k)); !ok || string(v) != "value" {
+		t.Errorf("after requests without the secret, owner has %q, %v", v, ok)
+	}
+}
+
+func TestPeerRender(t *testing.T) {
+	var renders int32
+	release := make(chan struct{})
+	fake := fakeZipper([]string{"foo.bar"}, []string{"foo.bar"})
+	defer fake.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/render/" {
+			atomic.AddInt32(&renders, 1)
+			<-release
+		}
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	Zipper = zipper{backends: []string{backend.URL}, client: &http.Client{}}
+	Limiter = newLimiter(2)
+	findCache = &nullCache{}
+
+	// two replicas, the second owning the entry of the request.  The render
+	// handlers of both run as the first, so that a miss on either is
+	// forwarded to the owner.
+	var forwarded int32
+	muxes := make([]*http.ServeMux, 2)
+	var addrs []string
+	for i := range muxes {
+		muxes[i] = http.NewServeMux()
+		srv := httptest.NewServer(muxes[i])
+		defer srv.Close()
+		addrs = append(addrs, srv.URL)
+	}
+
+	var locals []*ttlCache
+	for i, mux := range muxes {
+		pool := newPeerPool(addrs[i], "secret", addrs)
+		local := &ttlCache{}
+		locals = append(locals, local)
+		c := pool.cache("query", local)
+		if i == 0 {
+			cachePeers, queryCache = pool, c
+		}
+		mux.Handle("/peercache/", pool)
+		mux.HandleFunc("/render/", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(peerSecretHeader) != "" {
+				atomic.AddInt32(&forwarded, 1)
+			}
+			var stats renderStats
+			renderHandler(w, r, &stats)
+		})
+	}
+	defer func() { cachePeers, queryCache = nil, &nullCache{} }()
+
+	pc := queryCache.(*peerCache)
+	var query, key string
+	for i := 0; ; i++ {
+		until := int64(1000000060 + i*60)
+		query = fmt.Sprintf("target=foo.bar&format=json&from=1000000000&until=%d", until)
+		form, _ := url.ParseQuery(query)
+		k := renderCacheKey(form, form["target"], 1000000000, until)
+		if pc.owner(k) == addrs[1] {
+			key = pc.key(k)
+			break
+		}
+	}
+
+	render := func(addr string) (int, string) {
+		resp, err := http.Get(addr + "/render/?" + query)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// both replicas miss the entry at once
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			if code, body := render(addr); code != http.StatusOK || !strings.Contains(body, `"target":"foo.bar"`) {
+				t.Errorf("%s: got status %d, %s", addr, code, body)
+			}
+		}(addr)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&forwarded) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&forwarded); n != 2 {
+		t.Errorf("got %d misses forwarded to the owner, want 2", n)
+	}
+	if n := atomic.LoadInt32(&renders); n != 1 {
+		t.Errorf("got %d backend renders for the misses of two replicas, want 1", n)
+	}
+
+	// the owner keeps the response
+	var ok bool
+	for deadline := time.Now().Add(time.Second); !ok && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		_, ok = locals[1].get(key)
+	}
+	if !ok {
+		t.Fatalf("response not cached by the owner")
+	}
+	if _, ok := locals[0].get(key); ok {
+		t.Errorf("response cached by a peer not owning it")
+	}
+
+	// and answers the requests coming later from its cache
+	if code, _ := render(addrs[0]); code != http.StatusOK || atomic.LoadInt32(&renders) != 1 || atomic.LoadInt32(&forwarded) != 2 {
+		t.Errorf("got status %d, %d backend renders and %d forwarded requests for a cached request", code, atomic.LoadInt32(&renders), atomic.LoadInt32(&forwarded))
+	}
+}
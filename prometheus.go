@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus exposition of our internal statistics.  The expvar counters of
+// Metrics are exported as they are, along with latency histograms and
+// labelled counters which don't fit the flat graphite namespace.
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+var (
+	requestDuration = newHistogramVec("carbonapi_request_duration_seconds",
+		"Time spent serving requests, by endpoint and format.", "handler", "format")
+
+	limiterWait = newHistogramVec("carbonapi_limiter_wait_seconds",
+		"Time spent waiting for a zipper request slot.")
+
+	zipperDuration = newHistogramVec("carbonapi_zipper_request_duration_seconds",
+		"Latency of zipper requests, by backend and kind.", "backend", "kind")
+
+	zipperErrors = newCounterVec("carbonapi_zipper_errors_total",
+		"Failed zipper requests, by backend and kind.", "backend", "kind")
+
+	cacheRequests = newCounterVec("carbonapi_cache_requests_total",
+		"Cache lookups, by cache and result.", "cache", "result")
+)
+
+// knownFormats are the format label values of requests; anything else is
+// reported as "other" to bound the number of series
+var knownFormats = map[string]bool{
+	"json": true, "protobuf": true, "raw": true, "csv": true,
+	"pickle": true, "png": true, "svg": true,
+	"treejson": true, "completer": true,
+}
+
+func formatLabel(format string) string {
+	if format == "" || knownFormats[format] {
+		return format
+	}
+	return "other"
+}
+
+// observeRequest records the latency of a request to one of our endpoints
+func observeRequest(handler, format string, d time.Duration) {
+	requestDuration.with(handler, formatLabel(format)).observe(d.Seconds())
+}
+
+// timedHandler records the latency of the requests served by h
+func timedHandler(handler string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t0 := time.Now()
+		h(w, r)
+		observeRequest(handler, r.FormValue("format"), time.Since(t0))
+	}
+}
+
+// observeZipper records the outcome of a request to a zipper, started at t0
+// and failed with *err if not nil
+func observeZipper(backend, kind string, t0 time.Time, err *error) {
+	zipperDuration.with(backend, kind).observe(time.Since(t0).Seconds())
+	if *err != nil && *err != errNoMetrics {
+		zipperErrors.with(backend, kind).add(1)
+	}
+}
+
+// observeCache records the result of a lookup in the named cache
+func observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.with(cache, result).add(1)
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, plus one for +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// histogramVec is a histogram for each combination of label values
+type histogramVec struct {
+	name, help string
+	labels     []string
+
+	mu sync.Mutex
+	m  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, m: make(map[string]*histogram)}
+}
+
+func (v *histogramVec) with(values ...string) *histogram {
+	k := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.m[k]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		v.m[k] = h
+	}
+	return h
+}
+
+func (v *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.m))
+	for k := range v.m {
+		keys = append(keys, k)
+	}
+	v.mu.Unlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v.mu.Lock()
+		h := v.m[k]
+		v.mu.Unlock()
+
+		labels := labelPairs(v.labels, k)
+
+		h.mu.Lock()
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", v.name, withLabel(labels, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", v.name, withLabel(labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, braces(labels), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, braces(labels), h.count)
+		h.mu.Unlock()
+	}
+}
+
+// counterVec is a counter for each combination of label values
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu sync.Mutex
+	m  map[string]*counter
+}
+
+type counter struct{ n int64 }
+
+func (c *counter) add(n int64) { atomic.AddInt64(&c.n, n) }
+
+func (c *counter) value() int64 { return atomic.LoadInt64(&c.n) }
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, m: make(map[string]*counter)}
+}
+
+func (v *counterVec) with(values ...string) *counter {
+	k := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.m[k]
+	if !ok {
+		c = &counter{}
+		v.m[k] = c
+	}
+	return c
+}
+
+func (v *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.m))
+	for k := range v.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, braces(labelPairs(v.labels, k)), v.m[k].value())
+	}
+}
+
+// writeHitRatios writes the hit ratio of each cache since we started
+func writeHitRatios(w io.Writer) {
+	const name = "carbonapi_cache_hit_ratio"
+	fmt.Fprintf(w, "# HELP %s Ratio of cache lookups which were hits since startup.\n# TYPE %s gauge\n", name, name)
+
+	hits := make(map[string]int64)
+	total := make(map[string]int64)
+
+	cacheRequests.mu.Lock()
+	for k, c := range cacheRequests.m {
+		v := strings.Split(k, "\xff")
+		total[v[0]] += c.value()
+		if v[1] == "hit" {
+			hits[v[0]] += c.value()
+		}
+	}
+	cacheRequests.mu.Unlock()
+
+	var caches []string
+	for cache := range total {
+		caches = append(caches, cache)
+	}
+	sort.Strings(caches)
+
+	for _, cache := range caches {
+		fmt.Fprintf(w, "%s{cache=\"%s\"} %s\n", name, escapeLabel(cache), formatFloat(float64(hits[cache])/float64(total[cache])))
+	}
+}
+
+func labelPairs(names []string, key string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + `="` + escapeLabel(values[i]) + `"`
+	}
+	return pairs
+}
+
+func withLabel(pairs []string, name, value string) string {
+	return strings.Join(append(append([]string(nil), pairs...), name+`="`+value+`"`), ",")
+}
+
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsHandler serves our statistics in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			name := "carbonapi_" + kv.Key + "_total"
+			fmt.Fprintf(&buf, "# TYPE %s counter\n%s %s\n", name, name, v.String())
+		case expvar.Func:
+			// cache_size and cache_items, but not memstats or cmdline
+			s := fmt.Sprint(v())
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				name := "carbonapi_" + kv.Key
+				fmt.Fprintf(&buf, "# TYPE %s gauge\n%s %s\n", name, name, s)
+			}
+		}
+	})
+
+	inUse, waiting := Limiter.stats()
+	fmt.Fprintf(&buf, "# HELP carbonapi_limiter_in_use Zipper request slots in use.\n# TYPE carbonapi_limiter_in_use gauge\ncarbonapi_limiter_in_use %d\n", inUse)
+	fmt.Fprintf(&buf, "# HELP carbonapi_limiter_capacity Zipper request slots.\n# TYPE carbonapi_limiter_capacity gauge\ncarbonapi_limiter_capacity %d\n", Limiter.slots)
+	fmt.Fprintf(&buf, "# HELP carbonapi_limiter_waiting Requests waiting for a zipper request slot.\n# TYPE carbonapi_limiter_waiting gauge\ncarbonapi_limiter_waiting %d\n", waiting)
+
+	requestDuration.write(&buf)
+	limiterWait.write(&buf)
+	zipperDuration.write(&buf)
+	zipperErrors.write(&buf)
+	cacheRequests.write(&buf)
+	writeHitRatios(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
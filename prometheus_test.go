@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramVec(t *testing.T) {
+	v := newHistogramVec("test_seconds", "Test.", "kind")
+	v.with("a").observe(0.001)
+	v.with("a").observe(0.3)
+	v.with("a").observe(60)
+	v.with(`b"`).observe(0.01)
+
+	w := httptest.NewRecorder()
+	v.write(w)
+	out := w.Body.String()
+
+	for _, want := range []string{
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{kind="a",le="0.005"} 1` + "\n",
+		`test_seconds_bucket{kind="a",le="0.25"} 1` + "\n",
+		`test_seconds_bucket{kind="a",le="0.5"} 2` + "\n",
+		`test_seconds_bucket{kind="a",le="30"} 2` + "\n",
+		`test_seconds_bucket{kind="a",le="+Inf"} 3` + "\n",
+		`test_seconds_sum{kind="a"} 60.301` + "\n",
+		`test_seconds_count{kind="a"} 3` + "\n",
+		`test_seconds_bucket{kind="b\"",le="0.01"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	fake := fakeZipper([]string{"foo.bar"}, []string{"foo.bar"})
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(2)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+
+	req := httptest.NewRequest("GET", "/render?target=foo.bar&format=json&from=1000000000&until=1000000600", nil)
+	loggedRenderHandler(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+
+	for _, want := range []string{
+		"\ncarbonapi_requests_total ",
+		"\ncarbonapi_render_requests_total ",
+		"\ncarbonapi_limiter_capacity 2\n",
+		"\ncarbonapi_limiter_in_use 0\n",
+		"\ncarbonapi_limiter_wait_seconds_count ",
+		`carbonapi_request_duration_seconds_count{handler="render",format="json"} `,
+		`carbonapi_zipper_request_duration_seconds_count{backend="` + fake.URL + `",kind="find"} `,
+		`carbonapi_zipper_request_duration_seconds_count{backend="` + fake.URL + `",kind="render"} `,
+		`carbonapi_cache_requests_total{cache="query",result="miss"} `,
+		`carbonapi_cache_hit_ratio{cache="query"} `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/dgryski/carbonapi/expr"
+)
+
+// maxQueryBody bounds the size of JSON render queries
+const maxQueryBody = 1 << 20
+
+// renderQuery is a render request POSTed as JSON, for targets too long or
+// awkward to quote in a URL.  Targets are strings in the usual syntax or
+// expressions in the JSON form taken by expr.Expr.UnmarshalJSON.  Options are
+// any other render parameters, such as maxDataPoints or noCache.
+type renderQuery struct {
+	Targets []*expr.Expr         `json:"targets"`
+	From    formValue            `json:"from"`
+	Until   formValue            `json:"until"`
+	Format  formValue            `json:"format"`
+	Options map[string]formValue `json:"options"`
+}
+
+// formValue is a request parameter given in JSON as a string, number or boolean
+type formValue string
+
+func (v *formValue) UnmarshalJSON(b []byte) error {
+	if len(b) != 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*v = formValue(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err == nil {
+		*v = formValue(n)
+		return nil
+	}
+
+	var t bool
+	if err := json.Unmarshal(b, &t); err != nil {
+		return errors.New("parameter must be a string, number or boolean")
+	}
+	*v = formValue(strconv.FormatBool(t))
+	return nil
+}
+
+// isJSONQuery reports whether r carries a renderQuery
+func isJSONQuery(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// parseJSONQuery decodes the renderQuery of r into its form, as if its
+// parameters had been given in the URL, so that the request is served, and
+// cached, like the equivalent GET request.  r.ParseForm must have been called.
+func parseJSONQuery(w http.ResponseWriter, r *http.Request) error {
+	var q renderQuery
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryBody)).Decode(&q); err != nil {
+		return err
+	}
+
+	for i, t := range q.Targets {
+		if t == nil {
+			return errors.New("target " + strconv.Itoa(i) + " is null")
+		}
+		r.Form.Add("target", t.String())
+	}
+
+	for k, v := range q.Options {
+		r.Form.Set(k, string(v))
+	}
+
+	params := []struct {
+		name  string
+		value formValue
+	}{{"from", q.From}, {"until", q.Until}, {"format", q.Format}}
+
+	for _, p := range params {
+		if p.value != "" {
+			r.Form.Set(p.name, string(p.value))
+		}
+	}
+
+	return nil
+}
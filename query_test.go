@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderJSONQuery(t *testing.T) {
+	fake := fakeZipper([]string{"foo.a", "foo.b"}, []string{"foo.a", "foo.b"})
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+	defer func() { queryCache = &nullCache{} }()
+
+	body := `{
+		"targets": [
+			{"function": "sum", "args": [{"function": "scale", "args": ["foo.*", 2]}]},
+			"alias(foo.a, 'a')"
+		],
+		"from": 1000000000,
+		"until": "1000000600",
+		"format": "json",
+		"options": {"maxDataPoints": 100}
+	}`
+
+	req := httptest.NewRequest("POST", "/render", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	w := httptest.NewRecorder()
+	var stats renderStats
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	if stats.cacheHit {
+		t.Errorf("POST: got a cache hit, want a miss")
+	}
+	if got := strings.Join(stats.targets, " "); got != `sum(scale(foo.*,2)) alias(foo.a,"a")` {
+		t.Errorf("POST: got targets %s", got)
+	}
+	if !strings.Contains(w.Body.String(), `"target":"sumSeries(scale(foo.*,2))"`) {
+		t.Errorf("POST: got %s", w.Body.String())
+	}
+
+	// the equivalent GET request shares the cache entry
+	req = httptest.NewRequest("GET", "/render?target=sumSeries(scale(foo.*,2.0))&target=alias(foo.a,%22a%22)&from=1000000000&until=1000000600&format=json&maxDataPoints=100", nil)
+	w = httptest.NewRecorder()
+	stats = renderStats{}
+	renderHandler(w, req, &stats)
+
+	if w.Code != http.StatusOK || !stats.cacheHit {
+		t.Errorf("GET: got status %d, cache hit %v, want a cache hit", w.Code, stats.cacheHit)
+	}
+
+	for _, body := range []string{
+		`{"targets": [null]}`,
+		`{"targets": [{"args": ["foo"]}]}`,
+		`{"targets": [{"function": "scale", "args": ["foo", [2]]}]}`,
+		`{"targets": [{"function": "summarize", "args": ["foo", "'1h'"], "namedArgs": {"func": {"function": "sum", "args": ["x"]}}}]}`,
+		`{"targets": ["sum(foo"]}`,
+		`{"targets": ["foo"], "from": {}}`,
+	} {
+		req := httptest.NewRequest("POST", "/render", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		renderHandler(w, req, &renderStats{})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dgryski/carbonapi/expr"
+)
+
+// renderStats gathers what a render request did, for the query log
+type renderStats struct {
+	// filled in by renderHandler
+	targets     []string
+	from, until int64
+	format      string
+	cacheHit    bool
+
+	// filled in by evalTargets
+	findRequests   int
+	renderRequests int
+	leaves         int
+	targetTimes    []targetTime
+	backendErrors  []string
+
+	// filled in by evalTargets, for explain=1
+	exprs   []*expr.Expr
+	fetches []fetchStats
+}
+
+// fetchStats is what was done to fetch a metric request of a target
+type fetchStats struct {
+	target int // index in the request
+
+	Metric string `json:"metric"`
+	From   int64  `json:"from"`
+	Until  int64  `json:"until"`
+	// Reused is set for metrics already fetched for an earlier target
+	Reused         bool     `json:"reused,omitempty"`
+	FindCached     bool     `json:"findCached,omitempty"`
+	FindError      string   `json:"findError,omitempty"`
+	Matches        int      `json:"matches"`
+	Leaves         int      `json:"leaves"`
+	RenderRequests int      `json:"renderRequests"`
+	Series         int      `json:"series"`
+	FailedLeaves   []string `json:"failedLeaves,omitempty"`
+}
+
+// targetTime is how long a target took to evaluate, fetching its metrics included
+type targetTime struct {
+	Target  string  `json:"target"`
+	Runtime float64 `json:"runtime"`
+}
+
+// addEval adds the statistics gathered by evalTargets in e to s
+func (s *renderStats) addEval(e renderStats) {
+	s.findRequests += e.findRequests
+	s.renderRequests += e.renderRequests
+	s.leaves += e.leaves
+	s.targetTimes = append(s.targetTimes, e.targetTimes...)
+	s.backendErrors = append(s.backendErrors, e.backendErrors...)
+	s.exprs = append(s.exprs, e.exprs...)
+	s.fetches = append(s.fetches, e.fetches...)
+}
+
+// queryLogEntry is the JSON record logged for each render request
+type queryLogEntry struct {
+	Time           string       `json:"time"`
+	Client         string       `json:"client"`
+	URI            string       `json:"uri"`
+	Targets        []string     `json:"targets"`
+	From           int64        `json:"from"`
+	Until          int64        `json:"until"`
+	Format         string       `json:"format"`
+	Status         int          `json:"status"`
+	CacheHit       bool         `json:"cacheHit"`
+	FindRequests   int          `json:"findRequests"`
+	RenderRequests int          `json:"renderRequests"`
+	Leaves         int          `json:"leaves"`
+	Bytes          int          `json:"bytes"`
+	Runtime        float64      `json:"runtime"`
+	TargetTimes    []targetTime `json:"targetTimes,omitempty"`
+	BackendErrors  []string     `json:"backendErrors,omitempty"`
+}
+
+var (
+	// queryLog gets a JSON record for each render request
+	queryLog *log.Logger
+
+	// slowLog gets the records of requests taking longer than slowThreshold
+	slowLog       *log.Logger
+	slowThreshold time.Duration
+)
+
+// loggedRenderHandler serves a render request and logs it
+func loggedRenderHandler(w http.ResponseWriter, r *http.Request) {
+	var stats renderStats
+	t0 := time.Now()
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	renderHandler(lw, r, &stats)
+	runtime := time.Since(t0)
+	observeRequest("render", stats.format, runtime)
+	logRender(r, lw, &stats, runtime)
+}
+
+// logRender writes the query log record of a render request
+func logRender(r *http.Request, w *loggingResponseWriter, stats *renderStats, runtime time.Duration) {
+
+	slow := slowLog != nil && runtime >= slowThreshold
+	if queryLog == nil && !slow {
+		return
+	}
+
+	b, err := json.Marshal(queryLogEntry{
+		Time:           timeNow().Format(time.RFC3339),
+		Client:         clientID(r),
+		URI:            r.RequestURI,
+		Targets:        stats.targets,
+		From:           stats.from,
+		Until:          stats.until,
+		Format:         stats.format,
+		Status:         w.status,
+		CacheHit:       stats.cacheHit,
+		FindRequests:   stats.findRequests,
+		RenderRequests: stats.renderRequests,
+		Leaves:         stats.leaves,
+		Bytes:          w.bytes,
+		Runtime:        runtime.Seconds(),
+		TargetTimes:    stats.targetTimes,
+		BackendErrors:  stats.backendErrors,
+	})
+	if err != nil {
+		logger.Logf("render: unable to marshal query log: %v", err)
+		return
+	}
+
+	if queryLog != nil {
+		queryLog.Println(string(b))
+	}
+	if slow {
+		slowLog.Println(string(b))
+	}
+}
+
+// loggingResponseWriter records the status and size of a response
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
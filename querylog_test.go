@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	fake := fakeZipper([]string{"foo.bar", "foo.baz"}, []string{"foo.bar", "foo.baz"})
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(2)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+
+	var queries, slow bytes.Buffer
+	queryLog = log.New(&queries, "", 0)
+	slowLog = log.New(&slow, "", 0)
+	defer func() { queryLog, slowLog, slowThreshold = nil, nil, 0 }()
+
+	render := func(header string) {
+		req := httptest.NewRequest("GET", "/render?target=sum(foo.*)&format=json&from=1000000000&until=1000000600", nil)
+		if header != "" {
+			req.Header.Set("X-Forwarded-For", header)
+		}
+		loggedRenderHandler(httptest.NewRecorder(), req)
+	}
+
+	render("")
+	slowThreshold = time.Hour
+	clientKey = "header:X-Forwarded-For"
+	defer func() { clientKey = "ip" }()
+	render("192.0.2.99, 198.51.100.7")
+
+	lines := strings.Split(strings.TrimSpace(queries.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d query log lines, want 2:\n%s", len(lines), queries.String())
+	}
+
+	var miss, hit queryLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &miss); err != nil {
+		t.Fatalf("bad query log line %q: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &hit); err != nil {
+		t.Fatalf("bad query log line %q: %v", lines[1], err)
+	}
+
+	if !reflect.DeepEqual(miss.Targets, []string{"sum(foo.*)"}) || miss.From != 1000000000 || miss.Until != 1000000600 || miss.Format != "json" {
+		t.Errorf("bad request fields: %+v", miss)
+	}
+	if miss.CacheHit || miss.FindRequests != 1 || miss.RenderRequests != 2 || miss.Leaves != 2 {
+		t.Errorf("bad fetch fields for a cache miss: %+v", miss)
+	}
+	if miss.Status != http.StatusOK || miss.Bytes == 0 || len(miss.TargetTimes) != 1 || miss.Client != "192.0.2.1" {
+		t.Errorf("bad response fields: %+v", miss)
+	}
+
+	if !hit.CacheHit || hit.FindRequests != 0 || hit.RenderRequests != 0 || hit.Bytes != miss.Bytes {
+		t.Errorf("bad fields for a cache hit: %+v", hit)
+	}
+	if hit.Client != "198.51.100.7" {
+		t.Errorf("client=%q, want the forwarded address", hit.Client)
+	}
+
+	// only the first request was slower than the threshold in force
+	if n := strings.Count(slow.String(), "\n"); n != 1 || !strings.HasPrefix(slow.String(), lines[0]) {
+		t.Errorf("got slow query log %q, want the first request", slow.String())
+	}
+}
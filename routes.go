@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// route sends all metrics whose leading nodes match pattern to backends
+type route struct {
+	pattern  []string
+	backends []string
+}
+
+type routeConfig struct {
+	// Pattern is a metric prefix such as "servers." or a glob of leading nodes such as "apps.*.web"
+	Pattern  string   `json:"pattern"`
+	Backends []string `json:"backends"`
+}
+
+// loadRoutes reads a JSON list of routes, in order of priority
+func loadRoutes(file string) ([]route, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var config []routeConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	var routes []route
+	for _, c := range config {
+		p := strings.TrimSuffix(c.Pattern, ".")
+		if p == "" || len(c.Backends) == 0 {
+			return nil, fmt.Errorf("%s: route needs a pattern and at least one backend", file)
+		}
+		for _, b := range c.Backends {
+			if _, err := url.Parse(b); err != nil {
+				return nil, fmt.Errorf("%s: route %q: %v", file, c.Pattern, err)
+			}
+		}
+		routes = append(routes, route{pattern: strings.Split(p, "."), backends: c.Backends})
+	}
+
+	return routes, nil
+}
+
+func hasGlob(node string) bool {
+	return strings.ContainsAny(node, "*?[{")
+}
+
+// matchNode matches a single metric node against a glob, including {a,b} alternatives
+func matchNode(pattern, node string) bool {
+	if i := strings.IndexByte(pattern, '{'); i != -1 {
+		j := strings.IndexByte(pattern[i:], '}')
+		if j != -1 {
+			j += i
+			for _, alt := range strings.Split(pattern[i+1:j], ",") {
+				if matchNode(pattern[:i]+alt+pattern[j+1:], node) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	ok, err := path.Match(pattern, node)
+	return err == nil && ok
+}
+
+// overlaps reports whether the route pattern and the query may match a common metric
+func (r route) overlaps(query []string) bool {
+	for i := 0; i < len(r.pattern) && i < len(query); i++ {
+		p, q := r.pattern[i], query[i]
+		switch {
+		case !hasGlob(q):
+			if !matchNode(p, q) {
+				return false
+			}
+		case !hasGlob(p):
+			if !matchNode(q, p) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// covers reports whether every metric matched by the query belongs to this route
+func (r route) covers(query []string) bool {
+	if len(query) < len(r.pattern) {
+		return false
+	}
+
+	for i, p := range r.pattern {
+		if hasGlob(query[i]) || !matchNode(p, query[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// findBackends returns the backends which may hold metrics matching the glob query
+func (z zipper) findBackends(query string) []string {
+	nodes := strings.Split(query, ".")
+
+	var backends []string
+	seen := make(map[string]bool)
+
+	for _, r := range z.routes {
+		if !r.overlaps(nodes) {
+			continue
+		}
+		backends = appendBackends(backends, seen, r.backends)
+		if r.covers(nodes) {
+			return backends
+		}
+	}
+
+	backends = appendBackends(backends, seen, z.backends)
+
+	return backends
+}
+
+// renderBackends returns the backends owning the metric path
+func (z zipper) renderBackends(metric string) []string {
+	nodes := strings.Split(metric, ".")
+
+	for _, r := range z.routes {
+		if r.covers(nodes) {
+			return r.backends
+		}
+	}
+
+	return z.backends
+}
+
+// allBackends returns every backend the zipper may talk to
+func (z zipper) allBackends() []string {
+	seen := make(map[string]bool)
+	backends := appendBackends(nil, seen, z.backends)
+	for _, r := range z.routes {
+		backends = appendBackends(backends, seen, r.backends)
+	}
+
+	return backends
+}
+
+// appendBackends appends those of bs which are not yet in seen
+func appendBackends(backends []string, seen map[string]bool, bs []string) []string {
+	for _, b := range bs {
+		if !seen[b] {
+			seen[b] = true
+			backends = append(backends, b)
+		}
+	}
+
+	return backends
+}
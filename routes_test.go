@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+var testRoutes = zipper{
+	backends: []string{"default"},
+	routes: []route{
+		{pattern: []string{"servers"}, backends: []string{"a1", "a2"}},
+		{pattern: []string{"apps", "*", "web"}, backends: []string{"b"}},
+		{pattern: []string{"apps", "{foo,bar}"}, backends: []string{"c"}},
+	},
+}
+
+func TestMatchNode(t *testing.T) {
+	tests := []struct {
+		pattern string
+		node    string
+		want    bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"f*", "foo", true},
+		{"{foo,bar}", "bar", true},
+		{"{foo,bar}", "baz", false},
+		{"x{foo,bar}y", "xbary", true},
+		{"[ab]c", "bc", true},
+		{"[ab", "[ab", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchNode(tt.pattern, tt.node); got != tt.want {
+			t.Errorf("matchNode(%q, %q)=%v, want %v", tt.pattern, tt.node, got, tt.want)
+		}
+	}
+}
+
+func TestFindBackends(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"servers.host1.cpu", []string{"a1", "a2"}},
+		{"servers.*.cpu", []string{"a1", "a2"}},
+		{"serv*", []string{"a1", "a2", "default"}},
+		{"apps.x.web.requests", []string{"b"}},
+		{"apps.*", []string{"b", "c", "default"}},
+		{"apps.foo.db", []string{"c"}},
+		{"apps.baz.db", []string{"default"}},
+		{"*", []string{"a1", "a2", "b", "c", "default"}},
+		{"other.metric", []string{"default"}},
+	}
+
+	for _, tt := range tests {
+		if got := testRoutes.findBackends(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("findBackends(%q)=%v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestRenderBackends(t *testing.T) {
+	tests := []struct {
+		metric string
+		want   []string
+	}{
+		{"servers.host1.cpu", []string{"a1", "a2"}},
+		{"apps.x.web.requests", []string{"b"}},
+		{"apps.foo.web.requests", []string{"b"}},
+		{"apps.foo.db", []string{"c"}},
+		{"apps.x.db", []string{"default"}},
+		{"servers", []string{"a1", "a2"}},
+	}
+
+	for _, tt := range tests {
+		if got := testRoutes.renderBackends(tt.metric); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("renderBackends(%q)=%v, want %v", tt.metric, got, tt.want)
+		}
+	}
+}
+
+func TestZipperMerge(t *testing.T) {
+	a := fakeZipper([]string{"servers.a", "servers.b"}, []string{"servers.a"})
+	defer a.Close()
+	b := fakeZipper([]string{"servers.b", "servers.c"}, []string{"servers.c"})
+	defer b.Close()
+
+	z := zipper{
+		routes: []route{{pattern: []string{"servers"}, backends: []string{a.URL, b.URL}}},
+		client: &http.Client{},
+	}
+
+	glob, err := z.Find(context.Background(), "servers.*")
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+
+	var paths []string
+	for _, m := range glob.Matches {
+		paths = append(paths, m.GetPath())
+	}
+	if want := []string{"servers.a", "servers.b", "servers.c"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("Find: got %v, want %v", paths, want)
+	}
+
+	// servers.c only lives on the second backend
+	m, err := z.Render(context.Background(), "servers.c", 0, 60)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if m.GetName() != "servers.c" {
+		t.Errorf("Render: got %q, want servers.c", m.GetName())
+	}
+
+	if _, err := z.Render(context.Background(), "servers.d", 0, 60); err != errNoMetrics {
+		t.Errorf("Render of missing metric: got %v, want %v", err, errNoMetrics)
+	}
+
+	if _, err := z.Find(context.Background(), "other.*"); err != errNoBackends {
+		t.Errorf("Find without backends: got %v, want %v", err, errNoBackends)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/dgryski/carbonapi/expr"
+)
+
+type savedExprConfig struct {
+	// Params are the names of its arguments, referred to as $name in Expr
+	Params []string `json:"params"`
+	Expr   string   `json:"expr"`
+}
+
+// loadSavedExprs reads a JSON object of saved expressions by name
+func loadSavedExprs(file string) (expr.SavedExprs, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var config map[string]savedExprConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	saved := make(expr.SavedExprs)
+	for name, c := range config {
+		// validated once expanded, when the arguments are known
+		exp, rest, err := expr.ParseExpr(c.Expr)
+		if err == nil && rest != "" {
+			err = expr.ErrTrailingCharacters
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: @%s: %v", file, name, err)
+		}
+		saved[name] = &expr.SavedExpr{Params: c.Params, Expr: exp}
+	}
+
+	if err := saved.Check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	return saved, nil
+}
+
+// savedExprSet is a load of the saved expressions, used throughout a request
+type savedExprSet struct {
+	exprs expr.SavedExprs
+}
+
+// savedExprStore holds the saved expressions loaded from a file, which may be
+// reloaded while requests are served
+type savedExprStore struct {
+	file string
+
+	mu      sync.RWMutex
+	current *savedExprSet
+}
+
+// savedExprs are the expressions targets refer to as @name(args)
+var savedExprs savedExprStore
+
+// get returns the current load, or nil if there is none
+func (s *savedExprStore) get() *savedExprSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// reload reads the file again, keeping the current expressions if it fails
+func (s *savedExprStore) reload() error {
+	exprs, err := loadSavedExprs(s.file)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.current = &savedExprSet{exprs: exprs}
+	s.mu.Unlock()
+
+	return nil
+}
+
+type savedExprsContextKey struct{}
+
+// withSavedExprs returns a context carrying the saved expressions for the
+// targets of a request, so that a reload doesn't change them halfway
+func withSavedExprs(ctx context.Context, saved *savedExprSet) context.Context {
+	return context.WithValue(ctx, savedExprsContextKey{}, saved)
+}
+
+func savedExprsFromContext(ctx context.Context) expr.SavedExprs {
+	saved, _ := ctx.Value(savedExprsContextKey{}).(*savedExprSet)
+	if saved == nil {
+		return nil
+	}
+	return saved.exprs
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeSavedExprs(t *testing.T, file, config string) {
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSavedExprs(t *testing.T) {
+	f, err := ioutil.TempFile("", "savedexprs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`{"errorRate": {"params": ["app"], "expr": "divideSeries(apps.$app.errors, apps.$app.requests)"}}`, ""},
+		{`{"a": {"expr": "scale(@b, 2)"}, "b": {"expr": "sumSeries(@a)"}}`, "cycle @a -> @b -> @a"},
+		{`{"a": {"expr": "scale(@b, 2)"}}`, "unknown saved expression @b"},
+		{`{"a": {"expr": "scale(x.y, 2))"}}`, "@a: unexpected characters"},
+		{`["a"]`, "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		writeSavedExprs(t, f.Name(), tt.config)
+		_, err := loadSavedExprs(f.Name())
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestRenderSavedExprs(t *testing.T) {
+	leaves := []string{"apps.checkout.errors", "apps.checkout.requests", "apps.search.errors"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	queryCache = &ttlCache{}
+	findCache = &nullCache{}
+	defer func() { queryCache = &nullCache{} }()
+
+	f, err := ioutil.TempFile("", "savedexprs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	defer func() { savedExprs = savedExprStore{} }()
+	savedExprs = savedExprStore{file: f.Name()}
+
+	render := func(query string) (int, string) {
+		req := httptest.NewRequest("GET", "/render?format=json&from=1000000000&until=1000000600&"+query, nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+		return w.Code, w.Body.String()
+	}
+
+	writeSavedExprs(t, f.Name(), `{"errors": {"params": ["app"], "expr": "alias(apps.$app.errors, '$app errors')"}}`)
+	if err := savedExprs.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"target=@errors(checkout)", http.StatusOK, `"target":"checkout errors"`},
+		{"target=sumSeries(@errors(app=search))", http.StatusOK, `"target":"sumSeries(alias(apps.search.errors,`},
+		{"target=@errors", http.StatusBadRequest, "missing argument app"},
+		{"target=@nope(checkout)", http.StatusBadRequest, "unknown saved expression @nope"},
+		{"target=@errors(checkout,1)", http.StatusBadRequest, "takes 1 arguments, got 2"},
+	}
+
+	for _, tt := range tests {
+		if code, body := render(tt.query); code != tt.status || !strings.Contains(body, tt.want) {
+			t.Errorf("%s: got status %d, %s, want %d, %s", tt.query, code, body, tt.status, tt.want)
+		}
+	}
+
+	// reloaded without a restart, and not answered from the cache
+	writeSavedExprs(t, f.Name(), `{"errors": {"params": ["app"], "expr": "alias(apps.$app.errors, 'errors of $app')"}}`)
+	if err := savedExprs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := render("target=@errors(checkout)"); code != http.StatusOK || !strings.Contains(body, `"target":"errors of checkout"`) {
+		t.Errorf("after reload: got status %d, %s", code, body)
+	}
+
+	// a bad file keeps the expressions loaded before
+	writeSavedExprs(t, f.Name(), `{"errors": {"expr": "@errors"}}`)
+	if err := savedExprs.reload(); err == nil {
+		t.Errorf("reload of a cycle succeeded")
+	}
+	if code, body := render("target=@errors(checkout)"); code != http.StatusOK || !strings.Contains(body, `"target":"errors of checkout"`) {
+		t.Errorf("after failed reload: got status %d, %s", code, body)
+	}
+
+	// errors in a saved expression point at the reference to it
+	writeSavedExprs(t, f.Name(), `{"errors": {"params": ["app"], "expr": "scale(apps.$app.errors, 'x')"}}`)
+	if err := savedExprs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	code, body := render("target=" + url.QueryEscape("sumSeries(@errors(checkout))"))
+	var perr parseErrorJSON
+	json.Unmarshal([]byte(body), &perr)
+	if code != http.StatusBadRequest || perr.Target != "sumSeries(@errors(checkout))" || perr.Offset != 10 || !strings.HasPrefix(perr.Error, "@errors: scale:") {
+		t.Errorf("error in a saved expression: got status %d, %s", code, body)
+	}
+}
+
+func TestSavedExprsSnapshot(t *testing.T) {
+	leaves := []string{"apps.checkout.errors"}
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+
+	Zipper = zipper{backends: []string{fake.URL}, client: &http.Client{}}
+	Limiter = newLimiter(1)
+	findCache = &nullCache{}
+
+	f, err := ioutil.TempFile("", "savedexprs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	defer func() { savedExprs = savedExprStore{} }()
+	savedExprs = savedExprStore{file: f.Name()}
+
+	writeSavedExprs(t, f.Name(), `{"errors": {"params": ["app"], "expr": "alias(apps.$app.errors, 'before')"}}`)
+	if err := savedExprs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	before := savedExprs.get()
+
+	// reloaded while a request taken before is under way
+	writeSavedExprs(t, f.Name(), `{"errors": {"params": ["app"], "expr": "alias(apps.$app.errors, 'after')"}}`)
+	if err := savedExprs.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []string{"@errors(checkout)"}
+	form := url.Values{"target": targets}
+	key := func(saved *savedExprSet) string {
+		return renderCacheKey(form, canonicalTargets(targets, saved), 1000000000, 1000000600)
+	}
+	after := key(savedExprs.get())
+	if key(before) == after {
+		t.Errorf("same cache key for different definitions")
+	}
+
+	// the keys depend on the definitions only, as on another replica or
+	// after a restart loading the same file
+	other := savedExprStore{file: f.Name()}
+	if err := other.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := savedExprs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if k := key(other.get()); k != after {
+		t.Errorf("got cache key %s on another load of the same definitions, want %s", k, after)
+	}
+	if k := key(savedExprs.get()); k != after {
+		t.Errorf("got cache key %s after reloading the same definitions, want %s", k, after)
+	}
+
+	req := httptest.NewRequest("GET", "/render?"+form.Encode(), nil)
+	req.ParseForm()
+	results, _, err := evalTargets(withSavedExprs(context.Background(), before), req, targets, 1000000000, 1000000600, false, &renderStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].GetName() != "before" {
+		t.Errorf("got %v, want the series of the definitions taken first", results)
+	}
+}
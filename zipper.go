@@ -1,31 +1,268 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dgryski/carbonapi/expr"
 	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
 )
 
-var errNoMetrics = errors.New("no metrics")
+var (
+	errNoMetrics  = errors.New("no metrics")
+	errNoBackends = errors.New("no backends for metric")
+)
 
 type unmarshaler interface {
 	Unmarshal([]byte) error
 }
 
+// zipper talks to one or more carbonzipper backends.  Metrics matching one of
+// the routes go to the backends of the first such route, everything else to
+// the default backends.
 type zipper struct {
-	z      string
-	client *http.Client
+	backends []string
+	routes   []route
+	client   *http.Client
+
+	// retries is the number of times a failed Find or Render is retried,
+	// waiting retryDelay before the first retry and doubling it each time
+	retries    int
+	retryDelay time.Duration
+
+	// hedgeDelay, if set, is how long to wait for a backend to answer a
+	// Render before also asking the next one owning the metric
+	hedgeDelay time.Duration
+
+	// batchSize is the number of metrics fetched with one render request;
+	// renderGlob sends a glob instead of its leaves when it can
+	batchSize  int
+	renderGlob bool
+
+	// breakers holds the circuit breaker for each backend, if enabled
+	breakers map[string]*breaker
+}
+
+// fetchFunc makes a single request to a backend
+type fetchFunc func(ctx context.Context, backend string) (interface{}, error)
+
+// fetch calls fn for a single backend, retrying failures with exponential
+// backoff.  Backends with an open circuit breaker fail fast.
+func (z zipper) fetch(ctx context.Context, backend string, fn fetchFunc) (interface{}, error) {
+	b := z.breakers[backend]
+	delay := z.retryDelay
+
+	for attempt := 0; ; attempt++ {
+		if !b.allow() {
+			Metrics.ZipperBackendDown.Add(1)
+			return nil, errBackendDown
+		}
+
+		v, err := fn(ctx, backend)
+		switch {
+		case err == nil || err == errNoMetrics:
+			// the backend answered, even if it had nothing for us
+			b.success()
+			return v, err
+		case ctx.Err() != nil:
+			b.cancel()
+			return nil, err
+		}
+
+		b.failure()
+
+		if attempt >= z.retries {
+			return nil, err
+		}
+
+		Metrics.ZipperRetries.Add(1)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// hedge calls fn for each backend in turn until one of them succeeds.  If
+// hedgeDelay is set and a backend has not answered in time, the next one is
+// started in parallel and the first answer wins.
+func (z zipper) hedge(ctx context.Context, backends []string, fn fetchFunc) (interface{}, error) {
+	if len(backends) == 0 {
+		return nil, errNoBackends
+	}
+
+	// abandon the slower requests once we have an answer
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		v   interface{}
+		err error
+	}
+
+	ch := make(chan result, len(backends))
+	var next, inflight int
+	start := func() {
+		b := backends[next]
+		next++
+		inflight++
+		go func() {
+			v, err := z.fetch(ctx, b, fn)
+			ch <- result{v, err}
+		}()
+	}
+
+	start()
+
+	var hedgeTimer <-chan time.Time
+	if z.hedgeDelay > 0 && len(backends) > 1 {
+		t := time.NewTicker(z.hedgeDelay)
+		defer t.Stop()
+		hedgeTimer = t.C
+	}
+
+	var err error
+	for {
+		select {
+		case r := <-ch:
+			inflight--
+			if r.err == nil {
+				return r.v, nil
+			}
+			// a failure is more interesting than a backend without the metric
+			if err == nil || err == errNoMetrics {
+				err = r.err
+			}
+			if next < len(backends) {
+				start()
+			} else if inflight == 0 {
+				return nil, err
+			}
+		case <-hedgeTimer:
+			if next < len(backends) {
+				Metrics.ZipperHedges.Add(1)
+				start()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
-func (z zipper) Find(metric string) (pb.GlobResponse, error) {
+type findResult struct {
+	backend string
+	resp    pb.GlobResponse
+	err     error
+}
+
+var (
+	findFlights   = flightGroup{shared: Metrics.FindFlightsShared}
+	renderFlights = flightGroup{shared: Metrics.RenderFlightsShared}
+)
+
+// partialFindError is returned along with the matches of the backends which
+// answered a find, when some others failed
+type partialFindError struct {
+	failed []string
+}
+
+func (e *partialFindError) Error() string {
+	return "some backends failed: " + strings.Join(e.failed, "; ")
+}
+
+// Find sends the query to all backends which may hold matching metrics and
+// merges the results.  If only some of the backends fail, the matches of the
+// others are returned with a *partialFindError.  Concurrent finds for the
+// same query are done once.
+func (z zipper) Find(ctx context.Context, metric string) (pb.GlobResponse, error) {
+
+	v, err, _ := findFlights.do(ctx, metric, func(ctx context.Context) (interface{}, error) {
+		return z.findAll(ctx, metric)
+	})
+	if _, ok := err.(*partialFindError); err != nil && !ok {
+		return pb.GlobResponse{}, err
+	}
+
+	return v.(pb.GlobResponse), err
+}
+
+func (z zipper) findAll(ctx context.Context, metric string) (pb.GlobResponse, error) {
+
+	backends := z.findBackends(metric)
+	if len(backends) == 0 {
+		return pb.GlobResponse{}, errNoBackends
+	}
+
+	ch := make(chan findResult, len(backends))
+	for _, b := range backends {
+		go func(b string) {
+			v, err := z.fetch(ctx, b, func(ctx context.Context, b string) (interface{}, error) {
+				return z.find(ctx, b, metric)
+			})
+			resp, _ := v.(pb.GlobResponse)
+			ch <- findResult{backend: b, resp: resp, err: err}
+		}(b)
+	}
+
+	merged := pb.GlobResponse{Name: proto.String(metric)}
+	type matchKey struct {
+		path   string
+		isLeaf bool
+	}
+	seen := make(map[matchKey]bool)
+	var err error
+	var answered int
+	var failed []string
+	for range backends {
+		r := <-ch
+		if r.err != nil {
+			logger.Logf("find: %s: %v", r.backend, r.err)
+			err = r.err
+			failed = append(failed, r.backend+": "+r.err.Error())
+			continue
+		}
+		answered++
+		for _, m := range r.resp.Matches {
+			k := matchKey{m.GetPath(), m.GetIsLeaf()}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			merged.Matches = append(merged.Matches, m)
+		}
+	}
+
+	if answered == 0 {
+		return pb.GlobResponse{}, err
+	}
+
+	sort.Sort(byPath(merged.Matches))
+
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		return merged, &partialFindError{failed: failed}
+	}
+
+	return merged, nil
+}
 
-	u, _ := url.Parse(z.z + "/metrics/find/")
+func (z zipper) find(ctx context.Context, backend, metric string) (pb.GlobResponse, error) {
+
+	u, _ := url.Parse(backend + "/metrics/find/")
 
 	u.RawQuery = url.Values{
 		"query":  []string{metric},
@@ -34,18 +271,39 @@ func (z zipper) Find(metric string) (pb.GlobResponse, error) {
 
 	var pbresp pb.GlobResponse
 
-	err := z.get("Find", u, &pbresp)
+	err := z.get(ctx, "Find", u, &pbresp)
 
 	return pbresp, err
 }
 
-func (z zipper) get(who string, u *url.URL, msg unmarshaler) error {
-	resp, err := z.client.Get(u.String())
+type byPath []*pb.GlobMatch
+
+func (s byPath) Len() int      { return len(s) }
+func (s byPath) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPath) Less(i, j int) bool {
+	if s[i].GetPath() != s[j].GetPath() {
+		return s[i].GetPath() < s[j].GetPath()
+	}
+	return !s[i].GetIsLeaf() && s[j].GetIsLeaf()
+}
+
+func (z zipper) get(ctx context.Context, who string, u *url.URL, msg unmarshaler) (err error) {
+	defer observeZipper(u.Scheme+"://"+u.Host, strings.ToLower(who), time.Now(), &err)
+
+	resp, err := z.do(ctx, u)
 	if err != nil {
-		return fmt.Errorf("http.Get: %+v", err)
+		return err
 	}
 	defer resp.Body.Close()
 
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errNoMetrics
+	default:
+		return fmt.Errorf("http.Get: %s", resp.Status)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("ioutil.ReadAll: %+v", err)
@@ -59,17 +317,55 @@ func (z zipper) get(who string, u *url.URL, msg unmarshaler) error {
 	return nil
 }
 
-func (z zipper) Passthrough(metric string) ([]byte, error) {
-
-	u, _ := url.Parse(z.z + metric)
+// do sends a GET request for u which is aborted when ctx is done
+func (z zipper) do(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %+v", err)
+	}
 
-	resp, err := z.client.Get(u.String())
+	resp, err := z.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("http.Get: %+v", err)
 	}
+
+	return resp, nil
+}
+
+// Passthrough forwards the request to the backends owning its target, if any
+func (z zipper) Passthrough(ctx context.Context, metric string) ([]byte, error) {
+
+	backends := z.backends
+	if u, err := url.Parse(metric); err == nil {
+		if target := u.Query().Get("target"); target != "" {
+			backends = z.renderBackends(target)
+		}
+	}
+
+	err := errNoBackends
+	for _, b := range backends {
+		var body []byte
+		body, err = z.passthrough(ctx, b, metric)
+		if err == nil {
+			return body, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (z zipper) passthrough(ctx context.Context, backend, metric string) (body []byte, err error) {
+	defer observeZipper(backend, "passthrough", time.Now(), &err)
+
+	u, _ := url.Parse(backend + metric)
+
+	resp, err := z.do(ctx, u)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("ioutil.ReadAll: %+v", err)
 	}
@@ -77,28 +373,106 @@ func (z zipper) Passthrough(metric string) ([]byte, error) {
 	return body, nil
 }
 
-func (z zipper) Render(metric string, from, until int32) (expr.MetricData, error) {
+// Render fetches the metric from the backends owning it, trying each in turn
+// until one of them has data
+func (z zipper) Render(ctx context.Context, metric string, from, until int64) (expr.MetricData, error) {
+
+	metrics, err := z.RenderMulti(ctx, []string{metric}, from, until)
+	if err != nil {
+		return expr.MetricData{}, err
+	}
+
+	return metrics[0], nil
+}
+
+// RenderMulti fetches several metrics owned by the same backends with a
+// single request.  Each target may be a path or a glob.  Concurrent requests
+// for the same targets and time range are done once.
+func (z zipper) RenderMulti(ctx context.Context, targets []string, from, until int64) ([]expr.MetricData, error) {
+
+	if len(targets) == 0 {
+		return nil, errNoMetrics
+	}
+
+	key := fmt.Sprintf("%d:%d:%s", from, until, strings.Join(targets, ","))
+	v, err, _ := renderFlights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return z.hedge(ctx, z.renderBackends(targets[0]), func(ctx context.Context, b string) (interface{}, error) {
+			return z.render(ctx, b, targets, from, until)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// every caller gets its own copies, as rendering sets options such as
+	// valuesPerPoint on them
+	return append([]expr.MetricData(nil), v.([]expr.MetricData)...), nil
+}
+
+func (z zipper) render(ctx context.Context, backend string, targets []string, from, until int64) ([]expr.MetricData, error) {
 
-	u, _ := url.Parse(z.z + "/render/")
+	u, _ := url.Parse(backend + "/render/")
 
 	u.RawQuery = url.Values{
-		"target": []string{metric},
+		"target": targets,
 		"format": []string{"protobuf"},
-		"from":   []string{strconv.Itoa(int(from))},
-		"until":  []string{strconv.Itoa(int(until))},
+		"from":   []string{strconv.FormatInt(from, 10)},
+		"until":  []string{strconv.FormatInt(until, 10)},
 	}.Encode()
 
 	var pbresp pb.MultiFetchResponse
-	err := z.get("Render", u, &pbresp)
+	err := z.get(ctx, "Render", u, &pbresp)
 	if err != nil {
-		return expr.MetricData{}, err
+		return nil, err
 	}
 
 	if m := pbresp.Metrics; len(m) == 0 {
-		return expr.MetricData{}, errNoMetrics
+		return nil, errNoMetrics
+	}
+
+	metrics := make([]expr.MetricData, len(pbresp.Metrics))
+	for i, m := range pbresp.Metrics {
+		metrics[i] = expr.MetricData{FetchResponse: *m}
 	}
 
-	mdata := expr.MetricData{FetchResponse: *pbresp.Metrics[0]}
+	return metrics, nil
+}
+
+// renderBatches splits the leaves matched by glob into the target lists of
+// the render requests to send: at most batchSize paths each, and never mixing
+// metrics owned by different backends.  With renderGlob set, a glob owned
+// entirely by one set of backends is sent as it is, provided it is routed to
+// them: a glob within the nodes of a route pattern isn't covered by it.
+func (z zipper) renderBatches(glob string, leaves []string) [][]string {
+
+	batchSize := z.batchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	var owners []string
+	byOwner := make(map[string][]string)
+	for _, leaf := range leaves {
+		owner := strings.Join(z.renderBackends(leaf), ",")
+		if _, ok := byOwner[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		byOwner[owner] = append(byOwner[owner], leaf)
+	}
+
+	if z.renderGlob && len(owners) == 1 && batchSize < len(leaves) && owners[0] == strings.Join(z.renderBackends(glob), ",") {
+		return [][]string{{glob}}
+	}
+
+	var batches [][]string
+	for _, owner := range owners {
+		paths := byOwner[owner]
+		for len(paths) > batchSize {
+			batches = append(batches, paths[:batchSize])
+			paths = paths[batchSize:]
+		}
+		batches = append(batches, paths)
+	}
 
-	return mdata, nil
+	return batches
 }
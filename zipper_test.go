@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/dgryski/carbonzipper/carbonzipperpb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// fakeZipper answers finds with matches, and renders of any target matching
+// one of leaves with a single datapoint
+func fakeZipper(matches []string, leaves []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/metrics/find/":
+			resp := pb.GlobResponse{Name: proto.String(r.FormValue("query"))}
+			for _, m := range matches {
+				resp.Matches = append(resp.Matches, &pb.GlobMatch{Path: proto.String(m), IsLeaf: proto.Bool(true)})
+			}
+			b, _ := resp.Marshal()
+			w.Write(b)
+		case "/render/":
+			var resp pb.MultiFetchResponse
+			for _, target := range r.Form["target"] {
+				for _, leaf := range leaves {
+					if !matchPath(target, leaf) {
+						continue
+					}
+					resp.Metrics = append(resp.Metrics, &pb.FetchResponse{
+						Name:      proto.String(leaf),
+						StartTime: proto.Int32(0),
+						StopTime:  proto.Int32(60),
+						StepTime:  proto.Int32(60),
+						Values:    []float64{1},
+						IsAbsent:  []bool{false},
+					})
+				}
+			}
+			b, _ := resp.Marshal()
+			w.Write(b)
+		}
+	}))
+}
+
+func matchPath(glob, path string) bool {
+	g, p := strings.Split(glob, "."), strings.Split(path, ".")
+	if len(g) != len(p) {
+		return false
+	}
+	for i := range g {
+		if !matchNode(g[i], p[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestZipperRetry(t *testing.T) {
+	var calls int32
+	good := fakeZipper(nil, []string{"foo.bar"})
+	defer good.Close()
+
+	// fails twice before answering
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		good.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	z := zipper{backends: []string{flaky.URL}, client: &http.Client{}, retries: 2, retryDelay: time.Millisecond}
+
+	if _, err := z.Render(context.Background(), "foo.bar", 0, 60); err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	z.retries = 1
+	if _, err := z.Render(context.Background(), "foo.bar", 0, 60); err == nil {
+		t.Errorf("Render succeeded with too few retries")
+	}
+}
+
+func TestZipperHedge(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	fast := fakeZipper(nil, []string{"foo.bar"})
+	defer fast.Close()
+
+	z := zipper{backends: []string{slow.URL, fast.URL}, client: &http.Client{}, hedgeDelay: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m, err := z.Render(ctx, "foo.bar", 0, 60)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if m.GetName() != "foo.bar" {
+		t.Errorf("got %q, want foo.bar", m.GetName())
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	b := &breaker{threshold: 2, cooldown: 10 * time.Second}
+
+	b.failure()
+	if !b.allow() {
+		t.Fatalf("breaker open after one failure")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatalf("breaker closed after two failures")
+	}
+
+	now = now.Add(11 * time.Second)
+	if !b.allow() {
+		t.Fatalf("no probe allowed after cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("second probe allowed while the first is running")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatalf("breaker closed after a failed probe")
+	}
+
+	now = now.Add(11 * time.Second)
+	if !b.allow() {
+		t.Fatalf("no probe allowed after cooldown")
+	}
+	b.success()
+	if !b.allow() || !b.allow() {
+		t.Errorf("breaker still open after a successful probe")
+	}
+}
+
+func TestZipperBackendDown(t *testing.T) {
+	var calls int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	z := zipper{backends: []string{down.URL}, client: &http.Client{}}
+	z.breakers = newBreakers(z.allBackends(), 2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, err := z.Find(context.Background(), "foo.*"); err == nil || err == errBackendDown {
+			t.Fatalf("Find %d: got %v, want backend error", i, err)
+		}
+	}
+
+	if _, err := z.Find(context.Background(), "foo.*"); err != errBackendDown {
+		t.Errorf("Find: got %v, want %v", err, errBackendDown)
+	}
+
+	if calls != 2 {
+		t.Errorf("got %d calls to a dead backend, want 2", calls)
+	}
+}
+
+func TestRenderBatches(t *testing.T) {
+	z := testRoutes
+	z.batchSize = 2
+
+	leaves := []string{"servers.a", "other.a", "servers.b", "servers.c", "other.b"}
+	want := [][]string{{"servers.a", "servers.b"}, {"servers.c"}, {"other.a", "other.b"}}
+	if got := z.renderBatches("*.*", leaves); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderBatches=%v, want %v", got, want)
+	}
+
+	z.renderGlob = true
+	if got := z.renderBatches("*.*", leaves); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderBatches across backends=%v, want %v", got, want)
+	}
+
+	want = [][]string{{"servers.*"}}
+	if got := z.renderBatches("servers.*", leaves[2:4]); !reflect.DeepEqual(got, [][]string{{"servers.b", "servers.c"}}) {
+		t.Errorf("renderBatches of a single batch=%v, want the leaves", got)
+	}
+	if got := z.renderBatches("servers.*", []string{"servers.a", "servers.b", "servers.c"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderBatches with renderGlob=%v, want %v", got, want)
+	}
+
+	// the glob itself would go to the default backends rather than b
+	apps := []string{"apps.x.web.requests", "apps.y.web.requests", "apps.z.web.requests"}
+	want = [][]string{apps[:2], apps[2:]}
+	if got := z.renderBatches("apps.*.web.requests", apps); !reflect.DeepEqual(got, want) {
+		t.Errorf("renderBatches of a glob within a route=%v, want %v", got, want)
+	}
+}
+
+func TestRenderBatched(t *testing.T) {
+	leaves := []string{"foo.a", "foo.b", "foo.c", "foo.d", "foo.e"}
+	var requests int32
+	fake := fakeZipper(leaves, leaves)
+	defer fake.Close()
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/render/" {
+			atomic.AddInt32(&requests, 1)
+		}
+		fake.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counting.Close()
+
+	Limiter = newLimiter(2)
+	queryCache = &nullCache{}
+	findCache = &nullCache{}
+
+	tests := []struct {
+		batchSize  int
+		renderGlob bool
+		requests   int32
+	}{
+		{1, false, 5},
+		{2, false, 3},
+		{10, false, 1},
+		{2, true, 1},
+	}
+
+	for _, tt := range tests {
+		atomic.StoreInt32(&requests, 0)
+		Zipper = zipper{backends: []string{counting.URL}, client: &http.Client{}, batchSize: tt.batchSize, renderGlob: tt.renderGlob}
+
+		req := httptest.NewRequest("GET", "/render?target=foo.*&format=json&from=0&until=60", nil)
+		w := httptest.NewRecorder()
+		var stats renderStats
+		renderHandler(w, req, &stats)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("batch=%d: got status %d: %s", tt.batchSize, w.Code, w.Body.String())
+		}
+		if requests != tt.requests {
+			t.Errorf("batch=%d glob=%v: got %d render requests, want %d", tt.batchSize, tt.renderGlob, requests, tt.requests)
+		}
+		for _, l := range leaves {
+			if !strings.Contains(w.Body.String(), `"`+l+`"`) {
+				t.Errorf("batch=%d glob=%v: %s missing from %s", tt.batchSize, tt.renderGlob, l, w.Body.String())
+			}
+		}
+	}
+}